@@ -10,15 +10,65 @@ import (
 type Request struct {
 	ApiKey string          `json:"apiKey"`
 	Data   json.RawMessage `json:"data"`
+
+	//IdempotencyKey makes a create request safe to retry, it can also be sent in the Idempotency-Key http header
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	//IfMatch is populated from the If-Match http header, it is not part of the json payload
+	IfMatch string `json:"-"`
+	//ApiVersion is the version of the api the request was made to, taken from the path
+	ApiVersion int `json:"-"`
+	//RequestId is populated from the X-Request-Id http header, it identifies the changes of the request in the audit log
+	RequestId string `json:"-"`
 }
 
 type Response struct {
-	Error  []string    `json:"error,omitempty"`
+	Errors []Error     `json:"errors,omitempty"`
 	Result interface{} `json:"result,omitempty"`
+
+	//Error is the legacy flat list of error messages, only populated when the service runs in legacy error mode
+	Error []string `json:"error,omitempty"`
+
+	//WriteMode tells how a batch write was kept all-or-nothing: "transaction" or "compensating"
+	WriteMode string `json:"writeMode,omitempty"`
 }
 
 type CouponCollection struct {
 	Coupons []Coupon `json:"coupons"`
+
+	//Atomic makes a batch all-or-nothing: a single invalid coupon fails the whole request.
+	//Otherwise every coupon gets its own result and the valid ones are written.
+	//Batches are atomic unless they say atomic is false, as they were before per coupon results,
+	//whichever api or encoding they are sent in.
+	Atomic bool `json:"atomic"`
+}
+
+func (c *CouponCollection) UnmarshalJSON(data []byte) error {
+	type collection CouponCollection
+	decoded := collection{Atomic: true}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*c = CouponCollection(decoded)
+	return nil
+}
+
+//BatchResult is the outcome of a non-atomic create or update, Items are in the order of the request
+type BatchResult struct {
+	Items   []BatchItemResult `json:"items"`
+	Summary BatchSummary      `json:"summary"`
+}
+
+type BatchItemResult struct {
+	Index  int     `json:"index"`
+	Coupon *Coupon `json:"coupon,omitempty"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+type BatchSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
 }
 
 type Coupon struct {
@@ -28,6 +78,40 @@ type Coupon struct {
 	Value     float64            `json:"value" bson:"value"`
 	Expiry    time.Time          `json:"expiry" bson:"expiry"`
 	CreatedAt time.Time          `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+	Version   int64              `json:"version,omitempty" bson:"version"`
+
+	//Import records the import and row a coupon was created by, it is not part of the api
+	Import *ImportRef `json:"-" bson:"import,omitempty"`
+}
+
+//ImportRef identifies the row of a bulk import, so an interrupted import can be resumed after the last written row
+type ImportRef struct {
+	Id  string `bson:"id"`
+	Row int    `bson:"row"`
+}
+
+//ImportReport is the outcome of a bulk import. Rows are numbered as in a spreadsheet, the header being row 1.
+type ImportReport struct {
+	//ImportId resumes the import when sent again with the same file
+	ImportId string `json:"importId,omitempty"`
+	DryRun   bool   `json:"dryRun,omitempty"`
+
+	//data rows in the file, the header excluded
+	Rows int `json:"rows"`
+	//rows written by an earlier run of the same import
+	Skipped  int `json:"skipped"`
+	Valid    int `json:"valid"`
+	Invalid  int `json:"invalid"`
+	Imported int `json:"imported"`
+
+	Errors []ImportRowError `json:"errors,omitempty"`
+	//set when there were more invalid rows than are reported
+	ErrorsTruncated bool `json:"errorsTruncated,omitempty"`
+}
+
+type ImportRowError struct {
+	Row    int     `json:"row"`
+	Errors []Error `json:"errors"`
 }
 
 type CouponFilter struct {
@@ -40,4 +124,65 @@ type CouponFilter struct {
 	ExpiryTo      time.Time `json:"expiryTo"`
 	CreatedAtFrom time.Time `json:"createdAtFrom"`
 	CreatedAtTo   time.Time `json:"createdAtTo"`
+
+	//MinValue and MaxValue bound the value in fractions of the currency, for the apis whose amounts are not whole (v2, grpc).
+	//They are not part of the v1 payload, and take precedence over ValueFrom and ValueTo.
+	MinValue *float64 `json:"-"`
+	MaxValue *float64 `json:"-"`
+}
+
+//ValueRange is the range of values the filter asks for, a nil bound is open
+func (f *CouponFilter) ValueRange() (from, to *float64) {
+	from, to = f.MinValue, f.MaxValue
+	if from == nil && f.ValueFrom != nil {
+		value := float64(*f.ValueFrom)
+		from = &value
+	}
+	if to == nil && f.ValueTo != nil {
+		value := float64(*f.ValueTo)
+		to = &value
+	}
+	return from, to
+}
+
+const (
+	EVENT_CREATED string = "created"
+	EVENT_UPDATED string = "updated"
+	EVENT_DELETED string = "deleted"
+	//the coupon reached its expiry date
+	EVENT_EXPIRED string = "expired"
+)
+
+//CouponEvent is a change of a coupon. Seq orders the events of every coupon, a stream of events is resumed from it.
+type CouponEvent struct {
+	Seq      int64              `json:"seq" bson:"_id"`
+	Type     string             `json:"type" bson:"type"`
+	CouponId primitive.ObjectID `json:"couponId" bson:"couponId"`
+	Brand    string             `json:"brand" bson:"brand"`
+	//PreviousBrand is set when an update moved the coupon to another brand
+	PreviousBrand string `json:"previousBrand,omitempty" bson:"previousBrand,omitempty"`
+	//ChangedFields lists the json names of the fields the change set
+	ChangedFields []string `json:"changedFields,omitempty" bson:"changedFields,omitempty"`
+	//Version is the version of the coupon after the change, the deleted version for a delete
+	Version int64     `json:"version" bson:"version"`
+	At      time.Time `json:"at" bson:"at"`
+}
+
+//SyncResult is a page of the changes since a sync token. Coupons holds the current state of the coupons that were
+//created or modified, Deleted the coupons to purge. A full sync carries every coupon instead, replacing what the client holds.
+type SyncResult struct {
+	Coupons []Coupon    `json:"coupons"`
+	Deleted []Tombstone `json:"deleted"`
+	//Token is sent with the next sync, it is opaque to clients
+	Token string `json:"token"`
+	//HasMore asks for another sync right away, more changes are waiting
+	HasMore bool `json:"hasMore,omitempty"`
+	Full    bool `json:"full,omitempty"`
+}
+
+//Tombstone is a deleted coupon, at the version it was deleted at
+type Tombstone struct {
+	Id        primitive.ObjectID `json:"id"`
+	Version   int64              `json:"version"`
+	DeletedAt time.Time          `json:"deletedAt"`
 }
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+)
+
+//ApiKey is a key clients authenticate with. Only a salted hash of the secret is stored: Key, the full api key the
+//client sends, is only returned when the key is created or rotated.
+type ApiKey struct {
+	Id          primitive.ObjectID `json:"id" bson:"_id"`
+	Owner       string             `json:"owner" bson:"owner"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	//admin keys can manage the api keys
+	Admin     bool      `json:"admin,omitempty" bson:"admin,omitempty"`
+	Disabled  bool      `json:"disabled" bson:"disabled"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	//the key is not accepted after ExpiresAt, it does not expire when zero
+	ExpiresAt time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	RotatedAt time.Time `json:"rotatedAt,omitempty" bson:"rotatedAt,omitempty"`
+
+	Key  string `json:"key,omitempty" bson:"-"`
+	Salt []byte `json:"-" bson:"salt"`
+	Hash []byte `json:"-" bson:"hash"`
+}
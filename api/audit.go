@@ -0,0 +1,40 @@
+package api
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+)
+
+//Actor is who made a change: the principal authenticated by the api key and the id of the request
+type Actor struct {
+	Principal string `json:"principal" bson:"principal"`
+	RequestId string `json:"requestId,omitempty" bson:"requestId,omitempty"`
+}
+
+//AuditEntry records a change of a coupon. The action is one of the event types (EVENT_CREATED, ...), Before is not
+//set for a create and After not for a delete. Entries are only ever added, never changed or removed.
+//Redemptions will be recorded as EVENT_REDEEMED, the service does not record them yet.
+type AuditEntry struct {
+	Id       primitive.ObjectID `json:"id" bson:"_id"`
+	CouponId primitive.ObjectID `json:"couponId" bson:"couponId"`
+	Action   string             `json:"action" bson:"action"`
+	Actor    Actor              `json:"actor" bson:"actor"`
+	At       time.Time          `json:"at" bson:"at"`
+	//Version is the version of the coupon after the change, the deleted version for a delete
+	Version int64 `json:"version" bson:"version"`
+	//ChangedFields lists the json names of the fields an update changed the value of
+	ChangedFields []string `json:"changedFields,omitempty" bson:"changedFields,omitempty"`
+	//Before and After are the coupon at the versions either side of the change, as the write read and stored it
+	Before *Coupon `json:"before,omitempty" bson:"before,omitempty"`
+	After  *Coupon `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+//AuditFilter selects entries of the audit log, the newest first. Zero fields do not filter, the time range is inclusive.
+type AuditFilter struct {
+	CouponId  primitive.ObjectID
+	Principal string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
@@ -0,0 +1,213 @@
+package couponspb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//a zero time is sent as an unset timestamp, rather than as the year 1
+func timestampFrom(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func timeFrom(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+func FromInternal(cpn api.Coupon) *Coupon {
+	converted := &Coupon{
+		Name:      cpn.Name,
+		Brand:     cpn.Brand,
+		Value:     cpn.Value,
+		Expiry:    timestampFrom(cpn.Expiry),
+		CreatedAt: timestampFrom(cpn.CreatedAt),
+		Version:   cpn.Version,
+	}
+	if !cpn.Id.IsZero() {
+		converted.Id = cpn.Id.Hex()
+	}
+	return converted
+}
+
+func FromInternalMany(coupons []api.Coupon) []*Coupon {
+	converted := []*Coupon{}
+	for _, cpn := range coupons {
+		converted = append(converted, FromInternal(cpn))
+	}
+	return converted
+}
+
+//ToInternal converts the coupon to the internal model, index is its position in the request and is used to report a malformed id
+func (cpn *Coupon) ToInternal(index int) (api.Coupon, error) {
+	converted := api.Coupon{
+		Name:      cpn.GetName(),
+		Brand:     cpn.GetBrand(),
+		Value:     cpn.GetValue(),
+		Expiry:    timeFrom(cpn.GetExpiry()),
+		CreatedAt: timeFrom(cpn.GetCreatedAt()),
+		Version:   cpn.GetVersion(),
+	}
+
+	if cpn.GetId() != "" {
+		id, err := primitive.ObjectIDFromHex(cpn.GetId())
+		if err != nil {
+			return converted, api.NewErrorf(api.ERR_ID_INVALID, "Coupon ID is not valid: %s", cpn.GetId()).
+				WithItem(index, fmt.Sprintf("coupons[%d].id", index))
+		}
+		converted.Id = id
+	}
+
+	return converted, nil
+}
+
+//CollectionToInternal converts the coupons of a create or update request to the internal collection.
+//Like a json batch, a batch that leaves atomic unset is all-or-nothing.
+func CollectionToInternal(coupons []*Coupon, atomic *bool) (*api.CouponCollection, error) {
+	converted := &api.CouponCollection{Coupons: []api.Coupon{}, Atomic: atomic == nil || *atomic}
+	for i, cpn := range coupons {
+		internal, err := cpn.ToInternal(i)
+		if err != nil {
+			return nil, err
+		}
+		converted.Coupons = append(converted.Coupons, internal)
+	}
+	return converted, nil
+}
+
+//ToInternal converts the filter, a missing filter matches every coupon
+func (f *CouponFilter) ToInternal() *api.CouponFilter {
+	converted := &api.CouponFilter{
+		IdIn:          f.GetIdIn(),
+		NameContains:  f.GetNameContains(),
+		BrandEqual:    f.GetBrandEqual(),
+		ExpiryFrom:    timeFrom(f.GetExpiryFrom()),
+		ExpiryTo:      timeFrom(f.GetExpiryTo()),
+		CreatedAtFrom: timeFrom(f.GetCreatedAtFrom()),
+		CreatedAtTo:   timeFrom(f.GetCreatedAtTo()),
+	}
+
+	if f.GetValueFrom() != nil {
+		from := f.GetValueFrom().GetValue()
+		converted.MinValue = &from
+	}
+	if f.GetValueTo() != nil {
+		to := f.GetValueTo().GetValue()
+		converted.MaxValue = &to
+	}
+
+	return converted
+}
+
+func ErrorFromInternal(e api.Error) *Error {
+	converted := &Error{Code: e.Code, Message: e.Message, Field: e.Field}
+	if e.Index != nil {
+		converted.Index = wrapperspb.Int32(int32(*e.Index))
+	}
+	return converted
+}
+
+func ErrorsFromInternal(errs []api.Error) []*Error {
+	converted := []*Error{}
+	for _, e := range errs {
+		converted = append(converted, ErrorFromInternal(e))
+	}
+	return converted
+}
+
+//BatchFromInternal converts the result of a non-atomic batch
+func BatchFromInternal(batch *api.BatchResult, writeMode string) *WriteCouponsResponse {
+	converted := &WriteCouponsResponse{
+		Items: []*ItemResult{},
+		Summary: &BatchSummary{
+			Total:     int32(batch.Summary.Total),
+			Succeeded: int32(batch.Summary.Succeeded),
+			Failed:    int32(batch.Summary.Failed),
+		},
+		WriteMode: writeMode,
+	}
+
+	for _, item := range batch.Items {
+		convItem := &ItemResult{Index: int32(item.Index), Errors: ErrorsFromInternal(item.Errors)}
+		if item.Coupon != nil {
+			convItem.Coupon = FromInternal(*item.Coupon)
+		}
+		converted.Items = append(converted.Items, convItem)
+	}
+
+	return converted
+}
+
+//WrittenFromInternal converts the coupons written by an atomic batch, every coupon gets a successful item
+func WrittenFromInternal(coupons []api.Coupon, writeMode string) *WriteCouponsResponse {
+	converted := &WriteCouponsResponse{
+		Items: []*ItemResult{},
+		Summary: &BatchSummary{
+			Total:     int32(len(coupons)),
+			Succeeded: int32(len(coupons)),
+		},
+		WriteMode: writeMode,
+	}
+
+	for i, cpn := range coupons {
+		converted.Items = append(converted.Items, &ItemResult{Index: int32(i), Coupon: FromInternal(cpn)})
+	}
+
+	return converted
+}
+
+//RequestToInternal converts the protobuf envelope of the http api. The data is handed on as json,
+//so the handlers parse it the same way whichever encoding the request was sent in.
+func RequestToInternal(req *Request) (*api.Request, error) {
+	converted := &api.Request{ApiKey: req.GetApiKey(), IdempotencyKey: req.GetIdempotencyKey()}
+
+	var data interface{}
+	switch d := req.GetData().(type) {
+	case *Request_Filter:
+		data = d.Filter.ToInternal()
+	case *Request_Coupons:
+		cpnCollection, err := CollectionToInternal(d.Coupons.GetCoupons(), d.Coupons.Atomic)
+		if err != nil {
+			return nil, err
+		}
+		data = cpnCollection
+	default:
+		return converted, nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	converted.Data = raw
+	return converted, nil
+}
+
+//ResponseFromInternal converts a response of the v1 http api, results of any other shape cannot be sent as protobuf
+func ResponseFromInternal(resp *api.Response) (*Response, error) {
+	converted := &Response{Errors: ErrorsFromInternal(resp.Errors), WriteMode: resp.WriteMode}
+
+	switch result := resp.Result.(type) {
+	case nil:
+	case []api.Coupon:
+		converted.Result = &Response_Coupons{Coupons: &CouponList{Coupons: FromInternalMany(result)}}
+	case *api.BatchResult:
+		converted.Result = &Response_Batch{Batch: BatchFromInternal(result, resp.WriteMode)}
+	default:
+		return nil, fmt.Errorf("a result of type %T cannot be sent as protobuf", resp.Result)
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,1113 @@
+// The gRPC api of the coupon service. It shares the validation and storage of the http api,
+// the messages mirror api.Coupon and api.CouponFilter.
+//
+// Regenerate the go code from the repository root with:
+//   protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative api/couponspb/coupons.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        v5.29.3
+// source: api/couponspb/coupons.proto
+
+package couponspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	wrapperspb "google.golang.org/protobuf/types/known/wrapperspb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Coupon struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// hex encoded object id
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Brand         string                 `protobuf:"bytes,3,opt,name=brand,proto3" json:"brand,omitempty"`
+	Value         float64                `protobuf:"fixed64,4,opt,name=value,proto3" json:"value,omitempty"`
+	Expiry        *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=expiry,proto3" json:"expiry,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Version       int64                  `protobuf:"varint,7,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Coupon) Reset() {
+	*x = Coupon{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Coupon) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Coupon) ProtoMessage() {}
+
+func (x *Coupon) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Coupon.ProtoReflect.Descriptor instead.
+func (*Coupon) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Coupon) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Coupon) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Coupon) GetBrand() string {
+	if x != nil {
+		return x.Brand
+	}
+	return ""
+}
+
+func (x *Coupon) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *Coupon) GetExpiry() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Expiry
+	}
+	return nil
+}
+
+func (x *Coupon) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Coupon) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+type CouponFilter struct {
+	state         protoimpl.MessageState  `protogen:"open.v1"`
+	IdIn          []string                `protobuf:"bytes,1,rep,name=id_in,json=idIn,proto3" json:"id_in,omitempty"`
+	NameContains  string                  `protobuf:"bytes,2,opt,name=name_contains,json=nameContains,proto3" json:"name_contains,omitempty"`
+	BrandEqual    string                  `protobuf:"bytes,3,opt,name=brand_equal,json=brandEqual,proto3" json:"brand_equal,omitempty"`
+	ValueFrom     *wrapperspb.DoubleValue `protobuf:"bytes,4,opt,name=value_from,json=valueFrom,proto3" json:"value_from,omitempty"`
+	ValueTo       *wrapperspb.DoubleValue `protobuf:"bytes,5,opt,name=value_to,json=valueTo,proto3" json:"value_to,omitempty"`
+	ExpiryFrom    *timestamppb.Timestamp  `protobuf:"bytes,6,opt,name=expiry_from,json=expiryFrom,proto3" json:"expiry_from,omitempty"`
+	ExpiryTo      *timestamppb.Timestamp  `protobuf:"bytes,7,opt,name=expiry_to,json=expiryTo,proto3" json:"expiry_to,omitempty"`
+	CreatedAtFrom *timestamppb.Timestamp  `protobuf:"bytes,8,opt,name=created_at_from,json=createdAtFrom,proto3" json:"created_at_from,omitempty"`
+	CreatedAtTo   *timestamppb.Timestamp  `protobuf:"bytes,9,opt,name=created_at_to,json=createdAtTo,proto3" json:"created_at_to,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CouponFilter) Reset() {
+	*x = CouponFilter{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CouponFilter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CouponFilter) ProtoMessage() {}
+
+func (x *CouponFilter) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CouponFilter.ProtoReflect.Descriptor instead.
+func (*CouponFilter) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CouponFilter) GetIdIn() []string {
+	if x != nil {
+		return x.IdIn
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetNameContains() string {
+	if x != nil {
+		return x.NameContains
+	}
+	return ""
+}
+
+func (x *CouponFilter) GetBrandEqual() string {
+	if x != nil {
+		return x.BrandEqual
+	}
+	return ""
+}
+
+func (x *CouponFilter) GetValueFrom() *wrapperspb.DoubleValue {
+	if x != nil {
+		return x.ValueFrom
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetValueTo() *wrapperspb.DoubleValue {
+	if x != nil {
+		return x.ValueTo
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetExpiryFrom() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiryFrom
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetExpiryTo() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiryTo
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetCreatedAtFrom() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAtFrom
+	}
+	return nil
+}
+
+func (x *CouponFilter) GetCreatedAtTo() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAtTo
+	}
+	return nil
+}
+
+type CreateCouponsRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Coupons []*Coupon              `protobuf:"bytes,1,rep,name=coupons,proto3" json:"coupons,omitempty"`
+	// a batch is all-or-nothing unless atomic is set to false, then the valid coupons are written and every coupon gets its own result
+	Atomic        *bool `protobuf:"varint,2,opt,name=atomic,proto3,oneof" json:"atomic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateCouponsRequest) Reset() {
+	*x = CreateCouponsRequest{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateCouponsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateCouponsRequest) ProtoMessage() {}
+
+func (x *CreateCouponsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateCouponsRequest.ProtoReflect.Descriptor instead.
+func (*CreateCouponsRequest) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CreateCouponsRequest) GetCoupons() []*Coupon {
+	if x != nil {
+		return x.Coupons
+	}
+	return nil
+}
+
+func (x *CreateCouponsRequest) GetAtomic() bool {
+	if x != nil && x.Atomic != nil {
+		return *x.Atomic
+	}
+	return false
+}
+
+type UpdateCouponsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Coupons       []*Coupon              `protobuf:"bytes,1,rep,name=coupons,proto3" json:"coupons,omitempty"`
+	Atomic        *bool                  `protobuf:"varint,2,opt,name=atomic,proto3,oneof" json:"atomic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateCouponsRequest) Reset() {
+	*x = UpdateCouponsRequest{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateCouponsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateCouponsRequest) ProtoMessage() {}
+
+func (x *UpdateCouponsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateCouponsRequest.ProtoReflect.Descriptor instead.
+func (*UpdateCouponsRequest) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *UpdateCouponsRequest) GetCoupons() []*Coupon {
+	if x != nil {
+		return x.Coupons
+	}
+	return nil
+}
+
+func (x *UpdateCouponsRequest) GetAtomic() bool {
+	if x != nil && x.Atomic != nil {
+		return *x.Atomic
+	}
+	return false
+}
+
+type SearchCouponsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Filter        *CouponFilter          `protobuf:"bytes,1,opt,name=filter,proto3" json:"filter,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchCouponsRequest) Reset() {
+	*x = SearchCouponsRequest{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchCouponsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchCouponsRequest) ProtoMessage() {}
+
+func (x *SearchCouponsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchCouponsRequest.ProtoReflect.Descriptor instead.
+func (*SearchCouponsRequest) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SearchCouponsRequest) GetFilter() *CouponFilter {
+	if x != nil {
+		return x.Filter
+	}
+	return nil
+}
+
+// Error mirrors api.Error. Failed calls carry the errors as details of the grpc status.
+type Error struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Code          string                 `protobuf:"bytes,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Field         string                 `protobuf:"bytes,3,opt,name=field,proto3" json:"field,omitempty"`
+	Index         *wrapperspb.Int32Value `protobuf:"bytes,4,opt,name=index,proto3" json:"index,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Error) Reset() {
+	*x = Error{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Error) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Error) ProtoMessage() {}
+
+func (x *Error) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Error.ProtoReflect.Descriptor instead.
+func (*Error) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Error) GetCode() string {
+	if x != nil {
+		return x.Code
+	}
+	return ""
+}
+
+func (x *Error) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Error) GetField() string {
+	if x != nil {
+		return x.Field
+	}
+	return ""
+}
+
+func (x *Error) GetIndex() *wrapperspb.Int32Value {
+	if x != nil {
+		return x.Index
+	}
+	return nil
+}
+
+type ItemResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         int32                  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Coupon        *Coupon                `protobuf:"bytes,2,opt,name=coupon,proto3" json:"coupon,omitempty"`
+	Errors        []*Error               `protobuf:"bytes,3,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ItemResult) Reset() {
+	*x = ItemResult{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ItemResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ItemResult) ProtoMessage() {}
+
+func (x *ItemResult) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ItemResult.ProtoReflect.Descriptor instead.
+func (*ItemResult) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ItemResult) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *ItemResult) GetCoupon() *Coupon {
+	if x != nil {
+		return x.Coupon
+	}
+	return nil
+}
+
+func (x *ItemResult) GetErrors() []*Error {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+type BatchSummary struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Total         int32                  `protobuf:"varint,1,opt,name=total,proto3" json:"total,omitempty"`
+	Succeeded     int32                  `protobuf:"varint,2,opt,name=succeeded,proto3" json:"succeeded,omitempty"`
+	Failed        int32                  `protobuf:"varint,3,opt,name=failed,proto3" json:"failed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchSummary) Reset() {
+	*x = BatchSummary{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchSummary) ProtoMessage() {}
+
+func (x *BatchSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchSummary.ProtoReflect.Descriptor instead.
+func (*BatchSummary) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *BatchSummary) GetTotal() int32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *BatchSummary) GetSucceeded() int32 {
+	if x != nil {
+		return x.Succeeded
+	}
+	return 0
+}
+
+func (x *BatchSummary) GetFailed() int32 {
+	if x != nil {
+		return x.Failed
+	}
+	return 0
+}
+
+type WriteCouponsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// one result per coupon of the request, in the order of the request
+	Items   []*ItemResult `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	Summary *BatchSummary `protobuf:"bytes,2,opt,name=summary,proto3" json:"summary,omitempty"`
+	// how the batch was kept all-or-nothing in the db: "transaction" or "compensating"
+	WriteMode     string `protobuf:"bytes,3,opt,name=write_mode,json=writeMode,proto3" json:"write_mode,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WriteCouponsResponse) Reset() {
+	*x = WriteCouponsResponse{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WriteCouponsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteCouponsResponse) ProtoMessage() {}
+
+func (x *WriteCouponsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteCouponsResponse.ProtoReflect.Descriptor instead.
+func (*WriteCouponsResponse) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *WriteCouponsResponse) GetItems() []*ItemResult {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+func (x *WriteCouponsResponse) GetSummary() *BatchSummary {
+	if x != nil {
+		return x.Summary
+	}
+	return nil
+}
+
+func (x *WriteCouponsResponse) GetWriteMode() string {
+	if x != nil {
+		return x.WriteMode
+	}
+	return ""
+}
+
+type Request struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	ApiKey         string                 `protobuf:"bytes,1,opt,name=api_key,json=apiKey,proto3" json:"api_key,omitempty"`
+	IdempotencyKey string                 `protobuf:"bytes,2,opt,name=idempotency_key,json=idempotencyKey,proto3" json:"idempotency_key,omitempty"`
+	// Types that are valid to be assigned to Data:
+	//
+	//	*Request_Filter
+	//	*Request_Coupons
+	Data          isRequest_Data `protobuf_oneof:"data"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Request) Reset() {
+	*x = Request{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Request) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Request) ProtoMessage() {}
+
+func (x *Request) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Request.ProtoReflect.Descriptor instead.
+func (*Request) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Request) GetApiKey() string {
+	if x != nil {
+		return x.ApiKey
+	}
+	return ""
+}
+
+func (x *Request) GetIdempotencyKey() string {
+	if x != nil {
+		return x.IdempotencyKey
+	}
+	return ""
+}
+
+func (x *Request) GetData() isRequest_Data {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Request) GetFilter() *CouponFilter {
+	if x != nil {
+		if x, ok := x.Data.(*Request_Filter); ok {
+			return x.Filter
+		}
+	}
+	return nil
+}
+
+func (x *Request) GetCoupons() *CouponBatch {
+	if x != nil {
+		if x, ok := x.Data.(*Request_Coupons); ok {
+			return x.Coupons
+		}
+	}
+	return nil
+}
+
+type isRequest_Data interface {
+	isRequest_Data()
+}
+
+type Request_Filter struct {
+	// the filter of a search (GET)
+	Filter *CouponFilter `protobuf:"bytes,3,opt,name=filter,proto3,oneof"`
+}
+
+type Request_Coupons struct {
+	// the coupons of a create or an update (POST, PUT)
+	Coupons *CouponBatch `protobuf:"bytes,4,opt,name=coupons,proto3,oneof"`
+}
+
+func (*Request_Filter) isRequest_Data() {}
+
+func (*Request_Coupons) isRequest_Data() {}
+
+type CouponBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Coupons       []*Coupon              `protobuf:"bytes,1,rep,name=coupons,proto3" json:"coupons,omitempty"`
+	Atomic        *bool                  `protobuf:"varint,2,opt,name=atomic,proto3,oneof" json:"atomic,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CouponBatch) Reset() {
+	*x = CouponBatch{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CouponBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CouponBatch) ProtoMessage() {}
+
+func (x *CouponBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CouponBatch.ProtoReflect.Descriptor instead.
+func (*CouponBatch) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CouponBatch) GetCoupons() []*Coupon {
+	if x != nil {
+		return x.Coupons
+	}
+	return nil
+}
+
+func (x *CouponBatch) GetAtomic() bool {
+	if x != nil && x.Atomic != nil {
+		return *x.Atomic
+	}
+	return false
+}
+
+type CouponList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Coupons       []*Coupon              `protobuf:"bytes,1,rep,name=coupons,proto3" json:"coupons,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CouponList) Reset() {
+	*x = CouponList{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CouponList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CouponList) ProtoMessage() {}
+
+func (x *CouponList) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CouponList.ProtoReflect.Descriptor instead.
+func (*CouponList) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *CouponList) GetCoupons() []*Coupon {
+	if x != nil {
+		return x.Coupons
+	}
+	return nil
+}
+
+type Response struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Errors []*Error               `protobuf:"bytes,1,rep,name=errors,proto3" json:"errors,omitempty"`
+	// Types that are valid to be assigned to Result:
+	//
+	//	*Response_Coupons
+	//	*Response_Batch
+	Result isResponse_Result `protobuf_oneof:"result"`
+	// how a batch was kept all-or-nothing in the db: "transaction" or "compensating"
+	WriteMode     string `protobuf:"bytes,4,opt,name=write_mode,json=writeMode,proto3" json:"write_mode,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Response) Reset() {
+	*x = Response{}
+	mi := &file_api_couponspb_coupons_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Response) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Response) ProtoMessage() {}
+
+func (x *Response) ProtoReflect() protoreflect.Message {
+	mi := &file_api_couponspb_coupons_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Response.ProtoReflect.Descriptor instead.
+func (*Response) Descriptor() ([]byte, []int) {
+	return file_api_couponspb_coupons_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Response) GetErrors() []*Error {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+func (x *Response) GetResult() isResponse_Result {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *Response) GetCoupons() *CouponList {
+	if x != nil {
+		if x, ok := x.Result.(*Response_Coupons); ok {
+			return x.Coupons
+		}
+	}
+	return nil
+}
+
+func (x *Response) GetBatch() *WriteCouponsResponse {
+	if x != nil {
+		if x, ok := x.Result.(*Response_Batch); ok {
+			return x.Batch
+		}
+	}
+	return nil
+}
+
+func (x *Response) GetWriteMode() string {
+	if x != nil {
+		return x.WriteMode
+	}
+	return ""
+}
+
+type isResponse_Result interface {
+	isResponse_Result()
+}
+
+type Response_Coupons struct {
+	// the coupons found by a search, written by an atomic batch or in conflict with an update
+	Coupons *CouponList `protobuf:"bytes,2,opt,name=coupons,proto3,oneof"`
+}
+
+type Response_Batch struct {
+	// the result per coupon of a batch that is not atomic
+	Batch *WriteCouponsResponse `protobuf:"bytes,3,opt,name=batch,proto3,oneof"`
+}
+
+func (*Response_Coupons) isResponse_Result() {}
+
+func (*Response_Batch) isResponse_Result() {}
+
+var File_api_couponspb_coupons_proto protoreflect.FileDescriptor
+
+const file_api_couponspb_coupons_proto_rawDesc = "" +
+	"\n" +
+	"\x1bapi/couponspb/coupons.proto\x12\n" +
+	"coupons.v1\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1egoogle/protobuf/wrappers.proto\"\xe1\x01\n" +
+	"\x06Coupon\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x14\n" +
+	"\x05brand\x18\x03 \x01(\tR\x05brand\x12\x14\n" +
+	"\x05value\x18\x04 \x01(\x01R\x05value\x122\n" +
+	"\x06expiry\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\x06expiry\x129\n" +
+	"\n" +
+	"created_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12\x18\n" +
+	"\aversion\x18\a \x01(\x03R\aversion\"\xd9\x03\n" +
+	"\fCouponFilter\x12\x13\n" +
+	"\x05id_in\x18\x01 \x03(\tR\x04idIn\x12#\n" +
+	"\rname_contains\x18\x02 \x01(\tR\fnameContains\x12\x1f\n" +
+	"\vbrand_equal\x18\x03 \x01(\tR\n" +
+	"brandEqual\x12;\n" +
+	"\n" +
+	"value_from\x18\x04 \x01(\v2\x1c.google.protobuf.DoubleValueR\tvalueFrom\x127\n" +
+	"\bvalue_to\x18\x05 \x01(\v2\x1c.google.protobuf.DoubleValueR\avalueTo\x12;\n" +
+	"\vexpiry_from\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"expiryFrom\x127\n" +
+	"\texpiry_to\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\bexpiryTo\x12B\n" +
+	"\x0fcreated_at_from\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\rcreatedAtFrom\x12>\n" +
+	"\rcreated_at_to\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\vcreatedAtTo\"l\n" +
+	"\x14CreateCouponsRequest\x12,\n" +
+	"\acoupons\x18\x01 \x03(\v2\x12.coupons.v1.CouponR\acoupons\x12\x1b\n" +
+	"\x06atomic\x18\x02 \x01(\bH\x00R\x06atomic\x88\x01\x01B\t\n" +
+	"\a_atomic\"l\n" +
+	"\x14UpdateCouponsRequest\x12,\n" +
+	"\acoupons\x18\x01 \x03(\v2\x12.coupons.v1.CouponR\acoupons\x12\x1b\n" +
+	"\x06atomic\x18\x02 \x01(\bH\x00R\x06atomic\x88\x01\x01B\t\n" +
+	"\a_atomic\"H\n" +
+	"\x14SearchCouponsRequest\x120\n" +
+	"\x06filter\x18\x01 \x01(\v2\x18.coupons.v1.CouponFilterR\x06filter\"~\n" +
+	"\x05Error\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\tR\x04code\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12\x14\n" +
+	"\x05field\x18\x03 \x01(\tR\x05field\x121\n" +
+	"\x05index\x18\x04 \x01(\v2\x1b.google.protobuf.Int32ValueR\x05index\"y\n" +
+	"\n" +
+	"ItemResult\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x05R\x05index\x12*\n" +
+	"\x06coupon\x18\x02 \x01(\v2\x12.coupons.v1.CouponR\x06coupon\x12)\n" +
+	"\x06errors\x18\x03 \x03(\v2\x11.coupons.v1.ErrorR\x06errors\"Z\n" +
+	"\fBatchSummary\x12\x14\n" +
+	"\x05total\x18\x01 \x01(\x05R\x05total\x12\x1c\n" +
+	"\tsucceeded\x18\x02 \x01(\x05R\tsucceeded\x12\x16\n" +
+	"\x06failed\x18\x03 \x01(\x05R\x06failed\"\x97\x01\n" +
+	"\x14WriteCouponsResponse\x12,\n" +
+	"\x05items\x18\x01 \x03(\v2\x16.coupons.v1.ItemResultR\x05items\x122\n" +
+	"\asummary\x18\x02 \x01(\v2\x18.coupons.v1.BatchSummaryR\asummary\x12\x1d\n" +
+	"\n" +
+	"write_mode\x18\x03 \x01(\tR\twriteMode\"\xbc\x01\n" +
+	"\aRequest\x12\x17\n" +
+	"\aapi_key\x18\x01 \x01(\tR\x06apiKey\x12'\n" +
+	"\x0fidempotency_key\x18\x02 \x01(\tR\x0eidempotencyKey\x122\n" +
+	"\x06filter\x18\x03 \x01(\v2\x18.coupons.v1.CouponFilterH\x00R\x06filter\x123\n" +
+	"\acoupons\x18\x04 \x01(\v2\x17.coupons.v1.CouponBatchH\x00R\acouponsB\x06\n" +
+	"\x04data\"c\n" +
+	"\vCouponBatch\x12,\n" +
+	"\acoupons\x18\x01 \x03(\v2\x12.coupons.v1.CouponR\acoupons\x12\x1b\n" +
+	"\x06atomic\x18\x02 \x01(\bH\x00R\x06atomic\x88\x01\x01B\t\n" +
+	"\a_atomic\":\n" +
+	"\n" +
+	"CouponList\x12,\n" +
+	"\acoupons\x18\x01 \x03(\v2\x12.coupons.v1.CouponR\acoupons\"\xcc\x01\n" +
+	"\bResponse\x12)\n" +
+	"\x06errors\x18\x01 \x03(\v2\x11.coupons.v1.ErrorR\x06errors\x122\n" +
+	"\acoupons\x18\x02 \x01(\v2\x16.coupons.v1.CouponListH\x00R\acoupons\x128\n" +
+	"\x05batch\x18\x03 \x01(\v2 .coupons.v1.WriteCouponsResponseH\x00R\x05batch\x12\x1d\n" +
+	"\n" +
+	"write_mode\x18\x04 \x01(\tR\twriteModeB\b\n" +
+	"\x06result2\xfc\x01\n" +
+	"\aCoupons\x12S\n" +
+	"\rCreateCoupons\x12 .coupons.v1.CreateCouponsRequest\x1a .coupons.v1.WriteCouponsResponse\x12S\n" +
+	"\rUpdateCoupons\x12 .coupons.v1.UpdateCouponsRequest\x1a .coupons.v1.WriteCouponsResponse\x12G\n" +
+	"\rSearchCoupons\x12 .coupons.v1.SearchCouponsRequest\x1a\x12.coupons.v1.Coupon0\x01B2Z0github.com/akh-dev/coupons-service/api/couponspbb\x06proto3"
+
+var (
+	file_api_couponspb_coupons_proto_rawDescOnce sync.Once
+	file_api_couponspb_coupons_proto_rawDescData []byte
+)
+
+func file_api_couponspb_coupons_proto_rawDescGZIP() []byte {
+	file_api_couponspb_coupons_proto_rawDescOnce.Do(func() {
+		file_api_couponspb_coupons_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_couponspb_coupons_proto_rawDesc), len(file_api_couponspb_coupons_proto_rawDesc)))
+	})
+	return file_api_couponspb_coupons_proto_rawDescData
+}
+
+var file_api_couponspb_coupons_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_api_couponspb_coupons_proto_goTypes = []any{
+	(*Coupon)(nil),                 // 0: coupons.v1.Coupon
+	(*CouponFilter)(nil),           // 1: coupons.v1.CouponFilter
+	(*CreateCouponsRequest)(nil),   // 2: coupons.v1.CreateCouponsRequest
+	(*UpdateCouponsRequest)(nil),   // 3: coupons.v1.UpdateCouponsRequest
+	(*SearchCouponsRequest)(nil),   // 4: coupons.v1.SearchCouponsRequest
+	(*Error)(nil),                  // 5: coupons.v1.Error
+	(*ItemResult)(nil),             // 6: coupons.v1.ItemResult
+	(*BatchSummary)(nil),           // 7: coupons.v1.BatchSummary
+	(*WriteCouponsResponse)(nil),   // 8: coupons.v1.WriteCouponsResponse
+	(*Request)(nil),                // 9: coupons.v1.Request
+	(*CouponBatch)(nil),            // 10: coupons.v1.CouponBatch
+	(*CouponList)(nil),             // 11: coupons.v1.CouponList
+	(*Response)(nil),               // 12: coupons.v1.Response
+	(*timestamppb.Timestamp)(nil),  // 13: google.protobuf.Timestamp
+	(*wrapperspb.DoubleValue)(nil), // 14: google.protobuf.DoubleValue
+	(*wrapperspb.Int32Value)(nil),  // 15: google.protobuf.Int32Value
+}
+var file_api_couponspb_coupons_proto_depIdxs = []int32{
+	13, // 0: coupons.v1.Coupon.expiry:type_name -> google.protobuf.Timestamp
+	13, // 1: coupons.v1.Coupon.created_at:type_name -> google.protobuf.Timestamp
+	14, // 2: coupons.v1.CouponFilter.value_from:type_name -> google.protobuf.DoubleValue
+	14, // 3: coupons.v1.CouponFilter.value_to:type_name -> google.protobuf.DoubleValue
+	13, // 4: coupons.v1.CouponFilter.expiry_from:type_name -> google.protobuf.Timestamp
+	13, // 5: coupons.v1.CouponFilter.expiry_to:type_name -> google.protobuf.Timestamp
+	13, // 6: coupons.v1.CouponFilter.created_at_from:type_name -> google.protobuf.Timestamp
+	13, // 7: coupons.v1.CouponFilter.created_at_to:type_name -> google.protobuf.Timestamp
+	0,  // 8: coupons.v1.CreateCouponsRequest.coupons:type_name -> coupons.v1.Coupon
+	0,  // 9: coupons.v1.UpdateCouponsRequest.coupons:type_name -> coupons.v1.Coupon
+	1,  // 10: coupons.v1.SearchCouponsRequest.filter:type_name -> coupons.v1.CouponFilter
+	15, // 11: coupons.v1.Error.index:type_name -> google.protobuf.Int32Value
+	0,  // 12: coupons.v1.ItemResult.coupon:type_name -> coupons.v1.Coupon
+	5,  // 13: coupons.v1.ItemResult.errors:type_name -> coupons.v1.Error
+	6,  // 14: coupons.v1.WriteCouponsResponse.items:type_name -> coupons.v1.ItemResult
+	7,  // 15: coupons.v1.WriteCouponsResponse.summary:type_name -> coupons.v1.BatchSummary
+	1,  // 16: coupons.v1.Request.filter:type_name -> coupons.v1.CouponFilter
+	10, // 17: coupons.v1.Request.coupons:type_name -> coupons.v1.CouponBatch
+	0,  // 18: coupons.v1.CouponBatch.coupons:type_name -> coupons.v1.Coupon
+	0,  // 19: coupons.v1.CouponList.coupons:type_name -> coupons.v1.Coupon
+	5,  // 20: coupons.v1.Response.errors:type_name -> coupons.v1.Error
+	11, // 21: coupons.v1.Response.coupons:type_name -> coupons.v1.CouponList
+	8,  // 22: coupons.v1.Response.batch:type_name -> coupons.v1.WriteCouponsResponse
+	2,  // 23: coupons.v1.Coupons.CreateCoupons:input_type -> coupons.v1.CreateCouponsRequest
+	3,  // 24: coupons.v1.Coupons.UpdateCoupons:input_type -> coupons.v1.UpdateCouponsRequest
+	4,  // 25: coupons.v1.Coupons.SearchCoupons:input_type -> coupons.v1.SearchCouponsRequest
+	8,  // 26: coupons.v1.Coupons.CreateCoupons:output_type -> coupons.v1.WriteCouponsResponse
+	8,  // 27: coupons.v1.Coupons.UpdateCoupons:output_type -> coupons.v1.WriteCouponsResponse
+	0,  // 28: coupons.v1.Coupons.SearchCoupons:output_type -> coupons.v1.Coupon
+	26, // [26:29] is the sub-list for method output_type
+	23, // [23:26] is the sub-list for method input_type
+	23, // [23:23] is the sub-list for extension type_name
+	23, // [23:23] is the sub-list for extension extendee
+	0,  // [0:23] is the sub-list for field type_name
+}
+
+func init() { file_api_couponspb_coupons_proto_init() }
+func file_api_couponspb_coupons_proto_init() {
+	if File_api_couponspb_coupons_proto != nil {
+		return
+	}
+	file_api_couponspb_coupons_proto_msgTypes[2].OneofWrappers = []any{}
+	file_api_couponspb_coupons_proto_msgTypes[3].OneofWrappers = []any{}
+	file_api_couponspb_coupons_proto_msgTypes[9].OneofWrappers = []any{
+		(*Request_Filter)(nil),
+		(*Request_Coupons)(nil),
+	}
+	file_api_couponspb_coupons_proto_msgTypes[10].OneofWrappers = []any{}
+	file_api_couponspb_coupons_proto_msgTypes[12].OneofWrappers = []any{
+		(*Response_Coupons)(nil),
+		(*Response_Batch)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_couponspb_coupons_proto_rawDesc), len(file_api_couponspb_coupons_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_couponspb_coupons_proto_goTypes,
+		DependencyIndexes: file_api_couponspb_coupons_proto_depIdxs,
+		MessageInfos:      file_api_couponspb_coupons_proto_msgTypes,
+	}.Build()
+	File_api_couponspb_coupons_proto = out.File
+	file_api_couponspb_coupons_proto_goTypes = nil
+	file_api_couponspb_coupons_proto_depIdxs = nil
+}
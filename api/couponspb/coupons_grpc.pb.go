@@ -0,0 +1,217 @@
+// The gRPC api of the coupon service. It shares the validation and storage of the http api,
+// the messages mirror api.Coupon and api.CouponFilter.
+//
+// Regenerate the go code from the repository root with:
+//   protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative api/couponspb/coupons.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: api/couponspb/coupons.proto
+
+package couponspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Coupons_CreateCoupons_FullMethodName = "/coupons.v1.Coupons/CreateCoupons"
+	Coupons_UpdateCoupons_FullMethodName = "/coupons.v1.Coupons/UpdateCoupons"
+	Coupons_SearchCoupons_FullMethodName = "/coupons.v1.Coupons/SearchCoupons"
+)
+
+// CouponsClient is the client API for Coupons service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Every call must carry the api key in the "x-api-key" metadata.
+type CouponsClient interface {
+	// CreateCoupons creates a batch of coupons, see CreateCouponsRequest.atomic.
+	CreateCoupons(ctx context.Context, in *CreateCouponsRequest, opts ...grpc.CallOption) (*WriteCouponsResponse, error)
+	// UpdateCoupons updates a batch of coupons, every coupon must carry the version the update is based on.
+	UpdateCoupons(ctx context.Context, in *UpdateCouponsRequest, opts ...grpc.CallOption) (*WriteCouponsResponse, error)
+	// SearchCoupons streams the coupons matching every condition of the filter, as they are read from the db.
+	SearchCoupons(ctx context.Context, in *SearchCouponsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Coupon], error)
+}
+
+type couponsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCouponsClient(cc grpc.ClientConnInterface) CouponsClient {
+	return &couponsClient{cc}
+}
+
+func (c *couponsClient) CreateCoupons(ctx context.Context, in *CreateCouponsRequest, opts ...grpc.CallOption) (*WriteCouponsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(WriteCouponsResponse)
+	err := c.cc.Invoke(ctx, Coupons_CreateCoupons_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *couponsClient) UpdateCoupons(ctx context.Context, in *UpdateCouponsRequest, opts ...grpc.CallOption) (*WriteCouponsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(WriteCouponsResponse)
+	err := c.cc.Invoke(ctx, Coupons_UpdateCoupons_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *couponsClient) SearchCoupons(ctx context.Context, in *SearchCouponsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Coupon], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Coupons_ServiceDesc.Streams[0], Coupons_SearchCoupons_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SearchCouponsRequest, Coupon]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Coupons_SearchCouponsClient = grpc.ServerStreamingClient[Coupon]
+
+// CouponsServer is the server API for Coupons service.
+// All implementations must embed UnimplementedCouponsServer
+// for forward compatibility.
+//
+// Every call must carry the api key in the "x-api-key" metadata.
+type CouponsServer interface {
+	// CreateCoupons creates a batch of coupons, see CreateCouponsRequest.atomic.
+	CreateCoupons(context.Context, *CreateCouponsRequest) (*WriteCouponsResponse, error)
+	// UpdateCoupons updates a batch of coupons, every coupon must carry the version the update is based on.
+	UpdateCoupons(context.Context, *UpdateCouponsRequest) (*WriteCouponsResponse, error)
+	// SearchCoupons streams the coupons matching every condition of the filter, as they are read from the db.
+	SearchCoupons(*SearchCouponsRequest, grpc.ServerStreamingServer[Coupon]) error
+	mustEmbedUnimplementedCouponsServer()
+}
+
+// UnimplementedCouponsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCouponsServer struct{}
+
+func (UnimplementedCouponsServer) CreateCoupons(context.Context, *CreateCouponsRequest) (*WriteCouponsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateCoupons not implemented")
+}
+func (UnimplementedCouponsServer) UpdateCoupons(context.Context, *UpdateCouponsRequest) (*WriteCouponsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateCoupons not implemented")
+}
+func (UnimplementedCouponsServer) SearchCoupons(*SearchCouponsRequest, grpc.ServerStreamingServer[Coupon]) error {
+	return status.Errorf(codes.Unimplemented, "method SearchCoupons not implemented")
+}
+func (UnimplementedCouponsServer) mustEmbedUnimplementedCouponsServer() {}
+func (UnimplementedCouponsServer) testEmbeddedByValue()                 {}
+
+// UnsafeCouponsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CouponsServer will
+// result in compilation errors.
+type UnsafeCouponsServer interface {
+	mustEmbedUnimplementedCouponsServer()
+}
+
+func RegisterCouponsServer(s grpc.ServiceRegistrar, srv CouponsServer) {
+	// If the following call pancis, it indicates UnimplementedCouponsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Coupons_ServiceDesc, srv)
+}
+
+func _Coupons_CreateCoupons_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateCouponsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CouponsServer).CreateCoupons(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Coupons_CreateCoupons_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CouponsServer).CreateCoupons(ctx, req.(*CreateCouponsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coupons_UpdateCoupons_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateCouponsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CouponsServer).UpdateCoupons(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Coupons_UpdateCoupons_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CouponsServer).UpdateCoupons(ctx, req.(*UpdateCouponsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Coupons_SearchCoupons_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SearchCouponsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CouponsServer).SearchCoupons(m, &grpc.GenericServerStream[SearchCouponsRequest, Coupon]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Coupons_SearchCouponsServer = grpc.ServerStreamingServer[Coupon]
+
+// Coupons_ServiceDesc is the grpc.ServiceDesc for Coupons service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Coupons_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "coupons.v1.Coupons",
+	HandlerType: (*CouponsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateCoupons",
+			Handler:    _Coupons_CreateCoupons_Handler,
+		},
+		{
+			MethodName: "UpdateCoupons",
+			Handler:    _Coupons_UpdateCoupons_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SearchCoupons",
+			Handler:       _Coupons_SearchCoupons_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/couponspb/coupons.proto",
+}
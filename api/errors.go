@@ -0,0 +1,143 @@
+package api
+
+import "fmt"
+
+//Error codes reported in Response.Errors. The codes are stable, clients should switch on them rather than on messages.
+const (
+	//the request could not be parsed
+	ERR_INVALID_REQUEST string = "invalid_request"
+	//no api key was provided
+	ERR_UNAUTHENTICATED string = "unauthenticated"
+	//the api key is not valid
+	ERR_FORBIDDEN string = "forbidden"
+	//the http method / path is not supported
+	ERR_UNKNOWN_OPERATION string = "unknown_operation"
+	//a create or update request did not contain any coupons
+	ERR_NO_COUPONS string = "no_coupons"
+	//the search filter is missing or malformed
+	ERR_INVALID_FILTER string = "invalid_filter"
+
+	//coupon validation
+	ERR_COUPON_MISSING     string = "coupon_missing"
+	ERR_NAME_REQUIRED      string = "name_required"
+	ERR_BRAND_REQUIRED     string = "brand_required"
+	ERR_VALUE_NOT_POSITIVE string = "value_not_positive"
+	ERR_EXPIRY_TOO_EARLY   string = "expiry_too_early"
+	ERR_ID_REQUIRED        string = "id_required"
+	ERR_ID_INVALID         string = "id_invalid"
+	ERR_VERSION_REQUIRED   string = "version_required"
+	ERR_READ_ONLY_FIELD    string = "read_only_field"
+	//a batch names the same coupon more than once
+	ERR_DUPLICATE_ID string = "duplicate_id"
+	//a v2 money amount is not in the currency the service keeps values in
+	ERR_UNSUPPORTED_CURRENCY string = "unsupported_currency"
+	//the path names a version of the api that does not exist
+	ERR_UNKNOWN_API_VERSION string = "unknown_api_version"
+
+	//the If-Match header could not be applied to the request
+	ERR_INVALID_IF_MATCH string = "invalid_if_match"
+	//the coupon was modified since the version the request was based on
+	ERR_VERSION_CONFLICT string = "version_conflict"
+	//the coupon does not exist
+	ERR_COUPON_NOT_FOUND string = "coupon_not_found"
+	//the coupon has no such version in its history, or did not exist at the time asked for
+	ERR_COUPON_VERSION_NOT_FOUND string = "coupon_version_not_found"
+
+	//the idempotency key was already used with a different request
+	ERR_IDEMPOTENCY_KEY_REUSED string = "idempotency_key_reused"
+	//a request with the same idempotency key is still being processed
+	ERR_IDEMPOTENCY_KEY_IN_USE string = "idempotency_key_in_use"
+
+	//none of the formats in the Accept header can be produced
+	ERR_NOT_ACCEPTABLE string = "not_acceptable"
+	//the request body is sent in an encoding (or compressed with a Content-Encoding) the endpoint does not take
+	ERR_UNSUPPORTED_MEDIA_TYPE string = "unsupported_media_type"
+	//the request body decompresses to more than the service accepts
+	ERR_REQUEST_TOO_LARGE string = "request_too_large"
+
+	//the csv file is malformed or its header does not map to coupon fields
+	ERR_INVALID_CSV string = "invalid_csv"
+	//a value of an imported row cannot be read as the type of its field (e.g. a date in an unknown format)
+	ERR_INVALID_FIELD_FORMAT string = "invalid_field_format"
+
+	//the GraphQL query could not be parsed or does not match the schema
+	ERR_INVALID_QUERY string = "invalid_query"
+	//the GraphQL query nests fields deeper than allowed
+	ERR_QUERY_TOO_DEEP string = "query_too_deep"
+	//the GraphQL query asks for more work than allowed
+	ERR_QUERY_TOO_COMPLEX string = "query_too_complex"
+
+	//the sync token was not issued by the service
+	ERR_INVALID_SYNC_TOKEN string = "invalid_sync_token"
+	//the changes since the sync token are no longer kept, the client has to sync in full
+	ERR_SYNC_TOKEN_EXPIRED string = "sync_token_expired"
+
+	//the webhook subscription has an invalid url or asks for an unknown event type
+	ERR_INVALID_SUBSCRIPTION string = "invalid_subscription"
+	//the webhook subscription does not exist
+	ERR_SUBSCRIPTION_NOT_FOUND string = "subscription_not_found"
+	//the webhook delivery does not exist
+	ERR_DELIVERY_NOT_FOUND string = "delivery_not_found"
+	//the service does not deliver webhooks, the outbox relay is not running
+	ERR_WEBHOOKS_UNAVAILABLE string = "webhooks_unavailable"
+
+	//the api key to create has no owner or has already expired
+	ERR_INVALID_API_KEY string = "invalid_api_key"
+	//the api key does not exist
+	ERR_API_KEY_NOT_FOUND string = "api_key_not_found"
+
+	//the db could not be reached
+	ERR_DB_UNAVAILABLE string = "db_unavailable"
+	//the db rejected or failed the operation
+	ERR_DB_FAILURE string = "db_failure"
+	//a batch failed midway and undoing the part already written failed too, the message lists the coupons left changed
+	ERR_BATCH_PARTIALLY_APPLIED string = "batch_partially_applied"
+	//anything else that went wrong on the server side
+	ERR_INTERNAL string = "internal"
+)
+
+//Error is a machine-readable description of a failure. Field is the path of the offending field
+//(e.g. coupons[3].expiry) and Index the position of the item in a batch, when they apply.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	Index   *int   `json:"index,omitempty"`
+
+	//how the error used to be reported in the flat list of strings, if different from Message
+	legacy string
+}
+
+func NewError(code, message string) Error {
+	return Error{Code: code, Message: message}
+}
+
+func NewErrorf(code, format string, args ...interface{}) Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+//Error makes an api Error usable as a go error, so lower layers can return it as is
+func (e Error) Error() string {
+	return e.Message
+}
+
+//WithItem points the error at a field of an item in a batch
+func (e Error) WithItem(index int, field string) Error {
+	e.Index = &index
+	e.Field = field
+	return e
+}
+
+//WithLegacy sets the text the error is reported with in the legacy error format
+func (e Error) WithLegacy(legacy string) Error {
+	e.legacy = legacy
+	return e
+}
+
+//Legacy renders the error as it was reported before error codes were introduced
+func (e Error) Legacy() string {
+	if e.legacy != "" {
+		return e.legacy
+	}
+	return e.Message
+}
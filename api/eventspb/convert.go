@@ -0,0 +1,24 @@
+package eventspb
+
+import (
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//SCHEMA_VERSION is the version of the schema the events of this package are encoded with
+const SCHEMA_VERSION int32 = 1
+
+func FromInternal(event api.CouponEvent) *CouponEvent {
+	return &CouponEvent{
+		SchemaVersion: SCHEMA_VERSION,
+		Seq:           event.Seq,
+		Type:          event.Type,
+		CouponId:      event.CouponId.Hex(),
+		Brand:         event.Brand,
+		PreviousBrand: event.PreviousBrand,
+		ChangedFields: event.ChangedFields,
+		Version:       event.Version,
+		OccurredAt:    timestamppb.New(event.At),
+	}
+}
@@ -0,0 +1,213 @@
+// The schema of the coupon events published to message brokers (see the outbox package), encoded as protobuf or,
+// with the canonical json mapping of protobuf, as json. Fields are only ever added to a version of the schema,
+// a change that breaks consumers comes as a new package (coupons.events.v2) and schema version.
+//
+// Regenerate the go code from the repository root with:
+//   protoc --go_out=. --go_opt=paths=source_relative api/eventspb/events.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        v5.29.3
+// source: api/eventspb/events.proto
+
+package eventspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// CouponEvent is a change of a coupon, it mirrors api.CouponEvent.
+type CouponEvent struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the version of the schema the event is encoded with, 1
+	SchemaVersion int32 `protobuf:"varint,1,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	// increasing sequence number of the event, an event delivered again carries the same one
+	Seq int64 `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	// created, updated, deleted, expired or redeemed
+	Type string `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	// hex encoded object id
+	CouponId string `protobuf:"bytes,4,opt,name=coupon_id,json=couponId,proto3" json:"coupon_id,omitempty"`
+	Brand    string `protobuf:"bytes,5,opt,name=brand,proto3" json:"brand,omitempty"`
+	// set when the coupon moved to another brand
+	PreviousBrand string `protobuf:"bytes,6,opt,name=previous_brand,json=previousBrand,proto3" json:"previous_brand,omitempty"`
+	// the fields an update changed
+	ChangedFields []string `protobuf:"bytes,7,rep,name=changed_fields,json=changedFields,proto3" json:"changed_fields,omitempty"`
+	// the version of the coupon after the change
+	Version       int64                  `protobuf:"varint,8,opt,name=version,proto3" json:"version,omitempty"`
+	OccurredAt    *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=occurred_at,json=occurredAt,proto3" json:"occurred_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CouponEvent) Reset() {
+	*x = CouponEvent{}
+	mi := &file_api_eventspb_events_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CouponEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CouponEvent) ProtoMessage() {}
+
+func (x *CouponEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_api_eventspb_events_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CouponEvent.ProtoReflect.Descriptor instead.
+func (*CouponEvent) Descriptor() ([]byte, []int) {
+	return file_api_eventspb_events_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CouponEvent) GetSchemaVersion() int32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *CouponEvent) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *CouponEvent) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *CouponEvent) GetCouponId() string {
+	if x != nil {
+		return x.CouponId
+	}
+	return ""
+}
+
+func (x *CouponEvent) GetBrand() string {
+	if x != nil {
+		return x.Brand
+	}
+	return ""
+}
+
+func (x *CouponEvent) GetPreviousBrand() string {
+	if x != nil {
+		return x.PreviousBrand
+	}
+	return ""
+}
+
+func (x *CouponEvent) GetChangedFields() []string {
+	if x != nil {
+		return x.ChangedFields
+	}
+	return nil
+}
+
+func (x *CouponEvent) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *CouponEvent) GetOccurredAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.OccurredAt
+	}
+	return nil
+}
+
+var File_api_eventspb_events_proto protoreflect.FileDescriptor
+
+const file_api_eventspb_events_proto_rawDesc = "" +
+	"\n" +
+	"\x19api/eventspb/events.proto\x12\x11coupons.events.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xb2\x02\n" +
+	"\vCouponEvent\x12%\n" +
+	"\x0eschema_version\x18\x01 \x01(\x05R\rschemaVersion\x12\x10\n" +
+	"\x03seq\x18\x02 \x01(\x03R\x03seq\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x12\x1b\n" +
+	"\tcoupon_id\x18\x04 \x01(\tR\bcouponId\x12\x14\n" +
+	"\x05brand\x18\x05 \x01(\tR\x05brand\x12%\n" +
+	"\x0eprevious_brand\x18\x06 \x01(\tR\rpreviousBrand\x12%\n" +
+	"\x0echanged_fields\x18\a \x03(\tR\rchangedFields\x12\x18\n" +
+	"\aversion\x18\b \x01(\x03R\aversion\x12;\n" +
+	"\voccurred_at\x18\t \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"occurredAtB1Z/github.com/akh-dev/coupons-service/api/eventspbb\x06proto3"
+
+var (
+	file_api_eventspb_events_proto_rawDescOnce sync.Once
+	file_api_eventspb_events_proto_rawDescData []byte
+)
+
+func file_api_eventspb_events_proto_rawDescGZIP() []byte {
+	file_api_eventspb_events_proto_rawDescOnce.Do(func() {
+		file_api_eventspb_events_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_eventspb_events_proto_rawDesc), len(file_api_eventspb_events_proto_rawDesc)))
+	})
+	return file_api_eventspb_events_proto_rawDescData
+}
+
+var file_api_eventspb_events_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_api_eventspb_events_proto_goTypes = []any{
+	(*CouponEvent)(nil),           // 0: coupons.events.v1.CouponEvent
+	(*timestamppb.Timestamp)(nil), // 1: google.protobuf.Timestamp
+}
+var file_api_eventspb_events_proto_depIdxs = []int32{
+	1, // 0: coupons.events.v1.CouponEvent.occurred_at:type_name -> google.protobuf.Timestamp
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_api_eventspb_events_proto_init() }
+func file_api_eventspb_events_proto_init() {
+	if File_api_eventspb_events_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_eventspb_events_proto_rawDesc), len(file_api_eventspb_events_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_api_eventspb_events_proto_goTypes,
+		DependencyIndexes: file_api_eventspb_events_proto_depIdxs,
+		MessageInfos:      file_api_eventspb_events_proto_msgTypes,
+	}.Build()
+	File_api_eventspb_events_proto = out.File
+	file_api_eventspb_events_proto_goTypes = nil
+	file_api_eventspb_events_proto_depIdxs = nil
+}
@@ -0,0 +1,63 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func TestSchemaForCoupon(t *testing.T) {
+	g := NewGenerator()
+
+	ref := g.SchemaFor(api.Coupon{})
+	if ref.Ref != "#/components/schemas/Coupon" {
+		t.Errorf("expected a reference to the Coupon schema, but got %+v", ref)
+		return
+	}
+
+	schema := g.Components().Schemas["Coupon"]
+	if schema == nil {
+		t.Error("expected the Coupon schema to be registered")
+		return
+	}
+
+	//every json field of the type must be described, under its json name
+	cpnType := reflect.TypeOf(api.Coupon{})
+	for i := 0; i < cpnType.NumField(); i++ {
+		name := strings.Split(cpnType.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if _, found := schema.Properties[name]; !found {
+			t.Errorf("field %s is not described", name)
+		}
+	}
+
+	if expiry := schema.Properties["expiry"]; expiry.Type != "string" || expiry.Format != "date-time" {
+		t.Errorf("unexpected expiry schema %+v", expiry)
+	}
+	if value := schema.Properties["value"]; value.Type != "number" {
+		t.Errorf("unexpected value schema %+v", value)
+	}
+}
+
+func TestSchemaForSkipsUnmarshalledFields(t *testing.T) {
+	g := NewGenerator()
+
+	schema := g.InlineSchemaFor(api.Request{})
+	for _, name := range []string{"IfMatch", "ApiVersion"} {
+		if _, found := schema.Properties[name]; found {
+			t.Errorf("field %s is not part of the json payload, but is described", name)
+		}
+	}
+	if _, found := schema.Properties["apiKey"]; !found {
+		t.Error("expected apiKey to be described")
+	}
+
+	filter := g.InlineSchemaFor(api.CouponFilter{})
+	if valueFrom := filter.Properties["valueFrom"]; !valueFrom.Nullable {
+		t.Errorf("expected valueFrom to be nullable, got %+v", valueFrom)
+	}
+}
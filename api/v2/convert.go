@@ -0,0 +1,125 @@
+package v2
+
+import (
+	"math"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//minorUnits is how many minor units make up one major unit of the currency.
+//The service checks its currency when it starts, so an unknown code does not get this far.
+func minorUnits(currency string) float64 {
+	digits, err := CurrencyExponent(currency)
+	if err != nil {
+		digits = 2
+	}
+	return math.Pow10(digits)
+}
+
+//the internal model keeps values in major units of the service currency
+func toMinor(value float64, currency string) int64 {
+	return int64(math.Round(value * minorUnits(currency)))
+}
+
+func toMajor(amount int64, currency string) float64 {
+	return float64(amount) / minorUnits(currency)
+}
+
+//FromInternal converts a stored coupon to its v2 shape, the status is derived from the expiry at the time of the call
+func FromInternal(cpn api.Coupon, currency string, now time.Time) Coupon {
+	status := STATUS_ACTIVE
+	if !cpn.Expiry.IsZero() && cpn.Expiry.Before(now) {
+		status = STATUS_EXPIRED
+	}
+
+	return Coupon{
+		Id:        cpn.Id,
+		Name:      cpn.Name,
+		Brand:     cpn.Brand,
+		Value:     Money{Amount: toMinor(cpn.Value, currency), Currency: currency},
+		Status:    status,
+		Expiry:    cpn.Expiry,
+		CreatedAt: cpn.CreatedAt,
+		Version:   cpn.Version,
+	}
+}
+
+func FromInternalMany(coupons []api.Coupon, currency string, now time.Time) []Coupon {
+	converted := []Coupon{}
+	for _, cpn := range coupons {
+		converted = append(converted, FromInternal(cpn, currency, now))
+	}
+	return converted
+}
+
+//ToInternal converts a v2 coupon to the internal model. The status is derived, so it is not carried over.
+//The currency must be the one the service keeps its values in, anything else is rejected by the caller.
+func (cpn Coupon) ToInternal(currency string) api.Coupon {
+	return api.Coupon{
+		Id:        cpn.Id,
+		Name:      cpn.Name,
+		Brand:     cpn.Brand,
+		Value:     toMajor(cpn.Value.Amount, currency),
+		Expiry:    cpn.Expiry,
+		CreatedAt: cpn.CreatedAt,
+		Version:   cpn.Version,
+	}
+}
+
+func (coll CouponCollection) ToInternal(currency string) *api.CouponCollection {
+	converted := &api.CouponCollection{Coupons: []api.Coupon{}, Atomic: coll.Atomic}
+	for _, cpn := range coll.Coupons {
+		converted.Coupons = append(converted.Coupons, cpn.ToInternal(currency))
+	}
+	return converted
+}
+
+func BatchFromInternal(batch *api.BatchResult, currency string, now time.Time) *BatchResult {
+	converted := &BatchResult{Items: []BatchItemResult{}, Summary: batch.Summary}
+	for _, item := range batch.Items {
+		convItem := BatchItemResult{Index: item.Index, Errors: item.Errors}
+		if item.Coupon != nil {
+			cpn := FromInternal(*item.Coupon, currency, now)
+			convItem.Coupon = &cpn
+		}
+		converted.Items = append(converted.Items, convItem)
+	}
+	return converted
+}
+
+//ToInternal converts the filter to the internal one, the status is turned into bounds on the expiry date.
+//Value bounds are minor units of currency.
+func (f CouponFilter) ToInternal(currency string, now time.Time) *api.CouponFilter {
+	converted := &api.CouponFilter{
+		IdIn:          f.IdIn,
+		NameContains:  f.NameContains,
+		BrandEqual:    f.BrandEqual,
+		ExpiryFrom:    f.ExpiryFrom,
+		ExpiryTo:      f.ExpiryTo,
+		CreatedAtFrom: f.CreatedAtFrom,
+		CreatedAtTo:   f.CreatedAtTo,
+	}
+
+	if f.ValueFrom != nil {
+		from := toMajor(*f.ValueFrom, currency)
+		converted.MinValue = &from
+	}
+	if f.ValueTo != nil {
+		to := toMajor(*f.ValueTo, currency)
+		converted.MaxValue = &to
+	}
+
+	switch f.Status {
+	case STATUS_ACTIVE:
+		if converted.ExpiryFrom.Before(now) {
+			converted.ExpiryFrom = now
+		}
+	case STATUS_EXPIRED:
+		if converted.ExpiryTo.IsZero() || converted.ExpiryTo.After(now) {
+			converted.ExpiryTo = now
+		}
+	}
+
+	return converted
+}
@@ -0,0 +1,137 @@
+package v2
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func TestFromInternal(t *testing.T) {
+	now := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name           string
+		coupon         api.Coupon
+		currency       string
+		expectedAmount int64
+		expectedStatus string
+	}{
+		{
+			name:           "active",
+			coupon:         api.Coupon{Value: 1.5, Expiry: now.Add(time.Hour)},
+			currency:       "GBP",
+			expectedAmount: 150,
+			expectedStatus: STATUS_ACTIVE,
+		},
+		{
+			name:           "expired",
+			coupon:         api.Coupon{Value: 0.1, Expiry: now.Add(-time.Hour)},
+			currency:       "GBP",
+			expectedAmount: 10,
+			expectedStatus: STATUS_EXPIRED,
+		},
+		{
+			name:           "no minor unit",
+			coupon:         api.Coupon{Value: 500, Expiry: now.Add(time.Hour)},
+			currency:       "JPY",
+			expectedAmount: 500,
+			expectedStatus: STATUS_ACTIVE,
+		},
+		{
+			name:           "thousandths",
+			coupon:         api.Coupon{Value: 1.5, Expiry: now.Add(time.Hour)},
+			currency:       "KWD",
+			expectedAmount: 1500,
+			expectedStatus: STATUS_ACTIVE,
+		},
+	}
+
+	for _, tc := range testCases {
+		cpn := FromInternal(tc.coupon, tc.currency, now)
+		if cpn.Value.Amount != tc.expectedAmount || cpn.Value.Currency != tc.currency {
+			t.Errorf("%s: unexpected value %+v", tc.name, cpn.Value)
+		}
+		if cpn.Status != tc.expectedStatus {
+			t.Errorf("%s: expected status %s, but got %s", tc.name, tc.expectedStatus, cpn.Status)
+		}
+		if back := cpn.ToInternal(tc.currency); back.Value != tc.coupon.Value {
+			t.Errorf("%s: value did not survive the round trip, %f != %f", tc.name, back.Value, tc.coupon.Value)
+		}
+	}
+}
+
+func TestCouponFilterToInternal(t *testing.T) {
+	now := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	from := int64(250)
+
+	filter := CouponFilter{Status: STATUS_EXPIRED, ValueFrom: &from}
+	converted := filter.ToInternal("GBP", now)
+
+	valueFrom, valueTo := converted.ValueRange()
+	if valueFrom == nil || *valueFrom != 2.5 || converted.ValueFrom != nil {
+		t.Errorf("expected valueFrom to be converted to 2.5, but got %v", valueFrom)
+	}
+	if valueTo != nil {
+		t.Errorf("expected no valueTo, but got %f", *valueTo)
+	}
+	if !converted.ExpiryTo.Equal(now) {
+		t.Errorf("expected expired coupons to be searched up to %s, but got %s", now, converted.ExpiryTo)
+	}
+
+	filter = CouponFilter{Status: STATUS_ACTIVE}
+	if converted := filter.ToInternal("GBP", now); !converted.ExpiryFrom.Equal(now) {
+		t.Errorf("expected active coupons to be searched from %s, but got %s", now, converted.ExpiryFrom)
+	}
+}
+
+func TestCurrencyExponent(t *testing.T) {
+	testCases := []struct {
+		currency       string
+		expectedDigits int
+		expectError    bool
+	}{
+		{currency: "GBP", expectedDigits: 2},
+		{currency: "JPY", expectedDigits: 0},
+		{currency: "KWD", expectedDigits: 3},
+		{currency: "gbp", expectError: true},
+		{currency: "POUND", expectError: true},
+		{currency: "", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		digits, err := CurrencyExponent(tc.currency)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("expected %q to be rejected", tc.currency)
+			}
+			continue
+		}
+		if err != nil || digits != tc.expectedDigits {
+			t.Errorf("expected %s to have %d digits, got %d (%v)", tc.currency, tc.expectedDigits, digits, err)
+		}
+	}
+}
+
+func TestCouponCollectionAtomicDefault(t *testing.T) {
+	testCases := []struct {
+		payload        string
+		expectedAtomic bool
+	}{
+		{payload: `{"coupons":[]}`, expectedAtomic: true},
+		{payload: `{"atomic":true,"coupons":[]}`, expectedAtomic: true},
+		{payload: `{"atomic":false,"coupons":[]}`, expectedAtomic: false},
+	}
+
+	for _, tc := range testCases {
+		coll := &CouponCollection{}
+		if err := json.Unmarshal([]byte(tc.payload), coll); err != nil {
+			t.Error(err)
+			continue
+		}
+		if converted := coll.ToInternal("GBP"); converted.Atomic != tc.expectedAtomic {
+			t.Errorf("expected %s to be atomic %t, but got %t", tc.payload, tc.expectedAtomic, converted.Atomic)
+		}
+	}
+}
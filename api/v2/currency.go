@@ -0,0 +1,31 @@
+package v2
+
+import (
+	"github.com/pkg/errors"
+)
+
+//minorUnitDigits are the ISO 4217 exponents of the currencies whose minor unit is not a hundredth,
+//every other currency counts its amounts in hundredths (e.g. pence, cents)
+var minorUnitDigits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+//CurrencyExponent is the number of digits of the minor unit of an ISO 4217 currency: 2 for GBP, 0 for JPY, 3 for KWD
+func CurrencyExponent(currency string) (int, error) {
+	if len(currency) != 3 {
+		return 0, errors.Errorf("%q is not an ISO 4217 currency code", currency)
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return 0, errors.Errorf("%q is not an ISO 4217 currency code", currency)
+		}
+	}
+
+	if digits, found := minorUnitDigits[currency]; found {
+		return digits, nil
+	}
+	return 2, nil
+}
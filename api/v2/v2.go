@@ -0,0 +1,76 @@
+//Package v2 holds the json shapes of the second version of the coupon api (served under /v2/).
+//The request / response envelope is shared with v1 (api.Request, api.Response), the coupons themselves change:
+//values are money amounts in minor units with a currency, and coupons report whether they are still active.
+package v2
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	STATUS_ACTIVE  string = "active"
+	STATUS_EXPIRED string = "expired"
+)
+
+//Money is an amount in minor units of the currency (e.g. pence), so values are exact
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type Coupon struct {
+	Id        primitive.ObjectID `json:"id,omitempty"`
+	Name      string             `json:"name"`
+	Brand     string             `json:"brand"`
+	Value     Money              `json:"value"`
+	Status    string             `json:"status,omitempty"`
+	Expiry    time.Time          `json:"expiry"`
+	CreatedAt time.Time          `json:"createdAt,omitempty"`
+	Version   int64              `json:"version,omitempty"`
+}
+
+type CouponCollection struct {
+	Coupons []Coupon `json:"coupons"`
+	Atomic  bool     `json:"atomic"`
+}
+
+//UnmarshalJSON makes batches atomic unless they say "atomic":false, the same as in v1
+func (c *CouponCollection) UnmarshalJSON(data []byte) error {
+	type collection CouponCollection
+	decoded := collection{Atomic: true}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*c = CouponCollection(decoded)
+	return nil
+}
+
+type BatchResult struct {
+	Items   []BatchItemResult `json:"items"`
+	Summary api.BatchSummary  `json:"summary"`
+}
+
+type BatchItemResult struct {
+	Index  int         `json:"index"`
+	Coupon *Coupon     `json:"coupon,omitempty"`
+	Errors []api.Error `json:"errors,omitempty"`
+}
+
+//CouponFilter is api.CouponFilter with value bounds in minor units and a status filter
+type CouponFilter struct {
+	IdIn          []string  `json:"idIn,omitempty"`
+	NameContains  string    `json:"nameContains,omitempty"`
+	BrandEqual    string    `json:"brandEqual,omitempty"`
+	Status        string    `json:"status,omitempty"`
+	ValueFrom     *int64    `json:"valueFrom,omitempty"`
+	ValueTo       *int64    `json:"valueTo,omitempty"`
+	ExpiryFrom    time.Time `json:"expiryFrom"`
+	ExpiryTo      time.Time `json:"expiryTo"`
+	CreatedAtFrom time.Time `json:"createdAtFrom"`
+	CreatedAtTo   time.Time `json:"createdAtTo"`
+}
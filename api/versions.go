@@ -0,0 +1,34 @@
+package api
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+)
+
+//CouponVersion is a coupon as written by a create or update. A delete is recorded as a version too, marked Deleted
+//and carrying the version that was deleted, so the history tells when the coupon stopped existing.
+type CouponVersion struct {
+	Id       primitive.ObjectID `json:"-" bson:"_id,omitempty"`
+	CouponId primitive.ObjectID `json:"couponId" bson:"couponId"`
+	Version  int64              `json:"version" bson:"version"`
+	//At is when the version was written, the coupon was in this state until the next version
+	At      time.Time `json:"at" bson:"at"`
+	Deleted bool      `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	Coupon  Coupon    `json:"coupon" bson:"coupon"`
+}
+
+//FieldChange is a field whose value differs between two versions of a coupon, Field is its json name
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+//VersionDiff lists the fields that changed between two versions of a coupon, in the order of the fields of a coupon
+type VersionDiff struct {
+	CouponId primitive.ObjectID `json:"couponId"`
+	From     int64              `json:"from"`
+	To       int64              `json:"to"`
+	Changes  []FieldChange      `json:"changes"`
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+)
+
+//EVENT_REDEEMED is reserved for coupon redemptions, which the service does not record yet.
+//Subscriptions may list it, so they receive redemptions once there are any.
+const EVENT_REDEEMED string = "redeemed"
+
+const (
+	//the delivery is waiting for its next attempt
+	DELIVERY_PENDING string = "pending"
+	//the receiver answered with a 2xx status
+	DELIVERY_DELIVERED string = "delivered"
+	//every attempt failed, the delivery is only retried when asked to
+	DELIVERY_DEAD string = "dead"
+)
+
+//WebhookSubscription asks for the events of coupons to be POSTed to URL. EventTypes and Brand narrow the events down,
+//every event is sent when they are empty. Secret signs the deliveries, it is only returned when the subscription is created.
+type WebhookSubscription struct {
+	Id         primitive.ObjectID `json:"id" bson:"_id"`
+	URL        string             `json:"url" bson:"url"`
+	EventTypes []string           `json:"eventTypes,omitempty" bson:"eventTypes,omitempty"`
+	Brand      string             `json:"brand,omitempty" bson:"brand,omitempty"`
+	Secret     string             `json:"secret,omitempty" bson:"secret"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+
+	//FromSeq is the last event stored before the subscription was created, the subscription gets the events after it
+	FromSeq int64 `json:"-" bson:"fromSeq"`
+	//Owner names the api key that created the subscription, no other key lists or deletes it
+	Owner string `json:"-" bson:"owner"`
+}
+
+//WebhookDelivery is an event on its way to a subscription, with the log of the attempts made to deliver it
+type WebhookDelivery struct {
+	Id             string             `json:"id" bson:"_id"`
+	SubscriptionId primitive.ObjectID `json:"subscriptionId" bson:"subscriptionId"`
+	Event          CouponEvent        `json:"event" bson:"event"`
+	Status         string             `json:"status" bson:"status"`
+	Attempts       []DeliveryAttempt  `json:"attempts" bson:"attempts"`
+	NextAttemptAt  time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	DeliveredAt    time.Time          `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+
+	//LockedUntil keeps other instances of the service from sending a delivery that is being sent
+	LockedUntil time.Time `json:"-" bson:"lockedUntil"`
+	//Owner is the one of the subscription, the delivery log of a key only holds the deliveries to its subscriptions
+	Owner string `json:"-" bson:"owner"`
+}
+
+type DeliveryAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"durationMs" bson:"durationMs"`
+}
+
+//WebhookPayload is the body of a delivery. DeliveryId stays the same across the attempts, so receivers can drop duplicates.
+type WebhookPayload struct {
+	DeliveryId string      `json:"deliveryId"`
+	Event      CouponEvent `json:"event"`
+}
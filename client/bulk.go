@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	EXPORT_FORMAT_CSV    string = "text/csv"
+	EXPORT_FORMAT_NDJSON string = "application/x-ndjson"
+
+	importPath string = "/import/csv"
+)
+
+// ExportOptions picks the format of an export (EXPORT_FORMAT_CSV by default) and its columns, every column when empty
+type ExportOptions struct {
+	Format  string
+	Columns []string
+}
+
+// Export streams the coupons matching the filter as the service writes them, every coupon when the filter is nil.
+// The caller must close the returned body. Only the request is retried, an export cut off midway fails the read.
+func (c *Client) Export(ctx context.Context, filter *api.CouponFilter, opts ExportOptions) (io.ReadCloser, error) {
+	httpResp, err := c.openExport(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return httpResp.Body, nil
+}
+
+func (c *Client) openExport(ctx context.Context, filter *api.CouponFilter, opts ExportOptions) (*http.Response, error) {
+	query := url.Values{}
+	if filter != nil {
+		encoded, err := json.Marshal(filter)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode the filter")
+		}
+		query.Set("filter", string(encoded))
+	}
+	if len(opts.Columns) > 0 {
+		query.Set("columns", strings.Join(opts.Columns, ","))
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = EXPORT_FORMAT_CSV
+	}
+
+	header := http.Header{}
+	header.Set("Accept", format)
+	header.Set(API_KEY_HEADER, c.apiKey)
+
+	httpResp, err := c.withRetries(ctx, func() (*http.Response, error) {
+		return c.send(ctx, http.MethodGet, c.baseURL+exportPath+"?"+query.Encode(), header, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		defer httpResp.Body.Close()
+		resp := &response{}
+		decodeErr := json.NewDecoder(httpResp.Body).Decode(resp)
+		return nil, errorFromResponse(httpResp, resp, decodeErr)
+	}
+	return httpResp, nil
+}
+
+// ImportOptions are the options of a csv import, see the import endpoint of the service
+type ImportOptions struct {
+	//a single character or "tab", a comma by default
+	Delimiter string
+	//layouts (as for time.Parse) dates are read with, the ones configured in the service by default
+	DateFormats []string
+	DryRun      bool
+	//ImportId resumes an import. The client picks one when none is given, so a retried import skips the rows already written.
+	ImportId string
+}
+
+// ImportCSV imports a csv file of coupons. The report is returned also when the import failed midway,
+// it carries the import id the import is resumed with.
+func (c *Client) ImportCSV(ctx context.Context, file io.Reader, opts ImportOptions) (*api.ImportReport, error) {
+	//the file is sent again by the retries
+	body, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the csv file")
+	}
+
+	query := url.Values{}
+	if opts.Delimiter != "" {
+		query.Set("delimiter", opts.Delimiter)
+	}
+	for _, format := range opts.DateFormats {
+		query.Add("dateFormat", format)
+	}
+	if opts.DryRun {
+		query.Set("dryRun", strconv.FormatBool(true))
+	} else {
+		importId := opts.ImportId
+		if importId == "" {
+			if importId, err = idempotencyKeyFrom(context.Background()); err != nil {
+				return nil, err
+			}
+		}
+		query.Set("importId", importId)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/csv")
+	header.Set(API_KEY_HEADER, c.apiKey)
+
+	resp, err := c.do(ctx, http.MethodPost, c.baseURL+importPath+"?"+query.Encode(), header, body)
+	if resp == nil {
+		return nil, err
+	}
+
+	var report *api.ImportReport
+	if len(bytes.TrimSpace(resp.Result)) > 0 && string(resp.Result) != "null" {
+		report = &api.ImportReport{}
+		if decodeErr := decodeResult(resp.Result, report); decodeErr != nil && err == nil {
+			return nil, decodeErr
+		}
+	}
+	return report, err
+}
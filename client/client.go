@@ -0,0 +1,467 @@
+// Package client is a go client of the coupon service http api (v1). It retries requests that failed on the server side
+// or were rate limited, with an exponential backoff, and sends and takes compressed payloads.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DEFAULT_TIMEOUT     = 30 * time.Second
+	DEFAULT_MAX_RETRIES = 3
+	DEFAULT_MIN_BACKOFF = 100 * time.Millisecond
+	DEFAULT_MAX_BACKOFF = 5 * time.Second
+
+	//the http header the api key is sent in by requests without an api.Request body, as the service names it
+	API_KEY_HEADER string = "X-API-Key"
+
+	//the paths of the service the client talks to
+	couponsPath string = "/v1/"
+	exportPath  string = "/export"
+	syncPath    string = "/sync"
+
+	//request bodies smaller than this many bytes are sent uncompressed, compressing them would only add overhead
+	gzipMinSize = 1024
+)
+
+// Config tells the client where the service is and how to talk to it, zero values pick the defaults
+type Config struct {
+	//BaseURL is the address of the service, e.g. http://localhost:8080
+	BaseURL string
+	ApiKey  string
+
+	//Timeout limits every attempt of a request, including reading the response. Exports are only limited by their context.
+	Timeout time.Duration
+
+	//MaxRetries is how many times a request is retried after a 5xx or 429 response or a network error, -1 turns retries off.
+	//The wait between attempts doubles from MinBackoff up to MaxBackoff, unless the service asks for longer with Retry-After.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	//DisableGzip sends request bodies as they are and asks for uncompressed responses
+	DisableGzip bool
+
+	//HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	baseURL     string
+	apiKey      string
+	timeout     time.Duration
+	maxRetries  int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	gzip        bool
+	httpClient  *http.Client
+	randomDelay func(max time.Duration) time.Duration
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.BaseURL == "" {
+		return nil, errors.New("the base url of the coupon service must be provided")
+	}
+
+	c := &Client{
+		baseURL:    strings.TrimSuffix(cfg.BaseURL, "/"),
+		apiKey:     cfg.ApiKey,
+		timeout:    cfg.Timeout,
+		maxRetries: cfg.MaxRetries,
+		minBackoff: cfg.MinBackoff,
+		maxBackoff: cfg.MaxBackoff,
+		gzip:       !cfg.DisableGzip,
+		httpClient: cfg.HTTPClient,
+		randomDelay: func(max time.Duration) time.Duration {
+			return time.Duration(mathrand.Int63n(int64(max) + 1))
+		},
+	}
+
+	if c.timeout <= 0 {
+		c.timeout = DEFAULT_TIMEOUT
+	}
+	switch {
+	case c.maxRetries == 0:
+		c.maxRetries = DEFAULT_MAX_RETRIES
+	case c.maxRetries < 0:
+		c.maxRetries = 0
+	}
+	if c.minBackoff <= 0 {
+		c.minBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if c.maxBackoff <= 0 {
+		c.maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if c.maxBackoff < c.minBackoff {
+		return nil, errors.Errorf("the max backoff (%s) must not be shorter than the min backoff (%s)", c.maxBackoff, c.minBackoff)
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+
+	return c, nil
+}
+
+// Error is a request the service answered with errors. Current holds the stored coupons of a version conflict,
+// so the update can be re-applied on top of them.
+type Error struct {
+	StatusCode int
+	Errors     []api.Error
+	Current    []api.Coupon
+}
+
+func (e *Error) Error() string {
+	messages := []string{}
+	for _, apiErr := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", apiErr.Code, apiErr.Message))
+	}
+	return fmt.Sprintf("coupon service responded with %d %s", e.StatusCode, strings.Join(messages, ", "))
+}
+
+// HasCode tells whether the service reported an error with the code (see the ERR_ constants of the api package)
+func (e *Error) HasCode(code string) bool {
+	for _, apiErr := range e.Errors {
+		if apiErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteResult is the outcome of a create or update. An atomic batch is answered with the written Coupons,
+// any other batch with a result per coupon in Batch.
+type WriteResult struct {
+	Coupons   []api.Coupon
+	Batch     *api.BatchResult
+	WriteMode string
+}
+
+//response is api.Response with the result left to be decoded into what the request returns
+type response struct {
+	Errors    []api.Error     `json:"errors"`
+	Result    json.RawMessage `json:"result"`
+	WriteMode string          `json:"writeMode"`
+}
+
+type idempotencyKeyCtxKey struct{}
+
+// WithIdempotencyKey makes CreateCoupons send the key rather than one of its own, so the create can also be retried
+// safely by the caller (e.g. after a restart)
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, key)
+}
+
+func idempotencyKeyFrom(ctx context.Context) (string, error) {
+	if key, found := ctx.Value(idempotencyKeyCtxKey{}).(string); found && key != "" {
+		return key, nil
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "failed to generate an idempotency key")
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// CreateCoupons creates the batch of coupons. The request carries an idempotency key, so retrying it never creates the coupons twice.
+func (c *Client) CreateCoupons(ctx context.Context, coupons *api.CouponCollection) (*WriteResult, error) {
+	key, err := idempotencyKeyFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.write(ctx, http.MethodPost, coupons, key)
+}
+
+// UpdateCoupons updates the batch of coupons, every coupon must carry the version it was read at.
+// A coupon modified since fails the update with an *Error holding its current state.
+// An update applied by an attempt whose response was lost is reported as a version conflict by the retry.
+func (c *Client) UpdateCoupons(ctx context.Context, coupons *api.CouponCollection) (*WriteResult, error) {
+	return c.write(ctx, http.MethodPut, coupons, "")
+}
+
+func (c *Client) write(ctx context.Context, method string, coupons *api.CouponCollection, idempotencyKey string) (*WriteResult, error) {
+	if coupons == nil {
+		return nil, errors.New("coupons must be provided")
+	}
+
+	resp, err := c.call(ctx, method, coupons, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &WriteResult{WriteMode: resp.WriteMode}
+	if coupons.Atomic {
+		err = decodeResult(resp.Result, &result.Coupons)
+	} else {
+		result.Batch = &api.BatchResult{}
+		err = decodeResult(resp.Result, result.Batch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteCoupons deletes the coupons, every coupon must carry its id and the version it was read at.
+// The batch is all-or-nothing, a coupon modified since fails it with an *Error holding its current state.
+// The deleted coupons are returned as they were. A delete applied by an attempt whose response was lost
+// is reported as coupon_not_found by the retry.
+func (c *Client) DeleteCoupons(ctx context.Context, coupons []api.Coupon) ([]api.Coupon, error) {
+	resp, err := c.call(ctx, http.MethodDelete, &api.CouponCollection{Coupons: coupons, Atomic: true}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []api.Coupon{}
+	if err := decodeResult(resp.Result, &deleted); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// SearchCoupons returns the coupons matching every condition of the filter in one response, see Coupons for large results
+func (c *Client) SearchCoupons(ctx context.Context, filter *api.CouponFilter) ([]api.Coupon, error) {
+	if filter == nil {
+		filter = &api.CouponFilter{}
+	}
+
+	resp, err := c.call(ctx, http.MethodGet, filter, "")
+	if err != nil {
+		return nil, err
+	}
+
+	coupons := []api.Coupon{}
+	if err := decodeResult(resp.Result, &coupons); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// Sync returns the coupons created, modified or deleted since the token of the previous sync, every coupon when token is empty.
+// The token of the result is kept for the next sync, which should follow right away while HasMore is set.
+// A token whose changes are no longer kept fails with the sync_token_expired code, the client then syncs in full.
+func (c *Client) Sync(ctx context.Context, token string) (*api.SyncResult, error) {
+	query := url.Values{}
+	if token != "" {
+		query.Set("token", token)
+	}
+
+	header := http.Header{}
+	header.Set(API_KEY_HEADER, c.apiKey)
+
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+syncPath+"?"+query.Encode(), header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &api.SyncResult{}
+	if err := decodeResult(resp.Result, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func decodeResult(result json.RawMessage, v interface{}) error {
+	if len(result) == 0 || string(result) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(result, v); err != nil {
+		return errors.Wrap(err, "failed to decode the response of the coupon service")
+	}
+	return nil
+}
+
+//call sends a request of the coupon api and decodes its response, errors reported by the service are returned as *Error
+func (c *Client) call(ctx context.Context, method string, data interface{}, idempotencyKey string) (*response, error) {
+	rawData, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the request")
+	}
+	body, err := json.Marshal(&api.Request{ApiKey: c.apiKey, Data: rawData, IdempotencyKey: idempotencyKey})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the request")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.do(ctx, method, c.baseURL+couponsPath, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//do sends a request answered with an api.Response. The response is returned along with the *Error of a failed request,
+//as some failures carry a result (e.g. the report of an import that failed midway).
+func (c *Client) do(ctx context.Context, method, url string, header http.Header, body []byte) (*response, error) {
+	header.Set("Accept", "application/json")
+	if c.gzip && len(body) >= gzipMinSize {
+		var err error
+		if body, err = gzipped(body); err != nil {
+			return nil, err
+		}
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	httpResp, err := c.withRetries(ctx, func() (*http.Response, error) {
+		return c.attempt(ctx, method, url, header, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	resp := &response{}
+	decodeErr := json.NewDecoder(httpResp.Body).Decode(resp)
+	if httpResp.StatusCode >= http.StatusBadRequest || len(resp.Errors) > 0 {
+		return resp, errorFromResponse(httpResp, resp, decodeErr)
+	}
+	if decodeErr != nil {
+		return nil, errors.Wrap(decodeErr, "failed to decode the response of the coupon service")
+	}
+	return resp, nil
+}
+
+//errorFromResponse describes a failed request, also when it was not answered by the service itself (e.g. a proxy)
+func errorFromResponse(httpResp *http.Response, resp *response, decodeErr error) *Error {
+	apiErr := &Error{StatusCode: httpResp.StatusCode, Errors: resp.Errors}
+	if decodeErr != nil || len(apiErr.Errors) == 0 {
+		apiErr.Errors = []api.Error{api.NewError(api.ERR_INTERNAL, http.StatusText(httpResp.StatusCode))}
+		return apiErr
+	}
+	if apiErr.HasCode(api.ERR_VERSION_CONFLICT) {
+		decodeResult(resp.Result, &apiErr.Current)
+	}
+	return apiErr
+}
+
+func gzipped(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, errors.Wrap(err, "failed to compress the request")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress the request")
+	}
+	return buf.Bytes(), nil
+}
+
+//attempt sends the request once within the timeout, the response is read in full so the timeout can be released
+func (c *Client) attempt(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	httpResp, err := c.send(ctx, method, url, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	read, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the response of the coupon service")
+	}
+	httpResp.Body = ioutil.NopCloser(bytes.NewReader(read))
+	return httpResp, nil
+}
+
+func (c *Client) send(ctx context.Context, method, url string, header http.Header, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the request")
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	//net/http asks for gzip and decompresses the response itself, unless the request says which encoding it takes
+	if !c.gzip {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	return c.httpClient.Do(req)
+}
+
+//withRetries repeats the attempt while it fails in a way worth retrying, the response of the last attempt is returned
+func (c *Client) withRetries(ctx context.Context, attempt func() (*http.Response, error)) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		httpResp, err := attempt()
+		if retry >= c.maxRetries || !retryable(ctx, httpResp, err) {
+			return httpResp, err
+		}
+
+		wait := c.backoff(retry, httpResp)
+		if httpResp != nil {
+			io.Copy(ioutil.Discard, httpResp.Body)
+			httpResp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//retryable tells apart failures that may pass on a retry: the service failing or rate limiting, or the request not getting through.
+//Nothing is retried once the caller gave up on the request.
+func retryable(ctx context.Context, httpResp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return httpResp.StatusCode == http.StatusTooManyRequests ||
+		(httpResp.StatusCode >= http.StatusInternalServerError && httpResp.StatusCode != http.StatusNotImplemented)
+}
+
+//backoff is the wait before the retry: what the service asks for in Retry-After, otherwise an exponential backoff
+//with jitter, so clients failing together do not retry together
+func (c *Client) backoff(retry int, httpResp *http.Response) time.Duration {
+	if httpResp != nil {
+		if seconds, err := strconv.Atoi(httpResp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	wait := c.minBackoff
+	for i := 0; i < retry && wait < c.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+	return wait/2 + c.randomDelay(wait/2)
+}
@@ -0,0 +1,504 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/config"
+	"github.com/akh-dev/coupons-service/couponservice"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+)
+
+const testApiKey string = "Valid API Key"
+
+//newTestService serves the real handlers of the coupon service on top of an in-memory db
+func newTestService(t *testing.T) (http.Handler, *dbtest.DB) {
+	cfg := &config.Config{}
+	cfg.Service = config.ServiceConf{
+		CtxTimeout:        10,
+		IdempotencyKeyTTL: 24,
+		Currency:          "GBP",
+		AdminApiKey:       testApiKey,
+	}
+
+	db := dbtest.New()
+	svc, err := couponservice.NewWithDb(cfg, db)
+	if err != nil {
+		t.Fatalf("couponservice.NewWithDb() failed: %s", err.Error())
+	}
+	return svc.Handler(), db
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := New(Config{
+		BaseURL:    srv.URL,
+		ApiKey:     testApiKey,
+		Timeout:    5 * time.Second,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() failed: %s", err.Error())
+	}
+	return c
+}
+
+func testCoupons(n int) []api.Coupon {
+	coupons := []api.Coupon{}
+	for i := 0; i < n; i++ {
+		coupons = append(coupons, api.Coupon{
+			Name:   fmt.Sprintf("coupon %d", i),
+			Brand:  "Tesco",
+			Value:  float64(i + 1),
+			Expiry: time.Now().Add(48 * time.Hour).Truncate(time.Second).UTC(),
+		})
+	}
+	return coupons
+}
+
+//failingHandler answers the first failures requests with the status, then hands the requests on
+type failingHandler struct {
+	next       http.Handler
+	status     int
+	retryAfter string
+	failures   int32
+	requests   int32
+}
+
+func (h *failingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&h.requests, 1) <= atomic.LoadInt32(&h.failures) {
+		if h.retryAfter != "" {
+			w.Header().Set("Retry-After", h.retryAfter)
+		}
+		http.Error(w, http.StatusText(h.status), h.status)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func TestNewRequiresBaseURL(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("New() was expected to fail without a base url")
+	}
+	if _, err := New(Config{BaseURL: "http://localhost", MinBackoff: time.Second, MaxBackoff: time.Millisecond}); err == nil {
+		t.Error("New() was expected to fail with a max backoff shorter than the min backoff")
+	}
+}
+
+func TestCreateAndSearchCoupons(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+	ctx := context.Background()
+
+	written, err := c.CreateCoupons(ctx, &api.CouponCollection{Coupons: testCoupons(3), Atomic: true})
+	if err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+	if len(written.Coupons) != 3 || written.Batch != nil {
+		t.Fatalf("an atomic create was expected to answer with 3 coupons, got: %+v", written)
+	}
+	for _, cpn := range written.Coupons {
+		if cpn.Id.IsZero() || cpn.Version != 1 {
+			t.Errorf("a created coupon was expected to have an id and version 1, got: %+v", cpn)
+		}
+	}
+
+	valueFrom := 2
+	found, err := c.SearchCoupons(ctx, &api.CouponFilter{BrandEqual: "Tesco", ValueFrom: &valueFrom})
+	if err != nil {
+		t.Fatalf("SearchCoupons() failed: %s", err.Error())
+	}
+	if len(found) != 2 {
+		t.Errorf("SearchCoupons() was expected to find 2 coupons, got: %d", len(found))
+	}
+
+	found, err = c.SearchCoupons(ctx, &api.CouponFilter{BrandEqual: "Asda"})
+	if err != nil {
+		t.Fatalf("SearchCoupons() failed: %s", err.Error())
+	}
+	if len(found) != 0 {
+		t.Errorf("SearchCoupons() was expected to find nothing, got: %d coupons", len(found))
+	}
+}
+
+func TestCreateCouponsBatch(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+
+	coupons := testCoupons(2)
+	coupons[1].Name = ""
+
+	written, err := c.CreateCoupons(context.Background(), &api.CouponCollection{Coupons: coupons})
+	if err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+	if written.Batch == nil {
+		t.Fatal("a batch that is not atomic was expected to answer with a result per coupon")
+	}
+	if written.Batch.Summary.Succeeded != 1 || written.Batch.Summary.Failed != 1 {
+		t.Errorf("the batch was expected to write 1 coupon and fail 1, got: %+v", written.Batch.Summary)
+	}
+}
+
+func TestCreateCouponsErrors(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+
+	coupons := testCoupons(1)
+	coupons[0].Value = -1
+
+	_, err := c.CreateCoupons(context.Background(), &api.CouponCollection{Coupons: coupons, Atomic: true})
+	apiErr, isApiErr := err.(*Error)
+	if !isApiErr {
+		t.Fatalf("CreateCoupons() was expected to fail with an *Error, got: %v", err)
+	}
+	if apiErr.StatusCode < 400 || apiErr.StatusCode >= 500 || !apiErr.HasCode(api.ERR_VALUE_NOT_POSITIVE) {
+		t.Errorf("CreateCoupons() was expected to be rejected with %s, got: %s", api.ERR_VALUE_NOT_POSITIVE, apiErr.Error())
+	}
+
+	c.apiKey = "Invalid Key"
+	_, err = c.SearchCoupons(context.Background(), nil)
+	if apiErr, isApiErr := err.(*Error); !isApiErr || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("SearchCoupons() was expected to be forbidden with an invalid key, got: %v", err)
+	}
+}
+
+func TestUpdateCoupons(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+	ctx := context.Background()
+
+	written, err := c.CreateCoupons(ctx, &api.CouponCollection{Coupons: testCoupons(1), Atomic: true})
+	if err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+
+	//an update carries the fields to change, along with the id and the version it is based on
+	created := written.Coupons[0]
+	cpn := api.Coupon{Id: created.Id, Version: created.Version, Name: "renamed"}
+	updated, err := c.UpdateCoupons(ctx, &api.CouponCollection{Coupons: []api.Coupon{cpn}, Atomic: true})
+	if err != nil {
+		t.Fatalf("UpdateCoupons() failed: %s", err.Error())
+	}
+	if len(updated.Coupons) != 1 || updated.Coupons[0].Version != 2 || updated.Coupons[0].Name != "renamed" {
+		t.Errorf("UpdateCoupons() was expected to answer with the renamed coupon at version 2, got: %+v", updated.Coupons)
+	}
+
+	//cpn still carries version 1
+	cpn.Name = "stale"
+	_, err = c.UpdateCoupons(ctx, &api.CouponCollection{Coupons: []api.Coupon{cpn}, Atomic: true})
+	apiErr, isApiErr := err.(*Error)
+	if !isApiErr || apiErr.StatusCode != http.StatusConflict || !apiErr.HasCode(api.ERR_VERSION_CONFLICT) {
+		t.Fatalf("UpdateCoupons() was expected to fail with a version conflict, got: %v", err)
+	}
+	if len(apiErr.Current) != 1 || apiErr.Current[0].Name != "renamed" || apiErr.Current[0].Version != 2 {
+		t.Errorf("the conflict was expected to carry the current coupon, got: %+v", apiErr.Current)
+	}
+}
+
+func TestSync(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+	ctx := context.Background()
+
+	written, err := c.CreateCoupons(ctx, &api.CouponCollection{Coupons: testCoupons(2), Atomic: true})
+	if err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+
+	full, err := c.Sync(ctx, "")
+	if err != nil {
+		t.Fatalf("Sync() failed: %s", err.Error())
+	}
+	if !full.Full || len(full.Coupons) != 2 || full.Token == "" {
+		t.Fatalf("Sync() without a token was expected to return every coupon, got: %+v", full)
+	}
+
+	renamed, deleted := written.Coupons[0], written.Coupons[1]
+	if _, err := c.UpdateCoupons(ctx, &api.CouponCollection{Coupons: []api.Coupon{{Id: renamed.Id, Version: renamed.Version, Name: "renamed"}}, Atomic: true}); err != nil {
+		t.Fatalf("UpdateCoupons() failed: %s", err.Error())
+	}
+	if _, err := c.DeleteCoupons(ctx, []api.Coupon{{Id: deleted.Id, Version: deleted.Version}}); err != nil {
+		t.Fatalf("DeleteCoupons() failed: %s", err.Error())
+	}
+
+	//the changes just made are not settled yet, so the full sync was consistent with an earlier point and the delta repeats them
+	delta, err := c.Sync(ctx, full.Token)
+	if err != nil {
+		t.Fatalf("Sync() failed: %s", err.Error())
+	}
+	found := false
+	for _, cpn := range delta.Coupons {
+		if cpn.Id == renamed.Id {
+			found = cpn.Name == "renamed" && cpn.Version == 2
+		}
+	}
+	if !found || delta.Full {
+		t.Errorf("Sync() was expected to return the renamed coupon, got: %+v", delta.Coupons)
+	}
+	if len(delta.Deleted) != 1 || delta.Deleted[0].Id != deleted.Id {
+		t.Errorf("Sync() was expected to return a tombstone of the deleted coupon, got: %+v", delta.Deleted)
+	}
+
+	_, err = c.Sync(ctx, "not a token")
+	if apiErr, isApiErr := err.(*Error); !isApiErr || !apiErr.HasCode(api.ERR_INVALID_SYNC_TOKEN) {
+		t.Errorf("Sync() was expected to reject the token, got: %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		failures   int32
+		expectErr  bool
+		expectReqs int32
+	}{
+		{name: "server errors are retried", status: http.StatusServiceUnavailable, failures: 2, expectReqs: 3},
+		{name: "rate limits are retried", status: http.StatusTooManyRequests, retryAfter: "0", failures: 1, expectReqs: 2},
+		{name: "retries give up", status: http.StatusBadGateway, failures: 10, expectErr: true, expectReqs: DEFAULT_MAX_RETRIES + 1},
+		{name: "client errors are not retried", status: http.StatusBadRequest, failures: 10, expectErr: true, expectReqs: 1},
+		{name: "not implemented is not retried", status: http.StatusNotImplemented, failures: 10, expectErr: true, expectReqs: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, _ := newTestService(t)
+			failing := &failingHandler{next: handler, status: test.status, retryAfter: test.retryAfter, failures: test.failures}
+			c := newTestClient(t, failing)
+
+			_, err := c.SearchCoupons(context.Background(), nil)
+			if test.expectErr {
+				if apiErr, isApiErr := err.(*Error); !isApiErr || apiErr.StatusCode != test.status {
+					t.Errorf("SearchCoupons() was expected to fail with status %d, got: %v", test.status, err)
+				}
+			} else if err != nil {
+				t.Errorf("SearchCoupons() was expected to succeed after retrying, got: %s", err.Error())
+			}
+			if requests := atomic.LoadInt32(&failing.requests); requests != test.expectReqs {
+				t.Errorf("%d requests were expected, got: %d", test.expectReqs, requests)
+			}
+		})
+	}
+}
+
+//lostResponseHandler executes the first request but answers it with a gateway error, as if the response was lost on the way
+type lostResponseHandler struct {
+	next     http.Handler
+	requests int32
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (h *lostResponseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.keys = append(h.keys, r.Header.Get("Idempotency-Key"))
+	h.mu.Unlock()
+	if atomic.AddInt32(&h.requests, 1) == 1 {
+		h.next.ServeHTTP(httptest.NewRecorder(), r)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func TestCreateCouponsRetryIsIdempotent(t *testing.T) {
+	handler, db := newTestService(t)
+	lost := &lostResponseHandler{next: handler}
+	c := newTestClient(t, lost)
+
+	written, err := c.CreateCoupons(context.Background(), &api.CouponCollection{Coupons: testCoupons(2), Atomic: true})
+	if err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+	if len(written.Coupons) != 2 {
+		t.Errorf("the retry was expected to answer with the 2 coupons created by the first attempt, got: %d", len(written.Coupons))
+	}
+	lost.mu.Lock()
+	defer lost.mu.Unlock()
+	if len(lost.keys) != 2 || lost.keys[0] == "" || lost.keys[0] != lost.keys[1] {
+		t.Errorf("both attempts were expected to carry the same idempotency key, got: %v", lost.keys)
+	}
+
+	stored, _ := db.SearchFromRequest(&api.CouponFilter{})
+	if len(stored) != 2 {
+		t.Errorf("the coupons were expected to be created once, got: %d coupons", len(stored))
+	}
+}
+
+func TestCreateCouponsWithIdempotencyKey(t *testing.T) {
+	handler, db := newTestService(t)
+	c := newTestClient(t, handler)
+
+	ctx := WithIdempotencyKey(context.Background(), "import-42")
+	coupons := &api.CouponCollection{Coupons: testCoupons(1), Atomic: true}
+	for i := 0; i < 2; i++ {
+		if _, err := c.CreateCoupons(ctx, coupons); err != nil {
+			t.Fatalf("CreateCoupons() failed: %s", err.Error())
+		}
+	}
+
+	stored, _ := db.SearchFromRequest(&api.CouponFilter{})
+	if len(stored) != 1 {
+		t.Errorf("creating twice with the same key was expected to create the coupon once, got: %d coupons", len(stored))
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	handler, _ := newTestService(t)
+	failing := &failingHandler{next: handler, status: http.StatusServiceUnavailable, retryAfter: "60", failures: 10}
+	c := newTestClient(t, failing)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.SearchCoupons(ctx, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("SearchCoupons() was expected to stop waiting for the retry with the context, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("SearchCoupons() was expected to return once the context was done")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c, err := New(Config{BaseURL: "http://localhost", MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	if err != nil {
+		t.Fatalf("New() failed: %s", err.Error())
+	}
+	//no jitter, the longest wait is checked
+	c.randomDelay = func(max time.Duration) time.Duration { return max }
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for retry, wait := range expected {
+		if got := c.backoff(retry, nil); got != wait {
+			t.Errorf("backoff(%d) was expected to be %s, got: %s", retry, wait, got)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"3"}}}
+	if got := c.backoff(0, resp); got != 3*time.Second {
+		t.Errorf("backoff() was expected to follow Retry-After, got: %s", got)
+	}
+}
+
+//encodingHandler records the encodings of the requests
+type encodingHandler struct {
+	next http.Handler
+
+	mu               sync.Mutex
+	contentEncodings []string
+}
+
+func (h *encodingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.contentEncodings = append(h.contentEncodings, r.Header.Get("Content-Encoding"))
+	h.mu.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func TestGzip(t *testing.T) {
+	handler, _ := newTestService(t)
+	recorder := &encodingHandler{next: handler}
+	c := newTestClient(t, recorder)
+	ctx := context.Background()
+
+	//large enough to be compressed
+	if _, err := c.CreateCoupons(ctx, &api.CouponCollection{Coupons: testCoupons(50), Atomic: true}); err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+	found, err := c.SearchCoupons(ctx, &api.CouponFilter{IdIn: []string{}})
+	if err != nil {
+		t.Fatalf("SearchCoupons() failed: %s", err.Error())
+	}
+	if len(found) != 50 {
+		t.Errorf("SearchCoupons() was expected to read the 50 coupons from a compressed response, got: %d", len(found))
+	}
+
+	expected := []string{"gzip", ""}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if strings.Join(recorder.contentEncodings, ",") != strings.Join(expected, ",") {
+		t.Errorf("the request encodings were expected to be %v, got: %v", expected, recorder.contentEncodings)
+	}
+}
+
+func TestCouponsIterator(t *testing.T) {
+	handler, _ := newTestService(t)
+	failing := &failingHandler{next: handler, status: http.StatusServiceUnavailable}
+	c := newTestClient(t, failing)
+	ctx := context.Background()
+
+	coupons := testCoupons(10)
+	for i := range coupons {
+		if i%2 == 0 {
+			coupons[i].Brand = "Asda"
+		}
+	}
+	if _, err := c.CreateCoupons(ctx, &api.CouponCollection{Coupons: coupons, Atomic: true}); err != nil {
+		t.Fatalf("CreateCoupons() failed: %s", err.Error())
+	}
+
+	//the export request fails once and is retried
+	atomic.StoreInt32(&failing.failures, atomic.LoadInt32(&failing.requests)+1)
+
+	it := c.Coupons(ctx, &api.CouponFilter{BrandEqual: "Asda"})
+	defer it.Close()
+
+	read := []api.Coupon{}
+	for it.Next() {
+		read = append(read, it.Coupon())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("the iteration failed: %s", err.Error())
+	}
+	if len(read) != 5 {
+		t.Fatalf("5 coupons were expected, got: %d", len(read))
+	}
+	for _, cpn := range read {
+		if cpn.Brand != "Asda" || cpn.Id.IsZero() || cpn.Version != 1 {
+			t.Errorf("the iterator was expected to read complete Asda coupons, got: %+v", cpn)
+		}
+	}
+	if it.Next() {
+		t.Error("Next() was expected to stay false once the iteration ended")
+	}
+
+	all := c.Coupons(ctx, nil)
+	defer all.Close()
+	count := 0
+	for all.Next() {
+		count++
+	}
+	if all.Err() != nil || count != 10 {
+		t.Errorf("iterating without a filter was expected to read all 10 coupons, got: %d (%v)", count, all.Err())
+	}
+}
+
+func TestCouponsIteratorErrors(t *testing.T) {
+	handler, _ := newTestService(t)
+	c := newTestClient(t, handler)
+
+	it := c.Coupons(context.Background(), &api.CouponFilter{IdIn: []string{"not an id"}})
+	defer it.Close()
+	if it.Next() {
+		t.Fatal("Next() was expected to be false for an invalid filter")
+	}
+	if apiErr, isApiErr := it.Err().(*Error); !isApiErr || !apiErr.HasCode(api.ERR_INVALID_FILTER) {
+		t.Errorf("the iteration was expected to fail with %s, got: %v", api.ERR_INVALID_FILTER, it.Err())
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+// CouponIterator walks the coupons matching a filter one at a time. The search api answers in a single response,
+// so the iterator reads the export of the service instead, which is streamed as it is read from the db:
+// a result of any size is never held in memory, by the service or the client.
+//
+//	it := c.Coupons(ctx, filter)
+//	defer it.Close()
+//	for it.Next() {
+//		cpn := it.Coupon()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type CouponIterator struct {
+	client *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	filter *api.CouponFilter
+
+	body   io.ReadCloser
+	dec    *json.Decoder
+	coupon api.Coupon
+	err    error
+	done   bool
+}
+
+// Coupons iterates the coupons matching every condition of the filter, every coupon when the filter is nil.
+// The export is requested on the first call to Next. Only the request is retried, an export cut off midway
+// ends the iteration with an error.
+func (c *Client) Coupons(ctx context.Context, filter *api.CouponFilter) *CouponIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	return &CouponIterator{client: c, ctx: ctx, cancel: cancel, filter: filter}
+}
+
+// Next reads the next coupon, false once every coupon was read or the export failed (see Err)
+func (it *CouponIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if it.dec == nil {
+		if it.err = it.open(); it.err != nil {
+			it.Close()
+			return false
+		}
+	}
+
+	it.coupon = api.Coupon{}
+	if err := it.dec.Decode(&it.coupon); err != nil {
+		//an export that fails midway is cut off by the service, which is no clean end of the stream
+		if err != io.EOF {
+			it.err = errors.Wrap(err, "failed to read the export of the coupon service")
+		}
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// Coupon is the coupon read by the last call to Next
+func (it *CouponIterator) Coupon() api.Coupon {
+	return it.coupon
+}
+
+// Err is the error that ended the iteration, nil when every coupon was read
+func (it *CouponIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iteration and releases the connection, it is safe to call more than once
+func (it *CouponIterator) Close() error {
+	it.done = true
+	var err error
+	if it.body != nil {
+		err = it.body.Close()
+		it.body = nil
+	}
+	it.cancel()
+	return err
+}
+
+func (it *CouponIterator) open() error {
+	httpResp, err := it.client.openExport(it.ctx, it.filter, ExportOptions{Format: EXPORT_FORMAT_NDJSON})
+	if err != nil {
+		return err
+	}
+
+	it.body = httpResp.Body
+	it.dec = json.NewDecoder(httpResp.Body)
+	return nil
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/client"
+)
+
+// the layouts dates are given in on the command line
+var dateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// timeValue is a date flag, left zero when not given
+type timeValue struct {
+	t *time.Time
+}
+
+func (v timeValue) String() string {
+	if v.t == nil {
+		return ""
+	}
+	return timeText(*v.t)
+}
+
+func (v timeValue) Set(value string) error {
+	for _, layout := range dateLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			*v.t = parsed
+			return nil
+		}
+	}
+	return errors.Errorf("%s is not a date, use 2006-01-02 or RFC 3339", value)
+}
+
+// floatValue is a number flag that tells whether it was given
+type floatValue struct {
+	value **float64
+}
+
+func (v floatValue) String() string {
+	if v.value == nil || *v.value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(**v.value, 'f', -1, 64)
+}
+
+func (v floatValue) Set(value string) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return errors.Errorf("%s is not a number", value)
+	}
+	*v.value = &parsed
+	return nil
+}
+
+// intValue is a whole number flag that tells whether it was given
+type intValue struct {
+	value **int
+}
+
+func (v intValue) String() string {
+	if v.value == nil || *v.value == nil {
+		return ""
+	}
+	return strconv.Itoa(**v.value)
+}
+
+func (v intValue) Set(value string) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.Errorf("%s is not a whole number", value)
+	}
+	*v.value = &parsed
+	return nil
+}
+
+// stringList collects a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// addFilterFlags adds the flags of api.CouponFilter, the filter is filled in as the flags are parsed
+func addFilterFlags(flags *flag.FlagSet) *api.CouponFilter {
+	filter := &api.CouponFilter{}
+	flags.Var((*stringList)(&filter.IdIn), "id", "a coupon id, may be repeated")
+	flags.StringVar(&filter.NameContains, "name", "", "coupons whose name contains this (a regular expression)")
+	flags.StringVar(&filter.BrandEqual, "brand", "", "coupons of this brand")
+	flags.Var(intValue{&filter.ValueFrom}, "value-from", "coupons worth at least this")
+	flags.Var(intValue{&filter.ValueTo}, "value-to", "coupons worth at most this")
+	flags.Var(timeValue{&filter.ExpiryFrom}, "expiry-from", "coupons expiring on or after this date")
+	flags.Var(timeValue{&filter.ExpiryTo}, "expiry-to", "coupons expiring on or before this date")
+	flags.Var(timeValue{&filter.CreatedAtFrom}, "created-from", "coupons created on or after this date")
+	flags.Var(timeValue{&filter.CreatedAtTo}, "created-to", "coupons created on or before this date")
+	return filter
+}
+
+func addOutputFlag(flags *flag.FlagSet) *string {
+	return flags.String("o", OUTPUT_TABLE, "the output format: table, json or csv")
+}
+
+func parseIds(args []string) ([]primitive.ObjectID, error) {
+	if len(args) == 0 {
+		return nil, errors.New("at least one coupon id must be given")
+	}
+
+	ids := []primitive.ObjectID{}
+	for _, arg := range args {
+		id, err := primitive.ObjectIDFromHex(arg)
+		if err != nil {
+			return nil, errors.Errorf("%s is not a coupon id", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// findCoupons looks the coupons up by id, every one of them must exist
+func (c *cli) findCoupons(ids []primitive.ObjectID) ([]api.Coupon, error) {
+	hexIds := []string{}
+	for _, id := range ids {
+		hexIds = append(hexIds, id.Hex())
+	}
+
+	found, err := c.client.SearchCoupons(context.Background(), &api.CouponFilter{IdIn: hexIds})
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[primitive.ObjectID]api.Coupon{}
+	for _, cpn := range found {
+		byId[cpn.Id] = cpn
+	}
+
+	//in the order they were asked for
+	coupons := []api.Coupon{}
+	for _, id := range ids {
+		cpn, exists := byId[id]
+		if !exists {
+			return nil, errors.Errorf("coupon %s does not exist", id.Hex())
+		}
+		coupons = append(coupons, cpn)
+	}
+	return coupons, nil
+}
+
+func (c *cli) list(args []string) int {
+	flags := c.newFlagSet("list", "[flags]")
+	filter := addFilterFlags(flags)
+	output := addOutputFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := validOutput(*output); err != nil {
+		return c.fail(err)
+	}
+
+	coupons, err := c.client.SearchCoupons(context.Background(), filter)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if err := writeCoupons(c.stdout, *output, coupons); err != nil {
+		return c.fail(err)
+	}
+	return EXIT_OK
+}
+
+func (c *cli) get(args []string) int {
+	flags := c.newFlagSet("get", "[flags] id...")
+	output := addOutputFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := validOutput(*output); err != nil {
+		return c.fail(err)
+	}
+
+	ids, err := parseIds(flags.Args())
+	if err != nil {
+		return c.fail(err)
+	}
+
+	coupons, err := c.findCoupons(ids)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if err := writeCoupons(c.stdout, *output, coupons); err != nil {
+		return c.fail(err)
+	}
+	return EXIT_OK
+}
+
+// openInput opens the file named on the command line, - being stdin
+func (c *cli) openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return ioutil.NopCloser(c.stdin), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	return file, nil
+}
+
+// readCoupons reads a json file of coupons, either a list of coupons or a coupon collection as the api takes it
+func readCoupons(r io.Reader) (*api.CouponCollection, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the coupons")
+	}
+
+	cpnCollection := &api.CouponCollection{}
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &cpnCollection.Coupons)
+	} else {
+		//unlike a request body, a file is only atomic if it says so (or -atomic is given)
+		file := &struct {
+			Coupons []api.Coupon `json:"coupons"`
+			Atomic  bool         `json:"atomic"`
+		}{}
+		err = json.Unmarshal(data, file)
+		cpnCollection.Coupons, cpnCollection.Atomic = file.Coupons, file.Atomic
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the coupons")
+	}
+	return cpnCollection, nil
+}
+
+// writeOutcome prints what a create or update wrote, a batch with rejected coupons exits with EXIT_PARTIAL
+func (c *cli) writeOutcome(output string, written *client.WriteResult) int {
+	if written.Batch != nil {
+		if err := writeBatch(c.stdout, output, written.Batch); err != nil {
+			return c.fail(err)
+		}
+		if written.Batch.Summary.Failed > 0 {
+			return EXIT_PARTIAL
+		}
+		return EXIT_OK
+	}
+
+	if err := writeCoupons(c.stdout, output, written.Coupons); err != nil {
+		return c.fail(err)
+	}
+	return EXIT_OK
+}
+
+func (c *cli) create(args []string) int {
+	flags := c.newFlagSet("create", "[flags] file.json|file.csv|-")
+	format := flags.String("format", "", "the format of the file, json or csv (default from the file extension)")
+	atomic := flags.Bool("atomic", false, "json: all-or-nothing, a single invalid coupon fails the whole file")
+	delimiter := flags.String("delimiter", "", "csv: the column delimiter, a single character or tab (default ,)")
+	var dateFormats stringList
+	flags.Var(&dateFormats, "date-format", "csv: a Go time layout dates are read with, may be repeated (default the formats of the service)")
+	dryRun := flags.Bool("dry-run", false, "csv: only validate the rows")
+	importId := flags.String("import-id", "", "csv: resume the import with this id")
+	output := addOutputFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := validOutput(*output); err != nil {
+		return c.fail(err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return EXIT_FAILED
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv", ".tsv":
+			*format = "csv"
+		case ".json":
+			*format = "json"
+		default:
+			return c.fail(errors.Errorf("the format of %s must be given with -format", path))
+		}
+	}
+
+	input, err := c.openInput(path)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer input.Close()
+
+	switch *format {
+	case "csv":
+		if *delimiter == "" && strings.ToLower(filepath.Ext(path)) == ".tsv" {
+			*delimiter = "tab"
+		}
+		report, err := c.client.ImportCSV(context.Background(), input, client.ImportOptions{
+			Delimiter:   *delimiter,
+			DateFormats: dateFormats,
+			DryRun:      *dryRun,
+			ImportId:    *importId,
+		})
+		if report != nil {
+			if writeErr := writeImportReport(c.stdout, *output, report); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}
+		if err != nil {
+			return c.fail(err)
+		}
+		if report != nil && report.Invalid > 0 {
+			return EXIT_PARTIAL
+		}
+		return EXIT_OK
+	case "json":
+		cpnCollection, err := readCoupons(input)
+		if err != nil {
+			return c.fail(err)
+		}
+		if *atomic {
+			cpnCollection.Atomic = true
+		}
+
+		written, err := c.client.CreateCoupons(context.Background(), cpnCollection)
+		if err != nil {
+			return c.fail(err)
+		}
+		return c.writeOutcome(*output, written)
+	default:
+		return c.fail(errors.Errorf("unknown format %s, use json or csv", *format))
+	}
+}
+
+func (c *cli) update(args []string) int {
+	flags := c.newFlagSet("update", "[flags] id | -file updates.json")
+	file := flags.String("file", "", "a json file of updates, each carrying the id and version of the coupon (- for stdin)")
+	atomic := flags.Bool("atomic", false, "file: all-or-nothing, a single invalid update fails the whole file")
+	version := flags.Int64("version", 0, "the version the update is based on (default the current version)")
+	cpn := api.Coupon{}
+	flags.StringVar(&cpn.Name, "name", "", "the new name")
+	flags.StringVar(&cpn.Brand, "brand", "", "the new brand")
+	var value *float64
+	flags.Var(floatValue{&value}, "value", "the new value")
+	flags.Var(timeValue{&cpn.Expiry}, "expiry", "the new expiry date")
+	output := addOutputFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := validOutput(*output); err != nil {
+		return c.fail(err)
+	}
+
+	var cpnCollection *api.CouponCollection
+	if *file != "" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			return EXIT_FAILED
+		}
+		input, err := c.openInput(*file)
+		if err != nil {
+			return c.fail(err)
+		}
+		defer input.Close()
+
+		if cpnCollection, err = readCoupons(input); err != nil {
+			return c.fail(err)
+		}
+		if *atomic {
+			cpnCollection.Atomic = true
+		}
+	} else {
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return EXIT_FAILED
+		}
+		ids, err := parseIds(flags.Args())
+		if err != nil {
+			return c.fail(err)
+		}
+		cpn.Id = ids[0]
+		if value != nil {
+			cpn.Value = *value
+		}
+
+		//the version check still catches an update made after the lookup
+		cpn.Version = *version
+		if cpn.Version == 0 {
+			current, err := c.findCoupons(ids)
+			if err != nil {
+				return c.fail(err)
+			}
+			cpn.Version = current[0].Version
+		}
+		cpnCollection = &api.CouponCollection{Coupons: []api.Coupon{cpn}, Atomic: true}
+	}
+
+	written, err := c.client.UpdateCoupons(context.Background(), cpnCollection)
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.writeOutcome(*output, written)
+}
+
+func (c *cli) delete(args []string) int {
+	flags := c.newFlagSet("delete", "[flags] id...")
+	version := flags.Int64("version", 0, "the version of the coupon, when deleting a single one (default the current version)")
+	output := addOutputFlag(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if err := validOutput(*output); err != nil {
+		return c.fail(err)
+	}
+
+	ids, err := parseIds(flags.Args())
+	if err != nil {
+		return c.fail(err)
+	}
+
+	coupons := []api.Coupon{}
+	if *version != 0 {
+		if len(ids) != 1 {
+			return c.fail(errors.New("-version can only be given when deleting a single coupon"))
+		}
+		coupons = append(coupons, api.Coupon{Id: ids[0], Version: *version})
+	} else {
+		current, err := c.findCoupons(ids)
+		if err != nil {
+			return c.fail(err)
+		}
+		for _, cpn := range current {
+			coupons = append(coupons, api.Coupon{Id: cpn.Id, Version: cpn.Version})
+		}
+	}
+
+	deleted, err := c.client.DeleteCoupons(context.Background(), coupons)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if err := writeCoupons(c.stdout, *output, deleted); err != nil {
+		return c.fail(err)
+	}
+	return EXIT_OK
+}
+
+func (c *cli) export(args []string) int {
+	flags := c.newFlagSet("export", "[flags]")
+	filter := addFilterFlags(flags)
+	format := flags.String("format", "csv", "csv or ndjson")
+	columns := flags.String("columns", "", "comma separated columns: id, name, brand, value, expiry, createdAt, version (default all)")
+	out := flags.String("out", "-", "the file the export is written to, - for stdout")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	opts := client.ExportOptions{}
+	switch *format {
+	case "csv":
+		opts.Format = client.EXPORT_FORMAT_CSV
+	case "ndjson":
+		opts.Format = client.EXPORT_FORMAT_NDJSON
+	default:
+		return c.fail(errors.Errorf("unknown export format %s, use csv or ndjson", *format))
+	}
+	if *columns != "" {
+		opts.Columns = strings.Split(*columns, ",")
+	}
+
+	var w io.Writer = c.stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return c.fail(errors.Wrapf(err, "failed to create %s", *out))
+		}
+		defer file.Close()
+		w = file
+	}
+
+	body, err := c.client.Export(context.Background(), filter, opts)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return c.fail(errors.Wrap(err, "the export was cut off"))
+	}
+	return EXIT_OK
+}
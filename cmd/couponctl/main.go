@@ -0,0 +1,146 @@
+// Command couponctl manages the coupons of a coupon service over its http api.
+//
+//	couponctl [-profile name] [-endpoint url] [-api-key key] <command> [flags] [args]
+//
+// The endpoint and the api key are taken from the flags, the COUPONCTL_ENDPOINT and COUPONCTL_API_KEY environment variables
+// or a profile of the profile file (~/.couponctl.json or COUPONCTL_CONFIG), in that order.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/client"
+)
+
+const (
+	EXIT_OK     int = 0
+	EXIT_FAILED int = 1
+	//the request went through, but some of the coupons or rows were rejected
+	EXIT_PARTIAL int = 2
+)
+
+// cli runs the commands against the service, writing what they print to stdout and the failures to stderr
+type cli struct {
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	summary string
+	run     func(c *cli, args []string) int
+}
+
+var commands = map[string]command{
+	"list":   {"list the coupons matching the filter flags", (*cli).list},
+	"get":    {"show coupons by id", (*cli).get},
+	"create": {"create the coupons of a json or csv file", (*cli).create},
+	"update": {"update a coupon from flags, or the coupons of a json file", (*cli).update},
+	"delete": {"delete coupons by id", (*cli).delete},
+	"export": {"stream the coupons matching the filter flags as csv or ndjson", (*cli).export},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("couponctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	profileName := global.String("profile", "", "the profile of the profile file to use (default "+DEFAULT_PROFILE+", or "+ENV_PROFILE+")")
+	endpoint := global.String("endpoint", "", "the address of the coupon service, e.g. http://localhost:8080 (or "+ENV_ENDPOINT+")")
+	apiKey := global.String("api-key", "", "the api key (or "+ENV_API_KEY+")")
+	timeout := global.Duration("timeout", client.DEFAULT_TIMEOUT, "how long a request may take, exports are not limited")
+	global.Usage = func() {
+		fmt.Fprintln(stderr, "usage: couponctl [flags] <command> [command flags] [args]")
+		fmt.Fprintln(stderr, "\ncommands:")
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(stderr, "  %-8s %s\n", name, commands[name].summary)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		global.PrintDefaults()
+	}
+
+	if err := global.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_FAILED
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return EXIT_FAILED
+	}
+
+	cmd, found := commands[global.Arg(0)]
+	if !found {
+		fmt.Fprintf(stderr, "couponctl: unknown command %s\n", global.Arg(0))
+		global.Usage()
+		return EXIT_FAILED
+	}
+
+	profile, err := resolveProfile(settings{profile: *profileName, endpoint: *endpoint, apiKey: *apiKey}, getenv)
+	if err != nil {
+		fmt.Fprintf(stderr, "couponctl: %s\n", err.Error())
+		return EXIT_FAILED
+	}
+
+	c, err := client.New(client.Config{BaseURL: profile.Endpoint, ApiKey: profile.ApiKey, Timeout: *timeout})
+	if err != nil {
+		fmt.Fprintf(stderr, "couponctl: %s\n", err.Error())
+		return EXIT_FAILED
+	}
+
+	return cmd.run(&cli{client: c, stdin: stdin, stdout: stdout, stderr: stderr}, global.Args()[1:])
+}
+
+// fail reports the error, the errors of every coupon when the service rejected the request
+func (c *cli) fail(err error) int {
+	apiErr, isApiErr := err.(*client.Error)
+	if !isApiErr {
+		fmt.Fprintf(c.stderr, "couponctl: %s\n", err.Error())
+		return EXIT_FAILED
+	}
+
+	fmt.Fprintf(c.stderr, "couponctl: the coupon service responded with %d\n", apiErr.StatusCode)
+	for _, e := range apiErr.Errors {
+		fmt.Fprintf(c.stderr, "  %s\n", errorsText([]api.Error{e}))
+	}
+	for _, cpn := range apiErr.Current {
+		fmt.Fprintf(c.stderr, "  coupon %s is at version %d\n", cpn.Id.Hex(), cpn.Version)
+	}
+	return EXIT_FAILED
+}
+
+// newFlagSet creates the flags of a command, usage errors are reported on stderr
+func (c *cli) newFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: couponctl %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses the flags of a command, the exit code is set when the command should not run
+func parseFlags(flags *flag.FlagSet, args []string) (exitCode int, ok bool) {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK, false
+		}
+		return EXIT_FAILED, false
+	}
+	return EXIT_OK, true
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/config"
+	"github.com/akh-dev/coupons-service/couponservice"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+)
+
+// newTestEnv serves the coupon service on top of an in-memory db, the returned getenv points couponctl to it
+func newTestEnv(t *testing.T) (func(string) string, *dbtest.DB) {
+	cfg := &config.Config{}
+	cfg.Service = config.ServiceConf{
+		CtxTimeout:        10,
+		IdempotencyKeyTTL: 24,
+		Currency:          "GBP",
+		ImportChunkSize:   100,
+		ImportDateFormats: "2006-01-02",
+		AdminApiKey:       "Valid API Key",
+	}
+
+	db := dbtest.New()
+	svc, err := couponservice.NewWithDb(cfg, db)
+	if err != nil {
+		t.Fatalf("couponservice.NewWithDb() failed: %s", err.Error())
+	}
+	srv := httptest.NewServer(svc.Handler())
+	t.Cleanup(srv.Close)
+
+	env := map[string]string{
+		ENV_ENDPOINT: srv.URL,
+		ENV_API_KEY:  "Valid API Key",
+		ENV_CONFIG:   filepath.Join(t.TempDir(), "none.json"),
+	}
+	return func(name string) string { return env[name] }, db
+}
+
+// runCtl runs couponctl, returning the exit code and what it printed
+func runCtl(getenv func(string) string, stdin string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(args, getenv, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func decodeCoupons(t *testing.T, out string) []api.Coupon {
+	coupons := []api.Coupon{}
+	if err := json.Unmarshal([]byte(out), &coupons); err != nil {
+		t.Fatalf("failed to decode the json output %q: %s", out, err.Error())
+	}
+	return coupons
+}
+
+const testCouponsJSON string = `[
+	{"name": "Save £1 at Tesco", "brand": "Tesco", "value": 1, "expiry": "2030-03-01T00:00:00Z"},
+	{"name": "Save £5 at Tesco", "brand": "Tesco", "value": 5, "expiry": "2030-03-01T00:00:00Z"},
+	{"name": "Save £2 at Asda", "brand": "Asda", "value": 2, "expiry": "2030-06-01T00:00:00Z"}
+]`
+
+func TestCommands(t *testing.T) {
+	getenv, db := newTestEnv(t)
+
+	code, out, errOut := runCtl(getenv, "", "create", "-atomic", "-o", "json", writeFile(t, "coupons.json", testCouponsJSON))
+	if code != EXIT_OK {
+		t.Fatalf("create exited with %d: %s", code, errOut)
+	}
+	created := decodeCoupons(t, out)
+	if len(created) != 3 {
+		t.Fatalf("create was expected to print 3 coupons, got: %d", len(created))
+	}
+
+	code, out, errOut = runCtl(getenv, "", "list", "-brand", "Tesco", "-value-from", "2", "-o", "json")
+	if code != EXIT_OK {
+		t.Fatalf("list exited with %d: %s", code, errOut)
+	}
+	if listed := decodeCoupons(t, out); len(listed) != 1 || listed[0].Value != 5 {
+		t.Errorf("list was expected to find the £5 Tesco coupon, got: %+v", listed)
+	}
+
+	code, out, errOut = runCtl(getenv, "", "list", "-expiry-from", "2030-04-01")
+	if code != EXIT_OK {
+		t.Fatalf("list exited with %d: %s", code, errOut)
+	}
+	if !strings.HasPrefix(out, "ID") || !strings.Contains(out, "Save £2 at Asda") || strings.Contains(out, "Tesco") {
+		t.Errorf("list was expected to print a table of the Asda coupon, got:\n%s", out)
+	}
+
+	id := created[0].Id.Hex()
+	code, out, errOut = runCtl(getenv, "", "get", "-o", "csv", id)
+	if code != EXIT_OK {
+		t.Fatalf("get exited with %d: %s", code, errOut)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], id+",Save £1 at Tesco,Tesco,1,") {
+		t.Errorf("get was expected to print the coupon as csv, got:\n%s", out)
+	}
+
+	code, out, errOut = runCtl(getenv, "", "update", "-name", "Save £1.50 at Tesco", "-value", "1.5", "-o", "json", id)
+	if code != EXIT_OK {
+		t.Fatalf("update exited with %d: %s", code, errOut)
+	}
+	if updated := decodeCoupons(t, out); updated[0].Version != 2 || updated[0].Value != 1.5 || updated[0].Brand != "Tesco" {
+		t.Errorf("update was expected to change the name and value only, got: %+v", updated[0])
+	}
+
+	code, _, errOut = runCtl(getenv, "", "update", "-version", "1", "-name", "stale", id)
+	if code != EXIT_FAILED || !strings.Contains(errOut, api.ERR_VERSION_CONFLICT) || !strings.Contains(errOut, "is at version 2") {
+		t.Errorf("a stale update was expected to fail with a version conflict, got %d: %s", code, errOut)
+	}
+
+	code, _, errOut = runCtl(getenv, "", "delete", id, created[1].Id.Hex())
+	if code != EXIT_OK {
+		t.Fatalf("delete exited with %d: %s", code, errOut)
+	}
+	if remaining, _ := db.SearchFromRequest(&api.CouponFilter{}); len(remaining) != 1 {
+		t.Errorf("1 coupon was expected to remain, got: %d", len(remaining))
+	}
+
+	code, _, errOut = runCtl(getenv, "", "get", id)
+	if code != EXIT_FAILED || !strings.Contains(errOut, "does not exist") {
+		t.Errorf("get of a deleted coupon was expected to fail, got %d: %s", code, errOut)
+	}
+
+	code, out, errOut = runCtl(getenv, "", "export", "-format", "ndjson", "-columns", "name,value")
+	if code != EXIT_OK {
+		t.Fatalf("export exited with %d: %s", code, errOut)
+	}
+	if strings.TrimSpace(out) != `{"name":"Save £2 at Asda","value":2}` {
+		t.Errorf("export was expected to stream the remaining coupon, got: %s", out)
+	}
+}
+
+func TestCreatePartial(t *testing.T) {
+	getenv, _ := newTestEnv(t)
+
+	//the second coupon has no brand
+	input := `{"coupons": [{"name": "Save £1", "brand": "Tesco", "value": 1, "expiry": "2030-03-01T00:00:00Z"},
+		{"name": "Save £2", "value": 2, "expiry": "2030-03-01T00:00:00Z"}]}`
+	code, out, errOut := runCtl(getenv, input, "create", "-format", "json", "-")
+	if code != EXIT_PARTIAL {
+		t.Fatalf("create was expected to exit with %d, got %d: %s", EXIT_PARTIAL, code, errOut)
+	}
+	if !strings.Contains(out, api.ERR_BRAND_REQUIRED) || !strings.Contains(out, "2 coupons, 1 succeeded, 1 failed") {
+		t.Errorf("create was expected to print the result per coupon, got:\n%s", out)
+	}
+
+	code, _, errOut = runCtl(getenv, input, "create", "-format", "json", "-atomic", "-")
+	if code != EXIT_FAILED || !strings.Contains(errOut, api.ERR_BRAND_REQUIRED) || !strings.Contains(errOut, "coupons[1].brand") {
+		t.Errorf("an atomic create was expected to fail with the errors of the coupon, got %d: %s", code, errOut)
+	}
+}
+
+func TestCreateFromCSV(t *testing.T) {
+	getenv, db := newTestEnv(t)
+
+	csvFile := writeFile(t, "coupons.csv", "name,brand,value,expiry\nSave £1,Tesco,1,2030-03-01\nSave £2,,2,2030-03-01\n")
+
+	code, out, errOut := runCtl(getenv, "", "create", "-dry-run", csvFile)
+	if code != EXIT_PARTIAL || !strings.Contains(out, "dry run") {
+		t.Fatalf("a dry run was expected to report the invalid row, got %d: %s%s", code, out, errOut)
+	}
+	if stored, _ := db.SearchFromRequest(&api.CouponFilter{}); len(stored) != 0 {
+		t.Errorf("a dry run was expected to write nothing, got: %d coupons", len(stored))
+	}
+
+	code, out, errOut = runCtl(getenv, "", "create", "-o", "json", csvFile)
+	if code != EXIT_PARTIAL {
+		t.Fatalf("create was expected to exit with %d, got %d: %s", EXIT_PARTIAL, code, errOut)
+	}
+	report := &api.ImportReport{}
+	if err := json.Unmarshal([]byte(out), report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Invalid != 1 || report.ImportId == "" || report.Errors[0].Row != 3 {
+		t.Errorf("the import was expected to write 1 row and reject row 3, got: %+v", report)
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	getenv, _ := newTestEnv(t)
+
+	tests := []struct {
+		name string
+		args []string
+		msg  string
+	}{
+		{"no command", []string{}, "usage: couponctl"},
+		{"unknown command", []string{"redeem"}, "unknown command redeem"},
+		{"invalid id", []string{"get", "123"}, "123 is not a coupon id"},
+		{"invalid output", []string{"list", "-o", "xml"}, "unknown output format xml"},
+		{"invalid date", []string{"list", "-expiry-from", "tomorrow"}, "tomorrow is not a date"},
+		{"unknown file format", []string{"create", "coupons.txt"}, "must be given with -format"},
+		{"version of several coupons", []string{"delete", "-version", "1", "5c6ab0d4e4ad1e0001a0e4a1", "5c6ab0d4e4ad1e0001a0e4a2"}, "single coupon"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, _, errOut := runCtl(getenv, "", test.args...)
+			if code != EXIT_FAILED || !strings.Contains(errOut, test.msg) {
+				t.Errorf("couponctl %v was expected to fail with %q, got %d: %s", test.args, test.msg, code, errOut)
+			}
+		})
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	profiles := writeFile(t, "profiles.json", `{
+		"default": {"endpoint": "http://localhost:8080", "apiKey": "local key"},
+		"prod": {"endpoint": "https://coupons.example.com", "apiKey": "prod key"}
+	}`)
+
+	tests := []struct {
+		name     string
+		cmdLine  settings
+		env      map[string]string
+		expected Profile
+		fails    bool
+	}{
+		{
+			name:     "default profile",
+			env:      map[string]string{ENV_CONFIG: profiles},
+			expected: Profile{Endpoint: "http://localhost:8080", ApiKey: "local key"},
+		},
+		{
+			name:     "profile from the environment",
+			env:      map[string]string{ENV_CONFIG: profiles, ENV_PROFILE: "prod"},
+			expected: Profile{Endpoint: "https://coupons.example.com", ApiKey: "prod key"},
+		},
+		{
+			name:     "environment over the profile",
+			env:      map[string]string{ENV_CONFIG: profiles, ENV_API_KEY: "env key"},
+			expected: Profile{Endpoint: "http://localhost:8080", ApiKey: "env key"},
+		},
+		{
+			name:     "command line over everything",
+			cmdLine:  settings{profile: "prod", endpoint: "http://other:8080"},
+			env:      map[string]string{ENV_CONFIG: profiles, ENV_ENDPOINT: "http://env:8080"},
+			expected: Profile{Endpoint: "http://other:8080", ApiKey: "prod key"},
+		},
+		{
+			name:     "home directory",
+			env:      map[string]string{"HOME": filepath.Dir(writeFile(t, DEFAULT_CONFIG, `{"default": {"endpoint": "http://home:8080"}}`))},
+			expected: Profile{Endpoint: "http://home:8080"},
+		},
+		{
+			name:     "no profile file",
+			env:      map[string]string{ENV_CONFIG: filepath.Join(t.TempDir(), "missing.json"), ENV_ENDPOINT: "http://env:8080"},
+			expected: Profile{Endpoint: "http://env:8080"},
+		},
+		{
+			name:    "unknown profile",
+			cmdLine: settings{profile: "staging"},
+			env:     map[string]string{ENV_CONFIG: profiles},
+			fails:   true,
+		},
+		{
+			name:  "no endpoint",
+			env:   map[string]string{ENV_CONFIG: filepath.Join(t.TempDir(), "missing.json")},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, err := resolveProfile(test.cmdLine, func(name string) string { return test.env[name] })
+			if test.fails {
+				if err == nil {
+					t.Errorf("resolveProfile() was expected to fail, got: %+v", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveProfile() failed: %s", err.Error())
+			}
+			if *profile != test.expected {
+				t.Errorf("resolveProfile() was expected to be %+v, got: %+v", test.expected, *profile)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	OUTPUT_TABLE string = "table"
+	OUTPUT_JSON  string = "json"
+	OUTPUT_CSV   string = "csv"
+)
+
+var outputFormats = []string{OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_CSV}
+
+func validOutput(format string) error {
+	for _, known := range outputFormats {
+		if format == known {
+			return nil
+		}
+	}
+	return errors.Errorf("unknown output format %s, use one of %v", format, outputFormats)
+}
+
+func timeText(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// writeCoupons prints the coupons in the output format, the csv columns are those of a full export of the service
+func writeCoupons(w io.Writer, format string, coupons []api.Coupon) error {
+	switch format {
+	case OUTPUT_JSON:
+		return writeJSON(w, coupons)
+	case OUTPUT_CSV:
+		out := csv.NewWriter(w)
+		out.Write([]string{"id", "name", "brand", "value", "expiry", "createdAt", "version"})
+		for _, cpn := range coupons {
+			out.Write([]string{
+				cpn.Id.Hex(),
+				cpn.Name,
+				cpn.Brand,
+				strconv.FormatFloat(cpn.Value, 'f', -1, 64),
+				timeText(cpn.Expiry),
+				timeText(cpn.CreatedAt),
+				strconv.FormatInt(cpn.Version, 10),
+			})
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "ID\tNAME\tBRAND\tVALUE\tEXPIRY\tVERSION")
+		for _, cpn := range coupons {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%d\n", cpn.Id.Hex(), cpn.Name, cpn.Brand,
+				strconv.FormatFloat(cpn.Value, 'f', -1, 64), timeText(cpn.Expiry), cpn.Version)
+		}
+		return out.Flush()
+	}
+}
+
+// writeBatch prints the result per coupon of a batch, the failed coupons with their errors
+func writeBatch(w io.Writer, format string, batch *api.BatchResult) error {
+	switch format {
+	case OUTPUT_JSON:
+		return writeJSON(w, batch)
+	case OUTPUT_CSV:
+		out := csv.NewWriter(w)
+		out.Write([]string{"index", "id", "version", "errors"})
+		for _, item := range batch.Items {
+			id, version := batchItemCoupon(item)
+			out.Write([]string{strconv.Itoa(item.Index), id, version, errorsText(item.Errors)})
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "INDEX\tID\tVERSION\tERRORS")
+		for _, item := range batch.Items {
+			id, version := batchItemCoupon(item)
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", item.Index, id, version, errorsText(item.Errors))
+		}
+		fmt.Fprintf(out, "\n%d coupons, %d succeeded, %d failed\n", batch.Summary.Total, batch.Summary.Succeeded, batch.Summary.Failed)
+		return out.Flush()
+	}
+}
+
+func batchItemCoupon(item api.BatchItemResult) (id, version string) {
+	if item.Coupon == nil {
+		return "", ""
+	}
+	return item.Coupon.Id.Hex(), strconv.FormatInt(item.Coupon.Version, 10)
+}
+
+func errorsText(errs []api.Error) string {
+	text := ""
+	for i, apiErr := range errs {
+		if i > 0 {
+			text += "; "
+		}
+		text += fmt.Sprintf("%s: %s", apiErr.Code, apiErr.Message)
+		if apiErr.Field != "" {
+			text += fmt.Sprintf(" (%s)", apiErr.Field)
+		}
+	}
+	return text
+}
+
+// writeImportReport prints the outcome of a csv import, the invalid rows with their errors
+func writeImportReport(w io.Writer, format string, report *api.ImportReport) error {
+	switch format {
+	case OUTPUT_JSON:
+		return writeJSON(w, report)
+	case OUTPUT_CSV:
+		out := csv.NewWriter(w)
+		out.Write([]string{"row", "errors"})
+		for _, rowErr := range report.Errors {
+			out.Write([]string{strconv.Itoa(rowErr.Row), errorsText(rowErr.Errors)})
+		}
+		out.Flush()
+		return out.Error()
+	default:
+		out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		if len(report.Errors) > 0 {
+			fmt.Fprintln(out, "ROW\tERRORS")
+			for _, rowErr := range report.Errors {
+				fmt.Fprintf(out, "%d\t%s\n", rowErr.Row, errorsText(rowErr.Errors))
+			}
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "%d rows, %d imported, %d invalid, %d skipped\n", report.Rows, report.Imported, report.Invalid, report.Skipped)
+		if report.DryRun {
+			fmt.Fprintln(out, "dry run, nothing was written")
+		} else if report.ImportId != "" {
+			fmt.Fprintf(out, "import id: %s\n", report.ImportId)
+		}
+		return out.Flush()
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ENV_ENDPOINT string = "COUPONCTL_ENDPOINT"
+	ENV_API_KEY  string = "COUPONCTL_API_KEY"
+	ENV_PROFILE  string = "COUPONCTL_PROFILE"
+	//the profile file, ~/.couponctl.json by default
+	ENV_CONFIG string = "COUPONCTL_CONFIG"
+
+	DEFAULT_PROFILE string = "default"
+	DEFAULT_CONFIG  string = ".couponctl.json"
+)
+
+// Profile is where a coupon service is and the api key it is used with. The profile file maps profile names to profiles:
+//
+//	{"default": {"endpoint": "http://localhost:8080", "apiKey": "..."}, "prod": {...}}
+type Profile struct {
+	Endpoint string `json:"endpoint"`
+	ApiKey   string `json:"apiKey"`
+}
+
+// settings are what the command line gives, left empty when not given
+type settings struct {
+	profile  string
+	endpoint string
+	apiKey   string
+}
+
+// resolveProfile merges the settings of the command line, the environment and the profile file, in that order of precedence.
+// A missing profile file is fine, as long as the endpoint and the api key are given otherwise.
+func resolveProfile(cmdLine settings, getenv func(string) string) (*Profile, error) {
+	name := firstOf(cmdLine.profile, getenv(ENV_PROFILE))
+	explicitProfile := name != ""
+	if name == "" {
+		name = DEFAULT_PROFILE
+	}
+
+	stored, err := loadProfile(configPath(getenv), name, explicitProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{
+		Endpoint: firstOf(cmdLine.endpoint, getenv(ENV_ENDPOINT), stored.Endpoint),
+		ApiKey:   firstOf(cmdLine.apiKey, getenv(ENV_API_KEY), stored.ApiKey),
+	}
+	if profile.Endpoint == "" {
+		return nil, errors.Errorf("the endpoint of the coupon service must be given with -endpoint, %s or a profile", ENV_ENDPOINT)
+	}
+	return profile, nil
+}
+
+func configPath(getenv func(string) string) string {
+	if path := getenv(ENV_CONFIG); path != "" {
+		return path
+	}
+	return filepath.Join(getenv("HOME"), DEFAULT_CONFIG)
+}
+
+// loadProfile reads the profile from the file. A profile that was asked for by name must exist.
+func loadProfile(path, name string, required bool) (Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return Profile{}, nil
+	}
+	if err != nil {
+		return Profile{}, errors.Wrapf(err, "failed to read the profile file %s", path)
+	}
+
+	profiles := map[string]Profile{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return Profile{}, errors.Wrapf(err, "failed to parse the profile file %s", path)
+	}
+
+	profile, found := profiles[name]
+	if !found && required {
+		return Profile{}, errors.Errorf("profile %s is not in %s", name, path)
+	}
+	return profile, nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -8,6 +8,8 @@ import (
 type Config struct {
 	DB      DBConf
 	Service ServiceConf
+	NATS    NATSConf
+	Kafka   KafkaConf
 }
 
 // DBConf - DB config
@@ -17,10 +19,96 @@ type DBConf struct {
 	Name string `env:"DB_NAME" envDefault:"test"`
 }
 
+// NATSConf - NATS publisher config, the coupon events are published to NATS when a url is set
+type NATSConf struct {
+	URL string `env:"NATS_URL" envDefault:""`
+	//events are published to <prefix>.<event type>
+	SubjectPrefix string `env:"NATS_SUBJECT_PREFIX" envDefault:"coupons.events"`
+	//publish through JetStream, which acknowledges every event once a stream stored it
+	JetStream bool `env:"NATS_JETSTREAM" envDefault:"false"`
+	//json or protobuf
+	Format string `env:"NATS_FORMAT" envDefault:"json"`
+}
+
+// KafkaConf - Kafka publisher config, the coupon events are published to Kafka when brokers are set
+type KafkaConf struct {
+	//comma separated host:port list
+	Brokers string `env:"KAFKA_BROKERS" envDefault:""`
+	Topic   string `env:"KAFKA_TOPIC" envDefault:"coupon-events"`
+	//json or protobuf
+	Format string `env:"KAFKA_FORMAT" envDefault:"json"`
+}
+
 type ServiceConf struct {
 	CtxTimeout int    `env:"CONTEXT_TIMEOUT" envDefault:"10"`
 	Port       string `env:"LISTEN_PORT" envDefault:"8080"`
 	Debug      bool   `env:"DEBUG" envDefault:"true"`
+
+	//port of the gRPC api, served alongside the http one. The gRPC api is not served when set to an empty value.
+	GrpcPort string `env:"GRPC_LISTEN_PORT" envDefault:"9090"`
+
+	//how long (in hours) the response of a request with an idempotency key is kept for replaying
+	IdempotencyKeyTTL int `env:"IDEMPOTENCY_KEY_TTL" envDefault:"24"`
+
+	//also report errors as the flat list of strings used before error codes were introduced
+	LegacyErrors bool `env:"LEGACY_ERRORS" envDefault:"false"`
+
+	//the ISO 4217 currency coupon values are kept in, v2 money amounts are in its minor unit
+	Currency string `env:"CURRENCY" envDefault:"GBP"`
+
+	//limits of a single GraphQL request, 0 turns a limit off
+	GraphqlMaxDepth      int `env:"GRAPHQL_MAX_DEPTH" envDefault:"8"`
+	GraphqlMaxComplexity int `env:"GRAPHQL_MAX_COMPLEXITY" envDefault:"1000"`
+
+	//how many rows of a csv import are written at once, a failed import is resumed after the last written chunk
+	ImportChunkSize int `env:"IMPORT_CHUNK_SIZE" envDefault:"1000"`
+	//layouts (as for time.Parse) the dates of a csv import are read with, unless the request gives its own.
+	//They are separated by ; or | as a layout can contain a comma.
+	ImportDateFormats string `env:"IMPORT_DATE_FORMATS" envDefault:"2006-01-02T15:04:05Z07:00;2006-01-02"`
+
+	//responses smaller than this many bytes are sent uncompressed
+	CompressionMinSize int `env:"COMPRESSION_MIN_SIZE" envDefault:"1024"`
+	//compression levels of the response encodings: gzip 1-9, brotli 0-11, zstd 1-22
+	GzipLevel   int `env:"GZIP_LEVEL" envDefault:"6"`
+	BrotliLevel int `env:"BROTLI_LEVEL" envDefault:"5"`
+	ZstdLevel   int `env:"ZSTD_LEVEL" envDefault:"3"`
+
+	//compressed request bodies are rejected once they decompress to more than this many bytes
+	MaxDecompressedRequestSize int `env:"MAX_DECOMPRESSED_REQUEST_SIZE" envDefault:"104857600"`
+
+	//how often (in milliseconds) an event stream looks for new coupon events
+	EventsPollInterval int `env:"EVENTS_POLL_INTERVAL" envDefault:"1000"`
+	//how long (in hours) coupon events are kept, a stream can be resumed from within this window
+	EventsRetention int `env:"EVENTS_RETENTION" envDefault:"168"`
+	//how often (in seconds) coupons are checked for having expired, 0 turns expired events off
+	ExpiryCheckInterval int `env:"EXPIRY_CHECK_INTERVAL" envDefault:"60"`
+
+	//how often (in milliseconds) the webhook worker looks for new events and due deliveries, 0 turns webhooks off
+	WebhookPollInterval int `env:"WEBHOOK_POLL_INTERVAL" envDefault:"1000"`
+	//how long (in seconds) a webhook receiver has to answer
+	WebhookTimeout int `env:"WEBHOOK_TIMEOUT" envDefault:"10"`
+	//a delivery is dead once this many attempts failed
+	WebhookMaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	//the wait (in seconds) after the first failed attempt, doubled after every further one up to WebhookMaxBackoff
+	WebhookMinBackoff int `env:"WEBHOOK_MIN_BACKOFF" envDefault:"10"`
+	WebhookMaxBackoff int `env:"WEBHOOK_MAX_BACKOFF" envDefault:"3600"`
+	//how many subscriptions are sent to at the same time, a slow receiver only holds up its own deliveries
+	WebhookConcurrency int `env:"WEBHOOK_CONCURRENCY" envDefault:"8"`
+	//lets webhooks be sent to loopback, private and link-local addresses, which are refused otherwise
+	WebhookAllowPrivateNetworks bool `env:"WEBHOOK_ALLOW_PRIVATE_NETWORKS" envDefault:"false"`
+
+	//how often (in milliseconds) the outbox relay looks for coupon events to hand to the sinks, 0 turns the relay off
+	OutboxPollInterval int `env:"OUTBOX_POLL_INTERVAL" envDefault:"1000"`
+	//the file the coupon events are appended to, as json lines, none when empty
+	OutboxLogFile string `env:"OUTBOX_LOG_FILE" envDefault:""`
+	//the coupon events are only relayed when mongo runs as a replica set, which writes them in the transaction of their coupons
+	OutboxRequireTransactions bool `env:"OUTBOX_REQUIRE_TRANSACTIONS" envDefault:"true"`
+
+	//a key accepted as an admin api key without being stored, to create the first keys with. None when empty.
+	AdminApiKey string `env:"ADMIN_API_KEY" envDefault:""`
+	//how long (in seconds) a looked up api key is cached, 0 looks the key up in the db on every request.
+	//It is how long the other instances of the service take to see a key disabled, rotated or deleted.
+	ApiKeyCacheTTL int `env:"API_KEY_CACHE_TTL" envDefault:"5"`
 }
 
 func Get() (*Config, error) {
@@ -34,5 +122,13 @@ func Get() (*Config, error) {
 		return nil, errors.Wrap(err, "Failed to load Service config")
 	}
 
+	if err := env.Parse(&cfg.NATS); err != nil {
+		return nil, errors.Wrap(err, "Failed to load NATS config")
+	}
+
+	if err := env.Parse(&cfg.Kafka); err != nil {
+		return nil, errors.Wrap(err, "Failed to load Kafka config")
+	}
+
 	return cfg, nil
 }
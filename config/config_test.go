@@ -24,6 +24,111 @@ const (
 
 	svcDebugEnvName string = "DEBUG"
 	svcDebugDefault bool   = true
+
+	svcGrpcPortEnvName string = "GRPC_LISTEN_PORT"
+	svcGrpcPortDefault string = "9090"
+
+	svcIdempotencyKeyTTLEnvName string = "IDEMPOTENCY_KEY_TTL"
+	svcIdempotencyKeyTTLDefault int    = 24
+
+	svcLegacyErrorsEnvName string = "LEGACY_ERRORS"
+	svcLegacyErrorsDefault bool   = false
+
+	svcCurrencyEnvName string = "CURRENCY"
+	svcCurrencyDefault string = "GBP"
+
+	svcGraphqlMaxDepthEnvName string = "GRAPHQL_MAX_DEPTH"
+	svcGraphqlMaxDepthDefault int    = 8
+
+	svcGraphqlMaxComplexityEnvName string = "GRAPHQL_MAX_COMPLEXITY"
+	svcGraphqlMaxComplexityDefault int    = 1000
+
+	svcImportChunkSizeEnvName string = "IMPORT_CHUNK_SIZE"
+	svcImportChunkSizeDefault int    = 1000
+
+	svcImportDateFormatsEnvName string = "IMPORT_DATE_FORMATS"
+	svcImportDateFormatsDefault string = "2006-01-02T15:04:05Z07:00;2006-01-02"
+
+	svcCompressionMinSizeEnvName string = "COMPRESSION_MIN_SIZE"
+	svcCompressionMinSizeDefault int    = 1024
+
+	svcGzipLevelEnvName string = "GZIP_LEVEL"
+	svcGzipLevelDefault int    = 6
+
+	svcBrotliLevelEnvName string = "BROTLI_LEVEL"
+	svcBrotliLevelDefault int    = 5
+
+	svcZstdLevelEnvName string = "ZSTD_LEVEL"
+	svcZstdLevelDefault int    = 3
+
+	svcMaxDecompressedRequestSizeEnvName string = "MAX_DECOMPRESSED_REQUEST_SIZE"
+	svcMaxDecompressedRequestSizeDefault int    = 104857600
+
+	svcEventsPollIntervalEnvName string = "EVENTS_POLL_INTERVAL"
+	svcEventsPollIntervalDefault int    = 1000
+
+	svcEventsRetentionEnvName string = "EVENTS_RETENTION"
+	svcEventsRetentionDefault int    = 168
+
+	svcExpiryCheckIntervalEnvName string = "EXPIRY_CHECK_INTERVAL"
+	svcExpiryCheckIntervalDefault int    = 60
+
+	svcWebhookPollIntervalEnvName string = "WEBHOOK_POLL_INTERVAL"
+	svcWebhookPollIntervalDefault int    = 1000
+
+	svcWebhookTimeoutEnvName string = "WEBHOOK_TIMEOUT"
+	svcWebhookTimeoutDefault int    = 10
+
+	svcWebhookMaxAttemptsEnvName string = "WEBHOOK_MAX_ATTEMPTS"
+	svcWebhookMaxAttemptsDefault int    = 8
+
+	svcWebhookMinBackoffEnvName string = "WEBHOOK_MIN_BACKOFF"
+	svcWebhookMinBackoffDefault int    = 10
+
+	svcWebhookMaxBackoffEnvName string = "WEBHOOK_MAX_BACKOFF"
+	svcWebhookMaxBackoffDefault int    = 3600
+
+	svcWebhookConcurrencyEnvName string = "WEBHOOK_CONCURRENCY"
+	svcWebhookConcurrencyDefault int    = 8
+
+	svcWebhookAllowPrivateNetworksEnvName string = "WEBHOOK_ALLOW_PRIVATE_NETWORKS"
+	svcWebhookAllowPrivateNetworksDefault bool   = false
+
+	svcOutboxPollIntervalEnvName string = "OUTBOX_POLL_INTERVAL"
+	svcOutboxPollIntervalDefault int    = 1000
+
+	svcOutboxLogFileEnvName string = "OUTBOX_LOG_FILE"
+	svcOutboxLogFileDefault string = ""
+
+	svcOutboxRequireTransactionsEnvName string = "OUTBOX_REQUIRE_TRANSACTIONS"
+	svcOutboxRequireTransactionsDefault bool   = true
+
+	svcAdminApiKeyEnvName string = "ADMIN_API_KEY"
+	svcAdminApiKeyDefault string = ""
+
+	svcApiKeyCacheTTLEnvName string = "API_KEY_CACHE_TTL"
+	svcApiKeyCacheTTLDefault int    = 5
+
+	natsURLEnvName string = "NATS_URL"
+	natsURLDefault string = ""
+
+	natsSubjectPrefixEnvName string = "NATS_SUBJECT_PREFIX"
+	natsSubjectPrefixDefault string = "coupons.events"
+
+	natsJetStreamEnvName string = "NATS_JETSTREAM"
+	natsJetStreamDefault bool   = false
+
+	natsFormatEnvName string = "NATS_FORMAT"
+	natsFormatDefault string = "json"
+
+	kafkaBrokersEnvName string = "KAFKA_BROKERS"
+	kafkaBrokersDefault string = ""
+
+	kafkaTopicEnvName string = "KAFKA_TOPIC"
+	kafkaTopicDefault string = "coupon-events"
+
+	kafkaFormatEnvName string = "KAFKA_FORMAT"
+	kafkaFormatDefault string = "json"
 )
 
 func TestGet(t *testing.T) {
@@ -71,6 +176,16 @@ func getExpectedConfig(t *testing.T) *Config {
 		CtxTimeout: 10,
 		Debug:      true,
 		Port:       os.Getenv(svcPortEnvName),
+		Currency:   os.Getenv(svcCurrencyEnvName),
+
+		ImportDateFormats: os.Getenv(svcImportDateFormatsEnvName),
+	}
+
+	//svc.GrpcPort, an empty value is kept as it disables the gRPC api
+	if envVarStr, isSet := os.LookupEnv(svcGrpcPortEnvName); isSet {
+		cfgExpected.Service.GrpcPort = envVarStr
+	} else {
+		cfgExpected.Service.GrpcPort = svcGrpcPortDefault
 	}
 
 	//svc.CtxTimeout
@@ -99,11 +214,377 @@ func getExpectedConfig(t *testing.T) *Config {
 		cfgExpected.Service.Debug = svcDebugDefault
 	}
 
+	//svc.IdempotencyKeyTTL
+	if envVarStr, isSet := os.LookupEnv(svcIdempotencyKeyTTLEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcIdempotencyKeyTTLEnvName, envVarStr)
+			cfgExpected.Service.IdempotencyKeyTTL = svcIdempotencyKeyTTLDefault
+		} else {
+			cfgExpected.Service.IdempotencyKeyTTL = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.IdempotencyKeyTTL = svcIdempotencyKeyTTLDefault
+	}
+
+	//svc.LegacyErrors
+	if envVarStr, isSet := os.LookupEnv(svcLegacyErrorsEnvName); isSet {
+		envVar, err := strconv.ParseBool(envVarStr)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to a boolean", svcLegacyErrorsEnvName, envVarStr)
+			cfgExpected.Service.LegacyErrors = svcLegacyErrorsDefault
+		} else {
+			cfgExpected.Service.LegacyErrors = envVar
+		}
+	} else {
+		cfgExpected.Service.LegacyErrors = svcLegacyErrorsDefault
+	}
+
+	//svc.GraphqlMaxDepth
+	if envVarStr, isSet := os.LookupEnv(svcGraphqlMaxDepthEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcGraphqlMaxDepthEnvName, envVarStr)
+			cfgExpected.Service.GraphqlMaxDepth = svcGraphqlMaxDepthDefault
+		} else {
+			cfgExpected.Service.GraphqlMaxDepth = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.GraphqlMaxDepth = svcGraphqlMaxDepthDefault
+	}
+
+	//svc.GraphqlMaxComplexity
+	if envVarStr, isSet := os.LookupEnv(svcGraphqlMaxComplexityEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcGraphqlMaxComplexityEnvName, envVarStr)
+			cfgExpected.Service.GraphqlMaxComplexity = svcGraphqlMaxComplexityDefault
+		} else {
+			cfgExpected.Service.GraphqlMaxComplexity = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.GraphqlMaxComplexity = svcGraphqlMaxComplexityDefault
+	}
+
+	//svc.ImportChunkSize
+	if envVarStr, isSet := os.LookupEnv(svcImportChunkSizeEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcImportChunkSizeEnvName, envVarStr)
+			cfgExpected.Service.ImportChunkSize = svcImportChunkSizeDefault
+		} else {
+			cfgExpected.Service.ImportChunkSize = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.ImportChunkSize = svcImportChunkSizeDefault
+	}
+
+	//svc.CompressionMinSize
+	if envVarStr, isSet := os.LookupEnv(svcCompressionMinSizeEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcCompressionMinSizeEnvName, envVarStr)
+			cfgExpected.Service.CompressionMinSize = svcCompressionMinSizeDefault
+		} else {
+			cfgExpected.Service.CompressionMinSize = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.CompressionMinSize = svcCompressionMinSizeDefault
+	}
+
+	//svc.GzipLevel
+	if envVarStr, isSet := os.LookupEnv(svcGzipLevelEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcGzipLevelEnvName, envVarStr)
+			cfgExpected.Service.GzipLevel = svcGzipLevelDefault
+		} else {
+			cfgExpected.Service.GzipLevel = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.GzipLevel = svcGzipLevelDefault
+	}
+
+	//svc.BrotliLevel
+	if envVarStr, isSet := os.LookupEnv(svcBrotliLevelEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcBrotliLevelEnvName, envVarStr)
+			cfgExpected.Service.BrotliLevel = svcBrotliLevelDefault
+		} else {
+			cfgExpected.Service.BrotliLevel = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.BrotliLevel = svcBrotliLevelDefault
+	}
+
+	//svc.ZstdLevel
+	if envVarStr, isSet := os.LookupEnv(svcZstdLevelEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcZstdLevelEnvName, envVarStr)
+			cfgExpected.Service.ZstdLevel = svcZstdLevelDefault
+		} else {
+			cfgExpected.Service.ZstdLevel = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.ZstdLevel = svcZstdLevelDefault
+	}
+
+	//svc.MaxDecompressedRequestSize
+	if envVarStr, isSet := os.LookupEnv(svcMaxDecompressedRequestSizeEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcMaxDecompressedRequestSizeEnvName, envVarStr)
+			cfgExpected.Service.MaxDecompressedRequestSize = svcMaxDecompressedRequestSizeDefault
+		} else {
+			cfgExpected.Service.MaxDecompressedRequestSize = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.MaxDecompressedRequestSize = svcMaxDecompressedRequestSizeDefault
+	}
+
+	//svc.EventsPollInterval
+	if envVarStr, isSet := os.LookupEnv(svcEventsPollIntervalEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcEventsPollIntervalEnvName, envVarStr)
+			cfgExpected.Service.EventsPollInterval = svcEventsPollIntervalDefault
+		} else {
+			cfgExpected.Service.EventsPollInterval = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.EventsPollInterval = svcEventsPollIntervalDefault
+	}
+
+	//svc.EventsRetention
+	if envVarStr, isSet := os.LookupEnv(svcEventsRetentionEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcEventsRetentionEnvName, envVarStr)
+			cfgExpected.Service.EventsRetention = svcEventsRetentionDefault
+		} else {
+			cfgExpected.Service.EventsRetention = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.EventsRetention = svcEventsRetentionDefault
+	}
+
+	//svc.ExpiryCheckInterval
+	if envVarStr, isSet := os.LookupEnv(svcExpiryCheckIntervalEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcExpiryCheckIntervalEnvName, envVarStr)
+			cfgExpected.Service.ExpiryCheckInterval = svcExpiryCheckIntervalDefault
+		} else {
+			cfgExpected.Service.ExpiryCheckInterval = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.ExpiryCheckInterval = svcExpiryCheckIntervalDefault
+	}
+
+	//svc.WebhookPollInterval
+	if envVarStr, isSet := os.LookupEnv(svcWebhookPollIntervalEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookPollIntervalEnvName, envVarStr)
+			cfgExpected.Service.WebhookPollInterval = svcWebhookPollIntervalDefault
+		} else {
+			cfgExpected.Service.WebhookPollInterval = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookPollInterval = svcWebhookPollIntervalDefault
+	}
+
+	//svc.WebhookTimeout
+	if envVarStr, isSet := os.LookupEnv(svcWebhookTimeoutEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookTimeoutEnvName, envVarStr)
+			cfgExpected.Service.WebhookTimeout = svcWebhookTimeoutDefault
+		} else {
+			cfgExpected.Service.WebhookTimeout = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookTimeout = svcWebhookTimeoutDefault
+	}
+
+	//svc.WebhookMaxAttempts
+	if envVarStr, isSet := os.LookupEnv(svcWebhookMaxAttemptsEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookMaxAttemptsEnvName, envVarStr)
+			cfgExpected.Service.WebhookMaxAttempts = svcWebhookMaxAttemptsDefault
+		} else {
+			cfgExpected.Service.WebhookMaxAttempts = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookMaxAttempts = svcWebhookMaxAttemptsDefault
+	}
+
+	//svc.WebhookMinBackoff
+	if envVarStr, isSet := os.LookupEnv(svcWebhookMinBackoffEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookMinBackoffEnvName, envVarStr)
+			cfgExpected.Service.WebhookMinBackoff = svcWebhookMinBackoffDefault
+		} else {
+			cfgExpected.Service.WebhookMinBackoff = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookMinBackoff = svcWebhookMinBackoffDefault
+	}
+
+	//svc.WebhookMaxBackoff
+	if envVarStr, isSet := os.LookupEnv(svcWebhookMaxBackoffEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookMaxBackoffEnvName, envVarStr)
+			cfgExpected.Service.WebhookMaxBackoff = svcWebhookMaxBackoffDefault
+		} else {
+			cfgExpected.Service.WebhookMaxBackoff = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookMaxBackoff = svcWebhookMaxBackoffDefault
+	}
+
+	//svc.WebhookConcurrency
+	if envVarStr, isSet := os.LookupEnv(svcWebhookConcurrencyEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcWebhookConcurrencyEnvName, envVarStr)
+			cfgExpected.Service.WebhookConcurrency = svcWebhookConcurrencyDefault
+		} else {
+			cfgExpected.Service.WebhookConcurrency = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.WebhookConcurrency = svcWebhookConcurrencyDefault
+	}
+
+	//svc.WebhookAllowPrivateNetworks
+	if envVarStr, isSet := os.LookupEnv(svcWebhookAllowPrivateNetworksEnvName); isSet {
+		envVar, err := strconv.ParseBool(envVarStr)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to a boolean", svcWebhookAllowPrivateNetworksEnvName, envVarStr)
+			cfgExpected.Service.WebhookAllowPrivateNetworks = svcWebhookAllowPrivateNetworksDefault
+		} else {
+			cfgExpected.Service.WebhookAllowPrivateNetworks = envVar
+		}
+	} else {
+		cfgExpected.Service.WebhookAllowPrivateNetworks = svcWebhookAllowPrivateNetworksDefault
+	}
+
+	//svc.OutboxPollInterval
+	if envVarStr, isSet := os.LookupEnv(svcOutboxPollIntervalEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcOutboxPollIntervalEnvName, envVarStr)
+			cfgExpected.Service.OutboxPollInterval = svcOutboxPollIntervalDefault
+		} else {
+			cfgExpected.Service.OutboxPollInterval = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.OutboxPollInterval = svcOutboxPollIntervalDefault
+	}
+
+	//svc.ApiKeyCacheTTL
+	if envVarStr, isSet := os.LookupEnv(svcApiKeyCacheTTLEnvName); isSet {
+		envVar, err := strconv.ParseInt(envVarStr, 10, 0)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to an integer", svcApiKeyCacheTTLEnvName, envVarStr)
+			cfgExpected.Service.ApiKeyCacheTTL = svcApiKeyCacheTTLDefault
+		} else {
+			cfgExpected.Service.ApiKeyCacheTTL = int(envVar)
+		}
+	} else {
+		cfgExpected.Service.ApiKeyCacheTTL = svcApiKeyCacheTTLDefault
+	}
+
 	//svc.Port
 	if cfgExpected.Service.Port == "" {
 		cfgExpected.Service.Port = svcPortDefault
 	}
 
+	//svc.Currency
+	if cfgExpected.Service.Currency == "" {
+		cfgExpected.Service.Currency = svcCurrencyDefault
+	}
+
+	//svc.ImportDateFormats
+	if cfgExpected.Service.ImportDateFormats == "" {
+		cfgExpected.Service.ImportDateFormats = svcImportDateFormatsDefault
+	}
+
+	//svc.OutboxLogFile
+	cfgExpected.Service.OutboxLogFile = os.Getenv(svcOutboxLogFileEnvName)
+	if cfgExpected.Service.OutboxLogFile == "" {
+		cfgExpected.Service.OutboxLogFile = svcOutboxLogFileDefault
+	}
+
+	//svc.OutboxRequireTransactions
+	if envVarStr, isSet := os.LookupEnv(svcOutboxRequireTransactionsEnvName); isSet {
+		envVar, err := strconv.ParseBool(envVarStr)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to a boolean", svcOutboxRequireTransactionsEnvName, envVarStr)
+			cfgExpected.Service.OutboxRequireTransactions = svcOutboxRequireTransactionsDefault
+		} else {
+			cfgExpected.Service.OutboxRequireTransactions = envVar
+		}
+	} else {
+		cfgExpected.Service.OutboxRequireTransactions = svcOutboxRequireTransactionsDefault
+	}
+
+	//svc.AdminApiKey
+	cfgExpected.Service.AdminApiKey = os.Getenv(svcAdminApiKeyEnvName)
+	if cfgExpected.Service.AdminApiKey == "" {
+		cfgExpected.Service.AdminApiKey = svcAdminApiKeyDefault
+	}
+
+	//expected NATS config
+	cfgExpected.NATS = NATSConf{
+		URL:           os.Getenv(natsURLEnvName),
+		SubjectPrefix: os.Getenv(natsSubjectPrefixEnvName),
+		Format:        os.Getenv(natsFormatEnvName),
+	}
+	if cfgExpected.NATS.URL == "" {
+		cfgExpected.NATS.URL = natsURLDefault
+	}
+	if cfgExpected.NATS.SubjectPrefix == "" {
+		cfgExpected.NATS.SubjectPrefix = natsSubjectPrefixDefault
+	}
+	if cfgExpected.NATS.Format == "" {
+		cfgExpected.NATS.Format = natsFormatDefault
+	}
+
+	//nats.JetStream
+	if envVarStr, isSet := os.LookupEnv(natsJetStreamEnvName); isSet {
+		envVar, err := strconv.ParseBool(envVarStr)
+		if err != nil {
+			t.Logf("env variable %s is set to %s, which cannot be parsed to a boolean", natsJetStreamEnvName, envVarStr)
+			cfgExpected.NATS.JetStream = natsJetStreamDefault
+		} else {
+			cfgExpected.NATS.JetStream = envVar
+		}
+	} else {
+		cfgExpected.NATS.JetStream = natsJetStreamDefault
+	}
+
+	//expected Kafka config
+	cfgExpected.Kafka = KafkaConf{
+		Brokers: os.Getenv(kafkaBrokersEnvName),
+		Topic:   os.Getenv(kafkaTopicEnvName),
+		Format:  os.Getenv(kafkaFormatEnvName),
+	}
+	if cfgExpected.Kafka.Brokers == "" {
+		cfgExpected.Kafka.Brokers = kafkaBrokersDefault
+	}
+	if cfgExpected.Kafka.Topic == "" {
+		cfgExpected.Kafka.Topic = kafkaTopicDefault
+	}
+	if cfgExpected.Kafka.Format == "" {
+		cfgExpected.Kafka.Format = kafkaFormatDefault
+	}
+
 	return cfgExpected
 }
 
@@ -133,6 +614,43 @@ func checkConfigsMatch(t *testing.T, expected, actual *Config) bool {
 	isOk = compareTwoIntegers(t, "Service ctx timeout", expected.Service.CtxTimeout, actual.Service.CtxTimeout) && isOk
 	isOk = compareTwoStrings(t, "Service port", expected.Service.Port, actual.Service.Port) && isOk
 	isOk = compareTwoBooleans(t, "Service debug", expected.Service.Debug, actual.Service.Debug) && isOk
+	isOk = compareTwoStrings(t, "Service grpc port", expected.Service.GrpcPort, actual.Service.GrpcPort) && isOk
+	isOk = compareTwoIntegers(t, "Service idempotency key ttl", expected.Service.IdempotencyKeyTTL, actual.Service.IdempotencyKeyTTL) && isOk
+	isOk = compareTwoBooleans(t, "Service legacy errors", expected.Service.LegacyErrors, actual.Service.LegacyErrors) && isOk
+	isOk = compareTwoStrings(t, "Service currency", expected.Service.Currency, actual.Service.Currency) && isOk
+	isOk = compareTwoIntegers(t, "Service graphql max depth", expected.Service.GraphqlMaxDepth, actual.Service.GraphqlMaxDepth) && isOk
+	isOk = compareTwoIntegers(t, "Service graphql max complexity", expected.Service.GraphqlMaxComplexity, actual.Service.GraphqlMaxComplexity) && isOk
+	isOk = compareTwoIntegers(t, "Service import chunk size", expected.Service.ImportChunkSize, actual.Service.ImportChunkSize) && isOk
+	isOk = compareTwoStrings(t, "Service import date formats", expected.Service.ImportDateFormats, actual.Service.ImportDateFormats) && isOk
+	isOk = compareTwoIntegers(t, "Service compression min size", expected.Service.CompressionMinSize, actual.Service.CompressionMinSize) && isOk
+	isOk = compareTwoIntegers(t, "Service gzip level", expected.Service.GzipLevel, actual.Service.GzipLevel) && isOk
+	isOk = compareTwoIntegers(t, "Service brotli level", expected.Service.BrotliLevel, actual.Service.BrotliLevel) && isOk
+	isOk = compareTwoIntegers(t, "Service zstd level", expected.Service.ZstdLevel, actual.Service.ZstdLevel) && isOk
+	isOk = compareTwoIntegers(t, "Service max decompressed request size", expected.Service.MaxDecompressedRequestSize, actual.Service.MaxDecompressedRequestSize) && isOk
+	isOk = compareTwoIntegers(t, "Service events poll interval", expected.Service.EventsPollInterval, actual.Service.EventsPollInterval) && isOk
+	isOk = compareTwoIntegers(t, "Service events retention", expected.Service.EventsRetention, actual.Service.EventsRetention) && isOk
+	isOk = compareTwoIntegers(t, "Service expiry check interval", expected.Service.ExpiryCheckInterval, actual.Service.ExpiryCheckInterval) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook poll interval", expected.Service.WebhookPollInterval, actual.Service.WebhookPollInterval) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook timeout", expected.Service.WebhookTimeout, actual.Service.WebhookTimeout) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook max attempts", expected.Service.WebhookMaxAttempts, actual.Service.WebhookMaxAttempts) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook min backoff", expected.Service.WebhookMinBackoff, actual.Service.WebhookMinBackoff) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook max backoff", expected.Service.WebhookMaxBackoff, actual.Service.WebhookMaxBackoff) && isOk
+	isOk = compareTwoIntegers(t, "Service webhook concurrency", expected.Service.WebhookConcurrency, actual.Service.WebhookConcurrency) && isOk
+	isOk = compareTwoBooleans(t, "Service webhook allow private networks", expected.Service.WebhookAllowPrivateNetworks, actual.Service.WebhookAllowPrivateNetworks) && isOk
+	isOk = compareTwoIntegers(t, "Service outbox poll interval", expected.Service.OutboxPollInterval, actual.Service.OutboxPollInterval) && isOk
+	isOk = compareTwoStrings(t, "Service outbox log file", expected.Service.OutboxLogFile, actual.Service.OutboxLogFile) && isOk
+	isOk = compareTwoBooleans(t, "Service outbox require transactions", expected.Service.OutboxRequireTransactions, actual.Service.OutboxRequireTransactions) && isOk
+	isOk = compareTwoStrings(t, "Service admin api key", expected.Service.AdminApiKey, actual.Service.AdminApiKey) && isOk
+	isOk = compareTwoIntegers(t, "Service api key cache ttl", expected.Service.ApiKeyCacheTTL, actual.Service.ApiKeyCacheTTL) && isOk
+
+	isOk = compareTwoStrings(t, "NATS url", expected.NATS.URL, actual.NATS.URL) && isOk
+	isOk = compareTwoStrings(t, "NATS subject prefix", expected.NATS.SubjectPrefix, actual.NATS.SubjectPrefix) && isOk
+	isOk = compareTwoBooleans(t, "NATS jetstream", expected.NATS.JetStream, actual.NATS.JetStream) && isOk
+	isOk = compareTwoStrings(t, "NATS format", expected.NATS.Format, actual.NATS.Format) && isOk
+
+	isOk = compareTwoStrings(t, "Kafka brokers", expected.Kafka.Brokers, actual.Kafka.Brokers) && isOk
+	isOk = compareTwoStrings(t, "Kafka topic", expected.Kafka.Topic, actual.Kafka.Topic) && isOk
+	isOk = compareTwoStrings(t, "Kafka format", expected.Kafka.Format, actual.Kafka.Format) && isOk
 
 	return isOk
 }
@@ -0,0 +1,390 @@
+package couponservice
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	API_KEYS_PATH        string = "/apikeys"
+	API_KEY_ROTATE_PATH  string = "/apikeys/rotate"
+	API_KEY_ENABLE_PATH  string = "/apikeys/enable"
+	API_KEY_DISABLE_PATH string = "/apikeys/disable"
+
+	//new api keys are small, a larger body is not one
+	maxApiKeySize = 64 << 10
+	//bytes of randomness in the secret of a key, and in its salt
+	apiKeySecretLength = 32
+	apiKeySaltLength   = 16
+	//the most keys the cache holds, the least recently used one makes room for a new one
+	maxCachedApiKeys = 10000
+)
+
+//formatApiKey is the key a client sends: the id of the stored key, which it is looked up by, and the secret
+func formatApiKey(id primitive.ObjectID, secret string) string {
+	return id.Hex() + "." + secret
+}
+
+func parseApiKey(apiKey string) (primitive.ObjectID, string, bool) {
+	parts := strings.SplitN(apiKey, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return primitive.ObjectID{}, "", false
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return primitive.ObjectID{}, "", false
+	}
+	return id, parts[1], true
+}
+
+func hashApiKeySecret(salt []byte, secret string) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, salt...), secret...))
+	return hash[:]
+}
+
+//newApiKeySecret generates a secret with the salt and hash it is stored as
+func newApiKeySecret() (string, []byte, []byte, error) {
+	secret, salt := make([]byte, apiKeySecretLength), make([]byte, apiKeySaltLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, nil, api.NewErrorf(api.ERR_INTERNAL, "failed to generate an api key: %s", err.Error())
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return "", nil, nil, api.NewErrorf(api.ERR_INTERNAL, "failed to generate an api key: %s", err.Error())
+	}
+	encoded := hex.EncodeToString(secret)
+	return encoded, salt, hashApiKeySecret(salt, encoded), nil
+}
+
+type cachedApiKey struct {
+	id    primitive.ObjectID
+	key   *api.ApiKey
+	until time.Time
+}
+
+//apiKeyCache keeps looked up keys for a short while, so authenticating a request does not cost a db round trip.
+//Only stored keys are kept, made up ids are looked up every time and cannot push the keys in use out of the cache.
+//A key changed through this instance is dropped from its cache right away, the other instances see the change once
+//their entry runs out.
+type apiKeyCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	//the keys by id, and in the order they were used, the most recent first
+	entries map[primitive.ObjectID]*list.Element
+	order   *list.List
+}
+
+func newApiKeyCache(ttl time.Duration) *apiKeyCache {
+	return &apiKeyCache{ttl: ttl, entries: map[primitive.ObjectID]*list.Element{}, order: list.New()}
+}
+
+func (c *apiKeyCache) get(id primitive.ObjectID) (*api.ApiKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[id]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedApiKey)
+	if time.Now().After(entry.until) {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.key, true
+}
+
+func (c *apiKeyCache) put(id primitive.ObjectID, key *api.ApiKey) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedApiKey{id: id, key: key, until: time.Now().Add(c.ttl)}
+	if elem, found := c.entries[id]; found {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= maxCachedApiKeys {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedApiKey).id)
+	}
+	c.entries[id] = c.order.PushFront(entry)
+}
+
+func (c *apiKeyCache) forget(id primitive.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[id]; found {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+//storedApiKey reads the key through the cache, a key that does not exist is nil
+func (s *CouponService) storedApiKey(id primitive.ObjectID) (*api.ApiKey, error) {
+	if key, found := s.apiKeys.get(id); found {
+		return key, nil
+	}
+
+	key, err := s.db.ApiKey(id)
+	if err != nil {
+		if apiErrorFrom(err).Code != api.ERR_API_KEY_NOT_FOUND {
+			return nil, err
+		}
+		return nil, nil
+	}
+	s.apiKeys.put(id, key)
+	return key, nil
+}
+
+//checkApiKeys makes sure the service can be used: without ADMIN_API_KEY and without a stored key no request is accepted.
+//Stored keys none of which is an enabled admin key cannot be managed, that is only logged.
+func (s *CouponService) checkApiKeys() error {
+	if s.adminApiKey != "" {
+		return nil
+	}
+	keys, err := s.db.ApiKeys()
+	if err != nil {
+		log.Printf("Failed to check the api keys: %s", err.Error())
+		return nil
+	}
+	if len(keys) == 0 {
+		return errors.New("ADMIN_API_KEY is not set and no api key is stored, no request would be accepted. Set ADMIN_API_KEY to create the first keys with")
+	}
+	for _, key := range keys {
+		if key.Admin && !key.Disabled {
+			return nil
+		}
+	}
+	log.Printf("WARNING: ADMIN_API_KEY is not set and no enabled admin key is stored, the api keys cannot be managed")
+	return nil
+}
+
+//lookupApiKey returns the key if it is accepted: the admin key of the config, or a stored key whose secret matches
+//and that is neither disabled nor expired
+func (s *CouponService) lookupApiKey(apiKey string) (*api.ApiKey, error) {
+	if s.adminApiKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(s.adminApiKey)) == 1 {
+		return &api.ApiKey{Owner: "admin", Admin: true}, nil
+	}
+
+	id, secret, ok := parseApiKey(apiKey)
+	if !ok {
+		return nil, api.NewError(api.ERR_FORBIDDEN, "Forbidden")
+	}
+	key, err := s.storedApiKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || subtle.ConstantTimeCompare(hashApiKeySecret(key.Salt, secret), key.Hash) != 1 {
+		return nil, api.NewError(api.ERR_FORBIDDEN, "Forbidden")
+	}
+	if key.Disabled {
+		return nil, api.NewError(api.ERR_FORBIDDEN, "the api key is disabled")
+	}
+	if !key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt) {
+		return nil, api.NewError(api.ERR_FORBIDDEN, "the api key has expired")
+	}
+	return key, nil
+}
+
+//authenticateAdmin lets through the requests made with an admin key, sent in the X-API-Key header
+func (s *CouponService) authenticateAdmin(r *http.Request) error {
+	key, err := s.authenticateKey(r.Header.Get(API_KEY_HEADER))
+	if err != nil {
+		return err
+	}
+	if !key.Admin {
+		return api.NewError(api.ERR_FORBIDDEN, "api keys are managed with an admin api key")
+	}
+	return nil
+}
+
+func invalidApiKey(field, format string, args ...interface{}) api.Error {
+	err := api.NewErrorf(api.ERR_INVALID_API_KEY, format, args...)
+	err.Field = field
+	return err
+}
+
+//apiKeyFromRequest reads the owner, description, admin flag and expiry of a new key
+func apiKeyFromRequest(r *http.Request) (*api.ApiKey, error) {
+	key := &api.ApiKey{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxApiKeySize)).Decode(key); err != nil {
+		return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse the api key: %s", err.Error())
+	}
+
+	if strings.TrimSpace(key.Owner) == "" {
+		return nil, invalidApiKey("owner", "the owner of the api key must be provided")
+	}
+	if !key.ExpiresAt.IsZero() && !key.ExpiresAt.After(time.Now()) {
+		return nil, invalidApiKey("expiresAt", "the api key would already have expired at %s", key.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return &api.ApiKey{Owner: key.Owner, Description: key.Description, Admin: key.Admin, ExpiresAt: key.ExpiresAt}, nil
+}
+
+//withoutSecrets leaves out the salt and hash, which are not sent anyway, and the key itself
+func withoutSecrets(key api.ApiKey) api.ApiKey {
+	key.Key, key.Salt, key.Hash = "", nil, nil
+	return key
+}
+
+//handleApiKeys creates (POST), lists (GET) and revokes (DELETE ?id=) api keys. It takes an admin key, sent in the
+//X-API-Key header. The key a client authenticates with is only returned by the POST creating it.
+func (s *CouponService) handleApiKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "api keys are created with POST, listed with GET and revoked with DELETE"))
+		return
+	}
+
+	if err := s.authenticateAdmin(r); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		key, err := apiKeyFromRequest(r)
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		secret, salt, hash, err := newApiKeySecret()
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		key.Salt, key.Hash = salt, hash
+		if err := s.db.CreateApiKey(key); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		key.Key = formatApiKey(key.Id, secret)
+		writeResponse(w, s.newResponse(key))
+
+	case http.MethodGet:
+		keys, err := s.db.ApiKeys()
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		for i := range keys {
+			keys[i] = withoutSecrets(keys[i])
+		}
+		writeResponse(w, s.newResponse(keys))
+
+	case http.MethodDelete:
+		id, err := objectIdFromQuery(r, "id")
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		err = s.db.DeleteApiKey(id)
+		s.apiKeys.forget(id)
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		writeResponse(w, s.newResponse(nil))
+	}
+}
+
+//changeApiKey applies the change to the key asked for (POST ?id=) by an admin, and reads the key back
+func (s *CouponService) changeApiKey(r *http.Request, change func(id primitive.ObjectID) error) (*api.ApiKey, error) {
+	if r.Method != http.MethodPost {
+		return nil, api.NewError(api.ERR_UNKNOWN_OPERATION, "api keys are changed with POST")
+	}
+
+	if err := s.authenticateAdmin(r); err != nil {
+		return nil, err
+	}
+
+	id, err := objectIdFromQuery(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	err = change(id)
+	s.apiKeys.forget(id)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.db.ApiKey(id)
+	if err != nil {
+		return nil, err
+	}
+	changed := withoutSecrets(*key)
+	return &changed, nil
+}
+
+//handleApiKeyRotate gives the key a new secret (POST ?id=), which is returned once. The old one stops working.
+func (s *CouponService) handleApiKeyRotate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	secret := ""
+	key, err := s.changeApiKey(r, func(id primitive.ObjectID) error {
+		var salt, hash []byte
+		var err error
+		if secret, salt, hash, err = newApiKeySecret(); err != nil {
+			return err
+		}
+		return s.db.RotateApiKey(id, salt, hash)
+	})
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	key.Key = formatApiKey(key.Id, secret)
+	writeResponse(w, s.newResponse(key))
+}
+
+//handleApiKeyEnable accepts a disabled key again (POST ?id=)
+func (s *CouponService) handleApiKeyEnable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, err := s.changeApiKey(r, func(id primitive.ObjectID) error {
+		return s.db.SetApiKeyDisabled(id, false)
+	})
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(key))
+}
+
+//handleApiKeyDisable stops accepting a key (POST ?id=) until it is enabled again
+func (s *CouponService) handleApiKeyDisable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, err := s.changeApiKey(r, func(id primitive.ObjectID) error {
+		return s.db.SetApiKeyDisabled(id, true)
+	})
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(key))
+}
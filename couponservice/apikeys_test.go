@@ -0,0 +1,238 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+)
+
+//apiKeyRequest calls an api key endpoint with the given key, decoding the result into result
+func apiKeyRequest(t *testing.T, handler http.HandlerFunc, method, path, apiKey, body string, result interface{}) (int, []api.Error) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set(API_KEY_HEADER, apiKey)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	resp := &struct {
+		Errors []api.Error `json:"errors"`
+		Result interface{} `json:"result"`
+	}{Result: result}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp.Errors
+}
+
+func newApiKeySvc(t *testing.T) (*CouponService, *dbtest.DB) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+	return s, db
+}
+
+//createApiKey creates a key with the admin key of the config
+func createApiKey(t *testing.T, s *CouponService, body string) *api.ApiKey {
+	key := &api.ApiKey{}
+	if status, errs := apiKeyRequest(t, s.handleApiKeys, http.MethodPost, API_KEYS_PATH, "Valid API Key", body, key); status != http.StatusOK {
+		t.Fatalf("failed to create an api key: %d %v", status, errs)
+	}
+	return key
+}
+
+func TestApiKeys(t *testing.T) {
+	s, db := newApiKeySvc(t)
+
+	key := createApiKey(t, s, `{"owner":"checkout","description":"checkout service"}`)
+	if key.Owner != "checkout" || key.Admin || key.Disabled || !strings.HasPrefix(key.Key, key.Id.Hex()+".") {
+		t.Fatalf("unexpected api key %+v", key)
+	}
+
+	//only a salted hash of the key is stored
+	stored, _ := db.ApiKey(key.Id)
+	if len(stored.Salt) == 0 || len(stored.Hash) == 0 || stored.Key != "" || strings.Contains(string(stored.Hash), key.Key) {
+		t.Errorf("expected only the hash of the key to be stored, but got %+v", stored)
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Errorf("expected the new key to be accepted, but got %s", err)
+	}
+	if principal := principalForKey(key.Key); principal != "key:"+key.Id.Hex() {
+		t.Errorf("expected the key to be named by its id, but got %s", principal)
+	}
+	for _, wrong := range []string{key.Id.Hex() + ".0123", key.Id.Hex(), "not a key", strings.Replace(key.Key, key.Id.Hex(), "5c58ea1afaa48016746e59b9", 1)} {
+		if err := s.authenticate(&api.Request{ApiKey: wrong}); err == nil || apiErrorFrom(err).Code != api.ERR_FORBIDDEN {
+			t.Errorf("expected %q to be forbidden, but got %v", wrong, err)
+		}
+	}
+
+	//a key that is not an admin key cannot manage the keys
+	if status, _ := apiKeyRequest(t, s.handleApiKeys, http.MethodGet, API_KEYS_PATH, key.Key, "", nil); status != http.StatusForbidden {
+		t.Errorf("expected listing the keys to take an admin key, but got %d", status)
+	}
+
+	listed := []api.ApiKey{}
+	apiKeyRequest(t, s.handleApiKeys, http.MethodGet, API_KEYS_PATH, "Valid API Key", "", &listed)
+	if len(listed) != 1 || listed[0].Id != key.Id || listed[0].Key != "" {
+		t.Errorf("expected the key to be listed without its secret, but got %+v", listed)
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"no owner", `{"description":"nobody's"}`, http.StatusUnprocessableEntity, api.ERR_INVALID_API_KEY},
+		{"expired", `{"owner":"checkout","expiresAt":"2019-03-01T00:00:00Z"}`, http.StatusUnprocessableEntity, api.ERR_INVALID_API_KEY},
+		{"malformed", `{"owner":`, http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, errs := apiKeyRequest(t, s.handleApiKeys, http.MethodPost, API_KEYS_PATH, "Valid API Key", test.body, nil)
+			if status != test.expectedStatus || len(errs) != 1 || errs[0].Code != test.expectedCode {
+				t.Errorf("expected %s (%d), but got %v (%d)", test.expectedCode, test.expectedStatus, errs, status)
+			}
+		})
+	}
+}
+
+func TestApiKeyLifecycle(t *testing.T) {
+	s, _ := newApiKeySvc(t)
+	admin := createApiKey(t, s, `{"owner":"ops","admin":true}`)
+	key := createApiKey(t, s, `{"owner":"checkout"}`)
+	query := "?id=" + key.Id.Hex()
+
+	//a stored admin key manages the keys like the one of the config
+	disabled := &api.ApiKey{}
+	if status, errs := apiKeyRequest(t, s.handleApiKeyDisable, http.MethodPost, API_KEY_DISABLE_PATH+query, admin.Key, "", disabled); status != http.StatusOK || !disabled.Disabled {
+		t.Fatalf("failed to disable the key: %d %v %+v", status, errs, disabled)
+	}
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err == nil {
+		t.Error("expected a disabled key to be forbidden")
+	}
+	apiKeyRequest(t, s.handleApiKeyEnable, http.MethodPost, API_KEY_ENABLE_PATH+query, admin.Key, "", nil)
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Errorf("expected an enabled key to be accepted, but got %s", err)
+	}
+
+	rotated := &api.ApiKey{}
+	apiKeyRequest(t, s.handleApiKeyRotate, http.MethodPost, API_KEY_ROTATE_PATH+query, admin.Key, "", rotated)
+	if rotated.Key == "" || rotated.Key == key.Key || rotated.RotatedAt.IsZero() {
+		t.Fatalf("expected a new key, but got %+v", rotated)
+	}
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err == nil {
+		t.Error("expected the key from before the rotation to be forbidden")
+	}
+	if err := s.authenticate(&api.Request{ApiKey: rotated.Key}); err != nil {
+		t.Errorf("expected the rotated key to be accepted, but got %s", err)
+	}
+
+	if status, _ := apiKeyRequest(t, s.handleApiKeys, http.MethodDelete, API_KEYS_PATH+query, admin.Key, "", nil); status != http.StatusOK {
+		t.Fatalf("failed to revoke the key: %d", status)
+	}
+	if err := s.authenticate(&api.Request{ApiKey: rotated.Key}); err == nil {
+		t.Error("expected a revoked key to be forbidden")
+	}
+	if status, errs := apiKeyRequest(t, s.handleApiKeyDisable, http.MethodPost, API_KEY_DISABLE_PATH+query, admin.Key, "", nil); status != http.StatusNotFound || errs[0].Code != api.ERR_API_KEY_NOT_FOUND {
+		t.Errorf("expected a revoked key not to exist, but got %d %v", status, errs)
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	s, db := newApiKeySvc(t)
+	key := createApiKey(t, s, `{"owner":"checkout","expiresAt":"`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`)
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Fatalf("expected a key that has not expired to be accepted, but got %s", err)
+	}
+
+	//the api does not create expired keys, they are only found once their time is up
+	secret, salt, hash, err := newApiKeySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := &api.ApiKey{Owner: "checkout", ExpiresAt: time.Now().Add(-time.Minute), Salt: salt, Hash: hash}
+	db.CreateApiKey(expired)
+	if err := s.authenticate(&api.Request{ApiKey: formatApiKey(expired.Id, secret)}); err == nil || apiErrorFrom(err).Code != api.ERR_FORBIDDEN {
+		t.Errorf("expected an expired key to be forbidden, but got %v", err)
+	}
+}
+
+func TestApiKeyCache(t *testing.T) {
+	s, db := newApiKeySvc(t)
+	s.apiKeys = newApiKeyCache(time.Minute)
+	key := createApiKey(t, s, `{"owner":"checkout"}`)
+
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a change made behind the back of the service is seen once the cached key runs out
+	db.SetApiKeyDisabled(key.Id, true)
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Errorf("expected the cached key to be accepted, but got %s", err)
+	}
+	s.apiKeys.entries[key.Id].Value.(*cachedApiKey).until = time.Now().Add(-time.Second)
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err == nil {
+		t.Error("expected the disabled key to be forbidden once its cache entry ran out")
+	}
+
+	//a change made through the service is seen right away
+	apiKeyRequest(t, s.handleApiKeyEnable, http.MethodPost, API_KEY_ENABLE_PATH+"?id="+key.Id.Hex(), "Valid API Key", "", nil)
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Errorf("expected the enabled key to be accepted, but got %s", err)
+	}
+}
+
+func TestApiKeyCacheEviction(t *testing.T) {
+	s, _ := newApiKeySvc(t)
+	s.apiKeys = newApiKeyCache(time.Minute)
+	key := createApiKey(t, s, `{"owner":"checkout"}`)
+
+	//made up ids are not cached
+	if err := s.authenticate(&api.Request{ApiKey: formatApiKey(primitive.NewObjectID(), "made up")}); err == nil {
+		t.Fatal("expected a made up key to be forbidden")
+	}
+	if len(s.apiKeys.entries) != 0 {
+		t.Errorf("expected a key that is not stored not to be cached, but got %d entries", len(s.apiKeys.entries))
+	}
+
+	//a full cache makes room by dropping the least recently used key, not the key in use
+	if err := s.authenticate(&api.Request{ApiKey: key.Key}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxCachedApiKeys; i++ {
+		s.apiKeys.put(primitive.NewObjectID(), &api.ApiKey{})
+		if i%1000 == 0 {
+			s.apiKeys.get(key.Id)
+		}
+	}
+	if _, found := s.apiKeys.get(key.Id); !found || len(s.apiKeys.entries) != maxCachedApiKeys {
+		t.Errorf("expected the key in use to stay cached in a full cache of %d, but got %t with %d entries", maxCachedApiKeys, found, len(s.apiKeys.entries))
+	}
+}
+
+func TestCheckApiKeys(t *testing.T) {
+	s, _ := newApiKeySvc(t)
+
+	s.adminApiKey = ""
+	if err := s.checkApiKeys(); err == nil {
+		t.Error("expected the start to fail without ADMIN_API_KEY and without stored keys")
+	}
+
+	s.adminApiKey = "Valid API Key"
+	createApiKey(t, s, `{"owner":"checkout"}`)
+	s.adminApiKey = ""
+	if err := s.checkApiKeys(); err != nil {
+		t.Errorf("expected the stored keys to be enough, but got %s", err)
+	}
+}
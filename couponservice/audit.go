@@ -0,0 +1,158 @@
+package couponservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	AUDIT_PATH string = "/audit"
+
+	//the http header identifying a request in the audit log, a request without one is given a random id
+	REQUEST_ID_HEADER string = "X-Request-Id"
+	//the grpc metadata counterpart of REQUEST_ID_HEADER
+	GRPC_REQUEST_ID_METADATA string = "x-request-id"
+
+	//ids sent by clients longer than this are replaced, they are stored with every change
+	maxRequestIdLength = 128
+	//entries listed when the request does not ask for a number, and the most it can ask for
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+//actorContextKey carries the actor of a request through a context, to the GraphQL resolvers
+type actorContextKey struct{}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("failed to generate a request id: %s", err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+//validRequestId keeps an id sent by the client, a missing or oversized one is replaced with a random id
+func validRequestId(id string) string {
+	if id == "" || len(id) > maxRequestIdLength {
+		return newRequestId()
+	}
+	return id
+}
+
+//withRequestId makes sure every http request carries an id. It is sent back, so a client can find its changes in the audit log.
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := validRequestId(r.Header.Get(REQUEST_ID_HEADER))
+		r.Header.Set(REQUEST_ID_HEADER, id)
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+//principalForKey names the holder of an api key in the audit log by the id of the key, without storing its secret.
+//The admin key of the config, which has no id, is named by a hash of it.
+func principalForKey(apiKey string) string {
+	if id, _, ok := parseApiKey(apiKey); ok {
+		return "key:" + id.Hex()
+	}
+	hash := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(hash[:6])
+}
+
+func actorFromRequest(r *api.Request) api.Actor {
+	return api.Actor{Principal: principalForKey(r.ApiKey), RequestId: r.RequestId}
+}
+
+//actorFromHTTP is the actor of a request whose body is not an api.Request, authenticated by the X-API-Key header
+func actorFromHTTP(r *http.Request) api.Actor {
+	return api.Actor{Principal: principalForKey(r.Header.Get(API_KEY_HEADER)), RequestId: r.Header.Get(REQUEST_ID_HEADER)}
+}
+
+//actorFromContext is the actor of a grpc call, or of a GraphQL request the actor was put in the context of
+func actorFromContext(ctx context.Context) api.Actor {
+	if actor, found := ctx.Value(actorContextKey{}).(api.Actor); found {
+		return actor
+	}
+
+	apiKey, requestId := "", ""
+	if md, found := metadata.FromIncomingContext(ctx); found {
+		if keys := md.Get(GRPC_API_KEY_METADATA); len(keys) > 0 {
+			apiKey = keys[0]
+		}
+		if ids := md.Get(GRPC_REQUEST_ID_METADATA); len(ids) > 0 {
+			requestId = ids[0]
+		}
+	}
+	return api.Actor{Principal: principalForKey(apiKey), RequestId: validRequestId(requestId)}
+}
+
+func auditFilterFromQuery(r *http.Request) (*api.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := &api.AuditFilter{Principal: query.Get("actor"), Limit: defaultAuditLimit}
+
+	if query.Get("couponId") != "" {
+		id, err := objectIdFromQuery(r, "couponId")
+		if err != nil {
+			return nil, err
+		}
+		filter.CouponId = id
+	}
+
+	for param, bound := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if raw := query.Get(param); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "%s must be an RFC 3339 time, e.g. 2019-03-01T00:00:00Z", param)
+			}
+			*bound = t
+		}
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "limit must be a number from 1 to %d", maxAuditLimit)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+//handleAudit searches the audit log (GET, newest first) by coupon (couponId), principal (actor) and time range (from, to).
+//The api key is sent in the X-API-Key header.
+func (s *CouponService) handleAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "the audit log is searched with GET"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	filter, err := auditFilterFromQuery(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	entries, err := s.db.SearchAudit(filter)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(entries))
+}
@@ -0,0 +1,199 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+)
+
+//auditRequest sends a coupons request through the full http stack, as the given request id when one is set
+func auditRequest(t *testing.T, s *CouponService, method, requestId, data string) (*httptest.ResponseRecorder, []api.Coupon) {
+	r := httptest.NewRequest(method, "/v1/", strings.NewReader(`{"apiKey":"Valid API Key","data":`+data+`}`))
+	r.Header.Set("Content-Type", ENCODING_JSON)
+	if requestId != "" {
+		r.Header.Set(REQUEST_ID_HEADER, requestId)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s failed with %d: %s", method, w.Code, w.Body.String())
+	}
+
+	resp := &struct {
+		Result []api.Coupon `json:"result"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	return w, resp.Result
+}
+
+func searchAudit(t *testing.T, s *CouponService, query string) (int, []api.AuditEntry) {
+	r := httptest.NewRequest(http.MethodGet, AUDIT_PATH+"?"+query, nil)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	w := httptest.NewRecorder()
+	s.handleAudit(w, r)
+
+	resp := &struct {
+		Result []api.AuditEntry `json:"result"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp.Result
+}
+
+func TestAuditLog(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db = dbtest.New()
+
+	_, created := auditRequest(t, s, http.MethodPost, "create-1",
+		`{"atomic":true,"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2030-03-01T00:00:00Z"}]}`)
+	id := created[0].Id.Hex()
+	_, _ = auditRequest(t, s, http.MethodPut, "update-1", fmt.Sprintf(`{"atomic":true,"coupons":[{"id":"%s","value":5,"version":1}]}`, id))
+	w, _ := auditRequest(t, s, http.MethodDelete, "", fmt.Sprintf(`{"coupons":[{"id":"%s","version":2}]}`, id))
+
+	//a request without an id is given one, and told about it
+	generated := w.Header().Get(REQUEST_ID_HEADER)
+	if generated == "" {
+		t.Fatal("expected the response to carry the generated request id")
+	}
+
+	status, entries := searchAudit(t, s, "couponId="+id)
+	if status != http.StatusOK || len(entries) != 3 {
+		t.Fatalf("expected an entry per change, but got %d (%d)", len(entries), status)
+	}
+	deleted, updated, createdEntry := entries[0], entries[1], entries[2]
+
+	principal := principalForKey("Valid API Key")
+	for _, entry := range entries {
+		if entry.Actor.Principal != principal || strings.Contains(entry.Actor.Principal, "Valid API Key") {
+			t.Errorf("expected the changes to be made by %s, but got %+v", principal, entry.Actor)
+		}
+	}
+
+	if createdEntry.Action != api.EVENT_CREATED || createdEntry.Actor.RequestId != "create-1" || createdEntry.Before != nil || createdEntry.After == nil || createdEntry.After.Value != 1 {
+		t.Errorf("unexpected create entry %+v", createdEntry)
+	}
+	if updated.Action != api.EVENT_UPDATED || updated.Actor.RequestId != "update-1" || updated.Version != 2 ||
+		updated.Before == nil || updated.Before.Value != 1 || updated.After == nil || updated.After.Value != 5 ||
+		fmt.Sprint(updated.ChangedFields) != "[value]" {
+		t.Errorf("unexpected update entry %+v", updated)
+	}
+	if deleted.Action != api.EVENT_DELETED || deleted.Actor.RequestId != generated || deleted.Before == nil || deleted.Before.Version != 2 || deleted.After != nil {
+		t.Errorf("unexpected delete entry %+v", deleted)
+	}
+}
+
+func TestAuditLogBatch(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+
+	res, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}, {Name: "Save 5", Brand: "Boots", Value: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpns, _ := db.FindByIds(res.InsertedIDs)
+
+	//only the update that was written is recorded, not the one that conflicted
+	_, err = s.updateCoupons(api.Actor{Principal: "key:test", RequestId: "batch"}, &api.CouponCollection{Coupons: []api.Coupon{
+		{Id: cpns[0].Id, Brand: "Boots", Version: 1},
+		{Id: cpns[1].Id, Value: 6, Version: 7},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, entries := searchAudit(t, s, "actor=key:test")
+	if status != http.StatusOK || len(entries) != 1 || entries[0].CouponId != cpns[0].Id || fmt.Sprint(entries[0].ChangedFields) != "[brand]" {
+		t.Errorf("expected the update of the first coupon only, but got %+v (%d)", entries, status)
+	}
+}
+
+//unreadableDB fails to read the coupons back after a write
+type unreadableDB struct {
+	*dbtest.DB
+}
+
+func (db *unreadableDB) FindByIds(ids []interface{}) ([]api.Coupon, error) {
+	return nil, errors.New("read failed")
+}
+
+func TestAuditLogWrittenWithTheCoupons(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = &unreadableDB{db}
+
+	//the write succeeded, so it is in the audit log even though the coupons could not be read back
+	if _, err := s.createCoupons(api.Actor{Principal: "key:test"}, &api.CouponCollection{Coupons: []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10, Expiry: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}}, Atomic: true}); err == nil {
+		t.Fatal("expected the read after the write to fail")
+	}
+	entries, _ := db.SearchAudit(&api.AuditFilter{Principal: "key:test"})
+	if len(entries) != 1 || entries[0].Action != api.EVENT_CREATED || entries[0].After == nil || entries[0].After.Name != "Save 10" {
+		t.Errorf("expected the create in the audit log, but got %+v", entries)
+	}
+}
+
+func TestAuditSearch(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+
+	now := time.Now()
+	if err := db.AppendAudit([]api.AuditEntry{
+		{Action: api.EVENT_CREATED, Actor: api.Actor{Principal: "key:a"}, At: now.Add(-2 * time.Hour)},
+		{Action: api.EVENT_UPDATED, Actor: api.Actor{Principal: "key:b"}, At: now.Add(-time.Hour)},
+		{Action: api.EVENT_DELETED, Actor: api.Actor{Principal: "key:a"}, At: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       string
+	}{
+		{"everything, newest first", "", http.StatusOK, "[deleted updated created]"},
+		{"by actor", "actor=key:a", http.StatusOK, "[deleted created]"},
+		{"time range", "from=" + now.Add(-90*time.Minute).Format(time.RFC3339) + "&to=" + now.Add(-30*time.Minute).Format(time.RFC3339), http.StatusOK, "[updated]"},
+		{"limit", "limit=1", http.StatusOK, "[deleted]"},
+		{"invalid time", "from=yesterday", http.StatusBadRequest, "[]"},
+		{"invalid limit", "limit=0", http.StatusBadRequest, "[]"},
+		{"invalid coupon id", "couponId=nope", http.StatusBadRequest, "[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, entries := searchAudit(t, s, test.query)
+			actions := []string{}
+			for _, entry := range entries {
+				actions = append(actions, entry.Action)
+			}
+			if status != test.expectedStatus || fmt.Sprint(actions) != test.expected {
+				t.Errorf("expected %s (%d), but got %v (%d)", test.expected, test.expectedStatus, actions, status)
+			}
+		})
+	}
+}
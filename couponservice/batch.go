@@ -0,0 +1,153 @@
+package couponservice
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+//newBatchResult creates a result item per coupon and records the validation errors against their items
+func newBatchResult(total int, errors []api.Error) *api.BatchResult {
+	batch := &api.BatchResult{Items: make([]api.BatchItemResult, total)}
+	for i := range batch.Items {
+		batch.Items[i].Index = i
+	}
+
+	for _, e := range errors {
+		if e.Index == nil || *e.Index < 0 || *e.Index >= total {
+			continue
+		}
+		batch.Items[*e.Index].Errors = append(batch.Items[*e.Index].Errors, e)
+	}
+
+	return batch
+}
+
+//validItems returns the coupons that have no errors so far, along with their positions in the request
+func validItems(batch *api.BatchResult, coupons []api.Coupon) ([]api.Coupon, []int) {
+	valid, indexes := []api.Coupon{}, []int{}
+	for i, cpn := range coupons {
+		if len(batch.Items[i].Errors) == 0 {
+			valid = append(valid, cpn)
+			indexes = append(indexes, i)
+		}
+	}
+	return valid, indexes
+}
+
+func summariseBatch(batch *api.BatchResult) {
+	batch.Summary = api.BatchSummary{Total: len(batch.Items)}
+	for _, item := range batch.Items {
+		if len(item.Errors) > 0 {
+			batch.Summary.Failed++
+		} else {
+			batch.Summary.Succeeded++
+		}
+	}
+}
+
+//a batch where nothing succeeded is reported with the status its errors map to, otherwise it is a success
+func (s *CouponService) respondWithBatch(w http.ResponseWriter, r *api.Request, batch *api.BatchResult) {
+	status := http.StatusOK
+	if batch.Summary.Succeeded == 0 {
+		errs := []api.Error{}
+		for _, item := range batch.Items {
+			errs = append(errs, item.Errors...)
+		}
+		status = httpStatusForErrors(errs)
+	}
+
+	s.respondWithWritten(w, r, status, batch, s.db.BatchWriteMode())
+}
+
+//fills in the stored state of the coupons written for the given items
+func (s *CouponService) attachStoredCoupons(batch *api.BatchResult, ids []interface{}, indexes []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	coupons, err := s.db.FindByIds(ids)
+	if err != nil {
+		return err
+	}
+
+	byId := map[interface{}]api.Coupon{}
+	for _, cpn := range coupons {
+		byId[cpn.Id] = cpn
+	}
+
+	for n, id := range ids {
+		if cpn, found := byId[id]; found {
+			batch.Items[indexes[n]].Coupon = &cpn
+		}
+	}
+
+	return nil
+}
+
+//createBatch writes the valid coupons of a non-atomic create and reports on every item
+func (s *CouponService) createBatch(actor api.Actor, cpnCollection *api.CouponCollection, errors []api.Error) (*api.BatchResult, error) {
+	batch := newBatchResult(len(cpnCollection.Coupons), errors)
+
+	valid, indexes := validItems(batch, cpnCollection.Coupons)
+	if len(valid) > 0 {
+		if s.debug {
+			log.Printf("Creating %d of %d coupons", len(valid), len(cpnCollection.Coupons))
+		}
+
+		res, err := s.db.CreateCoupons(actor, valid)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%d coupons created", len(res.InsertedIDs))
+
+		if err := s.attachStoredCoupons(batch, res.InsertedIDs, indexes); err != nil {
+			return nil, afterWrite(err)
+		}
+	}
+
+	summariseBatch(batch)
+	return batch, nil
+}
+
+//updateBatch applies the valid updates of a non-atomic update one by one, so a conflict only fails its own item
+func (s *CouponService) updateBatch(actor api.Actor, cpnCollection *api.CouponCollection, errors []api.Error) (*api.BatchResult, error) {
+	batch := newBatchResult(len(cpnCollection.Coupons), errors)
+
+	valid, indexes := validItems(batch, cpnCollection.Coupons)
+	if s.debug {
+		log.Printf("Updating %d of %d coupons", len(valid), len(cpnCollection.Coupons))
+	}
+
+	updatedIds, updatedIndexes := []interface{}{}, []int{}
+	for n, cpn := range valid {
+		i := indexes[n]
+
+		_, err := s.db.UpdateCoupons(actor, []api.Coupon{cpn})
+		if conflict, isConflict := err.(*dblayer.ConflictError); isConflict {
+			batch.Items[i].Errors = append(batch.Items[i].Errors, apiErrorFrom(conflict).WithItem(i, fmt.Sprintf("coupons[%d].version", i)))
+			if len(conflict.Current) > 0 {
+				batch.Items[i].Coupon = &conflict.Current[0]
+			}
+			continue
+		}
+		if err != nil {
+			batch.Items[i].Errors = append(batch.Items[i].Errors, apiErrorFrom(err).WithItem(i, fmt.Sprintf("coupons[%d]", i)))
+			continue
+		}
+
+		updatedIds = append(updatedIds, cpn.Id)
+		updatedIndexes = append(updatedIndexes, i)
+	}
+	log.Printf("%d coupons updated", len(updatedIds))
+
+	if err := s.attachStoredCoupons(batch, updatedIds, updatedIndexes); err != nil {
+		return nil, err
+	}
+
+	summariseBatch(batch)
+	return batch, nil
+}
@@ -0,0 +1,216 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+type batchResponse struct {
+	Errors []api.Error     `json:"errors"`
+	Result api.BatchResult `json:"result"`
+}
+
+func TestHandleCreateCouponPartialBatch(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	//the second coupon has no brand and a negative value
+	payload := `{"atomic":false,"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"},{"name":"Save £2 at Boots","value":-2,"expiry":"2019-04-01T00:00:00Z"},{"name":"Save £3 at Asda","brand":"Asda","value":3,"expiry":"2019-05-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey: "dont care",
+		Data:   []byte(payload),
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected http status %d", w.Code)
+		return
+	}
+
+	resp := &batchResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	summary := resp.Result.Summary
+	if summary.Total != 3 || summary.Succeeded != 2 || summary.Failed != 1 {
+		t.Errorf("unexpected batch summary %+v", summary)
+	}
+
+	if len(mock.coupons) != 2 {
+		t.Errorf("expected the 2 valid coupons to be written, but %d were", len(mock.coupons))
+	}
+
+	if len(resp.Result.Items) != 3 {
+		t.Errorf("expected a result for each of the 3 coupons, but got %d", len(resp.Result.Items))
+		return
+	}
+
+	failed := resp.Result.Items[1]
+	if failed.Index != 1 || failed.Coupon != nil || len(failed.Errors) != 2 {
+		t.Errorf("expected item 1 to fail with 2 errors, but got %+v", failed)
+	} else if failed.Errors[0].Field != "coupons[1].brand" || failed.Errors[1].Field != "coupons[1].value" {
+		t.Errorf("unexpected field paths %+v", failed.Errors)
+	} else if failed.Errors[0].Code != api.ERR_BRAND_REQUIRED || failed.Errors[1].Code != api.ERR_VALUE_NOT_POSITIVE {
+		t.Errorf("unexpected error codes %+v", failed.Errors)
+	} else if failed.Errors[0].Index == nil || *failed.Errors[0].Index != 1 {
+		t.Errorf("expected the errors to carry the item index, but got %+v", failed.Errors[0])
+	}
+
+	for _, i := range []int{0, 2} {
+		if item := resp.Result.Items[i]; item.Coupon == nil || item.Coupon.Id.IsZero() || len(item.Errors) > 0 {
+			t.Errorf("expected item %d to be created, but got %+v", i, item)
+		}
+	}
+}
+
+func TestHandleCreateCouponAtomicBatch(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"atomic":true,"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"},{"name":"Save £2 at Boots","value":2,"expiry":"2019-04-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey: "dont care",
+		Data:   []byte(payload),
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	resp := &api.Response{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_BRAND_REQUIRED || resp.Errors[0].Field != "coupons[1].brand" {
+		t.Errorf("expected a missing brand error, but got %+v", resp.Errors)
+	}
+
+	if mock.createCalls != 0 {
+		t.Errorf("expected nothing to be written for an invalid atomic batch, but CreateCoupons was called %d times", mock.createCalls)
+	}
+}
+
+func TestHandleUpdateCouponPartialBatchConflict(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex("5c58ea1afaa48016746e59b9")
+	mock := newDbMock()
+	mock.updateErr = &dblayer.ConflictError{Current: []api.Coupon{{Id: id, Name: "Save £1 at Tesco", Version: 3}}}
+	s.db = mock
+
+	//the first coupon is stale, the second is missing its version
+	payload := `{"atomic":false,"coupons":[{"id":"5c58ea1afaa48016746e59b9","name":"Save. Tesco. $1","version":2},{"id":"5c58ea1afaa48016746e59ba","value":4}]}`
+	r := &api.Request{
+		ApiKey: "dont care",
+		Data:   []byte(payload),
+	}
+
+	w := httptest.NewRecorder()
+	s.handleUpdateCoupon(w, r)
+
+	resp := &batchResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.Result.Summary.Failed != 2 || len(resp.Result.Items) != 2 {
+		t.Errorf("expected both items to fail, but got %+v", resp.Result)
+		return
+	}
+
+	stale := resp.Result.Items[0]
+	if len(stale.Errors) != 1 || stale.Errors[0].Code != api.ERR_VERSION_CONFLICT || stale.Coupon == nil || stale.Coupon.Version != 3 {
+		t.Errorf("expected a version conflict carrying the current coupon, but got %+v", stale)
+	}
+
+	invalid := resp.Result.Items[1]
+	if len(invalid.Errors) != 1 || invalid.Errors[0].Code != api.ERR_VERSION_REQUIRED || invalid.Errors[0].Field != "coupons[1].version" {
+		t.Errorf("expected a missing version error, but got %+v", invalid)
+	}
+}
+
+func TestHandleUpdateCouponDuplicateIds(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	//the second item names the coupon of the first one, the batch is refused before anything is written
+	payload := `{"coupons":[{"id":"5c58ea1afaa48016746e59b9","name":"Save £1","version":2},{"id":"5c58ea1afaa48016746e59ba","value":4,"version":1},{"id":"5c58ea1afaa48016746e59b9","value":2,"version":2}]}`
+	w := httptest.NewRecorder()
+	s.handleUpdateCoupon(w, &api.Request{ApiKey: "dont care", Data: []byte(payload)})
+
+	resp := &batchResponse{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_DUPLICATE_ID ||
+		resp.Errors[0].Index == nil || *resp.Errors[0].Index != 2 || resp.Errors[0].Field != "coupons[2].id" {
+		t.Errorf("expected the duplicate at coupons[2] to be refused, but got %d %+v", w.Code, resp.Errors)
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	s.db = newDbMock()
+	s.legacyErrors = true
+
+	payload := `{"atomic":true,"coupons":[{"name":"Save £2 at Boots","value":2,"expiry":"2019-04-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey: "dont care",
+		Data:   []byte(payload),
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	resp := &api.Response{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(resp.Error) != 1 || resp.Error[0] != "ValidateNewCoupon: Coupon brand must be provided" {
+		t.Errorf("expected the legacy validation error, but got %+v", resp.Error)
+	}
+
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_BRAND_REQUIRED {
+		t.Errorf("expected the structured error alongside the legacy one, but got %+v", resp.Errors)
+	}
+}
@@ -0,0 +1,151 @@
+package couponservice
+
+import (
+	"log"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+//writeOutcome is the result of a create or update, independent of the transport (http, grpc) it is reported over.
+//Exactly one of the fields is set.
+type writeOutcome struct {
+	//the written coupons of an atomic batch
+	coupons []api.Coupon
+	//the per item results of a non-atomic batch
+	batch *api.BatchResult
+	//the validation errors that failed an atomic batch
+	errors []api.Error
+	//the coupons of an atomic update that were modified in the meantime
+	conflict *dblayer.ConflictError
+}
+
+//persistedError is a failure that happened after the coupons were written, the request must not simply be run again
+type persistedError struct {
+	error
+}
+
+func (e *persistedError) Cause() error {
+	return e.error
+}
+
+func afterWrite(err error) error {
+	return &persistedError{err}
+}
+
+func isPersisted(err error) bool {
+	_, persisted := err.(*persistedError)
+	return persisted
+}
+
+//createCoupons validates and writes the coupons. Failures of individual coupons are reported in the outcome,
+//the returned error is for failures of the request as a whole. The written coupons are recorded in the audit log as changed by actor.
+func (s *CouponService) createCoupons(actor api.Actor, cpnCollection *api.CouponCollection) (*writeOutcome, error) {
+	validationSuccess, errors := s.validateManyForInsert(cpnCollection)
+	if !cpnCollection.Atomic && len(cpnCollection.Coupons) > 0 {
+		batch, err := s.createBatch(actor, cpnCollection, errors)
+		if err != nil {
+			return nil, err
+		}
+		return &writeOutcome{batch: batch}, nil
+	}
+
+	if !validationSuccess {
+		return &writeOutcome{errors: errors}, nil
+	}
+
+	if s.debug {
+		log.Println("Creating new coupons")
+	}
+
+	res, err := s.db.CreateCoupons(actor, cpnCollection.Coupons)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%d coupons created", len(res.InsertedIDs))
+
+	coupons, err := s.db.FindByIds(res.InsertedIDs)
+	if err != nil {
+		return nil, afterWrite(err)
+	}
+
+	return &writeOutcome{coupons: coupons}, nil
+}
+
+//updateCoupons validates and applies the updates, see createCoupons
+func (s *CouponService) updateCoupons(actor api.Actor, cpnCollection *api.CouponCollection) (*writeOutcome, error) {
+	validationSuccess, errors := s.validateManyForUpdate(cpnCollection)
+	if !cpnCollection.Atomic && len(cpnCollection.Coupons) > 0 {
+		batch, err := s.updateBatch(actor, cpnCollection, errors)
+		if err != nil {
+			return nil, err
+		}
+		return &writeOutcome{batch: batch}, nil
+	}
+
+	if !validationSuccess {
+		return &writeOutcome{errors: errors}, nil
+	}
+
+	if s.debug {
+		log.Println("Updating coupons")
+	}
+
+	cpnIDs := []interface{}{}
+	for _, cpn := range cpnCollection.Coupons {
+		cpnIDs = append(cpnIDs, cpn.Id)
+	}
+
+	updCount, err := s.db.UpdateCoupons(actor, cpnCollection.Coupons)
+	if conflict, isConflict := err.(*dblayer.ConflictError); isConflict {
+		return &writeOutcome{conflict: conflict}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%d coupons updated", updCount)
+
+	coupons, err := s.db.FindByIds(cpnIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeOutcome{coupons: coupons}, nil
+}
+
+//deleteCoupons removes the coupons, a batch of deletes is always all-or-nothing.
+//The outcome carries the coupons as they were when deleted.
+func (s *CouponService) deleteCoupons(actor api.Actor, cpnCollection *api.CouponCollection) (*writeOutcome, error) {
+	validationSuccess, errors := s.validateManyForDelete(cpnCollection)
+	if !validationSuccess {
+		return &writeOutcome{errors: errors}, nil
+	}
+
+	if s.debug {
+		log.Println("Deleting coupons")
+	}
+
+	cpnIDs := []interface{}{}
+	for _, cpn := range cpnCollection.Coupons {
+		cpnIDs = append(cpnIDs, cpn.Id)
+	}
+
+	//read upfront, the delete succeeds only if the coupons are still at these versions
+	coupons, err := s.db.FindByIds(cpnIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	delCount, err := s.db.DeleteCoupons(actor, cpnCollection.Coupons)
+	if conflict, isConflict := err.(*dblayer.ConflictError); isConflict {
+		return &writeOutcome{conflict: conflict}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%d coupons deleted", delCount)
+
+	return &writeOutcome{coupons: coupons}, nil
+}
@@ -0,0 +1,343 @@
+package couponservice
+
+import (
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	IMPORT_PATH string = "/import/csv"
+
+	//at most this many invalid rows are listed in an import report, the counts cover all of them
+	importMaxReportedErrors = 1000
+)
+
+//CSVImportOptions controls how a csv file is read and written
+type CSVImportOptions struct {
+	Delimiter rune
+	//layouts (as for time.Parse) tried in turn on the date columns
+	DateFormats []string
+	//validate every row without writing anything
+	DryRun bool
+	//ImportId resumes an earlier import of the same file after its last written row, a new import gets a fresh id.
+	//Only the principal of the Actor that started an import can resume it.
+	ImportId  string
+	ChunkSize int
+	//Actor is who the imported coupons are recorded in the audit log as created by
+	Actor api.Actor
+}
+
+//SplitDateFormats reads a list of layouts separated by ; or |, commas cannot separate them as a layout may contain one (Jan 2, 2006)
+func SplitDateFormats(formats string) []string {
+	layouts := []string{}
+	for _, layout := range strings.FieldsFunc(formats, func(r rune) bool { return r == ';' || r == '|' }) {
+		if layout = strings.TrimSpace(layout); layout != "" {
+			layouts = append(layouts, layout)
+		}
+	}
+	return layouts
+}
+
+//csvColumns maps the header names to the coupon fields they set, the names are the json names of api.Coupon
+var csvColumns = map[string]func(cpn *api.Coupon, value string, opts *CSVImportOptions) error{
+	"name": func(cpn *api.Coupon, value string, opts *CSVImportOptions) error {
+		cpn.Name = value
+		return nil
+	},
+	"brand": func(cpn *api.Coupon, value string, opts *CSVImportOptions) error {
+		cpn.Brand = value
+		return nil
+	},
+	"value": func(cpn *api.Coupon, value string, opts *CSVImportOptions) error {
+		if value == "" {
+			return nil
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return api.NewErrorf(api.ERR_INVALID_FIELD_FORMAT, "value is not a number: %s", value)
+		}
+		cpn.Value = parsed
+		return nil
+	},
+	"expiry": func(cpn *api.Coupon, value string, opts *CSVImportOptions) error {
+		if value == "" {
+			return nil
+		}
+		for _, layout := range opts.DateFormats {
+			if parsed, err := time.Parse(layout, value); err == nil {
+				cpn.Expiry = parsed
+				return nil
+			}
+		}
+		return api.NewErrorf(api.ERR_INVALID_FIELD_FORMAT, "expiry is not a date in any of the formats %s: %s", strings.Join(opts.DateFormats, ", "), value)
+	},
+}
+
+//readCSVHeader maps every column of the file to a coupon field
+func readCSVHeader(header []string) ([]string, error) {
+	columns := []string{}
+	seen := map[string]bool{}
+	for i, name := range header {
+		column := strings.ToLower(strings.TrimSpace(name))
+		if i == 0 {
+			//spreadsheets tend to save a byte order mark in front of the first column
+			column = strings.TrimPrefix(column, "\ufeff")
+		}
+		if _, known := csvColumns[column]; !known {
+			return nil, api.NewErrorf(api.ERR_INVALID_CSV, "column %d (%s) is not a coupon field", i+1, name)
+		}
+		if seen[column] {
+			return nil, api.NewErrorf(api.ERR_INVALID_CSV, "column %s appears more than once", column)
+		}
+		seen[column] = true
+		columns = append(columns, column)
+	}
+
+	for column := range csvColumns {
+		if !seen[column] {
+			return nil, api.NewErrorf(api.ERR_INVALID_CSV, "column %s is missing", column)
+		}
+	}
+
+	return columns, nil
+}
+
+//couponFromCSV reads a row into a coupon, reporting every value that cannot be read
+func couponFromCSV(columns, record []string, opts *CSVImportOptions) (*api.Coupon, []api.Error) {
+	if len(record) != len(columns) {
+		return nil, []api.Error{api.NewErrorf(api.ERR_INVALID_CSV, "the row has %d values, the header %d columns", len(record), len(columns))}
+	}
+
+	cpn := &api.Coupon{}
+	errors := []api.Error{}
+	for i, column := range columns {
+		if err := csvColumns[column](cpn, strings.TrimSpace(record[i]), opts); err != nil {
+			apiErr := apiErrorFrom(err)
+			apiErr.Field = column
+			errors = append(errors, apiErr)
+		}
+	}
+
+	return cpn, errors
+}
+
+func addRowError(report *api.ImportReport, row int, errors []api.Error) {
+	report.Invalid++
+	if len(report.Errors) >= importMaxReportedErrors {
+		report.ErrorsTruncated = true
+		return
+	}
+	report.Errors = append(report.Errors, api.ImportRowError{Row: row, Errors: errors})
+}
+
+//startImport stores a new import of principal, or returns the row an earlier import of the same principal carries on after.
+//Only whoever started an import can resume it. Rows up to its high-water mark are skipped even if their coupons were deleted since.
+func (s *CouponService) startImport(importId, principal string) (int, error) {
+	record, started, err := s.db.StartImport(importId, principal)
+	if err != nil {
+		return 0, err
+	}
+	if started {
+		return 0, nil
+	}
+	if record.Principal != principal {
+		return 0, api.NewErrorf(api.ERR_FORBIDDEN, "import %s was started with another api key", importId)
+	}
+
+	//a chunk written when advancing the high-water mark failed is still found by its coupons
+	lastWritten, err := s.db.LastImportedRow(importId)
+	if err != nil {
+		return 0, err
+	}
+	if record.LastRow > lastWritten {
+		lastWritten = record.LastRow
+	}
+	if lastWritten > 0 {
+		log.Printf("resuming import %s after row %d", importId, lastWritten)
+	}
+	return lastWritten, nil
+}
+
+//ImportCSV validates every row of the file and writes the valid ones in chunks, each chunk all-or-nothing.
+//Invalid rows are reported and skipped. When writing fails midway the report so far is returned with the error,
+//sending the file again with the same import id carries on after the last written chunk.
+func (s *CouponService) ImportCSV(file io.Reader, opts CSVImportOptions) (*api.ImportReport, error) {
+	if opts.ChunkSize < 1 {
+		opts.ChunkSize = 1
+	}
+	if len(opts.DateFormats) == 0 {
+		opts.DateFormats = []string{time.RFC3339}
+	}
+
+	report := &api.ImportReport{DryRun: opts.DryRun}
+
+	lastWritten := 0
+	if !opts.DryRun {
+		if opts.ImportId == "" {
+			opts.ImportId = primitive.NewObjectID().Hex()
+		}
+		var err error
+		if lastWritten, err = s.startImport(opts.ImportId, opts.Actor.Principal); err != nil {
+			return nil, err
+		}
+		report.ImportId = opts.ImportId
+	}
+
+	reader := csv.NewReader(file)
+	reader.Comma = opts.Delimiter
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, api.NewError(api.ERR_INVALID_CSV, "the file is empty")
+	}
+	if err != nil {
+		return nil, requestBodyError(err, api.NewErrorf(api.ERR_INVALID_CSV, "failed to read the header: %s", err.Error()))
+	}
+	columns, err := readCSVHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := []api.Coupon{}
+	writeChunk := func() error {
+		if len(chunk) == 0 || opts.DryRun {
+			chunk = chunk[:0]
+			return nil
+		}
+		res, err := s.db.CreateCoupons(opts.Actor, chunk)
+		if err != nil {
+			return err
+		}
+		report.Imported += len(res.InsertedIDs)
+		lastRow := chunk[len(chunk)-1].Import.Row
+		chunk = chunk[:0]
+		return s.db.AdvanceImport(opts.ImportId, lastRow)
+	}
+
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		report.Rows++
+		if row <= lastWritten {
+			report.Skipped++
+			continue
+		}
+
+		if err != nil {
+			if _, isParseErr := err.(*csv.ParseError); !isParseErr {
+				return report, requestBodyError(err, api.NewErrorf(api.ERR_INVALID_CSV, "failed to read row %d: %s", row, err.Error()))
+			}
+			addRowError(report, row, []api.Error{api.NewErrorf(api.ERR_INVALID_CSV, "row %d is malformed: %s", row, err.Error())})
+			continue
+		}
+
+		cpn, errors := couponFromCSV(columns, record, &opts)
+		if len(errors) > 0 {
+			addRowError(report, row, errors)
+			continue
+		}
+
+		if valid, errors := validateOneForInsert(cpn); !valid {
+			addRowError(report, row, errors)
+			continue
+		}
+
+		report.Valid++
+		cpn.Import = &api.ImportRef{Id: opts.ImportId, Row: row}
+		chunk = append(chunk, *cpn)
+		if len(chunk) >= opts.ChunkSize {
+			if err := writeChunk(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := writeChunk(); err != nil {
+		return report, err
+	}
+
+	log.Printf("import %s: %d rows, %d imported, %d invalid, %d skipped", report.ImportId, report.Rows, report.Imported, report.Invalid, report.Skipped)
+	return report, nil
+}
+
+//importOptionsFromQuery reads the options of an import request, defaults come from the service config
+func (s *CouponService) importOptionsFromQuery(r *http.Request) (CSVImportOptions, error) {
+	query := r.URL.Query()
+	opts := CSVImportOptions{
+		Delimiter:   ',',
+		DateFormats: s.importDateFormats,
+		ImportId:    query.Get("importId"),
+		ChunkSize:   s.importChunkSize,
+		Actor:       actorFromHTTP(r),
+	}
+
+	if delimiter := query.Get("delimiter"); delimiter != "" {
+		if delimiter == "tab" {
+			delimiter = "\t"
+		}
+		if utf8.RuneCountInString(delimiter) != 1 {
+			return opts, api.NewErrorf(api.ERR_INVALID_REQUEST, "the delimiter must be a single character, got %s", delimiter)
+		}
+		opts.Delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	}
+
+	if formats, found := query["dateFormat"]; found {
+		opts.DateFormats = formats
+	}
+
+	if dryRun := query.Get("dryRun"); dryRun != "" {
+		parsed, err := strconv.ParseBool(dryRun)
+		if err != nil {
+			return opts, api.NewErrorf(api.ERR_INVALID_REQUEST, "dryRun must be true or false, got %s", dryRun)
+		}
+		opts.DryRun = parsed
+	}
+
+	return opts, nil
+}
+
+//handleImportCSV imports the csv file sent as the request body. The body being the file, the api key is sent in the X-API-Key header.
+func (s *CouponService) handleImportCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "files must be imported with POST"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	opts, err := s.importOptionsFromQuery(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	report, err := s.ImportCSV(r.Body, opts)
+	if err != nil {
+		//whatever was written so far is reported, so the import can be resumed
+		errs := []api.Error{apiErrorFrom(err)}
+		writeResponseWithStatus(w, httpStatusForErrors(errs), s.newResponse(report, errs...))
+		return
+	}
+
+	writeResponse(w, s.newResponse(report))
+}
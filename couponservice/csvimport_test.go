@@ -0,0 +1,256 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const importTestCSV = `name,brand,value,expiry
+Save £1 at Tesco,Tesco,1,2019-03-01
+Save £2 at Boots,Boots,2,2019-04-01T00:00:00Z
+Save £3 at Asda,,3,2019-05-01
+Save £4 at Lidl,Lidl,four,01/06/2019
+Save £5 at Aldi,Aldi,5,2019-07-01
+"Save £6, at Coop",Coop,6,2019-08-01
+`
+
+func importTestOptions() CSVImportOptions {
+	return CSVImportOptions{
+		Delimiter:   ',',
+		DateFormats: []string{"2006-01-02T15:04:05Z07:00", "2006-01-02"},
+		ChunkSize:   2,
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	report, err := s.ImportCSV(strings.NewReader(importTestCSV), importTestOptions())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if report.Rows != 6 || report.Valid != 4 || report.Invalid != 2 || report.Imported != 4 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.ImportId == "" {
+		t.Error("expected the import to get an id")
+	}
+	if len(mock.coupons) != 4 || mock.createCalls != 2 {
+		t.Errorf("expected 4 coupons written in 2 chunks, got %d in %d", len(mock.coupons), mock.createCalls)
+	}
+
+	if len(report.Errors) != 2 {
+		t.Errorf("unexpected row errors %+v", report.Errors)
+		return
+	}
+	if rowErr := report.Errors[0]; rowErr.Row != 4 || rowErr.Errors[0].Code != api.ERR_BRAND_REQUIRED {
+		t.Errorf("expected the missing brand to be reported on row 4, got %+v", rowErr)
+	}
+	codes := map[string]bool{}
+	for _, e := range report.Errors[1].Errors {
+		codes[e.Field+" "+e.Code] = true
+	}
+	if report.Errors[1].Row != 5 || !codes["value "+api.ERR_INVALID_FIELD_FORMAT] || !codes["expiry "+api.ERR_INVALID_FIELD_FORMAT] {
+		t.Errorf("expected the unreadable value and expiry to be reported on row 5, got %+v", report.Errors[1])
+	}
+}
+
+func TestImportCSVDryRun(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	opts := importTestOptions()
+	opts.DryRun = true
+	report, err := s.ImportCSV(strings.NewReader(importTestCSV), opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if report.Valid != 4 || report.Invalid != 2 || report.Imported != 0 || report.ImportId != "" {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if mock.createCalls != 0 {
+		t.Errorf("expected nothing to be written, got %d calls", mock.createCalls)
+	}
+}
+
+func TestImportCSVResume(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	mock.failCreateCall = 2
+	s.db = mock
+
+	report, err := s.ImportCSV(strings.NewReader(importTestCSV), importTestOptions())
+	if err == nil {
+		t.Error("expected the second chunk to fail")
+		return
+	}
+	if report == nil || report.Imported != 2 || report.ImportId == "" {
+		t.Errorf("expected the report of the first chunk, got %+v", report)
+		return
+	}
+
+	//the coupons of the first chunk are deleted before the import is resumed, they must not come back
+	for id := range mock.coupons {
+		delete(mock.coupons, id)
+	}
+
+	opts := importTestOptions()
+	opts.ImportId = report.ImportId
+	resumed, err := s.ImportCSV(strings.NewReader(importTestCSV), opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//the first chunk ends on row 3
+	if resumed.Skipped != 2 || resumed.Imported != 2 || resumed.Invalid != 2 {
+		t.Errorf("unexpected report of the resumed import %+v", resumed)
+	}
+	if len(mock.coupons) != 2 {
+		t.Errorf("expected only the coupons after the first chunk to be written, got %d", len(mock.coupons))
+	}
+}
+
+func TestImportCSVResumeOwner(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	mock.failCreateCall = 2
+	s.db = mock
+
+	opts := importTestOptions()
+	opts.Actor = api.Actor{Principal: "key:owner"}
+	report, err := s.ImportCSV(strings.NewReader(importTestCSV), opts)
+	if err == nil || report == nil {
+		t.Errorf("expected the second chunk to fail, got %+v", report)
+		return
+	}
+
+	opts.ImportId = report.ImportId
+	opts.Actor = api.Actor{Principal: "key:other"}
+	_, err = s.ImportCSV(strings.NewReader(importTestCSV), opts)
+	if apiErr := apiErrorFrom(err); err == nil || apiErr.Code != api.ERR_FORBIDDEN {
+		t.Errorf("expected %s for an import started with another api key, got %v", api.ERR_FORBIDDEN, err)
+	}
+	if len(mock.coupons) != 2 {
+		t.Errorf("expected nothing to be written for another api key, got %d coupons", len(mock.coupons))
+	}
+}
+
+func TestImportCSVHeader(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	testCases := []struct {
+		name string
+		csv  string
+	}{
+		{"empty", ""},
+		{"missing column", "name,brand,value\nSave £1 at Tesco,Tesco,1\n"},
+		{"unknown column", "name,brand,value,expiry,id\n"},
+		{"repeated column", "name,brand,value,expiry,name\n"},
+	}
+
+	for _, tc := range testCases {
+		_, err := s.ImportCSV(strings.NewReader(tc.csv), importTestOptions())
+		if apiErr := apiErrorFrom(err); err == nil || apiErr.Code != api.ERR_INVALID_CSV {
+			t.Errorf("%s: expected %s, got %v", tc.name, api.ERR_INVALID_CSV, err)
+		}
+	}
+}
+
+func TestHandleImportCSV(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+	s.importChunkSize = 100
+	s.importDateFormats = []string{"2006-01-02"}
+
+	testCases := []struct {
+		name     string
+		method   string
+		apiKey   string
+		query    string
+		body     string
+		status   int
+		imported int
+	}{
+		{"imports", http.MethodPost, "Valid API Key", "", "name,brand,value,expiry\nSave £1 at Tesco,Tesco,1,2019-03-01\n", http.StatusOK, 1},
+		{"delimiter", http.MethodPost, "Valid API Key", "?delimiter=tab", "name\tbrand\tvalue\texpiry\nSave £1 at Tesco\tTesco\t1\t2019-03-01\n", http.StatusOK, 1},
+		{"dry run", http.MethodPost, "Valid API Key", "?dryRun=true", "name,brand,value,expiry\nSave £1 at Tesco,Tesco,1,2019-03-01\n", http.StatusOK, 0},
+		{"date format", http.MethodPost, "Valid API Key", "?dateFormat=02/01/2006", "name,brand,value,expiry\nSave £1 at Tesco,Tesco,1,01/03/2019\n", http.StatusOK, 1},
+		{"bad header", http.MethodPost, "Valid API Key", "", "coupon\n", http.StatusBadRequest, 0},
+		{"bad delimiter", http.MethodPost, "Valid API Key", "?delimiter=;;", "", http.StatusBadRequest, 0},
+		{"no api key", http.MethodPost, "", "", "", http.StatusUnauthorized, 0},
+		{"get", http.MethodGet, "Valid API Key", "", "", http.StatusMethodNotAllowed, 0},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, IMPORT_PATH+tc.query, strings.NewReader(tc.body))
+		r.Header.Set(API_KEY_HEADER, tc.apiKey)
+		w := httptest.NewRecorder()
+		s.handleImportCSV(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		resp := &struct {
+			Result api.ImportReport `json:"result"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+			continue
+		}
+		if resp.Result.Imported != tc.imported || resp.Result.Invalid != 0 {
+			t.Errorf("%s: unexpected report %+v", tc.name, resp.Result)
+		}
+	}
+}
+
+func TestSplitDateFormats(t *testing.T) {
+	layouts := SplitDateFormats("Jan 2, 2006; 2006-01-02 | 02/01/2006;")
+	expected := []string{"Jan 2, 2006", "2006-01-02", "02/01/2006"}
+	if strings.Join(layouts, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the layouts %q, but got %q", expected, layouts)
+	}
+}
@@ -0,0 +1,169 @@
+package couponservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/couponspb"
+)
+
+//Encodings of the coupon api, besides json the api takes and answers compact binary payloads for clients on slow links.
+//MessagePack carries the same fields as the json, protobuf the couponspb.Request and couponspb.Response messages.
+const (
+	ENCODING_JSON     string = "application/json"
+	ENCODING_MSGPACK  string = "application/msgpack"
+	ENCODING_PROTOBUF string = "application/x-protobuf"
+)
+
+//encodingByMediaType maps the media types clients use for the encodings, including the common unofficial ones
+var encodingByMediaType = map[string]string{
+	ENCODING_JSON:                     ENCODING_JSON,
+	ENCODING_MSGPACK:                  ENCODING_MSGPACK,
+	"application/x-msgpack":           ENCODING_MSGPACK,
+	"application/vnd.msgpack":         ENCODING_MSGPACK,
+	ENCODING_PROTOBUF:                 ENCODING_PROTOBUF,
+	"application/protobuf":            ENCODING_PROTOBUF,
+	"application/vnd.google.protobuf": ENCODING_PROTOBUF,
+}
+
+func init() {
+	//ids are sent as their hex string, as in the json
+	msgpack.Register(primitive.ObjectID{}, func(enc *msgpack.Encoder, v reflect.Value) error {
+		return enc.EncodeString(v.Interface().(primitive.ObjectID).Hex())
+	}, nil)
+}
+
+//requestEncoding is the encoding of the request body, anything that is not a known binary encoding is read as json
+//as it always was (e.g. curl sends form data content types by default)
+func requestEncoding(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ENCODING_JSON
+	}
+	if encoding, found := encodingByMediaType[mediaType]; found {
+		return encoding
+	}
+	return ENCODING_JSON
+}
+
+//responseEncoding picks the encoding of the response from the Accept header, the most preferred (by q-value)
+//of the encodings the client takes. Json is the default, also when the client accepts nothing the service produces,
+//as the api answered json whatever was asked before. The v2 coupons have no protobuf messages.
+func responseEncoding(r *http.Request, version int) (string, error) {
+	best, bestQ := ENCODING_JSON, 0.0
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qValue, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(qValue, 64); err != nil {
+				continue
+			}
+		}
+
+		encoding, found := encodingByMediaType[mediaType]
+		if !found && (mediaType == "*/*" || mediaType == "application/*") {
+			encoding, found = ENCODING_JSON, true
+		}
+		if found && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	if best == ENCODING_PROTOBUF && version == API_VERSION_2 {
+		return "", api.NewErrorf(api.ERR_NOT_ACCEPTABLE, "the v2 api is not available as %s, use the v1 api or %s", ENCODING_PROTOBUF, ENCODING_MSGPACK)
+	}
+	return best, nil
+}
+
+func parseMsgpackRequest(body []byte) (*api.Request, error) {
+	//the payload is read generically and handed on as json, so the handlers parse the data of every encoding the same way
+	var payload interface{}
+	if err := msgpack.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	asJson, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	baseRequest := &api.Request{}
+	if err := json.Unmarshal(asJson, baseRequest); err != nil {
+		return nil, err
+	}
+	return baseRequest, nil
+}
+
+func parseProtobufRequest(body []byte) (*api.Request, error) {
+	req := &couponspb.Request{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	return couponspb.RequestToInternal(req)
+}
+
+//parseEncodedRequest reads a request sent in one of the binary encodings
+func parseEncodedRequest(r *http.Request, encoding string) (*api.Request, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, requestBodyError(err, api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to read request: %s", err.Error()))
+	}
+
+	var baseRequest *api.Request
+	if encoding == ENCODING_PROTOBUF {
+		baseRequest, err = parseProtobufRequest(body)
+	} else {
+		baseRequest, err = parseMsgpackRequest(body)
+	}
+	if err != nil {
+		if apiErr, isApiErr := err.(api.Error); isApiErr {
+			return nil, apiErr
+		}
+		return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse %s request: %s", encoding, err.Error())
+	}
+
+	return baseRequest, nil
+}
+
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	//the fields are named and left out as in the json
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//encodeResponse encodes the response in the encoding its Content-Type was negotiated to, json unless set otherwise
+func encodeResponse(contentType string, respObj *api.Response) ([]byte, error) {
+	switch contentType {
+	case ENCODING_MSGPACK:
+		return marshalMsgpack(respObj)
+	case ENCODING_PROTOBUF:
+		converted, err := couponspb.ResponseFromInternal(respObj)
+		if err != nil {
+			return nil, api.NewErrorf(api.ERR_NOT_ACCEPTABLE, "the response cannot be sent as %s: %s", ENCODING_PROTOBUF, err.Error())
+		}
+		return proto.Marshal(converted)
+	default:
+		return json.Marshal(respObj)
+	}
+}
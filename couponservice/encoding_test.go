@@ -0,0 +1,291 @@
+package couponservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/couponspb"
+	"github.com/akh-dev/coupons-service/util"
+)
+
+func TestResponseEncoding(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		version  int
+		expected string
+		code     string
+	}{
+		{"", API_VERSION_1, ENCODING_JSON, ""},
+		{"*/*", API_VERSION_1, ENCODING_JSON, ""},
+		{"text/html", API_VERSION_1, ENCODING_JSON, ""},
+		{"application/x-msgpack", API_VERSION_1, ENCODING_MSGPACK, ""},
+		{"application/json;q=0.5, application/msgpack", API_VERSION_1, ENCODING_MSGPACK, ""},
+		{"application/x-protobuf;q=0.2, application/json;q=0.8", API_VERSION_1, ENCODING_JSON, ""},
+		{"application/protobuf", API_VERSION_1, ENCODING_PROTOBUF, ""},
+		{"application/x-protobuf", API_VERSION_2, "", api.ERR_NOT_ACCEPTABLE},
+		{"application/x-protobuf, application/msgpack;q=0.9", API_VERSION_2, "", api.ERR_NOT_ACCEPTABLE},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tc.accept)
+
+		encoding, err := responseEncoding(r, tc.version)
+		if tc.code != "" {
+			if apiErrorFrom(err).Code != tc.code {
+				t.Errorf("%s (v%d): expected %s, got %v", tc.accept, tc.version, tc.code, err)
+			}
+			continue
+		}
+		if err != nil || encoding != tc.expected {
+			t.Errorf("%s (v%d): expected %s, got %s %v", tc.accept, tc.version, tc.expected, encoding, err)
+		}
+	}
+}
+
+func TestMsgpackRequestAndResponse(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	body, err := msgpack.Marshal(map[string]interface{}{
+		"apiKey": "Valid API Key",
+		"data": map[string]interface{}{
+			"atomic": true,
+			"coupons": []interface{}{
+				map[string]interface{}{"name": "Save £1 at Tesco", "brand": "Tesco", "value": 1, "expiry": time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)},
+			},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", ENCODING_MSGPACK)
+	r.Header.Set("Accept", ENCODING_MSGPACK)
+	w := httptest.NewRecorder()
+	s.handleCouponsRequest(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ENCODING_MSGPACK {
+		t.Errorf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+		return
+	}
+
+	resp := struct {
+		Result []struct {
+			Id     string    `msgpack:"id"`
+			Name   string    `msgpack:"name"`
+			Value  float64   `msgpack:"value"`
+			Expiry time.Time `msgpack:"expiry"`
+		} `msgpack:"result"`
+		WriteMode string `msgpack:"writeMode"`
+	}{}
+	if err := msgpack.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(resp.Result) != 1 || resp.Result[0].Id == "" || resp.Result[0].Name != "Save £1 at Tesco" || resp.Result[0].Value != 1 {
+		t.Errorf("unexpected result %+v", resp.Result)
+	}
+	if !resp.Result[0].Expiry.Equal(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)) || resp.WriteMode == "" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func doProtobuf(s *CouponService, method, path string, req *couponspb.Request) (*httptest.ResponseRecorder, *couponspb.Response, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", ENCODING_PROTOBUF)
+	r.Header.Set("Accept", ENCODING_PROTOBUF)
+	w := httptest.NewRecorder()
+	s.handleCouponsRequest(w, r)
+
+	resp := &couponspb.Response{}
+	if w.Header().Get("Content-Type") == ENCODING_PROTOBUF {
+		err = proto.Unmarshal(w.Body.Bytes(), resp)
+	}
+	return w, resp, err
+}
+
+func TestProtobufRequestAndResponse(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	req := &couponspb.Request{
+		ApiKey: "Valid API Key",
+		Data: &couponspb.Request_Coupons{Coupons: &couponspb.CouponBatch{
+			Atomic: proto.Bool(false),
+			Coupons: []*couponspb.Coupon{
+				{Name: "Save £1 at Tesco", Brand: "Tesco", Value: 1, Expiry: timestamppb.New(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))},
+				{Name: "Save £2 at Boots", Value: 2, Expiry: timestamppb.New(time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC))},
+			},
+		}},
+	}
+
+	w, resp, err := doProtobuf(s, http.MethodPost, "/v1/", req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected http status %d", w.Code)
+		return
+	}
+
+	batch := resp.GetBatch()
+	if batch.GetSummary().GetSucceeded() != 1 || batch.GetSummary().GetFailed() != 1 {
+		t.Errorf("unexpected batch %+v", batch)
+		return
+	}
+	if batch.GetItems()[0].GetCoupon().GetId() == "" {
+		t.Errorf("expected the first coupon to be created, got %+v", batch.GetItems()[0])
+	}
+	if errs := batch.GetItems()[1].GetErrors(); len(errs) != 1 || errs[0].GetCode() != api.ERR_BRAND_REQUIRED {
+		t.Errorf("unexpected errors of the second coupon %+v", errs)
+	}
+
+	//errors are reported in the envelope too
+	w, resp, err = doProtobuf(s, http.MethodPost, "/v1/", &couponspb.Request{ApiKey: "some invalid key"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.Code != http.StatusForbidden || len(resp.GetErrors()) != 1 || resp.GetErrors()[0].GetCode() != api.ERR_FORBIDDEN {
+		t.Errorf("unexpected response %d %+v", w.Code, resp.GetErrors())
+	}
+}
+
+func TestProtobufV2(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	w, _, err := doProtobuf(s, http.MethodGet, "/v2/", &couponspb.Request{ApiKey: "Valid API Key"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected http status %d, got %d", http.StatusNotAcceptable, w.Code)
+	}
+
+	body, _ := proto.Marshal(&couponspb.Request{ApiKey: "Valid API Key"})
+	r := httptest.NewRequest(http.MethodGet, "/v2/", bytes.NewBuffer(body))
+	r.Header.Set("Content-Type", ENCODING_PROTOBUF)
+	w = httptest.NewRecorder()
+	s.handleCouponsRequest(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected http status %d, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+}
+
+func TestCompressedRequestErrors(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	body := &bytes.Buffer{}
+	gz := gzip.NewWriter(body)
+	gz.Write([]byte(`{"apiKey":"Valid API Key","data":{"coupons":[`))
+	for i := 0; i < 1000; i++ {
+		gz.Write([]byte(`{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"},`))
+	}
+	gz.Write([]byte(`{}]}}`))
+	gz.Close()
+
+	//the body is cut off while it is parsed
+	r := httptest.NewRequest(http.MethodPost, "/v1/", body)
+	r.Header.Set("Content-Encoding", "gzip")
+	if err := util.DecompressRequest(r, 10<<10); err != nil {
+		t.Error(err)
+		return
+	}
+	w := httptest.NewRecorder()
+	s.handleCouponsRequest(w, r)
+
+	resp := &api.Response{}
+	json.NewDecoder(w.Body).Decode(resp)
+	if w.Code != http.StatusRequestEntityTooLarge || len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_REQUEST_TOO_LARGE {
+		t.Errorf("expected %s, got %d %+v", api.ERR_REQUEST_TOO_LARGE, w.Code, resp.Errors)
+	}
+
+	//bodies that cannot be decoded are rejected before they reach the handlers
+	testCases := []struct {
+		contentEncoding string
+		status          int
+		code            string
+	}{
+		{"deflate", http.StatusUnsupportedMediaType, api.ERR_UNSUPPORTED_MEDIA_TYPE},
+		{"gzip", http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodPost, "/v1/", bytes.NewBufferString(`{"apiKey":"Valid API Key"}`))
+		r.Header.Set("Content-Encoding", tc.contentEncoding)
+		w := httptest.NewRecorder()
+		(&util.CompressHandler{RequestError: s.respondWithRequestBodyError}).ServeHTTP(w, r)
+
+		resp := &api.Response{}
+		json.NewDecoder(w.Body).Decode(resp)
+		if w.Code != tc.status || len(resp.Errors) != 1 || resp.Errors[0].Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %+v", tc.contentEncoding, tc.status, tc.code, w.Code, resp.Errors)
+		}
+	}
+}
+
+func TestWriteResponseEncodingFailure(t *testing.T) {
+	testCases := []struct {
+		name           string
+		contentType    string
+		result         interface{}
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"not in protobuf", ENCODING_PROTOBUF, map[string]int{"coupons": 1}, http.StatusNotAcceptable, api.ERR_NOT_ACCEPTABLE},
+		{"not in json", ENCODING_JSON, func() {}, http.StatusInternalServerError, api.ERR_INTERNAL},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", tc.contentType)
+		writeResponse(w, &api.Response{Result: tc.result})
+
+		//the failure is reported in json rather than as an empty success
+		resp := &api.Response{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+			continue
+		}
+		if w.Code != tc.expectedStatus || w.Header().Get("Content-Type") != ENCODING_JSON || len(resp.Errors) != 1 || resp.Errors[0].Code != tc.expectedCode {
+			t.Errorf("%s: expected %s (%d) in json, but got %d %s %s", tc.name, tc.expectedCode, tc.expectedStatus, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package couponservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+const (
+	EVENTS_PATH string = "/events"
+
+	EVENT_STREAM_FORMAT string = "text/event-stream"
+
+	//sent to a stream resumed from an event that is no longer kept, the client has to reload its coupons
+	EVENT_RESET string = "reset"
+
+	//events are read from the db this many at a time
+	eventsBatchSize = 500
+	//a stream with nothing to send writes a comment this often, so proxies do not take it for a dead connection
+	eventsHeartbeat = 15 * time.Second
+	//clients reconnect after this many milliseconds
+	eventsRetryMillis = 3000
+)
+
+//eventMatcher picks the events of the coupons a stream is filtered to. Events carry the id and the brand of the coupon,
+//so the idIn and brandEqual criteria are the only ones of a filter that apply to them.
+type eventMatcher struct {
+	ids   map[primitive.ObjectID]bool
+	brand string
+}
+
+func newEventMatcher(filter *api.CouponFilter) (*eventMatcher, error) {
+	valueFrom, valueTo := filter.ValueRange()
+	if filter.NameContains != "" || valueFrom != nil || valueTo != nil ||
+		!filter.ExpiryFrom.IsZero() || !filter.ExpiryTo.IsZero() || !filter.CreatedAtFrom.IsZero() || !filter.CreatedAtTo.IsZero() {
+		return nil, api.NewError(api.ERR_INVALID_FILTER, "events can only be filtered by idIn and brandEqual")
+	}
+
+	matcher := &eventMatcher{brand: filter.BrandEqual}
+	if len(filter.IdIn) > 0 {
+		matcher.ids = map[primitive.ObjectID]bool{}
+		for i, hex := range filter.IdIn {
+			id, err := primitive.ObjectIDFromHex(hex)
+			if err != nil {
+				filterErr := api.NewErrorf(api.ERR_INVALID_FILTER, "%s is not a valid coupon id", hex)
+				filterErr.Field = fmt.Sprintf("idIn[%d]", i)
+				return nil, filterErr
+			}
+			matcher.ids[id] = true
+		}
+	}
+	return matcher, nil
+}
+
+//matches takes a coupon moved to another brand as a change of both brands, so a client following the old one sees it leave
+func (m *eventMatcher) matches(event api.CouponEvent) bool {
+	if m.ids != nil && !m.ids[event.CouponId] {
+		return false
+	}
+	if m.brand != "" && event.Brand != m.brand && event.PreviousBrand != m.brand {
+		return false
+	}
+	return true
+}
+
+//eventCursor reads the events in sequence order. A sequence number is taken before the write it belongs to is committed,
+//so it can become visible after a higher one, or never when the write fails. The cursor only moves past the numbers
+//the db layer reports as settled, a write that is still pending is waited for however long it takes (see EventsAfter).
+type eventCursor struct {
+	db   dblayer.Interface
+	last int64
+	//more is set when next stopped at the batch size rather than at the end of the log or at a pending write
+	more bool
+}
+
+//next returns the events following the last one that can be delivered now
+func (c *eventCursor) next(ctx context.Context) ([]api.CouponEvent, error) {
+	events, settled, err := c.db.EventsAfter(ctx, c.last, eventsBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c.more = settled-c.last >= eventsBatchSize
+	c.last = settled
+	return events, nil
+}
+
+//lastEventId is where a stream resumes: the Last-Event-ID header a reconnecting EventSource sends,
+//or the lastEventId parameter. A stream without one starts with the events to come.
+func lastEventId(r *http.Request) (int64, bool, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("lastEventId")
+	}
+	if raw == "" {
+		return 0, false, nil
+	}
+
+	seq, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false, api.NewErrorf(api.ERR_INVALID_REQUEST, "%s is not a valid event id", raw)
+	}
+	return seq, true, nil
+}
+
+func writeEvent(w io.Writer, id int64, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, eventType, payload)
+	return err
+}
+
+//handleEvents streams the changes of the coupons as server-sent events, read from the events the db layer stores
+//with every write. The api key is sent in the X-API-Key header. The stream runs until the client goes away,
+//a client reconnecting with the id of the last event it got does not miss any change kept by the db.
+func (s *CouponService) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "events are streamed with GET"))
+		return
+	}
+
+	matcher, last, resumed, err := s.eventsRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithError(w, err)
+		return
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithErrors(w, api.NewError(api.ERR_INTERNAL, "the connection does not support streaming"))
+		return
+	}
+
+	oldest, newest, err := s.db.EventBounds()
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", EVENT_STREAM_FORMAT)
+	w.Header().Set("Cache-Control", "no-cache")
+	//keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetryMillis)
+
+	if !resumed {
+		last = newest
+	} else if oldest > last+1 {
+		//the events following the last one the client got were removed, it cannot catch up from the stream alone
+		last = oldest - 1
+		if err := writeEvent(w, last, EVENT_RESET, map[string]int64{"oldestSeq": oldest}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	pollInterval := s.eventsPollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	cursor := &eventCursor{db: s.db, last: last}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		events, err := cursor.next(r.Context())
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			//the client reconnects and resumes from the last event it got
+			log.Printf("event stream stopped: %s", err.Error())
+			return
+		}
+
+		written := 0
+		for _, event := range events {
+			if !matcher.matches(event) {
+				continue
+			}
+			if err := writeEvent(w, event.Seq, event.Type, event); err != nil {
+				return
+			}
+			written++
+		}
+
+		if written == 0 && time.Since(lastWrite) >= eventsHeartbeat {
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			written++
+		}
+		if written > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		//a full batch means more events are waiting
+		if cursor.more {
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *CouponService) eventsRequest(r *http.Request) (*eventMatcher, int64, bool, error) {
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		return nil, 0, false, err
+	}
+
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	matcher, err := newEventMatcher(filter)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	last, resumed, err := lastEventId(r)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return matcher, last, resumed, nil
+}
+
+//watchExpiries records the coupons that expired, every expiryCheckInterval until the service stops
+func (s *CouponService) watchExpiries() {
+	ticker := time.NewTicker(s.expiryCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expired, err := s.db.ExpireCoupons(now)
+		if err != nil {
+			log.Printf("failed to check for expired coupons: %s", err.Error())
+			continue
+		}
+		if expired > 0 {
+			log.Printf("%d coupons expired", expired)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package couponservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+type sseEvent struct {
+	id        string
+	eventType string
+	data      string
+}
+
+func parseSSE(body string) []sseEvent {
+	events := []sseEvent{}
+	for _, block := range strings.Split(body, "\n\n") {
+		event := sseEvent{}
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if event.eventType != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+//streamEvents runs the stream for a moment and returns what it wrote
+func streamEvents(s *CouponService, query, lastEventId string) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r := httptest.NewRequest(http.MethodGet, EVENTS_PATH+query, nil).WithContext(ctx)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	if lastEventId != "" {
+		r.Header.Set("Last-Event-ID", lastEventId)
+	}
+	w := httptest.NewRecorder()
+	s.handleEvents(w, r)
+	return w
+}
+
+func newEventsMock() *DbMock {
+	mock := newDbMock()
+	at := time.Now().Add(-time.Hour)
+	mock.events = []api.CouponEvent{
+		{Seq: 1, Type: api.EVENT_CREATED, CouponId: primitive.NewObjectID(), Brand: "Tesco", Version: 1, At: at},
+		{Seq: 2, Type: api.EVENT_CREATED, CouponId: primitive.NewObjectID(), Brand: "Boots", Version: 1, At: at},
+		{Seq: 3, Type: api.EVENT_UPDATED, CouponId: primitive.NewObjectID(), Brand: "Tesco", ChangedFields: []string{"value"}, Version: 2, At: at},
+		{Seq: 4, Type: api.EVENT_UPDATED, CouponId: primitive.NewObjectID(), Brand: "Tesco", PreviousBrand: "Boots", ChangedFields: []string{"brand"}, Version: 2, At: at},
+	}
+	return mock
+}
+
+func TestHandleEvents(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.eventsPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		query       string
+		lastEventId string
+		expectedIds []string
+	}{
+		{"resumed", "", "1", []string{"2", "3", "4"}},
+		{"resumed by parameter", "?lastEventId=3", "", []string{"4"}},
+		{"filtered by brand", "?filter=" + url.QueryEscape(`{"brandEqual":"Boots"}`), "0", []string{"2", "4"}},
+		{"from now on", "", "", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.db = newEventsMock()
+
+			w := streamEvents(s, test.query, test.lastEventId)
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EVENT_STREAM_FORMAT {
+				t.Errorf("unexpected response %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+				return
+			}
+
+			ids := []string{}
+			for _, event := range parseSSE(w.Body.String()) {
+				ids = append(ids, event.id)
+			}
+			if strings.Join(ids, ",") != strings.Join(test.expectedIds, ",") {
+				t.Errorf("expected the events %v, but got %v", test.expectedIds, ids)
+			}
+		})
+	}
+}
+
+func TestHandleEventsReset(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.eventsPollInterval = 10 * time.Millisecond
+
+	mock := newEventsMock()
+	mock.events = mock.events[2:]
+	s.db = mock
+
+	//events 2 and 3 are gone, the client missed a change it cannot catch up with
+	events := parseSSE(streamEvents(s, "", "1").Body.String())
+	if len(events) != 3 || events[0].eventType != EVENT_RESET || events[0].id != "2" {
+		t.Errorf("expected a reset followed by the kept events, but got %+v", events)
+		return
+	}
+	if events[1].id != "3" || events[1].eventType != api.EVENT_UPDATED || !strings.Contains(events[1].data, `"changedFields":["value"]`) {
+		t.Errorf("unexpected event %+v", events[1])
+	}
+}
+
+func TestHandleEventsErrors(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newEventsMock()
+
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		apiKey         string
+		lastEventId    string
+		expectedStatus int
+	}{
+		{"no api key", http.MethodGet, "", "", "", http.StatusUnauthorized},
+		{"not a get", http.MethodPost, "", "Valid API Key", "", http.StatusMethodNotAllowed},
+		{"unsupported filter", http.MethodGet, "?filter=" + url.QueryEscape(`{"nameContains":"Tesco"}`), "Valid API Key", "", http.StatusBadRequest},
+		{"invalid id filter", http.MethodGet, "?filter=" + url.QueryEscape(`{"idIn":["nope"]}`), "Valid API Key", "", http.StatusBadRequest},
+		{"invalid event id", http.MethodGet, "", "Valid API Key", "last", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, EVENTS_PATH+test.query, nil)
+			if test.apiKey != "" {
+				r.Header.Set(API_KEY_HEADER, test.apiKey)
+			}
+			if test.lastEventId != "" {
+				r.Header.Set("Last-Event-ID", test.lastEventId)
+			}
+			w := httptest.NewRecorder()
+			s.handleEvents(w, r)
+
+			if w.Code != test.expectedStatus {
+				t.Errorf("expected http status %d, but got %d: %s", test.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestEventCursorWaitsForPendingWrites(t *testing.T) {
+	mock := newDbMock()
+	mock.events = []api.CouponEvent{
+		{Seq: 1, At: time.Now()},
+		{Seq: 2, At: time.Now()},
+		{Seq: 4, At: time.Now()},
+	}
+	cursor := &eventCursor{db: mock}
+
+	//3 may still be committed, however old 4 is
+	mock.events[2].At = time.Now().Add(-time.Hour)
+	events, err := cursor.next(context.Background())
+	if err != nil || len(events) != 2 || cursor.last != 2 {
+		t.Errorf("expected the events up to the pending one, but got %+v (%v)", events, err)
+		return
+	}
+	if events, err = cursor.next(context.Background()); err != nil || len(events) != 0 || cursor.last != 2 {
+		t.Errorf("expected to wait for the pending event, but got %+v (%v)", events, err)
+		return
+	}
+
+	//the write that took 3 was committed
+	mock.events = append(mock.events[:2], api.CouponEvent{Seq: 3, At: time.Now()}, mock.events[2])
+	events, err = cursor.next(context.Background())
+	if err != nil || len(events) != 2 || events[0].Seq != 3 || cursor.last != 4 {
+		t.Errorf("expected the pending event and the one after it, but got %+v (%v)", events, err)
+	}
+}
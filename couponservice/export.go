@@ -0,0 +1,321 @@
+package couponservice
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	EXPORT_PATH string = "/export"
+
+	EXPORT_FORMAT_CSV    string = "text/csv"
+	EXPORT_FORMAT_NDJSON string = "application/x-ndjson"
+
+	//the response is flushed every this many coupons, so the client gets the export as it is read from the db
+	exportFlushEvery = 500
+)
+
+//exportColumn is a column of an export, named as the json field of api.Coupon it holds
+type exportColumn struct {
+	name string
+	//text renders the value in a csv cell
+	text func(cpn api.Coupon) string
+	//value is the value written to a json line
+	value func(cpn api.Coupon) interface{}
+}
+
+func timeText(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+//exportColumns lists every column in the order a full export writes them
+var exportColumns = []exportColumn{
+	{
+		name:  "id",
+		text:  func(cpn api.Coupon) string { return cpn.Id.Hex() },
+		value: func(cpn api.Coupon) interface{} { return cpn.Id },
+	},
+	{
+		name:  "name",
+		text:  func(cpn api.Coupon) string { return cpn.Name },
+		value: func(cpn api.Coupon) interface{} { return cpn.Name },
+	},
+	{
+		name:  "brand",
+		text:  func(cpn api.Coupon) string { return cpn.Brand },
+		value: func(cpn api.Coupon) interface{} { return cpn.Brand },
+	},
+	{
+		name:  "value",
+		text:  func(cpn api.Coupon) string { return strconv.FormatFloat(cpn.Value, 'f', -1, 64) },
+		value: func(cpn api.Coupon) interface{} { return cpn.Value },
+	},
+	{
+		name:  "expiry",
+		text:  func(cpn api.Coupon) string { return timeText(cpn.Expiry) },
+		value: func(cpn api.Coupon) interface{} { return cpn.Expiry },
+	},
+	{
+		name:  "createdAt",
+		text:  func(cpn api.Coupon) string { return timeText(cpn.CreatedAt) },
+		value: func(cpn api.Coupon) interface{} { return cpn.CreatedAt },
+	},
+	{
+		name:  "version",
+		text:  func(cpn api.Coupon) string { return strconv.FormatInt(cpn.Version, 10) },
+		value: func(cpn api.Coupon) interface{} { return cpn.Version },
+	},
+}
+
+//exportColumnsFromQuery picks the columns listed in the comma separated columns parameter, every column when there is none
+func exportColumnsFromQuery(r *http.Request) ([]exportColumn, error) {
+	names := r.URL.Query().Get("columns")
+	if names == "" {
+		return exportColumns, nil
+	}
+
+	byName := map[string]exportColumn{}
+	for _, column := range exportColumns {
+		byName[column.name] = column
+	}
+
+	columns := []exportColumn{}
+	for _, name := range strings.Split(names, ",") {
+		column, found := byName[strings.TrimSpace(name)]
+		if !found {
+			return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "unknown export column: %s", name)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+//filterFromQuery reads the filter from the filter parameter, a json api.CouponFilter as searches take it.
+//Without one every coupon matches.
+func filterFromQuery(r *http.Request) (*api.CouponFilter, error) {
+	filter := &api.CouponFilter{}
+	if raw := r.URL.Query().Get("filter"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), filter); err != nil {
+			return nil, api.NewErrorf(api.ERR_INVALID_FILTER, "failed to parse the filter: %s", err.Error())
+		}
+	}
+	return filter, nil
+}
+
+//exportFormat picks the first format of the Accept header that can be produced, csv when the client takes anything
+func exportFormat(r *http.Request) (string, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return EXPORT_FORMAT_CSV, nil
+	}
+
+	//the most preferred (by q-value) of the formats the client takes, q=0 rules a format out
+	best, bestQ := "", 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qValue, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(qValue, 64); err != nil {
+				continue
+			}
+		}
+
+		format := ""
+		switch mediaType {
+		case EXPORT_FORMAT_CSV, "text/*", "*/*":
+			format = EXPORT_FORMAT_CSV
+		case EXPORT_FORMAT_NDJSON, "application/ndjson", "application/jsonl":
+			format = EXPORT_FORMAT_NDJSON
+		}
+		if format != "" && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+
+	return "", api.NewErrorf(api.ERR_NOT_ACCEPTABLE, "exports are produced as %s or %s, not %s", EXPORT_FORMAT_CSV, EXPORT_FORMAT_NDJSON, accept)
+}
+
+//exportWriter writes the coupons of an export in one format
+type exportWriter interface {
+	begin() error
+	write(cpn api.Coupon) error
+	//flush pushes what is buffered to the response
+	flush() error
+}
+
+type csvExportWriter struct {
+	w       *csv.Writer
+	columns []exportColumn
+	record  []string
+}
+
+func (e *csvExportWriter) begin() error {
+	for i, column := range e.columns {
+		e.record[i] = column.name
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExportWriter) write(cpn api.Coupon) error {
+	for i, column := range e.columns {
+		e.record[i] = column.text(cpn)
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExportWriter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc     *json.Encoder
+	columns []exportColumn
+}
+
+func (e *ndjsonExportWriter) begin() error {
+	return nil
+}
+
+//write writes the coupon as the api does, a selection of columns as an object of just those fields
+func (e *ndjsonExportWriter) write(cpn api.Coupon) error {
+	if len(e.columns) == len(exportColumns) {
+		return e.enc.Encode(cpn)
+	}
+
+	line := map[string]interface{}{}
+	for _, column := range e.columns {
+		line[column.name] = column.value(cpn)
+	}
+	return e.enc.Encode(line)
+}
+
+func (e *ndjsonExportWriter) flush() error {
+	return nil
+}
+
+func newExportWriter(w io.Writer, format string, columns []exportColumn) exportWriter {
+	if format == EXPORT_FORMAT_NDJSON {
+		return &ndjsonExportWriter{enc: json.NewEncoder(w), columns: columns}
+	}
+	return &csvExportWriter{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+}
+
+//handleExport streams the coupons matching the filter straight from the db cursor, so exports of any size
+//are never held in memory. The api key is sent in the X-API-Key header.
+func (s *CouponService) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "exports are fetched with GET"))
+		return
+	}
+
+	format, columns, filter, err := s.exportRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		s.respondWithError(w, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	out := newExportWriter(w, format, columns)
+	started := false
+	//the response is only committed with the first coupon, so a search failing right away is still reported as an error
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", format)
+		w.Header().Set("Content-Disposition", "attachment; filename=\"coupons."+exportExtension(format)+"\"")
+		w.WriteHeader(http.StatusOK)
+		return out.begin()
+	}
+
+	written := 0
+	err = s.db.SearchEach(r.Context(), filter, func(cpn api.Coupon) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := out.write(cpn); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			if err := out.flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = out.flush()
+	}
+
+	if err != nil {
+		if !started {
+			w.Header().Set("Content-Type", "application/json")
+			s.respondWithError(w, err)
+			return
+		}
+		log.Printf("export failed after %d coupons: %s", written, err.Error())
+		//the status is sent already, aborting drops the connection so the client cannot take a partial export for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Printf("exported %d coupons as %s", written, format)
+}
+
+func (s *CouponService) exportRequest(r *http.Request) (string, []exportColumn, *api.CouponFilter, error) {
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		return "", nil, nil, err
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	columns, err := exportColumnsFromQuery(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return format, columns, filter, nil
+}
+
+func exportExtension(format string) string {
+	if format == EXPORT_FORMAT_NDJSON {
+		return "ndjson"
+	}
+	return "csv"
+}
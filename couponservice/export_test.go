@@ -0,0 +1,189 @@
+package couponservice
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func newExportMock(count int) *DbMock {
+	mock := newDbMock()
+	for i := 0; i < count; i++ {
+		cpn := api.Coupon{
+			Id:      primitive.NewObjectID(),
+			Name:    fmt.Sprintf("Save £%d at Tesco", i+1),
+			Brand:   "Tesco",
+			Value:   float64(i + 1),
+			Expiry:  time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+			Version: 1,
+		}
+		mock.coupons[cpn.Id] = cpn
+	}
+	return mock
+}
+
+func doExport(s *CouponService, method, query, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, EXPORT_PATH+query, nil)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	s.handleExport(w, r)
+	return w
+}
+
+func TestExportCSV(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newExportMock(exportFlushEvery + 1)
+
+	w := doExport(s, http.MethodGet, "?columns="+url.QueryEscape("name,value,expiry"), "text/csv")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EXPORT_FORMAT_CSV {
+		t.Errorf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+		return
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(records) != exportFlushEvery+2 {
+		t.Errorf("expected a header and %d rows, got %d records", exportFlushEvery+1, len(records))
+		return
+	}
+	if header := records[0]; len(header) != 3 || header[0] != "name" || header[1] != "value" || header[2] != "expiry" {
+		t.Errorf("unexpected header %v", header)
+	}
+	if expiry := records[1][2]; expiry != "2019-03-01T00:00:00Z" {
+		t.Errorf("unexpected expiry %s", expiry)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newExportMock(3)
+
+	w := doExport(s, http.MethodGet, "", "application/json;q=0.9, application/x-ndjson")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != EXPORT_FORMAT_NDJSON {
+		t.Errorf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+		return
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		cpn := api.Coupon{}
+		if err := json.Unmarshal(scanner.Bytes(), &cpn); err != nil {
+			t.Error(err)
+			return
+		}
+		if cpn.Id.IsZero() || cpn.Brand != "Tesco" {
+			t.Errorf("unexpected coupon %+v", cpn)
+		}
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 lines, got %d", lines)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	w := doExport(s, http.MethodGet, "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "id,name,brand,value,expiry,createdAt,version\n" {
+		t.Errorf("expected just the header, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		query  string
+		accept string
+		mock   func(mock *DbMock)
+		status int
+		code   string
+	}{
+		{"not acceptable", http.MethodGet, "", "application/xml", nil, http.StatusNotAcceptable, api.ERR_NOT_ACCEPTABLE},
+		{"ruled out", http.MethodGet, "", "text/csv;q=0, application/x-ndjson;q=0", nil, http.StatusNotAcceptable, api.ERR_NOT_ACCEPTABLE},
+		{"unknown column", http.MethodGet, "?columns=name,colour", "", nil, http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+		{"malformed filter", http.MethodGet, "?filter=" + url.QueryEscape(`{"brandEqual":`), "", nil, http.StatusBadRequest, api.ERR_INVALID_FILTER},
+		{"search failure", http.MethodGet, "", "", func(mock *DbMock) {
+			mock.searchErr = api.NewError(api.ERR_DB_UNAVAILABLE, "the db is unavailable")
+		}, http.StatusServiceUnavailable, api.ERR_DB_UNAVAILABLE},
+		{"post", http.MethodPost, "", "", nil, http.StatusMethodNotAllowed, api.ERR_UNKNOWN_OPERATION},
+	}
+
+	for _, tc := range testCases {
+		mock := newExportMock(1)
+		if tc.mock != nil {
+			tc.mock(mock)
+		}
+		s.db = mock
+
+		w := doExport(s, tc.method, tc.query, tc.accept)
+		resp := &api.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+			continue
+		}
+		if w.Code != tc.status || len(resp.Errors) != 1 || resp.Errors[0].Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %+v", tc.name, tc.status, tc.code, w.Code, resp.Errors)
+		}
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", EXPORT_FORMAT_CSV},
+		{"application/x-ndjson, text/csv", EXPORT_FORMAT_NDJSON},
+		{"text/csv;q=0.5, application/x-ndjson", EXPORT_FORMAT_NDJSON},
+		{"*/*;q=0.1, application/x-ndjson;q=0.9", EXPORT_FORMAT_NDJSON},
+		{"application/x-ndjson;q=0.2, text/*;q=0.8", EXPORT_FORMAT_CSV},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, EXPORT_PATH, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if format, err := exportFormat(r); err != nil || format != tc.expected {
+			t.Errorf("%q: expected %s, but got %s %v", tc.accept, tc.expected, format, err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package couponservice
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const GRAPHQL_PATH string = "/graphql"
+
+//graphqlRequest is the body of a GraphQL request, as sent by the usual GraphQL clients
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+//graphqlError reports api errors in the extensions of a GraphQL error, so clients can switch on the codes
+type graphqlError struct {
+	errs []api.Error
+}
+
+func (e graphqlError) Error() string {
+	return e.errs[0].Message
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{
+		"code":   e.errs[0].Code,
+		"errors": e.errs,
+	}
+}
+
+func newGraphqlError(err error) graphqlError {
+	return graphqlError{errs: []api.Error{apiErrorFrom(err)}}
+}
+
+var (
+	errorType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Error",
+		Fields: graphql.Fields{
+			"code":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"message": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"field":   &graphql.Field{Type: graphql.String},
+			"index":   &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	couponType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Coupon",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(api.Coupon).Id.Hex(), nil
+				},
+			},
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"brand":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"value":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"expiry":    &graphql.Field{Type: graphql.DateTime},
+			"createdAt": &graphql.Field{Type: graphql.DateTime},
+			"version":   &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	itemResultType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "ItemResult",
+		Fields: graphql.Fields{
+			"index": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"coupon": &graphql.Field{
+				Type: couponType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if cpn := p.Source.(api.BatchItemResult).Coupon; cpn != nil {
+						return *cpn, nil
+					}
+					return nil, nil
+				},
+			},
+			"errors": &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(errorType))},
+		},
+	})
+
+	writeResultType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "WriteResult",
+		Fields: graphql.Fields{
+			"items": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(itemResultType)))},
+			"summary": &graphql.Field{Type: graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+				Name: "BatchSummary",
+				Fields: graphql.Fields{
+					"total":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+					"succeeded": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+					"failed":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				},
+			}))},
+			"writeMode": &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	//every field is optional, so missing fields are reported by the coupon validation with its error codes
+	couponInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CouponInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":      &graphql.InputObjectFieldConfig{Type: graphql.ID},
+			"name":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"brand":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"value":   &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"expiry":  &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
+			"version": &graphql.InputObjectFieldConfig{Type: graphql.Int},
+		},
+	})
+
+	//the arguments of the coupons query are the fields of api.CouponFilter
+	couponFilterArgs = graphql.FieldConfigArgument{
+		"idIn":          &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.ID))},
+		"nameContains":  &graphql.ArgumentConfig{Type: graphql.String},
+		"brandEqual":    &graphql.ArgumentConfig{Type: graphql.String},
+		"valueFrom":     &graphql.ArgumentConfig{Type: graphql.Int},
+		"valueTo":       &graphql.ArgumentConfig{Type: graphql.Int},
+		"expiryFrom":    &graphql.ArgumentConfig{Type: graphql.DateTime},
+		"expiryTo":      &graphql.ArgumentConfig{Type: graphql.DateTime},
+		"createdAtFrom": &graphql.ArgumentConfig{Type: graphql.DateTime},
+		"createdAtTo":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+	}
+
+	writeArgs = graphql.FieldConfigArgument{
+		"coupons": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(couponInputType)))},
+		"atomic":  &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: true},
+	}
+)
+
+//newGraphqlSchema builds the GraphQL schema on top of the same core as the http handlers.
+//Types are kept in package variables so other data (e.g. campaigns) can be added to the schema next to the coupons.
+func (s *CouponService) newGraphqlSchema() (graphql.Schema, error) {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"coupons": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(couponType))),
+				Description: "The coupons matching every given condition",
+				Args:        couponFilterArgs,
+				Resolve:     s.resolveCoupons,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createCoupons": &graphql.Field{
+				Type:        graphql.NewNonNull(writeResultType),
+				Description: "Creates a batch of coupons, all-or-nothing unless atomic is false",
+				Args:        writeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.resolveWrite(p, s.createCoupons)
+				},
+			},
+			"updateCoupons": &graphql.Field{
+				Type:        graphql.NewNonNull(writeResultType),
+				Description: "Updates a batch of coupons, every coupon must carry the version the update is based on",
+				Args:        writeArgs,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.resolveWrite(p, s.updateCoupons)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+//graphqlSchema builds the schema on first use
+func (s *CouponService) graphqlSchema() (graphql.Schema, error) {
+	s.graphqlOnce.Do(func() {
+		s.graphqlSchemaObj, s.graphqlSchemaErr = s.newGraphqlSchema()
+	})
+	return s.graphqlSchemaObj, s.graphqlSchemaErr
+}
+
+//decodeArgs maps GraphQL arguments onto an api type through their shared json names
+func decodeArgs(args map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to read the arguments: %s", err.Error())
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to read the arguments: %s", err.Error())
+	}
+	return nil
+}
+
+func (s *CouponService) resolveCoupons(p graphql.ResolveParams) (interface{}, error) {
+	filter := &api.CouponFilter{}
+	if err := decodeArgs(p.Args, filter); err != nil {
+		return nil, newGraphqlError(err)
+	}
+
+	coupons, err := s.db.SearchFromRequest(filter)
+	if err != nil {
+		return nil, newGraphqlError(err)
+	}
+	return coupons, nil
+}
+
+type writeFunc func(actor api.Actor, cpnCollection *api.CouponCollection) (*writeOutcome, error)
+
+//resolveWrite runs a create or update, see respondWithOutcome for its http counterpart
+func (s *CouponService) resolveWrite(p graphql.ResolveParams, write writeFunc) (interface{}, error) {
+	cpnCollection := &api.CouponCollection{}
+	if err := decodeArgs(p.Args, cpnCollection); err != nil {
+		return nil, newGraphqlError(err)
+	}
+
+	outcome, err := write(actorFromContext(p.Context), cpnCollection)
+	if err != nil {
+		return nil, newGraphqlError(err)
+	}
+
+	switch {
+	case len(outcome.errors) > 0:
+		return nil, graphqlError{errs: outcome.errors}
+	case outcome.conflict != nil:
+		return nil, newGraphqlError(outcome.conflict)
+	}
+
+	batch := outcome.batch
+	if batch == nil {
+		batch = batchFromWritten(outcome.coupons)
+	}
+
+	return map[string]interface{}{
+		"items":     batch.Items,
+		"summary":   batch.Summary,
+		"writeMode": s.db.BatchWriteMode(),
+	}, nil
+}
+
+//batchFromWritten reports the coupons written by an atomic batch with one successful item each
+func batchFromWritten(coupons []api.Coupon) *api.BatchResult {
+	batch := &api.BatchResult{Items: []api.BatchItemResult{}}
+	for i := range coupons {
+		batch.Items = append(batch.Items, api.BatchItemResult{Index: i, Coupon: &coupons[i]})
+	}
+	summariseBatch(batch)
+	return batch
+}
+
+//respondGraphqlErrors reports errors that fail the request as a whole, with the http status the errors map to
+func respondGraphqlErrors(w http.ResponseWriter, errs ...api.Error) {
+	w.WriteHeader(httpStatusForErrors(errs))
+	writeGraphqlResult(w, &graphql.Result{Errors: []gqlerrors.FormattedError{
+		gqlerrors.FormatError(gqlerrors.NewError(errs[0].Message, nil, "", nil, nil, graphqlError{errs: errs})),
+	}})
+}
+
+func writeGraphqlResult(w http.ResponseWriter, result *graphql.Result) {
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+//handleGraphql serves GraphQL queries and mutations. The api key is sent in the X-API-Key header,
+//as the body is the standard GraphQL request.
+func (s *CouponService) handleGraphql(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		respondGraphqlErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "GraphQL requests must be sent with POST"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		respondGraphqlErrors(w, apiErrorFrom(err))
+		return
+	}
+
+	req := &graphqlRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Query == "" {
+		respondGraphqlErrors(w, requestBodyError(err, api.NewError(api.ERR_INVALID_REQUEST, "the body must be a GraphQL request with a query")))
+		return
+	}
+
+	schema, err := s.graphqlSchema()
+	if err != nil {
+		log.Printf("failed to build the GraphQL schema: %s", err.Error())
+		respondGraphqlErrors(w, apiErrorFrom(err))
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"})})
+	if err != nil {
+		respondGraphqlErrors(w, api.NewErrorf(api.ERR_INVALID_QUERY, "failed to parse the query: %s", err.Error()))
+		return
+	}
+
+	validation := graphql.ValidateDocument(&schema, doc, nil)
+	if !validation.IsValid {
+		w.WriteHeader(http.StatusBadRequest)
+		writeGraphqlResult(w, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	//the limits are checked before anything is resolved, so an expensive query never reaches the db
+	if err := s.graphqlLimits.check(&schema, doc, req.OperationName); err != nil {
+		respondGraphqlErrors(w, apiErrorFrom(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), actorContextKey{}, actorFromHTTP(r)), s.timeout)
+	defer cancel()
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	writeGraphqlResult(w, result)
+}
@@ -0,0 +1,152 @@
+package couponservice
+
+import (
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	//a list field is assumed to return this many items when estimating the cost of a query
+	graphqlListCostFactor = 10
+
+	//introspection (__schema, __type) is capped on its own, so the limits of the coupon queries do not have to allow
+	//for the introspection query of GraphQL tools, which is deep but bounded by the size of the schema
+	graphqlMaxIntrospectionDepth      = 15
+	graphqlMaxIntrospectionComplexity = 100000
+)
+
+//graphqlLimits bounds the work a single GraphQL request can ask for
+type graphqlLimits struct {
+	maxDepth      int
+	maxComplexity int
+}
+
+//queryCost walks the selections of an operation. Depth is the deepest nesting of fields, complexity counts
+//every field once and multiplies the fields selected under a list by graphqlListCostFactor.
+//The cost of the introspection fields is kept apart.
+type queryCost struct {
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+
+	introspectionDepth      int
+	introspectionComplexity int
+}
+
+//check rejects the operation when it is deeper or more complex than allowed. The document must have passed
+//validation already, so fragments are known and acyclic.
+func (l graphqlLimits) check(schema *graphql.Schema, doc *ast.Document, operationName string) error {
+	cost := &queryCost{schema: schema, fragments: map[string]*ast.FragmentDefinition{}}
+
+	var operation *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.FragmentDefinition:
+			cost.fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			if operationName == "" || (def.Name != nil && def.Name.Value == operationName) {
+				operation = def
+			}
+		}
+	}
+	if operation == nil {
+		return api.NewErrorf(api.ERR_INVALID_QUERY, "unknown operation: %s", operationName)
+	}
+
+	root := schema.QueryType()
+	if operation.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+
+	depth, complexity := cost.selectionSet(operation.SelectionSet, root)
+	if l.maxDepth > 0 && depth > l.maxDepth {
+		return api.NewErrorf(api.ERR_QUERY_TOO_DEEP, "the query is %d levels deep, at most %d are allowed", depth, l.maxDepth)
+	}
+	if l.maxComplexity > 0 && complexity > l.maxComplexity {
+		return api.NewErrorf(api.ERR_QUERY_TOO_COMPLEX, "the query has a complexity of %d, at most %d is allowed", complexity, l.maxComplexity)
+	}
+	if cost.introspectionDepth > graphqlMaxIntrospectionDepth {
+		return api.NewErrorf(api.ERR_QUERY_TOO_DEEP, "the introspection is %d levels deep, at most %d are allowed", cost.introspectionDepth, graphqlMaxIntrospectionDepth)
+	}
+	if cost.introspectionComplexity > graphqlMaxIntrospectionComplexity {
+		return api.NewErrorf(api.ERR_QUERY_TOO_COMPLEX, "the introspection has a complexity of %d, at most %d is allowed", cost.introspectionComplexity, graphqlMaxIntrospectionComplexity)
+	}
+
+	return nil
+}
+
+func (c *queryCost) selectionSet(set *ast.SelectionSet, parent *graphql.Object) (depth, complexity int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, selection := range set.Selections {
+		var d, cx int
+		switch selection := selection.(type) {
+		case *ast.Field:
+			d, cx = c.field(selection, parent)
+		case *ast.InlineFragment:
+			d, cx = c.selectionSet(selection.SelectionSet, parent)
+		case *ast.FragmentSpread:
+			if fragment, found := c.fragments[selection.Name.Value]; found {
+				d, cx = c.selectionSet(fragment.SelectionSet, parent)
+			}
+		}
+
+		if d > depth {
+			depth = d
+		}
+		complexity += cx
+	}
+
+	return depth, complexity
+}
+
+func (c *queryCost) field(field *ast.Field, parent *graphql.Object) (depth, complexity int) {
+	//the introspection fields are not among the fields of the types they can be selected on
+	var fieldType graphql.Type
+	introspection := false
+	switch field.Name.Value {
+	case graphql.SchemaMetaFieldDef.Name:
+		fieldType, introspection = graphql.SchemaMetaFieldDef.Type, true
+	case graphql.TypeMetaFieldDef.Name:
+		fieldType, introspection = graphql.TypeMetaFieldDef.Type, true
+	case graphql.TypeNameMetaFieldDef.Name:
+		fieldType = graphql.TypeNameMetaFieldDef.Type
+	default:
+		if parent != nil {
+			if def, found := parent.Fields()[field.Name.Value]; found {
+				fieldType = def.Type
+			}
+		}
+	}
+
+	isList := false
+	for unwrapped := true; unwrapped; {
+		switch t := fieldType.(type) {
+		case *graphql.NonNull:
+			fieldType = t.OfType
+		case *graphql.List:
+			isList = true
+			fieldType = t.OfType
+		default:
+			unwrapped = false
+		}
+	}
+
+	childParent, _ := fieldType.(*graphql.Object)
+	childDepth, childComplexity := c.selectionSet(field.SelectionSet, childParent)
+	if isList {
+		childComplexity *= graphqlListCostFactor
+	}
+
+	if introspection {
+		if childDepth+1 > c.introspectionDepth {
+			c.introspectionDepth = childDepth + 1
+		}
+		c.introspectionComplexity += childComplexity + 1
+		return 0, 0
+	}
+	return childDepth + 1, childComplexity + 1
+}
@@ -0,0 +1,213 @@
+package couponservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+type graphqlTestResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code   string      `json:"code"`
+			Errors []api.Error `json:"errors"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func doGraphql(s *CouponService, apiKey, query string, variables map[string]interface{}) (int, *graphqlTestResponse, error) {
+	body, _ := json.Marshal(graphqlRequest{Query: query, Variables: variables})
+	r := httptest.NewRequest(http.MethodPost, GRAPHQL_PATH, bytes.NewBuffer(body))
+	r.Header.Set(API_KEY_HEADER, apiKey)
+
+	w := httptest.NewRecorder()
+	s.handleGraphql(w, r)
+
+	resp := &graphqlTestResponse{}
+	err := json.NewDecoder(w.Body).Decode(resp)
+	return w.Code, resp, err
+}
+
+func TestGraphqlCreateCoupons(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	query := `mutation create($coupons: [CouponInput!]!) {
+		createCoupons(atomic: false, coupons: $coupons) {
+			items { index coupon { id name value } errors { code field } }
+			summary { succeeded failed }
+		}
+	}`
+	variables := map[string]interface{}{
+		"coupons": []interface{}{
+			map[string]interface{}{"name": "Save £1 at Tesco", "brand": "Tesco", "value": 1, "expiry": "2019-03-01T00:00:00Z"},
+			map[string]interface{}{"name": "Save £2 at Boots", "value": 2, "expiry": "2019-04-01T00:00:00Z"},
+		},
+	}
+
+	status, resp, err := doGraphql(s, "Valid API Key", query, variables)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if status != http.StatusOK || len(resp.Errors) > 0 {
+		t.Errorf("unexpected response %d %+v", status, resp.Errors)
+		return
+	}
+
+	result := &struct {
+		Items []struct {
+			Coupon *struct {
+				Id   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"coupon"`
+			Errors []api.Error `json:"errors"`
+		} `json:"items"`
+		Summary api.BatchSummary `json:"summary"`
+	}{}
+	if err := json.Unmarshal(resp.Data["createCoupons"], result); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if result.Summary.Succeeded != 1 || result.Summary.Failed != 1 {
+		t.Errorf("unexpected batch summary %+v", result.Summary)
+	}
+	if len(result.Items) != 2 || result.Items[0].Coupon == nil || result.Items[0].Coupon.Id == "" {
+		t.Errorf("expected the first coupon to be created, got %+v", result.Items)
+		return
+	}
+	if errs := result.Items[1].Errors; len(errs) != 1 || errs[0].Code != api.ERR_BRAND_REQUIRED || errs[0].Field != "coupons[1].brand" {
+		t.Errorf("unexpected errors for the second coupon %+v", errs)
+	}
+	if len(mock.coupons) != 1 {
+		t.Errorf("expected 1 coupon to be written, but %d were", len(mock.coupons))
+	}
+}
+
+func TestGraphqlAtomicValidationFailure(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	query := `mutation { createCoupons(coupons: [{name: "Save £1 at Tesco", value: -1}]) { summary { succeeded } } }`
+	_, resp, err := doGraphql(s, "Valid API Key", query, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(resp.Errors) != 1 {
+		t.Errorf("expected a single error, got %+v", resp.Errors)
+		return
+	}
+	codes := map[string]bool{}
+	for _, e := range resp.Errors[0].Extensions.Errors {
+		codes[e.Code] = true
+	}
+	if !codes[api.ERR_BRAND_REQUIRED] || !codes[api.ERR_VALUE_NOT_POSITIVE] {
+		t.Errorf("unexpected error codes %+v", resp.Errors[0].Extensions.Errors)
+	}
+	if len(mock.coupons) != 0 {
+		t.Errorf("expected no coupons to be written, but %d were", len(mock.coupons))
+	}
+}
+
+func TestGraphqlLimits(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+	s.graphqlLimits = graphqlLimits{maxDepth: 3, maxComplexity: 50}
+
+	testCases := []struct {
+		name         string
+		query        string
+		expectedCode string
+	}{
+		{
+			name:  "within the limits",
+			query: `{ coupons(brandEqual: "Tesco") { id name value } }`,
+		},
+		{
+			name:         "too deep",
+			query:        `mutation { createCoupons(coupons: []) { items { coupon { id } } } }`,
+			expectedCode: api.ERR_QUERY_TOO_DEEP,
+		},
+		{
+			//every field of a coupon is multiplied by the list cost factor
+			name:         "too complex",
+			query:        `{ coupons { id name brand value expiry createdAt version } }`,
+			expectedCode: api.ERR_QUERY_TOO_COMPLEX,
+		},
+		{
+			name:         "too complex through a fragment",
+			query:        `{ coupons { ...all } } fragment all on Coupon { id name brand value expiry createdAt version }`,
+			expectedCode: api.ERR_QUERY_TOO_COMPLEX,
+		},
+		{
+			//introspection is not held to the limits of the coupon queries, but to limits of its own
+			name:  "introspection",
+			query: `{ __schema { types { name fields { name type { name ofType { name ofType { name } } } } } } }`,
+		},
+		{
+			name:         "introspection too deep",
+			query:        `{ __type(name: "Coupon") { fields { type { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { name } } } } } } } } } } } } } } } }`,
+			expectedCode: api.ERR_QUERY_TOO_DEEP,
+		},
+	}
+
+	for _, tc := range testCases {
+		status, resp, err := doGraphql(s, "Valid API Key", tc.query, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+			continue
+		}
+
+		if tc.expectedCode == "" {
+			if status != http.StatusOK || len(resp.Errors) > 0 {
+				t.Errorf("%s: unexpected response %d %+v", tc.name, status, resp.Errors)
+			}
+			continue
+		}
+
+		if status != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != tc.expectedCode {
+			t.Errorf("%s: expected %s, got %d %+v", tc.name, tc.expectedCode, status, resp.Errors)
+		}
+	}
+}
+
+func TestGraphqlAuthentication(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	status, resp, err := doGraphql(s, "", `{ coupons { id } }`, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if status != http.StatusUnauthorized || len(resp.Errors) != 1 || resp.Errors[0].Extensions.Code != api.ERR_UNAUTHENTICATED {
+		t.Errorf("unexpected response without an api key %d %+v", status, resp.Errors)
+	}
+}
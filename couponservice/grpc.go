@@ -0,0 +1,154 @@
+package couponservice
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/couponspb"
+)
+
+//the metadata key gRPC clients send their api key in
+const GRPC_API_KEY_METADATA string = "x-api-key"
+
+//grpcServer implements the gRPC api on top of the same core as the http handlers
+type grpcServer struct {
+	couponspb.UnimplementedCouponsServer
+	s *CouponService
+}
+
+//NewGrpcServer creates a gRPC server with the coupon api registered, every call is authenticated
+func (s *CouponService) NewGrpcServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(s.authenticateUnary),
+		grpc.StreamInterceptor(s.authenticateStream),
+	)
+	couponspb.RegisterCouponsServer(srv, &grpcServer{s: s})
+	//lets tools like grpcurl discover the api without the .proto file
+	reflection.Register(srv)
+	return srv
+}
+
+func (s *CouponService) authenticateContext(ctx context.Context) error {
+	apiKey := ""
+	if md, found := metadata.FromIncomingContext(ctx); found {
+		if keys := md.Get(GRPC_API_KEY_METADATA); len(keys) > 0 {
+			apiKey = keys[0]
+		}
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: apiKey}); err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (s *CouponService) authenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authenticateContext(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *CouponService) authenticateStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authenticateContext(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+//grpcStatus reports api errors as a grpc status, with the code their http status maps to and the errors as details
+func grpcStatus(errs []api.Error, extraDetails ...protoadapt.MessageV1) error {
+	st := status.New(grpcCodeForStatus(httpStatusForErrors(errs)), errs[0].Message)
+
+	details := []protoadapt.MessageV1{}
+	for _, e := range errs {
+		details = append(details, protoadapt.MessageV1Of(couponspb.ErrorFromInternal(e)))
+	}
+	details = append(details, extraDetails...)
+
+	withDetails, err := st.WithDetails(details...)
+	if err != nil {
+		log.Printf("failed to attach the error details to the grpc status: %s", err.Error())
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+func grpcError(err error) error {
+	return grpcStatus([]api.Error{apiErrorFrom(err)})
+}
+
+//grpcWritten reports the outcome of a create or update, see respondWithOutcome for its http counterpart
+func (g *grpcServer) grpcWritten(outcome *writeOutcome) (*couponspb.WriteCouponsResponse, error) {
+	switch {
+	case len(outcome.errors) > 0:
+		return nil, grpcStatus(outcome.errors)
+	case outcome.conflict != nil:
+		//the current state of the coupons is sent along, so the client can rebase its changes
+		current := []protoadapt.MessageV1{}
+		for _, cpn := range outcome.conflict.Current {
+			current = append(current, protoadapt.MessageV1Of(couponspb.FromInternal(cpn)))
+		}
+		return nil, grpcStatus([]api.Error{apiErrorFrom(outcome.conflict)}, current...)
+	case outcome.batch != nil:
+		if outcome.batch.Summary.Succeeded == 0 {
+			errs := []api.Error{}
+			for _, item := range outcome.batch.Items {
+				errs = append(errs, item.Errors...)
+			}
+			return nil, grpcStatus(errs)
+		}
+		return couponspb.BatchFromInternal(outcome.batch, g.s.db.BatchWriteMode()), nil
+	default:
+		return couponspb.WrittenFromInternal(outcome.coupons, g.s.db.BatchWriteMode()), nil
+	}
+}
+
+func (g *grpcServer) CreateCoupons(ctx context.Context, req *couponspb.CreateCouponsRequest) (*couponspb.WriteCouponsResponse, error) {
+	cpnCollection, err := couponspb.CollectionToInternal(req.GetCoupons(), req.Atomic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	outcome, err := g.s.createCoupons(actorFromContext(ctx), cpnCollection)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return g.grpcWritten(outcome)
+}
+
+func (g *grpcServer) UpdateCoupons(ctx context.Context, req *couponspb.UpdateCouponsRequest) (*couponspb.WriteCouponsResponse, error) {
+	cpnCollection, err := couponspb.CollectionToInternal(req.GetCoupons(), req.Atomic)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	outcome, err := g.s.updateCoupons(actorFromContext(ctx), cpnCollection)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return g.grpcWritten(outcome)
+}
+
+//SearchCoupons sends the coupons as they are read from the db, the search is cancelled when the client goes away
+func (g *grpcServer) SearchCoupons(req *couponspb.SearchCouponsRequest, stream couponspb.Coupons_SearchCouponsServer) error {
+	filter := req.GetFilter().ToInternal()
+
+	err := g.s.db.SearchEach(stream.Context(), filter, func(cpn api.Coupon) error {
+		return stream.Send(couponspb.FromInternal(cpn))
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+
+	return nil
+}
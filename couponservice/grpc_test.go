@@ -0,0 +1,168 @@
+package couponservice
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/couponspb"
+)
+
+//newGrpcClient serves the grpc api of the service over an in-memory connection
+func newGrpcClient(t *testing.T, s *CouponService) (couponspb.CouponsClient, func()) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := s.NewGrpcServer()
+	go srv.Serve(lis)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return couponspb.NewCouponsClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func authenticated() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), GRPC_API_KEY_METADATA, "Valid API Key")
+}
+
+func TestGrpcCreateAndSearch(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	client, closeClient := newGrpcClient(t, s)
+	defer closeClient()
+
+	expiry := timestamppb.New(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))
+	resp, err := client.CreateCoupons(authenticated(), &couponspb.CreateCouponsRequest{
+		Atomic: proto.Bool(false),
+		Coupons: []*couponspb.Coupon{
+			{Name: "Save £1 at Tesco", Brand: "Tesco", Value: 1, Expiry: expiry},
+			{Name: "Save £2 at Boots", Value: 2, Expiry: expiry},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.GetSummary().GetSucceeded() != 1 || resp.GetSummary().GetFailed() != 1 {
+		t.Errorf("unexpected batch summary %+v", resp.GetSummary())
+	}
+	if len(resp.GetItems()) != 2 || resp.GetItems()[0].GetCoupon().GetId() == "" {
+		t.Errorf("expected the first coupon to be created, got %+v", resp.GetItems())
+		return
+	}
+	if errs := resp.GetItems()[1].GetErrors(); len(errs) != 1 || errs[0].GetCode() != api.ERR_BRAND_REQUIRED {
+		t.Errorf("expected the second coupon to fail with %s, got %+v", api.ERR_BRAND_REQUIRED, errs)
+	}
+
+	stream, err := client.SearchCoupons(authenticated(), &couponspb.SearchCouponsRequest{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	found := []*couponspb.Coupon{}
+	for {
+		cpn, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		found = append(found, cpn)
+	}
+
+	if len(found) != 1 || found[0].GetName() != "Save £1 at Tesco" || found[0].GetValue() != 1 {
+		t.Errorf("unexpected search result %+v", found)
+	}
+}
+
+func TestGrpcAtomicValidationFailure(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	mock := newDbMock()
+	s.db = mock
+
+	client, closeClient := newGrpcClient(t, s)
+	defer closeClient()
+
+	//a batch that leaves atomic unset is all-or-nothing
+	_, err = client.CreateCoupons(authenticated(), &couponspb.CreateCouponsRequest{
+		Coupons: []*couponspb.Coupon{{Name: "Save £1 at Tesco", Value: 1}},
+	})
+
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Errorf("expected %s, got %s", codes.InvalidArgument, st.Code())
+	}
+
+	codesFound := map[string]bool{}
+	for _, detail := range st.Details() {
+		if e, isError := detail.(*couponspb.Error); isError {
+			codesFound[e.GetCode()] = true
+		}
+	}
+	if !codesFound[api.ERR_BRAND_REQUIRED] {
+		t.Errorf("expected a %s error in the status details, got %+v", api.ERR_BRAND_REQUIRED, st.Details())
+	}
+
+	if len(mock.coupons) != 0 {
+		t.Errorf("expected no coupons to be written, but %d were", len(mock.coupons))
+	}
+}
+
+func TestGrpcAuthentication(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	client, closeClient := newGrpcClient(t, s)
+	defer closeClient()
+
+	_, err = client.CreateCoupons(context.Background(), &couponspb.CreateCouponsRequest{})
+	if code := status.Code(err); code != codes.Unauthenticated {
+		t.Errorf("expected %s without an api key, got %s", codes.Unauthenticated, code)
+	}
+
+	stream, err := client.SearchCoupons(metadata.AppendToOutgoingContext(context.Background(), GRPC_API_KEY_METADATA, "some invalid key"), &couponspb.SearchCouponsRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("expected %s with an invalid api key, got %s", codes.PermissionDenied, code)
+	}
+}
@@ -2,44 +2,141 @@ package couponservice
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+	"github.com/akh-dev/coupons-service/util"
 	"github.com/pkg/errors"
 )
 
 func parseBaseRequest(r *http.Request) (*api.Request, error) {
 	log.Println("parsing request")
 
+	if encoding := requestEncoding(r); encoding != ENCODING_JSON {
+		return parseEncodedRequest(r, encoding)
+	}
+
 	dec := json.NewDecoder(r.Body)
 	baseRequest := &api.Request{}
 	err := dec.Decode(baseRequest)
 	if err != nil {
-		err = errors.Wrap(err, "failed to parse request")
-		log.Println(err.Error())
-		return nil, err
+		apiErr := requestBodyError(err, api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse request: %s", err.Error()))
+		log.Println(apiErr.Message)
+		return nil, apiErr
 	}
 
 	return baseRequest, nil
 }
 
-func respondBadRequest(w http.ResponseWriter, msg string) {
-	w.WriteHeader(http.StatusBadRequest)
-	respObj := &api.Response{Error: []string{msg}}
-	writeResponse(w, respObj)
+//requestBodyError reports a failure to read the request body as the given error, unless the body was cut off
+//for decompressing to more than the service accepts (see util.DecompressRequest)
+func requestBodyError(err error, readErr api.Error) api.Error {
+	if errors.Cause(err) == util.ErrRequestTooLarge {
+		return apiErrorFrom(err)
+	}
+	return readErr
 }
 
-func respondForbidden(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusForbidden)
-	respObj := &api.Response{Error: []string{"Forbidden"}}
-	writeResponse(w, respObj)
+//apiErrorFrom describes any error returned by the db layer or the helpers as an api error
+func apiErrorFrom(err error) api.Error {
+	switch cause := errors.Cause(err).(type) {
+	case api.Error:
+		return cause
+	case *dblayer.ConflictError:
+		return api.NewError(api.ERR_VERSION_CONFLICT, cause.Error())
+	case *util.UnsupportedEncodingError:
+		return api.NewError(api.ERR_UNSUPPORTED_MEDIA_TYPE, cause.Error())
+	default:
+		if cause == util.ErrRequestTooLarge {
+			return api.NewError(api.ERR_REQUEST_TOO_LARGE, cause.Error())
+		}
+		return api.NewError(api.ERR_INTERNAL, err.Error())
+	}
+}
+
+//newResponse builds a response, adding the legacy flat list of errors when the service runs in legacy error mode
+func (s *CouponService) newResponse(result interface{}, errs ...api.Error) *api.Response {
+	respObj := &api.Response{Errors: errs, Result: result}
+	if s.legacyErrors && len(errs) > 0 {
+		for _, e := range errs {
+			respObj.Error = append(respObj.Error, e.Legacy())
+		}
+	}
+	return respObj
+}
+
+//respondWithErrors writes the errors with the http status they map to
+func (s *CouponService) respondWithErrors(w http.ResponseWriter, errs ...api.Error) {
+	writeResponseWithStatus(w, httpStatusForErrors(errs), s.newResponse(nil, errs...))
+}
+
+func (s *CouponService) respondWithError(w http.ResponseWriter, err error) {
+	s.respondWithErrors(w, apiErrorFrom(err))
+}
+
+//respondWithRequestBodyError reports a compressed request body that could not be decoded, before it reaches any handler
+func (s *CouponService) respondWithRequestBodyError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", ENCODING_JSON)
+	apiErr := apiErrorFrom(err)
+	if apiErr.Code == api.ERR_INTERNAL {
+		//the body is not what its Content-Encoding says
+		apiErr = api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to decompress request: %s", err.Error())
+	}
+	s.respondWithErrors(w, apiErr)
+}
+
+//responds with the current state of the coupons that failed the version check
+func (s *CouponService) respondConflict(w http.ResponseWriter, r *api.Request, conflict *dblayer.ConflictError) {
+	errs := []api.Error{apiErrorFrom(conflict)}
+	writeResponseWithStatus(w, httpStatusForErrors(errs), s.newResponse(s.present(r, conflict.Current), errs...))
+}
+
+func etagForVersion(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+func versionFromEtag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	version, err := strconv.ParseInt(strings.Trim(etag, "\""), 10, 64)
+	if err != nil || version < 1 {
+		return 0, api.NewErrorf(api.ERR_INVALID_IF_MATCH, "If-Match must carry a coupon version, got: %s", etag)
+	}
+	return version, nil
+}
+
+//applyIfMatch sets the expected version of a single coupon update from the If-Match header
+func applyIfMatch(r *api.Request, cpnCollection *api.CouponCollection) error {
+	if r.IfMatch == "" || cpnCollection == nil {
+		return nil
+	}
+
+	if len(cpnCollection.Coupons) != 1 {
+		return api.NewError(api.ERR_INVALID_IF_MATCH, "If-Match can only be used when updating a single coupon")
+	}
+
+	version, err := versionFromEtag(r.IfMatch)
+	if err != nil {
+		return err
+	}
+
+	cpn := &cpnCollection.Coupons[0]
+	if cpn.Version != 0 && cpn.Version != version {
+		return api.NewErrorf(api.ERR_INVALID_IF_MATCH, "If-Match version %d does not match the coupon version %d", version, cpn.Version)
+	}
+	cpn.Version = version
+
+	return nil
 }
 
 func extractCouponsFromRequest(r *api.Request) (*api.CouponCollection, error) {
 
 	if r == nil {
-		err := errors.Errorf("Coupons data must be provided")
+		err := api.NewError(api.ERR_NO_COUPONS, "Coupons data must be provided")
 		log.Println(err.Error())
 		return nil, err
 	}
@@ -47,9 +144,9 @@ func extractCouponsFromRequest(r *api.Request) (*api.CouponCollection, error) {
 	cpnCollection := &api.CouponCollection{}
 	err := json.Unmarshal(r.Data, cpnCollection)
 	if err != nil {
-		err = errors.Wrap(err, "failed to parse coupons request")
-		log.Println(err.Error())
-		return nil, err
+		apiErr := api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse coupons request: %s", err.Error())
+		log.Println(apiErr.Message)
+		return nil, apiErr
 	}
 
 	return cpnCollection, nil
@@ -58,7 +155,7 @@ func extractCouponsFromRequest(r *api.Request) (*api.CouponCollection, error) {
 func extractCouponFilterFromRequest(r *api.Request) (*api.CouponFilter, error) {
 
 	if r == nil {
-		err := errors.Errorf("Request data must be provided")
+		err := api.NewError(api.ERR_INVALID_FILTER, "Request data must be provided")
 		log.Println(err.Error())
 		return nil, err
 	}
@@ -66,21 +163,42 @@ func extractCouponFilterFromRequest(r *api.Request) (*api.CouponFilter, error) {
 	filter := &api.CouponFilter{}
 	err := json.Unmarshal(r.Data, filter)
 	if err != nil {
-		err = errors.Wrap(err, "failed to parse filter from the request")
-		log.Println(err.Error())
-		return nil, err
+		apiErr := api.NewErrorf(api.ERR_INVALID_FILTER, "failed to parse filter from the request: %s", err.Error())
+		log.Println(apiErr.Message)
+		return nil, apiErr
 	}
 
 	return filter, nil
 }
 
 func writeResponse(w http.ResponseWriter, respObj *api.Response) {
-	response, err := json.Marshal(respObj)
+	writeResponseWithStatus(w, http.StatusOK, respObj)
+}
+
+//writeResponseWithStatus encodes the response before sending the status, so a response that fails to encode
+//is answered with the error instead: not_acceptable (406) if the negotiated encoding cannot carry it, internal (500) otherwise
+func writeResponseWithStatus(w http.ResponseWriter, status int, respObj *api.Response) {
+	response, err := encodeResponse(w.Header().Get("Content-Type"), respObj)
 	if err != nil {
-		log.Println(err.Error())
-		return
+		apiErr := apiErrorFrom(err)
+		if apiErr.Code != api.ERR_NOT_ACCEPTABLE {
+			apiErr = api.NewErrorf(api.ERR_INTERNAL, "failed to encode the response: %s", err.Error())
+		}
+		log.Println(apiErr.Message)
+
+		//json can carry any error response
+		w.Header().Set("Content-Type", ENCODING_JSON)
+		status = httpStatusForErrors([]api.Error{apiErr})
+		if response, err = json.Marshal(&api.Response{Errors: []api.Error{apiErr}}); err != nil {
+			log.Println(err.Error())
+			w.WriteHeader(status)
+			return
+		}
 	}
 
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
 	n, err := w.Write(response)
 	if err != nil {
 		log.Println(err.Error())
@@ -90,7 +208,27 @@ func writeResponse(w http.ResponseWriter, respObj *api.Response) {
 
 }
 
-func respondWithCoupons(w http.ResponseWriter, coupons []api.Coupon) {
-	respObj := &api.Response{Result: coupons}
+func (s *CouponService) respondWithCoupons(w http.ResponseWriter, r *api.Request, coupons []api.Coupon) {
+	respObj := &api.Response{Result: s.present(r, coupons)}
 	writeResponse(w, respObj)
 }
+
+//responds with the outcome of a write, reporting how the batch was kept all-or-nothing
+func (s *CouponService) respondWithWritten(w http.ResponseWriter, r *api.Request, status int, result interface{}, writeMode string) {
+	respObj := &api.Response{Result: s.present(r, result), WriteMode: writeMode}
+	writeResponseWithStatus(w, status, respObj)
+}
+
+//respondWithOutcome reports the outcome of a create or update over http
+func (s *CouponService) respondWithOutcome(w http.ResponseWriter, r *api.Request, outcome *writeOutcome) {
+	switch {
+	case len(outcome.errors) > 0:
+		s.respondWithErrors(w, outcome.errors...)
+	case outcome.conflict != nil:
+		s.respondConflict(w, r, outcome.conflict)
+	case outcome.batch != nil:
+		s.respondWithBatch(w, r, outcome.batch)
+	default:
+		s.respondWithWritten(w, r, http.StatusOK, outcome.coupons, s.db.BatchWriteMode())
+	}
+}
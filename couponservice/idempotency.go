@@ -0,0 +1,146 @@
+package couponservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+const (
+	//storing the response of a request is retried, a key left pending is taken over once stale and the request runs again
+	idempotencyCompleteAttempts = 3
+	idempotencyCompleteBackoff  = 100 * time.Millisecond
+)
+
+//func type: a handler of an already authenticated request
+type requestHandlerFunc func(w http.ResponseWriter, r *api.Request)
+
+//recordingResponseWriter passes the response through while keeping a copy of it, so it can be stored for replays
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	//set by the handler once it wrote to the db, see markPersisted
+	persisted bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+//markPersisted tells withIdempotency the request wrote to the db, so a failure after it cannot be retried by running the request again
+func markPersisted(w http.ResponseWriter) {
+	if recorder, ok := w.(*recordingResponseWriter); ok {
+		recorder.persisted = true
+	}
+}
+
+//idempotencyKeyFor scopes the key of the request to its api key, clients pick their keys without knowing of each other
+func idempotencyKeyFor(r *api.Request) string {
+	return principalForKey(r.ApiKey) + "/" + r.IdempotencyKey
+}
+
+//withIdempotency executes the handler at most once per idempotency key; retries get the stored response
+func (s *CouponService) withIdempotency(w http.ResponseWriter, method string, r *api.Request, handler requestHandlerFunc) {
+	if r.IdempotencyKey == "" {
+		handler(w, r)
+		return
+	}
+
+	//the stored response is replayed as is, so it must have been encoded as the retry asks
+	requestHash := hashRequest(method, w.Header().Get("Content-Type"), r)
+
+	key := idempotencyKeyFor(r)
+
+	record, reserved, err := s.db.ReserveIdempotencyKey(key, requestHash, s.idempotencyTTL)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	if !reserved {
+		s.replayIdempotentResponse(w, record, requestHash)
+		return
+	}
+
+	recorder := &recordingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	handler(recorder, r)
+
+	//server side failures are not final, the client should be able to retry them with the same key.
+	//Unless the coupons were written before the failure, running the request again would write them twice.
+	if recorder.statusCode >= http.StatusInternalServerError && !recorder.persisted {
+		if err := s.db.ReleaseIdempotencyKey(key); err != nil {
+			log.Printf("failed to release idempotency key %s: %s", key, err.Error())
+		}
+		return
+	}
+
+	s.completeIdempotencyKey(key, recorder.statusCode, recorder.body.Bytes())
+}
+
+//completeIdempotencyKey stores the response for replays, retrying a few times before giving up
+func (s *CouponService) completeIdempotencyKey(key string, statusCode int, response []byte) {
+	var err error
+	for attempt := 1; attempt <= idempotencyCompleteAttempts; attempt++ {
+		if err = s.db.CompleteIdempotencyKey(key, statusCode, response); err == nil {
+			return
+		}
+		if attempt < idempotencyCompleteAttempts {
+			time.Sleep(time.Duration(attempt) * idempotencyCompleteBackoff)
+		}
+	}
+	log.Printf("failed to store the response for idempotency key %s, a retry once the key is stale runs the request again: %s", key, err.Error())
+}
+
+func (s *CouponService) replayIdempotentResponse(w http.ResponseWriter, record *dblayer.IdempotencyRecord, requestHash string) {
+	if record.RequestHash != requestHash {
+		log.Printf("idempotency key %s reused with a different payload", record.Key)
+		s.respondWithErrors(w, api.NewError(api.ERR_IDEMPOTENCY_KEY_REUSED, "Idempotency key was already used with a different request"))
+		return
+	}
+
+	if !record.Completed {
+		s.respondWithErrors(w, api.NewError(api.ERR_IDEMPOTENCY_KEY_IN_USE, "A request with this idempotency key is still being processed"))
+		return
+	}
+
+	log.Printf("replaying the stored response for idempotency key %s", record.Key)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	if _, err := w.Write(record.Response); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+//hashRequest fingerprints a request so a key reused with a different payload, or by another api key, can be detected
+func hashRequest(method, encoding string, r *api.Request) string {
+	data := &bytes.Buffer{}
+	if err := json.Compact(data, r.Data); err != nil {
+		//not valid json, the handler will reject it anyway
+		data.Reset()
+		data.Write(r.Data)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(encoding))
+	hash.Write([]byte{0})
+	hash.Write([]byte(principalForKey(r.ApiKey)))
+	hash.Write([]byte{0})
+	hash.Write(data.Bytes())
+	return hex.EncodeToString(hash.Sum(nil))
+}
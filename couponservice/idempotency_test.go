@@ -0,0 +1,180 @@
+package couponservice
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func TestWithIdempotencyReplaysResponse(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`
+
+	w1 := httptest.NewRecorder()
+	s.withIdempotency(w1, http.MethodPost, &api.Request{Data: []byte(payload), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+
+	//same payload with different formatting must still be recognised as the same request
+	w2 := httptest.NewRecorder()
+	s.withIdempotency(w2, http.MethodPost, &api.Request{Data: []byte(" " + payload + "\n"), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+
+	if mock.createCalls != 1 {
+		t.Errorf("expected coupons to be created once, but CreateCoupons was called %d times", mock.createCalls)
+	}
+
+	if w2.Code != w1.Code || w2.Body.String() != w1.Body.String() {
+		t.Errorf("expected the retry to get the original response %d %s, but got %d %s", w1.Code, w1.Body.String(), w2.Code, w2.Body.String())
+	}
+
+	if w2.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the retry to be marked as replayed")
+	}
+}
+
+func TestWithIdempotencyRejectsDifferentPayload(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload1 := `{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`
+	payload2 := `{"coupons":[{"name":"Save £2 at Tesco","brand":"Tesco","value":2,"expiry":"2019-03-01T00:00:00Z"}]}`
+
+	w1 := httptest.NewRecorder()
+	s.withIdempotency(w1, http.MethodPost, &api.Request{Data: []byte(payload1), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+
+	w2 := httptest.NewRecorder()
+	s.withIdempotency(w2, http.MethodPost, &api.Request{Data: []byte(payload2), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+
+	if w2.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected http status %d, but got %d", http.StatusUnprocessableEntity, w2.Code)
+	}
+
+	if mock.createCalls != 1 {
+		t.Errorf("expected coupons to be created once, but CreateCoupons was called %d times", mock.createCalls)
+	}
+}
+
+func TestWithIdempotencyRequestInProgress(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`
+	r := &api.Request{Data: []byte(payload), IdempotencyKey: "key-1"}
+
+	//the first request holds the key but has not completed yet
+	mock.ReserveIdempotencyKey(idempotencyKeyFor(r), hashRequest(http.MethodPost, "", r), s.idempotencyTTL)
+
+	w := httptest.NewRecorder()
+	s.withIdempotency(w, http.MethodPost, r, s.handleCreateCoupon)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected http status %d, but got %d", http.StatusConflict, w.Code)
+	}
+
+	if mock.createCalls != 0 {
+		t.Errorf("expected no coupons to be created while the key is held, but CreateCoupons was called %d times", mock.createCalls)
+	}
+}
+
+func TestWithIdempotencyScopedToApiKey(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`
+
+	//two clients that happen to pick the same key make two different requests
+	for _, apiKey := range []string{"Valid API Key", "5c58ea1afaa48016746e59b9.secret"} {
+		w := httptest.NewRecorder()
+		s.withIdempotency(w, http.MethodPost, &api.Request{ApiKey: apiKey, Data: []byte(payload), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+		if w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("expected the request made with %q not to get the response of another api key", apiKey)
+		}
+	}
+
+	if mock.createCalls != 2 {
+		t.Errorf("expected coupons to be created for each api key, but CreateCoupons was called %d times", mock.createCalls)
+	}
+}
+
+func TestWithIdempotencyFailureAfterWrite(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	payload := `{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`
+
+	for _, atomic := range []bool{true, false} {
+		t.Run(fmt.Sprintf("atomic %t", atomic), func(t *testing.T) {
+			mock := newDbMock()
+			mock.findErr = fmt.Errorf("find failed")
+			s.db = mock
+
+			data := fmt.Sprintf(`{"atomic":%t,%s`, atomic, payload[1:])
+			w1 := httptest.NewRecorder()
+			s.withIdempotency(w1, http.MethodPost, &api.Request{Data: []byte(data), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+			if w1.Code != http.StatusInternalServerError {
+				t.Fatalf("expected http status %d, but got %d", http.StatusInternalServerError, w1.Code)
+			}
+
+			//the coupons were written before the failure, so the retry gets the failure rather than writing them again
+			mock.findErr = nil
+			w2 := httptest.NewRecorder()
+			s.withIdempotency(w2, http.MethodPost, &api.Request{Data: []byte(data), IdempotencyKey: "key-1"}, s.handleCreateCoupon)
+
+			if mock.createCalls != 1 {
+				t.Errorf("expected coupons to be created once, but CreateCoupons was called %d times", mock.createCalls)
+			}
+			if w2.Code != http.StatusInternalServerError || w2.Header().Get("Idempotent-Replayed") != "true" {
+				t.Errorf("expected the stored failure to be replayed, but got %d %s", w2.Code, w2.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithIdempotencyRetriesStoringResponse(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	mock.failCompleteCalls = idempotencyCompleteAttempts - 1
+	s.db = mock
+
+	r := &api.Request{Data: []byte(`{"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}`), IdempotencyKey: "key-1"}
+	s.withIdempotency(httptest.NewRecorder(), http.MethodPost, r, s.handleCreateCoupon)
+
+	if record := mock.idempotencyKeys[idempotencyKeyFor(r)]; record == nil || !record.Completed {
+		t.Errorf("expected the response to be stored once a retry succeeded, but got %+v", record)
+	}
+}
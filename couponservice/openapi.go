@@ -0,0 +1,615 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/openapi"
+	"github.com/akh-dev/coupons-service/api/v2"
+)
+
+const OPENAPI_PATH string = "/openapi.json"
+
+//couponOperation is an operation of the coupon api. The table of operations both dispatches requests
+//and generates the OpenAPI document, so the two cannot disagree.
+type couponOperation struct {
+	summary     string
+	description string
+	handle      requestHandlerFunc
+
+	//http headers the operation reads, besides the api key in the body
+	headers []openapi.Parameter
+
+	//the shape of the request data and of the response result, per api version.
+	//An operation answering with different shapes lists all of them.
+	data    map[int]interface{}
+	results map[int][]interface{}
+}
+
+//couponOperations returns the operations of the coupon api keyed by http method
+func (s *CouponService) couponOperations() map[string]couponOperation {
+	return map[string]couponOperation{
+		http.MethodGet: {
+			summary:     "Search coupons",
+			description: "Lists the coupons matching every condition of the filter. A single coupon is returned with its version in the ETag header.",
+			handle:      s.handleListCoupons,
+			data: map[int]interface{}{
+				API_VERSION_1: api.CouponFilter{},
+				API_VERSION_2: v2.CouponFilter{},
+			},
+			results: map[int][]interface{}{
+				API_VERSION_1: {[]api.Coupon{}},
+				API_VERSION_2: {[]v2.Coupon{}},
+			},
+		},
+		http.MethodPost: {
+			summary:     "Create coupons",
+			description: "Creates a batch of coupons, all-or-nothing unless the batch says atomic: false. Atomic batches answer with the created coupons, other batches with a result per coupon.",
+			handle: func(w http.ResponseWriter, r *api.Request) {
+				s.withIdempotency(w, http.MethodPost, r, s.handleCreateCoupon)
+			},
+			headers: []openapi.Parameter{
+				{
+					Name:        "Idempotency-Key",
+					In:          "header",
+					Description: "Makes the request safe to retry, a retry with the same key gets the original response replayed",
+					Schema:      &openapi.Schema{Type: "string"},
+				},
+			},
+			data: map[int]interface{}{
+				API_VERSION_1: api.CouponCollection{},
+				API_VERSION_2: v2.CouponCollection{},
+			},
+			results: map[int][]interface{}{
+				API_VERSION_1: {api.BatchResult{}, []api.Coupon{}},
+				API_VERSION_2: {v2.BatchResult{}, []v2.Coupon{}},
+			},
+		},
+		http.MethodPut: {
+			summary:     "Update coupons",
+			description: "Updates a batch of coupons, every update must carry the version it is based on. A batch is all-or-nothing unless it says atomic: false. Atomic batches answer with the updated coupons, other batches with a result per coupon.",
+			handle:      s.handleUpdateCoupon,
+			headers: []openapi.Parameter{
+				{
+					Name:        "If-Match",
+					In:          "header",
+					Description: "The version (ETag) of the coupon, when updating a single coupon",
+					Schema:      &openapi.Schema{Type: "string"},
+				},
+			},
+			data: map[int]interface{}{
+				API_VERSION_1: api.CouponCollection{},
+				API_VERSION_2: v2.CouponCollection{},
+			},
+			results: map[int][]interface{}{
+				API_VERSION_1: {api.BatchResult{}, []api.Coupon{}},
+				API_VERSION_2: {v2.BatchResult{}, []v2.Coupon{}},
+			},
+		},
+		http.MethodDelete: {
+			summary:     "Delete coupons",
+			description: "Deletes a batch of coupons, every coupon must carry its id and the version it was last seen at. The batch is all-or-nothing and answers with the deleted coupons.",
+			handle:      s.handleDeleteCoupon,
+			headers: []openapi.Parameter{
+				{
+					Name:        "If-Match",
+					In:          "header",
+					Description: "The version (ETag) of the coupon, when deleting a single coupon",
+					Schema:      &openapi.Schema{Type: "string"},
+				},
+			},
+			data: map[int]interface{}{
+				API_VERSION_1: api.CouponCollection{},
+				API_VERSION_2: v2.CouponCollection{},
+			},
+			results: map[int][]interface{}{
+				API_VERSION_1: {[]api.Coupon{}},
+				API_VERSION_2: {[]v2.Coupon{}},
+			},
+		},
+	}
+}
+
+//OpenAPI generates the specification of every route the service serves
+func (s *CouponService) OpenAPI() *openapi.Document {
+	g := openapi.NewGenerator()
+	doc := &openapi.Document{
+		OpenAPI: openapi.VERSION,
+		Info: openapi.Info{
+			Title:       "coupon-service",
+			Description: "Every request carries the api key and the request data in a json envelope, every response carries the result and the errors.",
+			Version:     strconv.Itoa(API_VERSION_LATEST),
+		},
+		Paths: map[string]*openapi.PathItem{},
+	}
+
+	for path := range s.routes() {
+		switch path {
+		case OPENAPI_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": openAPIOperation()}
+			continue
+		case GRAPHQL_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": graphqlOperation(g)}
+			continue
+		case IMPORT_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": importOperation(g)}
+			continue
+		case EXPORT_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": exportOperation(g)}
+			continue
+		case EVENTS_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": eventsOperation(g)}
+			continue
+		case SYNC_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": syncOperation(g)}
+			continue
+		case WEBHOOKS_PATH:
+			doc.Paths[path] = webhookOperations(g)
+			continue
+		case WEBHOOK_DELIVERIES_PATH:
+			doc.Paths[path] = webhookDeliveryOperations(g)
+			continue
+		case AUDIT_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": auditOperation(g)}
+			continue
+		case VERSIONS_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": versionsOperation(g)}
+			continue
+		case VERSION_DIFF_PATH:
+			doc.Paths[path] = &openapi.PathItem{"get": versionDiffOperation(g)}
+			continue
+		case VERSION_REVERT_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": versionRevertOperation(g)}
+			continue
+		case API_KEYS_PATH:
+			doc.Paths[path] = apiKeyOperations(g)
+			continue
+		case API_KEY_ROTATE_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": apiKeyChangeOperation(g, "Give an api key a new secret", "The new key is only returned here, the old one stops working.")}
+			continue
+		case API_KEY_ENABLE_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": apiKeyChangeOperation(g, "Accept a disabled api key again", "")}
+			continue
+		case API_KEY_DISABLE_PATH:
+			doc.Paths[path] = &openapi.PathItem{"post": apiKeyChangeOperation(g, "Stop accepting an api key until it is enabled again", "")}
+			continue
+		}
+
+		version, _ := apiVersionFromPath(path)
+		item := openapi.PathItem{}
+		for method, op := range s.couponOperations() {
+			item[strings.ToLower(method)] = op.describe(g, version)
+		}
+		doc.Paths[path] = &item
+	}
+
+	doc.Components = g.Components()
+	return doc
+}
+
+func (op couponOperation) describe(g *openapi.Generator, version int) *openapi.Operation {
+	request := g.InlineSchemaFor(api.Request{})
+	request.Properties["data"] = g.SchemaFor(op.data[version])
+
+	response := g.InlineSchemaFor(api.Response{})
+	results := []*openapi.Schema{}
+	for _, result := range op.results[version] {
+		results = append(results, g.SchemaFor(result))
+	}
+	if len(results) == 1 {
+		response.Properties["result"] = results[0]
+	} else {
+		response.Properties["result"] = &openapi.Schema{OneOf: results}
+	}
+
+	return &openapi.Operation{
+		Summary:     op.summary,
+		Description: op.description,
+		Deprecated:  version < API_VERSION_LATEST,
+		Parameters:  op.headers,
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  encodedContent(request, version),
+		},
+		Responses: errorResponses(versionedResponse(response, version), g.SchemaFor(api.Response{})),
+	}
+}
+
+//encodedContent lists the encodings the coupon api takes and answers (see encoding.go), MessagePack carries
+//the fields of the json and protobuf the couponspb messages, which only exist for v1
+func encodedContent(schema *openapi.Schema, version int) map[string]*openapi.MediaType {
+	content := jsonContent(schema)
+	content[ENCODING_MSGPACK] = &openapi.MediaType{Schema: schema}
+	if version == API_VERSION_1 {
+		content[ENCODING_PROTOBUF] = &openapi.MediaType{Schema: &openapi.Schema{Type: "string", Format: "binary"}}
+	}
+	return content
+}
+
+func versionedResponse(schema *openapi.Schema, version int) *openapi.Response {
+	headers := map[string]*openapi.Header{
+		"API-Version": {Description: "The version of the api that served the request", Schema: &openapi.Schema{Type: "string"}},
+	}
+	if version < API_VERSION_LATEST {
+		headers["Deprecation"] = &openapi.Header{Schema: &openapi.Schema{Type: "string"}}
+		headers["Link"] = &openapi.Header{Description: "The successor version of the api", Schema: &openapi.Schema{Type: "string"}}
+	}
+
+	return &openapi.Response{
+		Description: "Success",
+		Headers:     headers,
+		Content:     encodedContent(schema, version),
+	}
+}
+
+//errorResponses adds a response for every http status an error code can be reported with (see status.go)
+func errorResponses(success *openapi.Response, errorSchema *openapi.Schema) map[string]*openapi.Response {
+	responses := map[string]*openapi.Response{strconv.Itoa(http.StatusOK): success}
+
+	codesByStatus := map[int][]string{}
+	for code, status := range httpStatusByCode {
+		codesByStatus[status] = append(codesByStatus[status], code)
+	}
+
+	for status, codes := range codesByStatus {
+		sort.Strings(codes)
+		responses[strconv.Itoa(status)] = &openapi.Response{
+			Description: fmt.Sprintf("%s (%s)", http.StatusText(status), strings.Join(codes, ", ")),
+			Content:     jsonContent(errorSchema),
+		}
+	}
+
+	return responses
+}
+
+func openAPIOperation() *openapi.Operation {
+	return &openapi.Operation{
+		Summary: "This specification",
+		Responses: map[string]*openapi.Response{
+			strconv.Itoa(http.StatusOK): {
+				Description: "The OpenAPI document",
+				Content:     jsonContent(&openapi.Schema{Type: "object"}),
+			},
+		},
+	}
+}
+
+func graphqlOperation(g *openapi.Generator) *openapi.Operation {
+	return &openapi.Operation{
+		Summary:     "GraphQL queries and mutations",
+		Description: "Takes standard GraphQL requests, the schema can be fetched by introspection.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+		},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  jsonContent(g.SchemaFor(graphqlRequest{})),
+		},
+		Responses: map[string]*openapi.Response{
+			strconv.Itoa(http.StatusOK): {
+				Description: "The result of the query, errors of individual fields are reported next to the data",
+				Content:     jsonContent(&openapi.Schema{Type: "object"}),
+			},
+		},
+	}
+}
+
+func importOperation(g *openapi.Generator) *openapi.Operation {
+	response := g.InlineSchemaFor(api.Response{})
+	response.Properties["result"] = g.SchemaFor(api.ImportReport{})
+
+	return &openapi.Operation{
+		Summary: "Import coupons from a csv file",
+		Description: "The header names the name, brand, value and expiry columns. Invalid rows are reported by row number and skipped, " +
+			"the valid ones are written in chunks. An import that failed midway is resumed by sending the file again with its importId.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "delimiter", In: "query", Description: "The column delimiter, a single character or tab", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "dateFormat", In: "query", Description: "A Go time layout dates are read with, may be repeated", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "dryRun", In: "query", Description: "Only validate the rows", Schema: &openapi.Schema{Type: "boolean"}},
+			{Name: "importId", In: "query", Description: "Resumes the import with this id, only the api key that started it can", Schema: &openapi.Schema{Type: "string"}},
+		},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]*openapi.MediaType{"text/csv": {Schema: &openapi.Schema{Type: "string"}}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The import report", Content: jsonContent(response)}, g.SchemaFor(api.Response{})),
+	}
+}
+
+func exportOperation(g *openapi.Generator) *openapi.Operation {
+	columns := []string{}
+	for _, column := range exportColumns {
+		columns = append(columns, column.name)
+	}
+
+	success := &openapi.Response{
+		Description: "The coupons, streamed as they are read from the db",
+		Content: map[string]*openapi.MediaType{
+			EXPORT_FORMAT_CSV:    {Schema: &openapi.Schema{Type: "string"}},
+			EXPORT_FORMAT_NDJSON: {Schema: g.SchemaFor(api.Coupon{})},
+		},
+	}
+
+	return &openapi.Operation{
+		Summary:     "Export coupons as csv or newline delimited json",
+		Description: "The format is picked from the Accept header, csv by default. A failure after the export started drops the connection.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "filter", In: "query", Description: "A json search filter, every coupon is exported without one", Schema: g.SchemaFor(api.CouponFilter{})},
+			{Name: "columns", In: "query", Description: "Comma separated columns out of " + strings.Join(columns, ", "), Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: errorResponses(success, g.SchemaFor(api.Response{})),
+	}
+}
+
+func eventsOperation(g *openapi.Generator) *openapi.Operation {
+	success := &openapi.Response{
+		Description: "Server-sent events named after the type of the change, the data of every event is the json change and its id the seq",
+		Content: map[string]*openapi.MediaType{
+			EVENT_STREAM_FORMAT: {Schema: g.SchemaFor(api.CouponEvent{})},
+		},
+	}
+
+	return &openapi.Operation{
+		Summary: "Stream the changes of coupons",
+		Description: "Created, updated, deleted and expired events, from the one following Last-Event-ID or from now on. " +
+			"A stream resumed from an event that is no longer kept starts with a reset event.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "Last-Event-ID", In: "header", Description: "Resumes the stream after this event", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "lastEventId", In: "query", Description: "Resumes the stream after this event, for clients that cannot set headers", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "filter", In: "query", Description: "A json search filter, only idIn and brandEqual apply to events", Schema: g.SchemaFor(api.CouponFilter{})},
+		},
+		Responses: errorResponses(success, g.SchemaFor(api.Response{})),
+	}
+}
+
+func syncOperation(g *openapi.Generator) *openapi.Operation {
+	response := g.InlineSchemaFor(api.Response{})
+	response.Properties["result"] = g.SchemaFor(api.SyncResult{})
+
+	return &openapi.Operation{
+		Summary: "Sync the coupons changed since a sync token",
+		Description: "Without a token every coupon is returned. With one, the coupons created or modified since, and the deleted ones as tombstones. " +
+			"The token of the response is sent with the next sync, hasMore asks for it right away. An expired token is answered with 410.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "token", In: "query", Description: "The token of the previous sync", Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The changes", Content: jsonContent(response)}, g.SchemaFor(api.Response{})),
+	}
+}
+
+func webhookOperations(g *openapi.Generator) *openapi.PathItem {
+	apiKey := openapi.Parameter{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}}
+	errorSchema := g.SchemaFor(api.Response{})
+
+	created := g.InlineSchemaFor(api.Response{})
+	created.Properties["result"] = g.SchemaFor(api.WebhookSubscription{})
+	listed := g.InlineSchemaFor(api.Response{})
+	listed.Properties["result"] = &openapi.Schema{Type: "array", Items: g.SchemaFor(api.WebhookSubscription{})}
+
+	return &openapi.PathItem{
+		"post": {
+			Summary: "Subscribe a url to coupon events",
+			Description: "The events stored from now on that match eventTypes and brand are POSTed to the url, signed with the secret in the " +
+				WEBHOOK_SIGNATURE_HEADER + " header. A random secret is generated when none is given, it is only returned here.",
+			Parameters:  []openapi.Parameter{apiKey},
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(g.SchemaFor(api.WebhookSubscription{}))},
+			Responses:   errorResponses(&openapi.Response{Description: "The subscription", Content: jsonContent(created)}, errorSchema),
+		},
+		"get": {
+			Summary:    "List the webhook subscriptions",
+			Parameters: []openapi.Parameter{apiKey},
+			Responses:  errorResponses(&openapi.Response{Description: "The subscriptions, without their secrets", Content: jsonContent(listed)}, errorSchema),
+		},
+		"delete": {
+			Summary:     "Delete a webhook subscription",
+			Description: "Its pending deliveries are not sent, the delivery log is kept.",
+			Parameters: []openapi.Parameter{
+				apiKey,
+				{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: errorResponses(&openapi.Response{Description: "The subscription was deleted", Content: jsonContent(errorSchema)}, errorSchema),
+		},
+	}
+}
+
+func webhookDeliveryOperations(g *openapi.Generator) *openapi.PathItem {
+	apiKey := openapi.Parameter{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}}
+	errorSchema := g.SchemaFor(api.Response{})
+
+	listed := g.InlineSchemaFor(api.Response{})
+	listed.Properties["result"] = &openapi.Schema{Type: "array", Items: g.SchemaFor(api.WebhookDelivery{})}
+
+	return &openapi.PathItem{
+		"get": {
+			Summary:     "List webhook deliveries with their attempts, newest first",
+			Description: "A delivery is dead once every attempt failed, it is only sent again when asked to with POST.",
+			Parameters: []openapi.Parameter{
+				apiKey,
+				{Name: "subscriptionId", In: "query", Schema: &openapi.Schema{Type: "string"}},
+				{Name: "status", In: "query", Description: strings.Join([]string{api.DELIVERY_PENDING, api.DELIVERY_DELIVERED, api.DELIVERY_DEAD}, ", "), Schema: &openapi.Schema{Type: "string"}},
+				{Name: "limit", In: "query", Description: fmt.Sprintf("%d by default, at most %d", defaultDeliveriesLimit, maxDeliveriesLimit), Schema: &openapi.Schema{Type: "integer"}},
+			},
+			Responses: errorResponses(&openapi.Response{Description: "The deliveries", Content: jsonContent(listed)}, errorSchema),
+		},
+		"post": {
+			Summary: "Send a webhook delivery again",
+			Parameters: []openapi.Parameter{
+				apiKey,
+				{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: errorResponses(&openapi.Response{Description: "The delivery is pending", Content: jsonContent(errorSchema)}, errorSchema),
+		},
+	}
+}
+
+func auditOperation(g *openapi.Generator) *openapi.Operation {
+	errorSchema := g.SchemaFor(api.Response{})
+
+	listed := g.InlineSchemaFor(api.Response{})
+	listed.Properties["result"] = &openapi.Schema{Type: "array", Items: g.SchemaFor(api.AuditEntry{})}
+
+	timeParam := func(name string) openapi.Parameter {
+		return openapi.Parameter{Name: name, In: "query", Description: "RFC 3339, inclusive", Schema: &openapi.Schema{Type: "string", Format: "date-time"}}
+	}
+
+	return &openapi.Operation{
+		Summary:     "Search the audit log, newest first",
+		Description: "Every create, update and delete of a coupon is recorded with the principal of the api key, the X-Request-Id of the request and the coupon before and after.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "couponId", In: "query", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "actor", In: "query", Description: "the principal of the changes", Schema: &openapi.Schema{Type: "string"}},
+			timeParam("from"),
+			timeParam("to"),
+			{Name: "limit", In: "query", Description: fmt.Sprintf("%d by default, at most %d", defaultAuditLimit, maxAuditLimit), Schema: &openapi.Schema{Type: "integer"}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The entries", Content: jsonContent(listed)}, errorSchema),
+	}
+}
+
+func versionsOperation(g *openapi.Generator) *openapi.Operation {
+	errorSchema := g.SchemaFor(api.Response{})
+
+	listed := g.InlineSchemaFor(api.Response{})
+	listed.Properties["result"] = &openapi.Schema{
+		Description: "the versions, oldest first, or the version asked for by number or time",
+		OneOf:       []*openapi.Schema{{Type: "array", Items: g.SchemaFor(api.CouponVersion{})}, g.SchemaFor(api.CouponVersion{})},
+	}
+
+	return &openapi.Operation{
+		Summary:     "Read the history of a coupon",
+		Description: "Every create, update and delete writes a version, a delete is marked deleted and carries the version it deleted.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "version", In: "query", Description: "a single version", Schema: &openapi.Schema{Type: "integer", Format: "int64"}},
+			{Name: "at", In: "query", Description: "the version current at this time, RFC 3339", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The versions", Content: jsonContent(listed)}, errorSchema),
+	}
+}
+
+func versionDiffOperation(g *openapi.Generator) *openapi.Operation {
+	errorSchema := g.SchemaFor(api.Response{})
+
+	diffed := g.InlineSchemaFor(api.Response{})
+	diffed.Properties["result"] = g.SchemaFor(api.VersionDiff{})
+
+	version := func(name string) openapi.Parameter {
+		return openapi.Parameter{Name: name, In: "query", Required: true, Schema: &openapi.Schema{Type: "integer", Format: "int64"}}
+	}
+
+	return &openapi.Operation{
+		Summary: "Compare two versions of a coupon field by field",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			version("from"),
+			version("to"),
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The changed fields", Content: jsonContent(diffed)}, errorSchema),
+	}
+}
+
+func versionRevertOperation(g *openapi.Generator) *openapi.Operation {
+	errorSchema := g.SchemaFor(api.Response{})
+
+	written := g.InlineSchemaFor(api.Response{})
+	written.Properties["result"] = &openapi.Schema{Type: "array", Items: g.SchemaFor(api.Coupon{})}
+
+	return &openapi.Operation{
+		Summary:     "Revert a coupon to a prior version",
+		Description: "The fields of the prior version are written as a new version, validated as an update. A coupon changed since the If-Match version is a conflict.",
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "If-Match", In: "header", Required: true, Description: "the current version of the coupon", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "version", In: "query", Required: true, Description: "the version to revert to", Schema: &openapi.Schema{Type: "integer", Format: "int64"}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The coupon at its new version", Content: jsonContent(written)}, errorSchema),
+	}
+}
+
+func apiKeyOperations(g *openapi.Generator) *openapi.PathItem {
+	apiKey := openapi.Parameter{Name: API_KEY_HEADER, In: "header", Required: true, Description: "an admin api key", Schema: &openapi.Schema{Type: "string"}}
+	errorSchema := g.SchemaFor(api.Response{})
+
+	created := g.InlineSchemaFor(api.Response{})
+	created.Properties["result"] = g.SchemaFor(api.ApiKey{})
+	listed := g.InlineSchemaFor(api.Response{})
+	listed.Properties["result"] = &openapi.Schema{Type: "array", Items: g.SchemaFor(api.ApiKey{})}
+
+	return &openapi.PathItem{
+		"post": {
+			Summary:     "Create an api key",
+			Description: "The key clients authenticate with is only returned here, the service keeps a salted hash of it.",
+			Parameters:  []openapi.Parameter{apiKey},
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(g.SchemaFor(api.ApiKey{}))},
+			Responses:   errorResponses(&openapi.Response{Description: "The api key", Content: jsonContent(created)}, errorSchema),
+		},
+		"get": {
+			Summary:    "List the api keys",
+			Parameters: []openapi.Parameter{apiKey},
+			Responses:  errorResponses(&openapi.Response{Description: "The api keys, without the keys themselves", Content: jsonContent(listed)}, errorSchema),
+		},
+		"delete": {
+			Summary: "Revoke an api key",
+			Parameters: []openapi.Parameter{
+				apiKey,
+				{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+			},
+			Responses: errorResponses(&openapi.Response{Description: "The api key was revoked", Content: jsonContent(errorSchema)}, errorSchema),
+		},
+	}
+}
+
+func apiKeyChangeOperation(g *openapi.Generator, summary, description string) *openapi.Operation {
+	errorSchema := g.SchemaFor(api.Response{})
+
+	changed := g.InlineSchemaFor(api.Response{})
+	changed.Properties["result"] = g.SchemaFor(api.ApiKey{})
+
+	return &openapi.Operation{
+		Summary:     summary,
+		Description: description,
+		Parameters: []openapi.Parameter{
+			{Name: API_KEY_HEADER, In: "header", Required: true, Description: "an admin api key", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "id", In: "query", Required: true, Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: errorResponses(&openapi.Response{Description: "The api key", Content: jsonContent(changed)}, errorSchema),
+	}
+}
+
+func jsonContent(schema *openapi.Schema) map[string]*openapi.MediaType {
+	return map[string]*openapi.MediaType{"application/json": {Schema: schema}}
+}
+
+//handleOpenAPI serves the specification, it is public so it does not go through authentication
+func (s *CouponService) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	spec, err := json.Marshal(s.OpenAPI())
+	if err != nil {
+		log.Printf("failed to generate the OpenAPI document: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(spec); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,77 @@
+package couponservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api/openapi"
+)
+
+//TestOpenAPIMatchesHandlers fails when the spec documents something the service does not serve, or the other way round
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	mux := http.NewServeMux()
+	routes := s.routes()
+	for path, handler := range routes {
+		mux.HandleFunc(path, handler)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, OPENAPI_PATH, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected http status %d when fetching the spec", w.Code)
+		return
+	}
+
+	doc := &openapi.Document{}
+	if err := json.NewDecoder(w.Body).Decode(doc); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for path := range routes {
+		if _, found := doc.Paths[path]; !found {
+			t.Errorf("route %s is not documented", path)
+		}
+	}
+
+	allMethods := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	for path, item := range doc.Paths {
+		if _, found := routes[path]; !found {
+			t.Errorf("documented path %s is not served", path)
+			continue
+		}
+
+		for _, method := range allMethods {
+			_, documented := (*item)[strings.ToLower(method)]
+
+			body := bytes.NewBufferString(`{"apiKey":"Valid API Key","data":{}}`)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(method, path, body))
+
+			served := w.Code != http.StatusMethodNotAllowed && w.Code != http.StatusNotFound
+			if documented && !served {
+				t.Errorf("%s %s is documented, but the service answered %d", method, path, w.Code)
+			}
+			if !documented && served {
+				t.Errorf("%s %s is not documented, but the service answered %d", method, path, w.Code)
+			}
+		}
+	}
+
+	for _, name := range []string{"Coupon", "CouponFilter", "CouponCollection", "Response", "V2Coupon"} {
+		if _, found := doc.Components.Schemas[name]; !found {
+			t.Errorf("schema %s is missing from the spec", name)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package couponservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/config"
+	"github.com/akh-dev/coupons-service/dblayer"
+	"github.com/akh-dev/coupons-service/outbox"
+)
+
+const (
+	//a relay holds the lease of a sink this long, it is renewed before every batch and a third of it apart while a batch is published
+	relayLeaseTTL = 30 * time.Second
+	//a failing sink is retried after the poll interval, doubled after every further failure up to this
+	relayMaxRetryWait = time.Minute
+)
+
+//outboxRelay hands the coupon events of the outbox (see dblayer/outbox.go) to the sinks. Each sink is relayed on its own,
+//from its own checkpoint, so a failing or slow sink holds up no other.
+type outboxRelay struct {
+	db       dblayer.Interface
+	owner    string
+	leaseTTL time.Duration
+}
+
+func (s *CouponService) newOutboxRelay() *outboxRelay {
+	return &outboxRelay{
+		db:       s.db,
+		owner:    relayOwner(),
+		leaseTTL: relayLeaseTTL,
+	}
+}
+
+//relayOwner tells the instances of the service apart when they compete for the lease of a sink
+func relayOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Printf("failed to generate the relay owner: %s", err.Error())
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+//AddSink has the coupon events relayed to sink too, next to the ones the config turns on. It is called before ListenAndServe.
+func (s *CouponService) AddSink(sink outbox.Sink) {
+	s.sinks = append(s.sinks, sink)
+}
+
+//validateBrokers checks the config of the message brokers without connecting to them, see brokerSinks
+func validateBrokers(cfg *config.Config) error {
+	if cfg.NATS.URL != "" {
+		if err := outbox.ValidateFormat(cfg.NATS.Format); err != nil {
+			return errors.Wrap(err, "NATS_FORMAT")
+		}
+	}
+	if cfg.Kafka.Brokers != "" {
+		if err := outbox.ValidateFormat(cfg.Kafka.Format); err != nil {
+			return errors.Wrap(err, "KAFKA_FORMAT")
+		}
+	}
+	return nil
+}
+
+//brokerSinks publishes the coupon events to the message brokers the config sets up. They are connected to when the relay
+//starts, an instance that relays nothing opens no connection.
+//The names of the sinks keep their checkpoints, so they must not change between releases.
+func (s *CouponService) brokerSinks() ([]outbox.Sink, error) {
+	sinks := []outbox.Sink{}
+
+	if s.nats.URL != "" {
+		publisher, err := outbox.NewNATSPublisher(s.nats.URL, s.nats.SubjectPrefix, s.nats.JetStream)
+		if err != nil {
+			return nil, err
+		}
+		sink, err := outbox.NewBrokerSink("nats", publisher, s.nats.Format)
+		if err != nil {
+			publisher.Close()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if s.kafka.Brokers != "" {
+		publisher := outbox.NewKafkaPublisher(strings.Split(s.kafka.Brokers, ","), s.kafka.Topic)
+		sink, err := outbox.NewBrokerSink("kafka", publisher, s.kafka.Format)
+		if err != nil {
+			publisher.Close()
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+//outboxSinks are the sinks relayed every OUTBOX_POLL_INTERVAL, the webhooks have an interval of their own
+func (s *CouponService) outboxSinks() []outbox.Sink {
+	sinks := []outbox.Sink{}
+	if s.outboxLogFile != "" {
+		sinks = append(sinks, outbox.NewFileSink(s.outboxLogFile))
+	}
+	return append(sinks, s.sinks...)
+}
+
+//startRelay relays the coupon events to the webhooks every WEBHOOK_POLL_INTERVAL, and to the other sinks every
+//OUTBOX_POLL_INTERVAL. The events are only written in the transaction of their coupons when mongo runs as a replica set.
+//Otherwise a write undone after its events were stored relays events of changes that were never made, and a crash
+//between the two loses events, so the relay is not started unless OUTBOX_REQUIRE_TRANSACTIONS is turned off.
+//That is returned as an error when message brokers are set up, as is a broker that cannot be connected to; without
+//brokers the webhooks are only turned off, POST /webhooks tells the clients so.
+func (s *CouponService) startRelay(ctx context.Context) (bool, error) {
+	sinks := s.outboxSinks()
+	brokers := s.nats.URL != "" || s.kafka.Brokers != ""
+	if s.outboxPollInterval <= 0 {
+		for _, sink := range sinks {
+			log.Printf("OUTBOX_POLL_INTERVAL is 0, the coupon events are not relayed to %s", sink.Name())
+		}
+		if brokers {
+			log.Printf("OUTBOX_POLL_INTERVAL is 0, the coupon events are not relayed to the message brokers")
+		}
+		sinks = nil
+		brokers = false
+	}
+	if s.webhooks.pollInterval <= 0 && len(sinks) == 0 && !brokers {
+		return false, nil
+	}
+
+	if s.db.BatchWriteMode() != dblayer.WRITE_MODE_TRANSACTION {
+		if s.outboxRequireTransactions {
+			refused := "mongo does not run as a replica set, so the coupon events cannot be written in the transaction of their " +
+				"coupons. Run mongo as a replica set, or set OUTBOX_REQUIRE_TRANSACTIONS=false to relay them anyway"
+			if brokers {
+				return false, errors.Errorf("NATS_URL or KAFKA_BROKERS is set, but %s", refused)
+			}
+			log.Printf("WARNING: webhooks and the outbox sinks are turned off: %s", refused)
+			return false, nil
+		}
+		log.Printf("The coupon events are relayed without transactions, events may be lost or relayed for writes that were undone")
+	}
+
+	if brokers {
+		brokerSinks, err := s.brokerSinks()
+		if err != nil {
+			return false, err
+		}
+		sinks = append(sinks, brokerSinks...)
+	}
+
+	relay := s.newOutboxRelay()
+	if s.webhooks.pollInterval > 0 {
+		atomic.StoreInt32(&s.webhooksRelayed, 1)
+		go relay.runSink(ctx, &webhookSink{db: s.db}, s.webhooks.pollInterval)
+	}
+	for _, sink := range sinks {
+		go relay.runSink(ctx, sink, s.outboxPollInterval)
+	}
+	return true, nil
+}
+
+func (r *outboxRelay) runSink(ctx context.Context, sink outbox.Sink, pollInterval time.Duration) {
+	wait := pollInterval
+	for {
+		if _, err := r.relay(ctx, sink); err != nil {
+			log.Printf("failed to relay coupon events to %s: %s", sink.Name(), err.Error())
+			wait *= 2
+			if wait > relayMaxRetryWait {
+				wait = relayMaxRetryWait
+			}
+		} else {
+			wait = pollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//relay hands the sink the events after its checkpoint, a batch at a time, and moves the checkpoint past every batch it took.
+//A batch that fails is handed over again by the next run, events are never skipped, so the events of a coupon
+//reach the sink in order. Another instance of the service holding the lease of the sink leaves nothing to do.
+func (r *outboxRelay) relay(ctx context.Context, sink outbox.Sink) (int, error) {
+	last, err := r.db.RelayCheckpoint(sink.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	//a sink that fell behind by more than the retention cannot be caught up
+	if oldest, _, err := r.db.EventBounds(); err != nil {
+		return 0, err
+	} else if last > 0 && oldest > last+1 {
+		log.Printf("%d coupon events were removed before they were relayed to %s", oldest-last-1, sink.Name())
+	}
+
+	relayed := 0
+	cursor := &eventCursor{db: r.db, last: last}
+	for {
+		held, err := r.db.AcquireRelayLease(sink.Name(), r.owner, r.leaseTTL)
+		if err != nil || !held {
+			return relayed, err
+		}
+
+		from := cursor.last
+		events, err := cursor.next(ctx)
+		if err != nil {
+			return relayed, err
+		}
+		if cursor.last == from {
+			return relayed, nil
+		}
+
+		//a batch of abandoned numbers only moves the checkpoint
+		if len(events) > 0 {
+			if err := r.publish(ctx, sink, events); err != nil {
+				return relayed, err
+			}
+		}
+		if err := r.db.SaveRelayCheckpoint(sink.Name(), cursor.last); err != nil {
+			return relayed, err
+		}
+		relayed += len(events)
+
+		//the cursor stopped at the end of the log or at a pending write
+		if !cursor.more {
+			return relayed, nil
+		}
+	}
+}
+
+//publish hands the batch to the sink, renewing the lease of the sink while the sink takes it. A lease that cannot be
+//renewed cancels the publish: another instance may have taken the sink over, the batch is left to the checkpoint.
+func (r *outboxRelay) publish(ctx context.Context, sink outbox.Sink, events []api.CouponEvent) error {
+	pubCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lost := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(r.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			held, err := r.db.AcquireRelayLease(sink.Name(), r.owner, r.leaseTTL)
+			if err == nil && !held {
+				err = errors.Errorf("the lease of %s was taken over while publishing", sink.Name())
+			}
+			if err != nil {
+				lost <- err
+				cancel()
+				return
+			}
+		}
+	}()
+
+	err := sink.Publish(pubCtx, events)
+	close(stop)
+
+	select {
+	case leaseErr := <-lost:
+		return leaseErr
+	default:
+	}
+	if err != nil {
+		return err
+	}
+
+	//the checkpoint is only moved by the holder of the lease
+	held, err := r.db.AcquireRelayLease(sink.Name(), r.owner, r.leaseTTL)
+	if err == nil && !held {
+		err = errors.Errorf("the lease of %s was taken over while publishing", sink.Name())
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package couponservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+	"github.com/akh-dev/coupons-service/outbox"
+)
+
+//recordingSink takes the events it is handed, unless it is told to fail
+type recordingSink struct {
+	fail   bool
+	events []api.CouponEvent
+}
+
+func (rs *recordingSink) Name() string {
+	return "recording"
+}
+
+func (rs *recordingSink) Publish(ctx context.Context, events []api.CouponEvent) error {
+	if rs.fail {
+		return errors.New("the sink is down")
+	}
+	rs.events = append(rs.events, events...)
+	return nil
+}
+
+func seqs(events []api.CouponEvent) []int64 {
+	seqs := []int64{}
+	for _, event := range events {
+		seqs = append(seqs, event.Seq)
+	}
+	return seqs
+}
+
+func newOutboxSvc(t *testing.T) (*CouponService, *dbtest.DB) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+
+	res, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}, {Name: "Save 5", Brand: "Boots", Value: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpns, _ := db.FindByIds(res.InsertedIDs)
+	cpns[0].Value = 20
+	if _, err := db.UpdateCoupons(api.Actor{}, cpns[:1]); err != nil {
+		t.Fatal(err)
+	}
+	return s, db
+}
+
+func TestOutboxRelay(t *testing.T) {
+	s, db := newOutboxSvc(t)
+	relay := s.newOutboxRelay()
+	sink := &recordingSink{fail: true}
+
+	//nothing is taken, so nothing is skipped
+	if _, err := relay.relay(context.Background(), sink); err == nil {
+		t.Fatal("expected the failure of the sink to be reported")
+	}
+	if checkpoint, _ := db.RelayCheckpoint(sink.Name()); checkpoint != 0 {
+		t.Fatalf("expected the checkpoint to stay, but it moved to %d", checkpoint)
+	}
+
+	sink.fail = false
+	relayed, err := relay.relay(context.Background(), sink)
+	if err != nil || relayed != 3 || fmt.Sprint(seqs(sink.events)) != "[1 2 3]" {
+		t.Fatalf("expected the events in order, but got %v (%v)", seqs(sink.events), err)
+	}
+	if sink.events[2].Type != api.EVENT_UPDATED || sink.events[2].CouponId != sink.events[0].CouponId {
+		t.Errorf("expected the update to follow the create of the coupon, but got %+v", sink.events)
+	}
+
+	//a relay started later, e.g. after a restart, carries on from the checkpoint
+	if _, err := db.DeleteCoupons(api.Actor{}, []api.Coupon{{Id: sink.events[1].CouponId, Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.relay(context.Background(), sink); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(seqs(sink.events)) != "[1 2 3 4]" {
+		t.Errorf("expected only the new event, but got %v", seqs(sink.events))
+	}
+}
+
+func TestOutboxRelayLease(t *testing.T) {
+	s, db := newOutboxSvc(t)
+	sink := &recordingSink{}
+
+	holder, other := s.newOutboxRelay(), s.newOutboxRelay()
+	if relayed, err := holder.relay(context.Background(), sink); err != nil || relayed != 3 {
+		t.Fatalf("expected the first relay to take the lease, but it relayed %d (%v)", relayed, err)
+	}
+
+	//the other instance waits for the lease to run out
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 1", Brand: "Tesco", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if relayed, err := other.relay(context.Background(), &recordingSink{}); err != nil || relayed != 0 {
+		t.Errorf("expected nothing to be relayed without the lease, but %d events were (%v)", relayed, err)
+	}
+	if relayed, err := holder.relay(context.Background(), sink); err != nil || relayed != 1 {
+		t.Errorf("expected the holder to carry on, but it relayed %d (%v)", relayed, err)
+	}
+}
+
+//slowSink takes a while to publish, telling when it started
+type slowSink struct {
+	recordingSink
+	started chan struct{}
+	delay   time.Duration
+}
+
+func (ss *slowSink) Publish(ctx context.Context, events []api.CouponEvent) error {
+	close(ss.started)
+	select {
+	case <-time.After(ss.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return ss.recordingSink.Publish(ctx, events)
+}
+
+func TestOutboxRelayRenewsLease(t *testing.T) {
+	s, _ := newOutboxSvc(t)
+	holder, other := s.newOutboxRelay(), s.newOutboxRelay()
+	holder.leaseTTL, other.leaseTTL = 30*time.Millisecond, 30*time.Millisecond
+
+	sink := &slowSink{started: make(chan struct{}), delay: 150 * time.Millisecond}
+	done := make(chan error)
+	go func() {
+		_, err := holder.relay(context.Background(), sink)
+		done <- err
+	}()
+
+	//the publish outlasts the ttl several times over, the lease is held throughout
+	<-sink.started
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if relayed, err := other.relay(context.Background(), &recordingSink{}); err != nil || relayed != 0 {
+			t.Fatalf("expected the lease to be renewed while publishing, but the other relay relayed %d (%v)", relayed, err)
+		}
+	}
+
+	if err := <-done; err != nil || len(sink.events) != 3 {
+		t.Errorf("expected the batch to be published, but got %v (%v)", seqs(sink.events), err)
+	}
+}
+
+func TestStartRelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.webhooks.pollInterval = time.Second
+	s.outboxPollInterval = 0
+
+	//the mock writes without transactions
+	s.db = newDbMock()
+	s.outboxRequireTransactions = true
+	if started, err := s.startRelay(ctx); started || err != nil || s.webhooksRelayed != 0 {
+		t.Errorf("expected the relay and the webhooks not to start without transactions, got %v", err)
+	}
+	s.outboxRequireTransactions = false
+	if started, _ := s.startRelay(ctx); !started || s.webhooksRelayed != 1 {
+		t.Error("expected the relay to start once transactions are not required")
+	}
+
+	//the webhooks are relayed however OUTBOX_POLL_INTERVAL is set
+	s.db = dbtest.New()
+	s.outboxRequireTransactions = true
+	if started, _ := s.startRelay(ctx); !started {
+		t.Error("expected the webhooks to be relayed with OUTBOX_POLL_INTERVAL=0")
+	}
+
+	s.webhooks.pollInterval = 0
+	s.AddSink(&recordingSink{})
+	if started, _ := s.startRelay(ctx); started {
+		t.Error("expected nothing to be relayed with both intervals at 0")
+	}
+
+	//the brokers are connected to only once the relay starts, and never without transactions
+	s.nats.URL = "nats://127.0.0.1:1"
+	s.nats.Format = outbox.FORMAT_JSON
+	s.outboxPollInterval = time.Second
+	s.db = newDbMock()
+	if started, err := s.startRelay(ctx); started || err == nil {
+		t.Error("expected brokers that would never be published to to fail the start without transactions")
+	}
+	s.db = dbtest.New()
+	if _, err := s.startRelay(ctx); err == nil {
+		t.Error("expected a broker that cannot be connected to to fail the start of the relay")
+	}
+}
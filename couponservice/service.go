@@ -4,23 +4,66 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/akh-dev/coupons-service/dblayer"
 
 	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/v2"
 	"github.com/akh-dev/coupons-service/config"
+	"github.com/akh-dev/coupons-service/outbox"
 	"github.com/akh-dev/coupons-service/util"
 
+	"github.com/graphql-go/graphql"
 	"github.com/mongodb/mongo-go-driver/mongo"
 )
 
 type CouponService struct {
-	db      dblayer.Interface
-	timeout time.Duration
-	port    string
-	debug   bool
+	db             dblayer.Interface
+	timeout        time.Duration
+	port           string
+	grpcPort       string
+	debug          bool
+	idempotencyTTL time.Duration
+	legacyErrors   bool
+	currency       string
+
+	importChunkSize   int
+	importDateFormats []string
+
+	compression            util.CompressionConfig
+	maxDecompressedRequest int64
+
+	eventsPollInterval  time.Duration
+	expiryCheckInterval time.Duration
+	webhooks            webhookSettings
+	outboxPollInterval  time.Duration
+	outboxLogFile       string
+	//see startRelay
+	outboxRequireTransactions bool
+	//set once the relay hands the events to the webhooks, subscriptions are refused until then
+	webhooksRelayed int32
+	//the message brokers are only connected to once the relay starts
+	nats  config.NATSConf
+	kafka config.KafkaConf
+	//sinks added next to the ones the config turns on
+	sinks []outbox.Sink
+
+	//accepted as an admin key without being stored, see lookupApiKey
+	adminApiKey string
+	apiKeys     *apiKeyCache
+
+	//the event every change up to which was settled when the last full sync ran, see syncPoint
+	syncMu      sync.Mutex
+	syncSettled int64
+
+	graphqlLimits    graphqlLimits
+	graphqlOnce      sync.Once
+	graphqlSchemaObj graphql.Schema
+	graphqlSchemaErr error
 }
 
 func New(cfg *config.Config) (*CouponService, error) {
@@ -41,64 +84,198 @@ func New(cfg *config.Config) (*CouponService, error) {
 		return nil, err
 	}
 
-	db, err := dblayer.New(client, cfg.DB.Name, timeout)
+	db, err := dblayer.New(client, cfg.DB.Name, timeout, time.Duration(cfg.Service.EventsRetention)*time.Hour)
 	if err != nil {
 		log.Printf("Failed to create db layer object: %s", err.Error())
 		return nil, err
 	}
 
+	return NewWithDb(cfg, db)
+}
+
+//NewWithDb creates the service on top of the given db layer, e.g. an in-memory one (see dblayer/dbtest) in tests
+func NewWithDb(cfg *config.Config, db dblayer.Interface) (*CouponService, error) {
+	timeout := time.Duration(cfg.Service.CtxTimeout) * time.Second
+
+	compression := util.CompressionConfig{
+		MinSize:     cfg.Service.CompressionMinSize,
+		GzipLevel:   cfg.Service.GzipLevel,
+		BrotliLevel: cfg.Service.BrotliLevel,
+		ZstdLevel:   cfg.Service.ZstdLevel,
+	}.WithDefaults()
+	if err := compression.Validate(); err != nil {
+		log.Printf("Invalid compression config: %s", err.Error())
+		return nil, err
+	}
+
+	//v2 amounts are converted with the minor unit of the currency
+	if _, err := v2.CurrencyExponent(cfg.Service.Currency); err != nil {
+		log.Printf("Invalid currency: %s", err.Error())
+		return nil, err
+	}
+
 	service := &CouponService{
-		db:      db,
-		timeout: timeout,
-		port:    cfg.Service.Port,
-		debug:   cfg.Service.Debug,
+		db:             db,
+		timeout:        timeout,
+		port:           cfg.Service.Port,
+		grpcPort:       cfg.Service.GrpcPort,
+		debug:          cfg.Service.Debug,
+		idempotencyTTL: time.Duration(cfg.Service.IdempotencyKeyTTL) * time.Hour,
+		legacyErrors:   cfg.Service.LegacyErrors,
+		currency:       cfg.Service.Currency,
+		graphqlLimits: graphqlLimits{
+			maxDepth:      cfg.Service.GraphqlMaxDepth,
+			maxComplexity: cfg.Service.GraphqlMaxComplexity,
+		},
+		importChunkSize:   cfg.Service.ImportChunkSize,
+		importDateFormats: SplitDateFormats(cfg.Service.ImportDateFormats),
+		compression:       compression,
+
+		maxDecompressedRequest: int64(cfg.Service.MaxDecompressedRequestSize),
+
+		eventsPollInterval:  time.Duration(cfg.Service.EventsPollInterval) * time.Millisecond,
+		expiryCheckInterval: time.Duration(cfg.Service.ExpiryCheckInterval) * time.Second,
+		webhooks: webhookSettings{
+			pollInterval: time.Duration(cfg.Service.WebhookPollInterval) * time.Millisecond,
+			timeout:      time.Duration(cfg.Service.WebhookTimeout) * time.Second,
+			maxAttempts:  cfg.Service.WebhookMaxAttempts,
+			minBackoff:   time.Duration(cfg.Service.WebhookMinBackoff) * time.Second,
+			maxBackoff:   time.Duration(cfg.Service.WebhookMaxBackoff) * time.Second,
+			concurrency:  cfg.Service.WebhookConcurrency,
+
+			allowPrivateNetworks: cfg.Service.WebhookAllowPrivateNetworks,
+		},
+		outboxPollInterval: time.Duration(cfg.Service.OutboxPollInterval) * time.Millisecond,
+		outboxLogFile:      cfg.Service.OutboxLogFile,
+
+		outboxRequireTransactions: cfg.Service.OutboxRequireTransactions,
+		nats:                      cfg.NATS,
+		kafka:                     cfg.Kafka,
+
+		adminApiKey: cfg.Service.AdminApiKey,
+		apiKeys:     newApiKeyCache(time.Duration(cfg.Service.ApiKeyCacheTTL) * time.Second),
+	}
+
+	if err := validateBrokers(cfg); err != nil {
+		log.Printf("Failed to set up the message brokers: %s", err.Error())
+		return nil, err
 	}
 
 	return service, nil
 }
 
 func (s *CouponService) ListenAndServe() {
-	http.HandleFunc("/", s.handleCouponsRequest)
+	if err := s.db.Init(); err != nil {
+		log.Printf("Failed to initialise db collections: %s", err.Error())
+	}
+	if err := s.checkApiKeys(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	//the relay is started before the http api, so webhook subscriptions are not refused while it starts
+	started, err := s.startRelay(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to start the outbox relay: %s", err.Error())
+	}
+	if started && s.webhooks.pollInterval > 0 {
+		go s.newWebhookWorker().run(context.Background())
+	}
 
 	go func() {
-		//err := http.ListenAndServeTLS(fmt.Sprintf(":%s", s.port), "cert.pem", "key.pem", new(util.GzipHandler))
-		err := http.ListenAndServe(fmt.Sprintf(":%s", s.port), new(util.GzipHandler))
+		//err := http.ListenAndServeTLS(fmt.Sprintf(":%s", s.port), "cert.pem", "key.pem", s.Handler())
+		err := http.ListenAndServe(fmt.Sprintf(":%s", s.port), s.Handler())
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 	}()
+
+	if s.expiryCheckInterval > 0 {
+		go s.watchExpiries()
+	}
+
+	if s.grpcPort != "" {
+		go func() {
+			lis, err := net.Listen("tcp", fmt.Sprintf(":%s", s.grpcPort))
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			if err := s.NewGrpcServer().Serve(lis); err != nil {
+				log.Fatal(err.Error())
+			}
+		}()
+	}
+}
+
+//Handler serves every route of the http api, with compressed requests and responses and an id for every request
+func (s *CouponService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for path, handler := range s.routes() {
+		mux.HandleFunc(path, handler)
+	}
+
+	return withRequestId(&util.CompressHandler{
+		Compression:    s.compression,
+		MaxRequestSize: s.maxDecompressedRequest,
+		RequestError:   s.respondWithRequestBodyError,
+		Handler:        mux,
+	})
 }
 
 func (s *CouponService) handleCouponsRequest(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Content-Type", ENCODING_JSON)
+
+	version, known := apiVersionFromPath(r.URL.Path)
+	if !known {
+		s.respondWithErrors(w, api.NewErrorf(api.ERR_UNKNOWN_API_VERSION, "%s is not served by any version of the api, use /v%d/", r.URL.Path, API_VERSION_LATEST))
+		return
+	}
+	setVersionHeaders(w, version)
+
+	//writeResponse encodes the response in whatever the Content-Type says
+	encoding, err := responseEncoding(r, version)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", encoding)
+	w.Header().Add("Vary", "Accept")
+
+	if version == API_VERSION_2 && requestEncoding(r) == ENCODING_PROTOBUF {
+		s.respondWithErrors(w, api.NewErrorf(api.ERR_UNSUPPORTED_MEDIA_TYPE, "the v2 api does not take %s requests", ENCODING_PROTOBUF))
+		return
+	}
 
 	baseRequest, err := parseBaseRequest(r)
 	if err != nil {
 		log.Printf("errors during handleCouponsRequest:%s", err.Error())
-		respondBadRequest(w, err.Error())
+		s.respondWithError(w, err)
+		return
 	}
 
-	if !s.authenticate(baseRequest) {
-		respondForbidden(w)
+	if err := s.authenticate(baseRequest); err != nil {
+		s.respondWithError(w, err)
 		return
 	}
+	baseRequest.ApiVersion = version
+	baseRequest.IfMatch = r.Header.Get("If-Match")
+	baseRequest.RequestId = r.Header.Get(REQUEST_ID_HEADER)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		baseRequest.IdempotencyKey = key
+	}
 
-	switch r.Method {
-	case http.MethodGet:
-		s.handleListCoupons(w, baseRequest)
-	case http.MethodPost:
-		s.handleCreateCoupon(w, baseRequest)
-	case http.MethodPut:
-		s.handleUpdateCoupon(w, baseRequest)
-	default:
-		respondBadRequest(w, "unknown request")
+	op, found := s.couponOperations()[r.Method]
+	if !found {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "unknown request"))
+		return
 	}
+	op.handle(w, baseRequest)
 }
 
 func (s *CouponService) handleListCoupons(w http.ResponseWriter, r *api.Request) {
-	filter, err := extractCouponFilterFromRequest(r)
+	filter, err := s.filterFromRequest(r)
 	if err != nil {
-		respondBadRequest(w, err.Error())
+		s.respondWithError(w, err)
+		return
 	}
 
 	if s.debug {
@@ -107,112 +284,120 @@ func (s *CouponService) handleListCoupons(w http.ResponseWriter, r *api.Request)
 
 	coupons, err := s.db.SearchFromRequest(filter)
 	if err != nil {
-		respObj := &api.Response{Error: []string{err.Error()}}
-		writeResponse(w, respObj)
+		s.respondWithError(w, err)
 		return
 	}
 
-	respondWithCoupons(w, coupons)
+	//a single coupon carries its version as an ETag, so it can be sent back in If-Match when updating
+	if len(coupons) == 1 {
+		w.Header().Set("ETag", etagForVersion(coupons[0].Version))
+	}
+
+	s.respondWithCoupons(w, r, coupons)
 	return
 }
 
 func (s *CouponService) handleCreateCoupon(w http.ResponseWriter, r *api.Request) {
 
-	cpnCollection, err := extractCouponsFromRequest(r)
+	cpnCollection, err := s.couponsFromRequest(r)
 	if err != nil {
-		respondBadRequest(w, err.Error())
-	}
-
-	if s.debug {
-		log.Printf("coupon data: %s", string(r.Data))
-	}
-
-	if validationSuccess, errors := s.validateManyForInsert(cpnCollection); !validationSuccess {
-		respObj := &api.Response{Error: errors}
-		writeResponse(w, respObj)
+		s.respondWithError(w, err)
 		return
 	}
 
 	if s.debug {
-		log.Println("Creating new coupons")
-	}
-
-	res, err := s.db.CreateCoupons(cpnCollection.Coupons)
-	if err != nil {
-		respObj := &api.Response{Error: []string{err.Error()}}
-		writeResponse(w, respObj)
-		return
+		log.Printf("coupon data: %s", string(r.Data))
 	}
-	log.Printf("%d coupons created", len(res.InsertedIDs))
 
-	coupons, err := s.db.FindByIds(res.InsertedIDs)
+	outcome, err := s.createCoupons(actorFromRequest(r), cpnCollection)
 	if err != nil {
-		respObj := &api.Response{Error: []string{err.Error()}}
-		writeResponse(w, respObj)
+		if isPersisted(err) {
+			markPersisted(w)
+		}
+		s.respondWithError(w, err)
 		return
 	}
 
-	respondWithCoupons(w, coupons)
+	s.respondWithOutcome(w, r, outcome)
 	return
 }
 
 func (s *CouponService) handleUpdateCoupon(w http.ResponseWriter, r *api.Request) {
-	cpnCollection, err := extractCouponsFromRequest(r)
+	cpnCollection, err := s.couponsFromRequest(r)
 	if err != nil {
-		respondBadRequest(w, err.Error())
+		s.respondWithError(w, err)
+		return
 	}
 
 	if s.debug {
 		log.Printf("coupon data: %s", string(r.Data))
 	}
 
-	if validationSuccess, errors := s.validateManyForUpdate(cpnCollection); !validationSuccess {
-		respObj := &api.Response{Error: errors}
-		writeResponse(w, respObj)
+	if err := applyIfMatch(r, cpnCollection); err != nil {
+		s.respondWithError(w, err)
 		return
 	}
 
-	if s.debug {
-		log.Println("Updating coupons")
+	outcome, err := s.updateCoupons(actorFromRequest(r), cpnCollection)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
 	}
 
-	updCount, err := s.db.UpdateCoupons(cpnCollection.Coupons)
+	s.respondWithOutcome(w, r, outcome)
+	return
+}
+
+func (s *CouponService) handleDeleteCoupon(w http.ResponseWriter, r *api.Request) {
+	cpnCollection, err := s.couponsFromRequest(r)
 	if err != nil {
-		respObj := &api.Response{Error: []string{err.Error()}}
-		writeResponse(w, respObj)
+		s.respondWithError(w, err)
 		return
 	}
 
-	log.Printf("%d coupons updated", updCount)
+	if s.debug {
+		log.Printf("coupon data: %s", string(r.Data))
+	}
 
-	cpnIDs := []interface{}{}
-	for _, cpn := range cpnCollection.Coupons {
-		cpnIDs = append(cpnIDs, cpn.Id)
+	if err := applyIfMatch(r, cpnCollection); err != nil {
+		s.respondWithError(w, err)
+		return
 	}
 
-	coupons, err := s.db.FindByIds(cpnIDs)
+	outcome, err := s.deleteCoupons(actorFromRequest(r), cpnCollection)
 	if err != nil {
-		respObj := &api.Response{Error: []string{err.Error()}}
-		writeResponse(w, respObj)
+		s.respondWithError(w, err)
 		return
 	}
 
-	respondWithCoupons(w, coupons)
+	s.respondWithOutcome(w, r, outcome)
 	return
 }
 
-func (s *CouponService) authenticate(r *api.Request) bool {
+//the http header the api key is sent in by requests whose body is not an api.Request (GraphQL, csv imports)
+const API_KEY_HEADER string = "X-API-Key"
 
-	//TODO: replace stud with user lookup
+func (s *CouponService) authenticate(r *api.Request) error {
 	if r == nil {
+		r = &api.Request{}
+	}
+	_, err := s.authenticateKey(r.ApiKey)
+	return err
+}
+
+//authenticateKey looks up the api key, see lookupApiKey
+func (s *CouponService) authenticateKey(apiKey string) (*api.ApiKey, error) {
+	if apiKey == "" {
 		log.Println("No API key provided, authentication failed")
-		return false
+		return nil, api.NewError(api.ERR_UNAUTHENTICATED, "An API key must be provided")
 	}
-	if r.ApiKey != "Valid API Key" {
-		log.Printf("invalid key provided: %s - Authentication failed", r.ApiKey)
-		return false
+
+	key, err := s.lookupApiKey(apiKey)
+	if err != nil {
+		log.Printf("key %s not accepted: %s - Authentication failed", principalForKey(apiKey), err.Error())
+		return nil, err
 	}
 
 	log.Println("Authentication successful")
-	return true
+	return key, nil
 }
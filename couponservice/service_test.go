@@ -2,18 +2,21 @@ package couponservice
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 	"time"
 
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
 	"github.com/mongodb/mongo-go-driver/mongo"
 
 	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
 
 	"github.com/akh-dev/coupons-service/config"
 )
@@ -26,6 +29,8 @@ const (
 	svcContextTimeoutExpected int    = 5
 	svcPortExpected           string = "80"
 	svcDebugExpected          bool   = false
+	svcLegacyErrorsExpected   bool   = false
+	svcCurrencyExpected       string = "GBP"
 )
 
 func TestNew(t *testing.T) {
@@ -126,8 +131,8 @@ func TestHandleListCoupons(t *testing.T) {
 		return
 	}
 
-	if len(resp.Error) > 0 {
-		t.Errorf("Service returned unexpected errors: %s", strings.Join(resp.Error, ":"))
+	if len(resp.Errors) > 0 {
+		t.Errorf("Service returned unexpected errors: %+v", resp.Errors)
 	}
 
 }
@@ -167,8 +172,8 @@ func TestHandleCreateCoupon(t *testing.T) {
 		return
 	}
 
-	if len(resp.Error) > 0 {
-		t.Errorf("Service returned unexpected errors: %s", strings.Join(resp.Error, ":"))
+	if len(resp.Errors) > 0 {
+		t.Errorf("Service returned unexpected errors: %+v", resp.Errors)
 	}
 
 }
@@ -208,8 +213,149 @@ func TestHandleUpdateCoupon(t *testing.T) {
 		return
 	}
 
-	if len(resp.Error) > 0 {
-		t.Errorf("Service returned unexpected errors: %s", strings.Join(resp.Error, ":"))
+	if len(resp.Errors) > 0 {
+		t.Errorf("Service returned unexpected errors: %+v", resp.Errors)
+	}
+}
+
+func TestHandleUpdateCouponConflict(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex("5c58ea1afaa48016746e59b9")
+	mock := newDbMock()
+	mock.updateErr = &dblayer.ConflictError{Current: []api.Coupon{{Id: id, Name: "Save £1 at Tesco", Version: 3}}}
+	s.db = mock
+
+	payload := `{"coupons":[{"id":"5c58ea1afaa48016746e59b9","name":"Save. Tesco. $1","version":2}]}`
+	r := &api.Request{
+		ApiKey: "dont care",
+		Data:   []byte(payload),
+	}
+
+	w := httptest.NewRecorder()
+	s.handleUpdateCoupon(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected http status %d, but got %d", http.StatusConflict, w.Code)
+		return
+	}
+
+	resp := &struct {
+		Errors []api.Error  `json:"errors"`
+		Result []api.Coupon `json:"result"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_VERSION_CONFLICT {
+		t.Errorf("expected a version conflict error in the response, but got %+v", resp.Errors)
+	}
+	if len(resp.Result) != 1 || resp.Result[0].Version != 3 {
+		t.Errorf("expected the current coupon version 3 in the response, but got %+v", resp.Result)
+	}
+}
+
+func TestHandleDeleteCoupon(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex("5c58ea1afaa48016746e59b9")
+	mock := newDbMock()
+	mock.coupons[id] = api.Coupon{Id: id, Name: "Save £1 at Tesco", Version: 2}
+	s.db = mock
+
+	tests := []struct {
+		name           string
+		payload        string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"deletes", `{"coupons":[{"id":"5c58ea1afaa48016746e59b9","version":2}]}`, http.StatusOK, ""},
+		{"no coupons", `{"coupons":[]}`, http.StatusBadRequest, api.ERR_NO_COUPONS},
+		{"no version", `{"coupons":[{"id":"5c58ea1afaa48016746e59b9"}]}`, http.StatusBadRequest, api.ERR_VERSION_REQUIRED},
+		{"no id", `{"coupons":[{"version":2}]}`, http.StatusBadRequest, api.ERR_ID_REQUIRED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleDeleteCoupon(w, &api.Request{ApiKey: "dont care", Data: []byte(test.payload)})
+
+			resp := &struct {
+				Errors []api.Error  `json:"errors"`
+				Result []api.Coupon `json:"result"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if w.Code != test.expectedStatus {
+				t.Errorf("expected http status %d, but got %d (%+v)", test.expectedStatus, w.Code, resp.Errors)
+			}
+			if test.expectedCode == "" {
+				if len(resp.Result) != 1 || resp.Result[0].Id != id {
+					t.Errorf("expected the deleted coupon in the response, but got %+v", resp.Result)
+				}
+				return
+			}
+			if len(resp.Errors) == 0 || resp.Errors[0].Code != test.expectedCode {
+				t.Errorf("expected the error %s, but got %+v", test.expectedCode, resp.Errors)
+			}
+		})
+	}
+
+	if _, found := mock.coupons[id]; found {
+		t.Error("expected the coupon to be deleted")
+	}
+}
+
+func TestHandleDeleteCouponConflict(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	id, _ := primitive.ObjectIDFromHex("5c58ea1afaa48016746e59b9")
+	mock := newDbMock()
+	mock.updateErr = &dblayer.ConflictError{Current: []api.Coupon{{Id: id, Name: "Save £1 at Tesco", Version: 3}}}
+	s.db = mock
+
+	w := httptest.NewRecorder()
+	s.handleDeleteCoupon(w, &api.Request{ApiKey: "dont care", Data: []byte(`{"coupons":[{"id":"5c58ea1afaa48016746e59b9"}]}`), IfMatch: `"2"`})
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected http status %d, but got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestApplyIfMatch(t *testing.T) {
+	cpnCollection := &api.CouponCollection{Coupons: []api.Coupon{{Name: "Save £1 at Tesco"}}}
+
+	if err := applyIfMatch(&api.Request{IfMatch: `"4"`}, cpnCollection); err != nil {
+		t.Error(err)
+	}
+	if cpnCollection.Coupons[0].Version != 4 {
+		t.Errorf("expected version to be taken from If-Match, but got %d", cpnCollection.Coupons[0].Version)
+	}
+
+	if err := applyIfMatch(&api.Request{IfMatch: `"5"`}, cpnCollection); err == nil {
+		t.Error("expected an error when If-Match does not match the version in the payload")
+	}
+
+	cpnCollection.Coupons = append(cpnCollection.Coupons, api.Coupon{Name: "Save £2 at Boots"})
+	if err := applyIfMatch(&api.Request{IfMatch: `"4"`}, cpnCollection); err == nil {
+		t.Error("expected an error when If-Match is used with several coupons")
 	}
 }
 
@@ -227,17 +373,26 @@ func TestAuthenticate(t *testing.T) {
 		ApiKey: "some invalid key",
 		Data:   []byte(payload),
 	}
-	if authenticated := s.authenticate(req1); authenticated {
+	if err := s.authenticate(req1); err == nil {
 		t.Error("authentication failed: the call was able to authenticate with an invalid key")
+	} else if apiErrorFrom(err).Code != api.ERR_FORBIDDEN {
+		t.Errorf("expected an invalid key to be forbidden, but got %+v", err)
 	}
 
 	req2 := &api.Request{
 		ApiKey: "Valid API Key",
 		Data:   []byte(payload),
 	}
-	if authenticated := s.authenticate(req2); !authenticated {
+	if err := s.authenticate(req2); err != nil {
 		t.Error("authentication failed: the call was not able to authenticate with a valid key")
 	}
+
+	req3 := &api.Request{
+		Data: []byte(payload),
+	}
+	if err := s.authenticate(req3); err == nil || apiErrorFrom(err).Code != api.ERR_UNAUTHENTICATED {
+		t.Errorf("expected a missing key to be unauthenticated, but got %+v", err)
+	}
 }
 
 func newMockConfig() *config.Config {
@@ -250,9 +405,13 @@ func newMockConfig() *config.Config {
 	}
 
 	cfg.Service = config.ServiceConf{
-		CtxTimeout: svcContextTimeoutExpected,
-		Port:       svcPortExpected,
-		Debug:      svcDebugExpected,
+		CtxTimeout:   svcContextTimeoutExpected,
+		Port:         svcPortExpected,
+		Debug:        svcDebugExpected,
+		LegacyErrors: svcLegacyErrorsExpected,
+		Currency:     svcCurrencyExpected,
+		//the tests authenticate with the admin key of the config, see apikeys_test.go for the stored keys
+		AdminApiKey: "Valid API Key",
 	}
 
 	return cfg
@@ -268,32 +427,187 @@ type DbMock struct {
 	mongoClient *mongo.Client
 	dbName      string
 	timeout     time.Duration
+
+	updateErr error
+	searchErr error
+	findErr   error
+
+	createCalls int
+	//the create call that fails, 0 lets every call succeed
+	failCreateCall int
+	//the number of times storing an idempotent response fails before it succeeds
+	failCompleteCalls int
+	coupons           map[primitive.ObjectID]api.Coupon
+	idempotencyKeys   map[string]*dblayer.IdempotencyRecord
+	events            []api.CouponEvent
+
+	//webhooks, relay checkpoints, the audit log, the coupon history, the api keys and the imports are kept in memory, the tests of the mock do not cover them
+	dblayer.WebhookStore
+	dblayer.OutboxStore
+	dblayer.AuditStore
+	dblayer.VersionStore
+	dblayer.ApiKeyStore
+	dblayer.ImportStore
+}
+
+func (mock *DbMock) Init() error {
+	return nil
 }
 
-func (mock *DbMock) CreateCoupons(coupons []api.Coupon) (*mongo.InsertManyResult, error) {
+func (mock *DbMock) CreateCoupons(actor api.Actor, coupons []api.Coupon) (*mongo.InsertManyResult, error) {
+	mock.createCalls++
+	if mock.createCalls == mock.failCreateCall {
+		return nil, fmt.Errorf("insert failed")
+	}
 	insRes := &mongo.InsertManyResult{
 		InsertedIDs: []interface{}{},
 	}
 
+	for _, cpn := range coupons {
+		cpn.Id = primitive.NewObjectID()
+		cpn.Version = 1
+		mock.coupons[cpn.Id] = cpn
+		insRes.InsertedIDs = append(insRes.InsertedIDs, cpn.Id)
+	}
+
 	return insRes, nil
 }
 
-func (mock *DbMock) UpdateCoupons(coupons []api.Coupon) (int64, error) {
+func (mock *DbMock) UpdateCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+	if mock.updateErr != nil {
+		return 0, mock.updateErr
+	}
 	return 0, nil
 }
 
+func (mock *DbMock) RevertCoupon(actor api.Actor, cpn api.Coupon) error {
+	return mock.updateErr
+}
+
+func (mock *DbMock) DeleteCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+	if mock.updateErr != nil {
+		return 0, mock.updateErr
+	}
+	for _, cpn := range coupons {
+		delete(mock.coupons, cpn.Id)
+	}
+	return int64(len(coupons)), nil
+}
+
 func (mock *DbMock) FindByIds(ids []interface{}) ([]api.Coupon, error) {
-	return []api.Coupon{}, nil
+	if mock.findErr != nil {
+		return nil, mock.findErr
+	}
+	coupons := []api.Coupon{}
+	for _, id := range ids {
+		if cpn, found := mock.coupons[id.(primitive.ObjectID)]; found {
+			coupons = append(coupons, cpn)
+		}
+	}
+	return coupons, nil
+}
+
+func (mock *DbMock) BatchWriteMode() string {
+	return dblayer.WRITE_MODE_COMPENSATING
 }
 
 func (mock *DbMock) SearchFromRequest(reqFilter *api.CouponFilter) ([]api.Coupon, error) {
+	if mock.searchErr != nil {
+		return nil, mock.searchErr
+	}
 	return []api.Coupon{}, nil
 }
 
+//SearchEach ignores the filter and goes through every stored coupon
+func (mock *DbMock) SearchEach(ctx context.Context, reqFilter *api.CouponFilter, fn func(cpn api.Coupon) error) error {
+	if mock.searchErr != nil {
+		return mock.searchErr
+	}
+	for _, cpn := range mock.coupons {
+		if err := fn(cpn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *DbMock) LastImportedRow(importId string) (int, error) {
+	last := 0
+	for _, cpn := range mock.coupons {
+		if cpn.Import != nil && cpn.Import.Id == importId && cpn.Import.Row > last {
+			last = cpn.Import.Row
+		}
+	}
+	return last, nil
+}
+
+//EventsAfter takes a missing sequence number for a write that is still pending
+func (mock *DbMock) EventsAfter(ctx context.Context, after int64, limit int) ([]api.CouponEvent, int64, error) {
+	events := []api.CouponEvent{}
+	settled := after
+	for _, event := range mock.events {
+		if event.Seq <= after {
+			continue
+		}
+		if event.Seq != settled+1 || len(events) == limit {
+			break
+		}
+		events = append(events, event)
+		settled = event.Seq
+	}
+	return events, settled, nil
+}
+
+func (mock *DbMock) EventBounds() (oldest, newest int64, err error) {
+	if len(mock.events) == 0 {
+		return 0, 0, nil
+	}
+	return mock.events[0].Seq, mock.events[len(mock.events)-1].Seq, nil
+}
+
+func (mock *DbMock) ExpireCoupons(now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (mock *DbMock) ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*dblayer.IdempotencyRecord, bool, error) {
+	if existing, found := mock.idempotencyKeys[key]; found {
+		return existing, false, nil
+	}
+	record := &dblayer.IdempotencyRecord{Key: key, RequestHash: requestHash}
+	mock.idempotencyKeys[key] = record
+	return record, true, nil
+}
+
+func (mock *DbMock) CompleteIdempotencyKey(key string, statusCode int, response []byte) error {
+	if mock.failCompleteCalls > 0 {
+		mock.failCompleteCalls--
+		return fmt.Errorf("update failed")
+	}
+	record := mock.idempotencyKeys[key]
+	record.Completed = true
+	record.StatusCode = statusCode
+	record.Response = response
+	return nil
+}
+
+func (mock *DbMock) ReleaseIdempotencyKey(key string) error {
+	delete(mock.idempotencyKeys, key)
+	return nil
+}
+
 func newDbMock() *DbMock {
+	store := dbtest.New()
 	return &DbMock{
-		mongoClient: nil,
-		timeout:     time.Duration(1) * time.Second,
-		dbName:      "test",
+		mongoClient:     nil,
+		timeout:         time.Duration(1) * time.Second,
+		dbName:          "test",
+		coupons:         map[primitive.ObjectID]api.Coupon{},
+		idempotencyKeys: map[string]*dblayer.IdempotencyRecord{},
+		WebhookStore:    store,
+		OutboxStore:     store,
+		AuditStore:      store,
+		VersionStore:    store,
+		ApiKeyStore:     store,
+		ImportStore:     store,
 	}
 }
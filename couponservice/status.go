@@ -0,0 +1,122 @@
+package couponservice
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//httpStatusByCode is the single place that decides which http status an api error code is reported with
+var httpStatusByCode = map[string]int{
+	api.ERR_INVALID_REQUEST:   http.StatusBadRequest,
+	api.ERR_UNKNOWN_OPERATION: http.StatusMethodNotAllowed,
+	api.ERR_NO_COUPONS:        http.StatusBadRequest,
+	api.ERR_INVALID_FILTER:    http.StatusBadRequest,
+	api.ERR_INVALID_IF_MATCH:  http.StatusBadRequest,
+	api.ERR_INVALID_QUERY:     http.StatusBadRequest,
+	api.ERR_INVALID_CSV:       http.StatusBadRequest,
+	api.ERR_QUERY_TOO_DEEP:    http.StatusBadRequest,
+	api.ERR_QUERY_TOO_COMPLEX: http.StatusBadRequest,
+
+	api.ERR_INVALID_SYNC_TOKEN: http.StatusBadRequest,
+
+	//missing or malformed fields
+	api.ERR_COUPON_MISSING:   http.StatusBadRequest,
+	api.ERR_NAME_REQUIRED:    http.StatusBadRequest,
+	api.ERR_BRAND_REQUIRED:   http.StatusBadRequest,
+	api.ERR_ID_REQUIRED:      http.StatusBadRequest,
+	api.ERR_ID_INVALID:       http.StatusBadRequest,
+	api.ERR_DUPLICATE_ID:     http.StatusBadRequest,
+	api.ERR_VERSION_REQUIRED: http.StatusBadRequest,
+	api.ERR_READ_ONLY_FIELD:  http.StatusBadRequest,
+
+	api.ERR_INVALID_FIELD_FORMAT: http.StatusBadRequest,
+
+	//well formed, but semantically invalid
+	api.ERR_VALUE_NOT_POSITIVE:     http.StatusUnprocessableEntity,
+	api.ERR_EXPIRY_TOO_EARLY:       http.StatusUnprocessableEntity,
+	api.ERR_UNKNOWN_API_VERSION:    http.StatusNotFound,
+	api.ERR_UNSUPPORTED_CURRENCY:   http.StatusUnprocessableEntity,
+	api.ERR_IDEMPOTENCY_KEY_REUSED: http.StatusUnprocessableEntity,
+	api.ERR_INVALID_SUBSCRIPTION:   http.StatusUnprocessableEntity,
+	api.ERR_INVALID_API_KEY:        http.StatusUnprocessableEntity,
+
+	api.ERR_UNAUTHENTICATED: http.StatusUnauthorized,
+	api.ERR_FORBIDDEN:       http.StatusForbidden,
+
+	api.ERR_COUPON_NOT_FOUND:         http.StatusNotFound,
+	api.ERR_COUPON_VERSION_NOT_FOUND: http.StatusNotFound,
+	api.ERR_SUBSCRIPTION_NOT_FOUND:   http.StatusNotFound,
+	api.ERR_DELIVERY_NOT_FOUND:       http.StatusNotFound,
+	api.ERR_API_KEY_NOT_FOUND:        http.StatusNotFound,
+
+	api.ERR_NOT_ACCEPTABLE:         http.StatusNotAcceptable,
+	api.ERR_UNSUPPORTED_MEDIA_TYPE: http.StatusUnsupportedMediaType,
+	api.ERR_REQUEST_TOO_LARGE:      http.StatusRequestEntityTooLarge,
+
+	api.ERR_VERSION_CONFLICT:       http.StatusConflict,
+	api.ERR_IDEMPOTENCY_KEY_IN_USE: http.StatusConflict,
+
+	api.ERR_SYNC_TOKEN_EXPIRED: http.StatusGone,
+
+	api.ERR_WEBHOOKS_UNAVAILABLE: http.StatusServiceUnavailable,
+
+	api.ERR_DB_UNAVAILABLE:          http.StatusServiceUnavailable,
+	api.ERR_DB_FAILURE:              http.StatusInternalServerError,
+	api.ERR_BATCH_PARTIALLY_APPLIED: http.StatusInternalServerError,
+	api.ERR_INTERNAL:                http.StatusInternalServerError,
+}
+
+func httpStatusForCode(code string) int {
+	if status, found := httpStatusByCode[code]; found {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+//httpStatusForErrors picks the status of a response carrying several errors: server side failures win,
+//errors that all agree keep their status, and a mix of client errors is reported as a plain bad request
+func httpStatusForErrors(errs []api.Error) int {
+	if len(errs) == 0 {
+		return http.StatusOK
+	}
+
+	status := httpStatusForCode(errs[0].Code)
+	for _, e := range errs[1:] {
+		next := httpStatusForCode(e.Code)
+		switch {
+		case next == status:
+		case next >= http.StatusInternalServerError || status >= http.StatusInternalServerError:
+			if next > status {
+				status = next
+			}
+		default:
+			status = http.StatusBadRequest
+		}
+	}
+
+	return status
+}
+
+//grpcCodeByStatus translates the http statuses to grpc codes, so both apis report a failure the same way
+var grpcCodeByStatus = map[int]codes.Code{
+	http.StatusOK:                  codes.OK,
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusMethodNotAllowed:    codes.Unimplemented,
+	http.StatusConflict:            codes.Aborted,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+func grpcCodeForStatus(status int) codes.Code {
+	if code, found := grpcCodeByStatus[status]; found {
+		return code
+	}
+	return codes.Internal
+}
@@ -0,0 +1,177 @@
+package couponservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+func TestHandleCouponsRequestStatus(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("5c58ea1afaa48016746e59b9")
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		mock           func(mock *DbMock)
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "list",
+			method:         http.MethodGet,
+			body:           `{"apiKey":"Valid API Key","data":{}}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "malformed request",
+			method:         http.MethodGet,
+			body:           `{"apiKey":`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   api.ERR_INVALID_REQUEST,
+		},
+		{
+			name:           "missing api key",
+			method:         http.MethodGet,
+			body:           `{"data":{}}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedCode:   api.ERR_UNAUTHENTICATED,
+		},
+		{
+			name:           "invalid api key",
+			method:         http.MethodGet,
+			body:           `{"apiKey":"some invalid key","data":{}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   api.ERR_FORBIDDEN,
+		},
+		{
+			name:           "malformed filter",
+			method:         http.MethodGet,
+			body:           `{"apiKey":"Valid API Key","data":{"valueFrom":"one"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   api.ERR_INVALID_FILTER,
+		},
+		{
+			name:           "missing coupon field",
+			method:         http.MethodPost,
+			body:           `{"apiKey":"Valid API Key","data":{"atomic":true,"coupons":[{"brand":"Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   api.ERR_NAME_REQUIRED,
+		},
+		{
+			name:           "expiry in the past",
+			method:         http.MethodPost,
+			body:           `{"apiKey":"Valid API Key","data":{"atomic":true,"coupons":[{"name":"Save £1 at Tesco","brand":"Tesco","value":1,"expiry":"2000-03-01T00:00:00Z"}]}}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   api.ERR_EXPIRY_TOO_EARLY,
+		},
+		{
+			name:           "every item of a batch invalid",
+			method:         http.MethodPost,
+			body:           `{"apiKey":"Valid API Key","data":{"coupons":[{"name":"Save £1 at Tesco","value":1,"expiry":"2019-03-01T00:00:00Z"}]}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing coupon",
+			method:         http.MethodPut,
+			body:           `{"apiKey":"Valid API Key","data":{"atomic":true,"coupons":[{"id":"5c58ea1afaa48016746e59b9","value":2,"version":1}]}}`,
+			mock:           func(mock *DbMock) { mock.updateErr = api.NewError(api.ERR_COUPON_NOT_FOUND, "coupon does not exist") },
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   api.ERR_COUPON_NOT_FOUND,
+		},
+		{
+			name:   "version conflict",
+			method: http.MethodPut,
+			body:   `{"apiKey":"Valid API Key","data":{"atomic":true,"coupons":[{"id":"5c58ea1afaa48016746e59b9","value":2,"version":1}]}}`,
+			mock: func(mock *DbMock) {
+				mock.updateErr = &dblayer.ConflictError{Current: []api.Coupon{{Id: id, Version: 2}}}
+			},
+			expectedStatus: http.StatusConflict,
+			expectedCode:   api.ERR_VERSION_CONFLICT,
+		},
+		{
+			name:           "db down",
+			method:         http.MethodGet,
+			body:           `{"apiKey":"Valid API Key","data":{}}`,
+			mock:           func(mock *DbMock) { mock.searchErr = api.NewError(api.ERR_DB_UNAVAILABLE, "no reachable servers") },
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedCode:   api.ERR_DB_UNAVAILABLE,
+		},
+		{
+			name:           "unknown operation",
+			method:         http.MethodPatch,
+			body:           `{"apiKey":"Valid API Key","data":{}}`,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedCode:   api.ERR_UNKNOWN_OPERATION,
+		},
+	}
+
+	for _, tc := range testCases {
+		s, err := getNewSvc()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		mock := newDbMock()
+		if tc.mock != nil {
+			tc.mock(mock)
+		}
+		s.db = mock
+
+		r, err := http.NewRequest(tc.method, "http://localhost/", bytes.NewBufferString(tc.body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w := httptest.NewRecorder()
+		s.handleCouponsRequest(w, r)
+
+		if w.Code != tc.expectedStatus {
+			t.Errorf("%s: expected http status %d, but got %d", tc.name, tc.expectedStatus, w.Code)
+		}
+
+		resp := &api.Response{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Errorf("%s: %s", tc.name, err.Error())
+			continue
+		}
+
+		if tc.expectedCode != "" && (len(resp.Errors) == 0 || resp.Errors[0].Code != tc.expectedCode) {
+			t.Errorf("%s: expected error code %s, but got %+v", tc.name, tc.expectedCode, resp.Errors)
+		}
+	}
+}
+
+func TestHttpStatusForErrors(t *testing.T) {
+	testCases := []struct {
+		codes    []string
+		expected int
+	}{
+		{[]string{}, http.StatusOK},
+		{[]string{api.ERR_VALUE_NOT_POSITIVE, api.ERR_EXPIRY_TOO_EARLY}, http.StatusUnprocessableEntity},
+		{[]string{api.ERR_NAME_REQUIRED, api.ERR_EXPIRY_TOO_EARLY}, http.StatusBadRequest},
+		{[]string{api.ERR_NAME_REQUIRED, api.ERR_DB_UNAVAILABLE}, http.StatusServiceUnavailable},
+		{[]string{api.ERR_DB_UNAVAILABLE, api.ERR_NAME_REQUIRED}, http.StatusServiceUnavailable},
+		{[]string{"some_unknown_code"}, http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		errs := []api.Error{}
+		for _, code := range tc.codes {
+			errs = append(errs, api.NewError(code, code))
+		}
+
+		if status := httpStatusForErrors(errs); status != tc.expected {
+			t.Errorf("%v: expected http status %d, but got %d", tc.codes, tc.expected, status)
+		}
+	}
+}
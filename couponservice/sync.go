@@ -0,0 +1,179 @@
+package couponservice
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	SYNC_PATH string = "/sync"
+
+	//sync tokens are versioned, so their format can change without breaking the tokens clients hold
+	syncTokenPrefix = "s1."
+)
+
+//a sync token is the sequence number of the last coupon event the client has seen
+func encodeSyncToken(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(syncTokenPrefix + strconv.FormatInt(seq, 10)))
+}
+
+func decodeSyncToken(token string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || !strings.HasPrefix(string(raw), syncTokenPrefix) {
+		return 0, api.NewError(api.ERR_INVALID_SYNC_TOKEN, "the sync token was not issued by this service")
+	}
+
+	seq, err := strconv.ParseInt(strings.TrimPrefix(string(raw), syncTokenPrefix), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, api.NewError(api.ERR_INVALID_SYNC_TOKEN, "the sync token was not issued by this service")
+	}
+	return seq, nil
+}
+
+//syncPoint is the event a full sync is consistent with. Every change up to it is settled (see eventCursor),
+//so a read of the coupons made afterwards holds them all. Later changes may be in the read too, they are sent again by the next sync.
+//The log is read from where the previous full sync of the instance got to.
+func (s *CouponService) syncPoint(ctx context.Context) (int64, error) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	oldest, _, err := s.db.EventBounds()
+	if err != nil {
+		return 0, err
+	}
+
+	//every event before the oldest kept one was settled long ago
+	cursor := &eventCursor{db: s.db, last: s.syncSettled}
+	if cursor.last < oldest-1 {
+		cursor.last = oldest - 1
+	}
+	for {
+		if _, err := cursor.next(ctx); err != nil {
+			return 0, err
+		}
+		if !cursor.more {
+			break
+		}
+	}
+
+	s.syncSettled = cursor.last
+	return cursor.last, nil
+}
+
+//fullSync returns every coupon and the token the changes made since are synced with
+func (s *CouponService) fullSync(ctx context.Context) (*api.SyncResult, error) {
+	point, err := s.syncPoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coupons := []api.Coupon{}
+	err = s.db.SearchEach(ctx, &api.CouponFilter{}, func(cpn api.Coupon) error {
+		coupons = append(coupons, cpn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.SyncResult{Coupons: coupons, Deleted: []api.Tombstone{}, Token: encodeSyncToken(point), Full: true}, nil
+}
+
+//deltaSync returns the coupons changed since the event with the given sequence number, a page of events at a time.
+//A coupon changed several times is reported once, with its current state.
+func (s *CouponService) deltaSync(ctx context.Context, since int64) (*api.SyncResult, error) {
+	oldest, _, err := s.db.EventBounds()
+	if err != nil {
+		return nil, err
+	}
+	if oldest > since+1 {
+		return nil, api.NewError(api.ERR_SYNC_TOKEN_EXPIRED, "the changes since the sync token are no longer kept, sync without a token")
+	}
+
+	cursor := &eventCursor{db: s.db, last: since}
+	events, err := cursor.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	//the last event of a coupon decides whether it is reported as changed or deleted
+	lastEvents := map[primitive.ObjectID]api.CouponEvent{}
+	order := []primitive.ObjectID{}
+	for _, event := range events {
+		if _, seen := lastEvents[event.CouponId]; !seen {
+			order = append(order, event.CouponId)
+		}
+		lastEvents[event.CouponId] = event
+	}
+
+	result := &api.SyncResult{
+		Coupons: []api.Coupon{},
+		Deleted: []api.Tombstone{},
+		Token:   encodeSyncToken(cursor.last),
+		HasMore: cursor.more,
+	}
+
+	changed := []interface{}{}
+	for _, id := range order {
+		event := lastEvents[id]
+		if event.Type == api.EVENT_DELETED {
+			result.Deleted = append(result.Deleted, api.Tombstone{Id: id, Version: event.Version, DeletedAt: event.At})
+			continue
+		}
+		changed = append(changed, id)
+	}
+
+	//a coupon deleted after the last event of the page is not found, its tombstone comes with a later page
+	if len(changed) > 0 {
+		if result.Coupons, err = s.db.FindByIds(changed); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+//handleSync returns the coupons created, modified or deleted since the token, or every coupon when there is no token.
+//The api key is sent in the X-API-Key header.
+func (s *CouponService) handleSync(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "changes are synced with GET"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	var result *api.SyncResult
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		var err error
+		if result, err = s.fullSync(r.Context()); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+	} else {
+		since, err := decodeSyncToken(token)
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		if result, err = s.deltaSync(r.Context(), since); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+	}
+
+	writeResponse(w, s.newResponse(result))
+}
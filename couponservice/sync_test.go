@@ -0,0 +1,142 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+type syncResponse struct {
+	Errors []api.Error     `json:"errors"`
+	Result *api.SyncResult `json:"result"`
+}
+
+func doSync(s *CouponService, token string) (int, *syncResponse) {
+	query := ""
+	if token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+	r := httptest.NewRequest(http.MethodGet, SYNC_PATH+query, nil)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	w := httptest.NewRecorder()
+	s.handleSync(w, r)
+
+	resp := &syncResponse{}
+	json.NewDecoder(w.Body).Decode(resp)
+	return w.Code, resp
+}
+
+func TestSyncTokens(t *testing.T) {
+	for _, seq := range []int64{0, 1, 123456789} {
+		decoded, err := decodeSyncToken(encodeSyncToken(seq))
+		if err != nil || decoded != seq {
+			t.Errorf("expected the token of %d to decode to it, but got %d (%v)", seq, decoded, err)
+		}
+	}
+
+	for _, token := range []string{"42", "not base64!", encodeSyncToken(1)[:4]} {
+		if _, err := decodeSyncToken(token); err == nil {
+			t.Errorf("expected the token %s to be rejected", token)
+		}
+	}
+}
+
+func TestHandleSync(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	kept := api.Coupon{Id: primitive.NewObjectID(), Name: "Save £1 at Tesco", Brand: "Tesco", Value: 1, Version: 2}
+	deleted := primitive.NewObjectID()
+	settled := time.Now().Add(-time.Hour)
+
+	mock := newDbMock()
+	mock.coupons[kept.Id] = kept
+	mock.events = []api.CouponEvent{
+		{Seq: 1, Type: api.EVENT_CREATED, CouponId: kept.Id, Version: 1, At: settled},
+		{Seq: 2, Type: api.EVENT_CREATED, CouponId: deleted, Version: 1, At: settled},
+		{Seq: 3, Type: api.EVENT_UPDATED, CouponId: kept.Id, Version: 2, At: settled},
+		{Seq: 4, Type: api.EVENT_DELETED, CouponId: deleted, Version: 1, At: settled},
+	}
+	s.db = mock
+
+	//a full sync holds every coupon, the changes up to now are part of it
+	status, resp := doSync(s, "")
+	if status != http.StatusOK || !resp.Result.Full || len(resp.Result.Coupons) != 1 || resp.Result.Token != encodeSyncToken(4) {
+		t.Errorf("unexpected full sync %d %+v %+v", status, resp.Result, resp.Errors)
+		return
+	}
+
+	//a coupon changed twice is reported once, a deleted one as a tombstone
+	status, resp = doSync(s, encodeSyncToken(0))
+	if status != http.StatusOK || resp.Result.Full || resp.Result.HasMore {
+		t.Errorf("unexpected delta sync %d %+v %+v", status, resp.Result, resp.Errors)
+		return
+	}
+	if len(resp.Result.Coupons) != 1 || resp.Result.Coupons[0].Id != kept.Id || resp.Result.Coupons[0].Version != 2 {
+		t.Errorf("expected the current state of the changed coupon, but got %+v", resp.Result.Coupons)
+	}
+	if len(resp.Result.Deleted) != 1 || resp.Result.Deleted[0].Id != deleted || resp.Result.Deleted[0].Version != 1 {
+		t.Errorf("expected a tombstone of the deleted coupon, but got %+v", resp.Result.Deleted)
+	}
+	if resp.Result.Token != encodeSyncToken(4) {
+		t.Errorf("expected the token of the last event, but got %s", resp.Result.Token)
+	}
+
+	//nothing changed since
+	status, resp = doSync(s, resp.Result.Token)
+	if status != http.StatusOK || len(resp.Result.Coupons) != 0 || len(resp.Result.Deleted) != 0 || resp.Result.Token != encodeSyncToken(4) {
+		t.Errorf("expected an empty sync, but got %d %+v", status, resp.Result)
+	}
+
+	//a change still being written holds the token back, so it is not skipped
+	mock.events = append(mock.events, api.CouponEvent{Seq: 6, Type: api.EVENT_UPDATED, CouponId: kept.Id, Version: 3, At: time.Now()})
+	status, resp = doSync(s, encodeSyncToken(4))
+	if status != http.StatusOK || len(resp.Result.Coupons) != 0 || resp.Result.Token != encodeSyncToken(4) {
+		t.Errorf("expected the sync to wait for event 5, but got %d %+v", status, resp.Result)
+	}
+	status, resp = doSync(s, "")
+	if status != http.StatusOK || resp.Result.Token != encodeSyncToken(4) {
+		t.Errorf("expected the full sync to be consistent with event 4, but got %d %+v", status, resp.Result)
+	}
+}
+
+func TestHandleSyncErrors(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	mock.events = []api.CouponEvent{{Seq: 10, Type: api.EVENT_CREATED, CouponId: primitive.NewObjectID(), Version: 1}}
+	s.db = mock
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"invalid token", "42", http.StatusBadRequest, api.ERR_INVALID_SYNC_TOKEN},
+		{"expired token", encodeSyncToken(5), http.StatusGone, api.ERR_SYNC_TOKEN_EXPIRED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, resp := doSync(s, test.token)
+			if status != test.expectedStatus || len(resp.Errors) != 1 || resp.Errors[0].Code != test.expectedCode {
+				t.Errorf("expected %d %s, but got %d %+v", test.expectedStatus, test.expectedCode, status, resp.Errors)
+			}
+		})
+	}
+}
@@ -11,32 +11,77 @@ import (
 
 const COUPON_MIN_EXPIRY_DATE string = "2010-01-01T00:00:00Z"
 
+func newInsertError(code, field, msg string) api.Error {
+	err := api.NewError(code, msg).WithLegacy(fmt.Sprintf("ValidateNewCoupon: %s", msg))
+	err.Field = field
+	return err
+}
+
+func newUpdateError(code, field, msg string) api.Error {
+	err := api.NewError(code, msg).WithLegacy(fmt.Sprintf("ValidateUpdateCoupon: %s", msg))
+	err.Field = field
+	return err
+}
+
 //func type: validator for a single coupon data
-type cpnValidatorFunc func(cpnCollection *api.Coupon) (validationSuccess bool, errors []string)
+type cpnValidatorFunc func(cpnCollection *api.Coupon) (validationSuccess bool, errors []api.Error)
 
 //validates a coupon collection before performing an insert
-func (s *CouponService) validateManyForInsert(cpnCollection *api.CouponCollection) (validationSuccess bool, errors []string) {
+func (s *CouponService) validateManyForInsert(cpnCollection *api.CouponCollection) (validationSuccess bool, errors []api.Error) {
 	return validateMany(cpnCollection, validateOneForInsert)
 }
 
 //validates a coupon collection before performing an update
-func (s *CouponService) validateManyForUpdate(cpnCollection *api.CouponCollection) (validationSuccess bool, errors []string) {
-	return validateMany(cpnCollection, validateOneForUpdate)
+func (s *CouponService) validateManyForUpdate(cpnCollection *api.CouponCollection) (validationSuccess bool, errors []api.Error) {
+	validationSuccess, errors = validateMany(cpnCollection, validateOneForUpdate)
+	return rejectDuplicateIds(cpnCollection, validationSuccess, errors)
+}
+
+//validates a coupon collection before performing a delete
+func (s *CouponService) validateManyForDelete(cpnCollection *api.CouponCollection) (validationSuccess bool, errors []api.Error) {
+	validationSuccess, errors = validateMany(cpnCollection, validateOneForDelete)
+	return rejectDuplicateIds(cpnCollection, validationSuccess, errors)
+}
+
+//rejectDuplicateIds fails every item naming a coupon an earlier item of the batch names already: both carry the same
+//expected version, so the second would conflict with the first and fail the batch after it was partly written
+func rejectDuplicateIds(cpnCollection *api.CouponCollection, validationSuccess bool, errors []api.Error) (bool, []api.Error) {
+	if cpnCollection == nil {
+		return validationSuccess, errors
+	}
+
+	seen := map[primitive.ObjectID]int{}
+	for i, cpn := range cpnCollection.Coupons {
+		if cpn.Id.IsZero() {
+			continue
+		}
+		if first, found := seen[cpn.Id]; found {
+			validationSuccess = false
+			dup := newUpdateError(api.ERR_DUPLICATE_ID, "id", fmt.Sprintf("Coupon %s is already in the batch at coupons[%d]", cpn.Id.Hex(), first))
+			errors = append(errors, dup.WithItem(i, fmt.Sprintf("coupons[%d].id", i)))
+			continue
+		}
+		seen[cpn.Id] = i
+	}
+	return validationSuccess, errors
 }
 
 //generic validation for a coupon collection (actual validator is passed as parameter)
-func validateMany(cpnCollection *api.CouponCollection, validator cpnValidatorFunc) (validationSuccess bool, errors []string) {
+func validateMany(cpnCollection *api.CouponCollection, validator cpnValidatorFunc) (validationSuccess bool, errors []api.Error) {
 	validationSuccess = true
 
 	if cpnCollection == nil || len(cpnCollection.Coupons) == 0 {
 		validationSuccess = false
-		errors = append(errors, "No coupon data provided")
+		noCoupons := api.NewError(api.ERR_NO_COUPONS, "No coupon data provided")
+		noCoupons.Field = "coupons"
+		errors = append(errors, noCoupons)
 	} else {
-		for _, cpn := range cpnCollection.Coupons {
-			//ok, e := (&cpn)
+		for i, cpn := range cpnCollection.Coupons {
 			ok, e := validator(&cpn)
 			validationSuccess = validationSuccess && ok
-			errors = append(errors, e...)
+			for _, itemErr := range e {
+				errors = append(errors, itemErr.WithItem(i, fmt.Sprintf("coupons[%d].%s", i, itemErr.Field)))
+			}
 		}
 	}
 
@@ -44,93 +89,120 @@ func validateMany(cpnCollection *api.CouponCollection, validator cpnValidatorFun
 }
 
 //validates one coupon before inserting
-func validateOneForInsert(cpn *api.Coupon) (validationSuccess bool, errors []string) {
+func validateOneForInsert(cpn *api.Coupon) (validationSuccess bool, errors []api.Error) {
 
 	if cpn == nil {
-		return false, []string{"ValidateNewCoupon: coupon data needs to be provided"}
+		return false, []api.Error{newInsertError(api.ERR_COUPON_MISSING, "", "coupon data needs to be provided")}
 	}
 
 	validationSuccess = true
-	errors = []string{}
+	errors = []api.Error{}
 
 	if cpn.Name == "" {
 		validationSuccess = false
-		errors = append(errors, "ValidateNewCoupon: Coupon name must be provided")
+		errors = append(errors, newInsertError(api.ERR_NAME_REQUIRED, "name", "Coupon name must be provided"))
 	}
 
 	if cpn.Brand == "" {
 		validationSuccess = false
-		errors = append(errors, "ValidateNewCoupon: Coupon brand must be provided")
+		errors = append(errors, newInsertError(api.ERR_BRAND_REQUIRED, "brand", "Coupon brand must be provided"))
 	}
 
 	if cpn.Value <= 0 {
 		validationSuccess = false
-		errors = append(errors, "ValidateNewCoupon: A positive coupon value must be provided")
+		errors = append(errors, newInsertError(api.ERR_VALUE_NOT_POSITIVE, "value", "A positive coupon value must be provided"))
 	}
 
 	bot, _ := time.Parse(time.RFC3339, COUPON_MIN_EXPIRY_DATE)
 	if cpn.Expiry.IsZero() || cpn.Expiry.Before(bot) {
 		validationSuccess = false
-		errors = append(errors, fmt.Sprintf("ValidateNewCoupon: Coupon expiry date must be after %s", COUPON_MIN_EXPIRY_DATE))
+		errors = append(errors, newInsertError(api.ERR_EXPIRY_TOO_EARLY, "expiry", fmt.Sprintf("Coupon expiry date must be after %s", COUPON_MIN_EXPIRY_DATE)))
 	}
 
 	return validationSuccess, errors
 }
 
 //validates one coupon before updating
-func validateOneForUpdate(cpn *api.Coupon) (ok bool, errors []string) {
+func validateOneForUpdate(cpn *api.Coupon) (ok bool, errors []api.Error) {
 
 	if cpn == nil {
-		return false, []string{"ValidateUpdateCoupon: coupon data needs to be provided"}
+		return false, []api.Error{newUpdateError(api.ERR_COUPON_MISSING, "", "coupon data needs to be provided")}
 	}
 
-	ok, errors = true, []string{}
+	ok, errors = true, []api.Error{}
 
 	if cpn.Id.IsZero() {
 		ok = false
-		errors = append(errors, "ValidateUpdateCoupon: Coupon id must be provided")
+		errors = append(errors, newUpdateError(api.ERR_ID_REQUIRED, "id", "Coupon id must be provided"))
+	}
+
+	if cpn.Version < 1 {
+		ok = false
+		errors = append(errors, newUpdateError(api.ERR_VERSION_REQUIRED, "version", "The expected coupon version must be provided"))
 	}
 
 	if cpn.Value < 0 {
 		ok = false
-		errors = append(errors, "ValidateUpdateCoupon: A positive coupon value must be provided")
+		errors = append(errors, newUpdateError(api.ERR_VALUE_NOT_POSITIVE, "value", "A positive coupon value must be provided"))
 	}
 
 	if !cpn.CreatedAt.IsZero() {
 		ok = false
-		errors = append(errors, "ValidateUpdateCoupon: CreatedAt is a read-only field")
+		errors = append(errors, newUpdateError(api.ERR_READ_ONLY_FIELD, "createdAt", "CreatedAt is a read-only field"))
+	}
+
+	return ok, errors
+}
+
+//validates one coupon before deleting, only the id and the expected version are looked at
+func validateOneForDelete(cpn *api.Coupon) (ok bool, errors []api.Error) {
+
+	if cpn == nil {
+		return false, []api.Error{newUpdateError(api.ERR_COUPON_MISSING, "", "coupon data needs to be provided")}
+	}
+
+	ok, errors = true, []api.Error{}
+
+	if cpn.Id.IsZero() {
+		ok = false
+		errors = append(errors, newUpdateError(api.ERR_ID_REQUIRED, "id", "Coupon id must be provided"))
+	}
+
+	if cpn.Version < 1 {
+		ok = false
+		errors = append(errors, newUpdateError(api.ERR_VERSION_REQUIRED, "version", "The expected coupon version must be provided"))
 	}
 
 	return ok, errors
 }
 
-func validateCouponId(id interface{}) (ok bool, errors []string) {
+func validateCouponId(id interface{}) (ok bool, errors []api.Error) {
 
 	ok = true
-	errors = []string{}
+	errors = []api.Error{}
 
 	switch id.(type) {
 	case primitive.ObjectID:
 		cast := id.(primitive.ObjectID)
 		if cast.IsZero() {
 			ok = false
-			errors = append(errors, "ValidateUpdateCoupon: Coupon id must be provided")
+			errors = append(errors, newUpdateError(api.ERR_ID_REQUIRED, "id", "Coupon id must be provided"))
 		}
 	case int:
 		cast := id.(int)
 		if cast < 1 {
 			ok = false
-			errors = append(errors, "ValidateUpdateCoupon: Coupon id must be provided")
+			errors = append(errors, newUpdateError(api.ERR_ID_REQUIRED, "id", "Coupon id must be provided"))
 		}
 	case string:
 		cast := id.(string)
 		if cast == "" {
 			ok = false
-			errors = append(errors, "ValidateUpdateCoupon: Coupon id must be provided")
+			errors = append(errors, newUpdateError(api.ERR_ID_REQUIRED, "id", "Coupon id must be provided"))
 		}
 	default:
 		ok = false
-		errors = append(errors, "ValidateUpdateCoupon: Coupon id is of unknown type")
+		errors = append(errors, newUpdateError(api.ERR_ID_INVALID, "id", "Coupon id is of unknown type"))
 	}
 
 	return ok, errors
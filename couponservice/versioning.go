@@ -0,0 +1,143 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/v2"
+)
+
+const (
+	API_VERSION_1 int = 1
+	API_VERSION_2 int = 2
+
+	//the newest version, which v1 clients are pointed to
+	API_VERSION_LATEST = API_VERSION_2
+)
+
+//routes is the table of paths served by the service. "/" is kept for clients that predate versioning and serves v1.
+func (s *CouponService) routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/":    s.handleCouponsRequest,
+		"/v1/": s.handleCouponsRequest,
+		"/v2/": s.handleCouponsRequest,
+
+		OPENAPI_PATH: s.handleOpenAPI,
+		GRAPHQL_PATH: s.handleGraphql,
+		IMPORT_PATH:  s.handleImportCSV,
+		EXPORT_PATH:  s.handleExport,
+		EVENTS_PATH:  s.handleEvents,
+		SYNC_PATH:    s.handleSync,
+
+		WEBHOOKS_PATH:           s.handleWebhooks,
+		WEBHOOK_DELIVERIES_PATH: s.handleWebhookDeliveries,
+
+		AUDIT_PATH: s.handleAudit,
+
+		VERSIONS_PATH:       s.handleVersions,
+		VERSION_DIFF_PATH:   s.handleVersionDiff,
+		VERSION_REVERT_PATH: s.handleVersionRevert,
+
+		API_KEYS_PATH:        s.handleApiKeys,
+		API_KEY_ROTATE_PATH:  s.handleApiKeyRotate,
+		API_KEY_ENABLE_PATH:  s.handleApiKeyEnable,
+		API_KEY_DISABLE_PATH: s.handleApiKeyDisable,
+	}
+}
+
+//apiVersionPath matches the paths naming a version of the api, e.g. /v3/
+var apiVersionPath = regexp.MustCompile(`^/v[0-9]+(/|$)`)
+
+//apiVersionFromPath returns the version of the api serving the path, known is false for a version that does not exist
+func apiVersionFromPath(path string) (version int, known bool) {
+	switch {
+	case strings.HasPrefix(path, "/v2/") || path == "/v2":
+		return API_VERSION_2, true
+	case strings.HasPrefix(path, "/v1/") || path == "/v1":
+		return API_VERSION_1, true
+	case apiVersionPath.MatchString(path):
+		//"/" would otherwise serve it as v1
+		return 0, false
+	}
+	return API_VERSION_1, true
+}
+
+//every response says which version served it, v1 responses also announce the deprecation and where to move to
+func setVersionHeaders(w http.ResponseWriter, version int) {
+	w.Header().Set("API-Version", strconv.Itoa(version))
+
+	if version < API_VERSION_LATEST {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("</v%d/>; rel=\"successor-version\"", API_VERSION_LATEST))
+	}
+}
+
+//couponsFromRequest reads the coupons in the shape of the requested api version and converts them to the internal model
+func (s *CouponService) couponsFromRequest(r *api.Request) (*api.CouponCollection, error) {
+	if r == nil || r.ApiVersion != API_VERSION_2 {
+		return extractCouponsFromRequest(r)
+	}
+
+	cpnCollection := &v2.CouponCollection{}
+	if err := json.Unmarshal(r.Data, cpnCollection); err != nil {
+		apiErr := api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse coupons request: %s", err.Error())
+		log.Println(apiErr.Message)
+		return nil, apiErr
+	}
+
+	for i, cpn := range cpnCollection.Coupons {
+		//coupons that leave out the currency are taken to be in the service currency
+		if cpn.Value.Currency != "" && cpn.Value.Currency != s.currency {
+			return nil, api.NewErrorf(api.ERR_UNSUPPORTED_CURRENCY, "only %s amounts are supported, got %s", s.currency, cpn.Value.Currency).
+				WithItem(i, fmt.Sprintf("coupons[%d].value.currency", i))
+		}
+	}
+
+	return cpnCollection.ToInternal(s.currency), nil
+}
+
+//filterFromRequest reads the search filter in the shape of the requested api version
+func (s *CouponService) filterFromRequest(r *api.Request) (*api.CouponFilter, error) {
+	if r == nil || r.ApiVersion != API_VERSION_2 {
+		return extractCouponFilterFromRequest(r)
+	}
+
+	filter := &v2.CouponFilter{}
+	if err := json.Unmarshal(r.Data, filter); err != nil {
+		apiErr := api.NewErrorf(api.ERR_INVALID_FILTER, "failed to parse filter from the request: %s", err.Error())
+		log.Println(apiErr.Message)
+		return nil, apiErr
+	}
+
+	if filter.Status != "" && filter.Status != v2.STATUS_ACTIVE && filter.Status != v2.STATUS_EXPIRED {
+		apiErr := api.NewErrorf(api.ERR_INVALID_FILTER, "unknown status: %s", filter.Status)
+		apiErr.Field = "status"
+		return nil, apiErr
+	}
+
+	return filter.ToInternal(s.currency, time.Now()), nil
+}
+
+//present converts a result to the shape of the requested api version, v1 results are the internal model as is
+func (s *CouponService) present(r *api.Request, result interface{}) interface{} {
+	if r == nil || r.ApiVersion != API_VERSION_2 {
+		return result
+	}
+
+	now := time.Now()
+	switch res := result.(type) {
+	case []api.Coupon:
+		return v2.FromInternalMany(res, s.currency, now)
+	case *api.BatchResult:
+		return v2.BatchFromInternal(res, s.currency, now)
+	default:
+		return result
+	}
+}
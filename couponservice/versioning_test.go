@@ -0,0 +1,196 @@
+package couponservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/v2"
+)
+
+func TestVersionHeaders(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	testCases := []struct {
+		path               string
+		expectedVersion    string
+		expectedDeprecated bool
+	}{
+		{path: "/", expectedVersion: "1", expectedDeprecated: true},
+		{path: "/v1/", expectedVersion: "1", expectedDeprecated: true},
+		{path: "/v2/", expectedVersion: "2", expectedDeprecated: false},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, tc.path, bytes.NewBufferString(`{"apiKey":"Valid API Key","data":{}}`))
+		w := httptest.NewRecorder()
+		s.handleCouponsRequest(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: unexpected http status %d", tc.path, w.Code)
+		}
+		if version := w.Header().Get("API-Version"); version != tc.expectedVersion {
+			t.Errorf("%s: expected API-Version %s, but got %s", tc.path, tc.expectedVersion, version)
+		}
+		if deprecated := w.Header().Get("Deprecation") == "true"; deprecated != tc.expectedDeprecated {
+			t.Errorf("%s: expected deprecated to be %t, but got %t", tc.path, tc.expectedDeprecated, deprecated)
+		}
+		if tc.expectedDeprecated && w.Header().Get("Link") == "" {
+			t.Errorf("%s: expected a link to the successor version", tc.path)
+		}
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+	s.db = newDbMock()
+
+	//"/" serves v1 for the clients that predate versioning, not the versions that do not exist
+	for _, path := range []string{"/v3/", "/v3", "/v10/coupons"} {
+		r := httptest.NewRequest(http.MethodGet, path, bytes.NewBufferString(`{"apiKey":"Valid API Key","data":{}}`))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+
+		resp := &api.Response{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		if w.Code != http.StatusNotFound || len(resp.Errors) != 1 || resp.Errors[0].Code != api.ERR_UNKNOWN_API_VERSION {
+			t.Errorf("%s: expected %s (404), but got %d %s", path, api.ERR_UNKNOWN_API_VERSION, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHandleCreateCouponV2(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"atomic":true,"coupons":[{"name":"Save £1.50 at Tesco","brand":"Tesco","value":{"amount":150,"currency":"GBP"},"expiry":"2019-03-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey:     "dont care",
+		Data:       []byte(payload),
+		ApiVersion: API_VERSION_2,
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected http status %d", w.Code)
+		return
+	}
+
+	for _, cpn := range mock.coupons {
+		if cpn.Value != 1.5 {
+			t.Errorf("expected the value to be stored as 1.5, but got %f", cpn.Value)
+		}
+	}
+
+	resp := &struct {
+		Result []v2.Coupon `json:"result"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(resp.Result) != 1 {
+		t.Errorf("expected 1 coupon in the response, but got %d", len(resp.Result))
+		return
+	}
+	if value := resp.Result[0].Value; value.Amount != 150 || value.Currency != "GBP" {
+		t.Errorf("unexpected value in the response %+v", value)
+	}
+	if resp.Result[0].Status == "" {
+		t.Error("expected the coupon status to be reported")
+	}
+}
+
+func TestHandleCreateCouponV2UnsupportedCurrency(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+
+	payload := `{"coupons":[{"name":"Save €1 at Lidl","brand":"Lidl","value":{"amount":100,"currency":"EUR"},"expiry":"2019-03-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey:     "dont care",
+		Data:       []byte(payload),
+		ApiVersion: API_VERSION_2,
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected http status %d", w.Code)
+	}
+	if len(mock.coupons) != 0 {
+		t.Errorf("expected no coupons to be written, but %d were", len(mock.coupons))
+	}
+}
+
+func TestHandleCreateCouponV2MinorUnits(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Log(err)
+		return
+	}
+
+	mock := newDbMock()
+	s.db = mock
+	s.currency = "JPY"
+
+	//the yen has no minor unit, so the amount is the value
+	payload := `{"coupons":[{"name":"Save ¥500 at Uniqlo","brand":"Uniqlo","value":{"amount":500,"currency":"JPY"},"expiry":"2019-03-01T00:00:00Z"}]}`
+	r := &api.Request{
+		ApiKey:     "dont care",
+		Data:       []byte(payload),
+		ApiVersion: API_VERSION_2,
+	}
+
+	w := httptest.NewRecorder()
+	s.handleCreateCoupon(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected http status %d: %s", w.Code, w.Body.String())
+		return
+	}
+	if len(mock.coupons) != 1 {
+		t.Errorf("expected 1 coupon to be written, but %d were", len(mock.coupons))
+	}
+	for _, cpn := range mock.coupons {
+		if cpn.Value != 500 {
+			t.Errorf("expected a value of 500, got %f", cpn.Value)
+		}
+	}
+}
+
+func TestNewWithUnknownCurrency(t *testing.T) {
+	cfg := newMockConfig()
+	cfg.Service.Currency = "pounds"
+
+	if _, err := NewWithDb(cfg, newDbMock()); err == nil {
+		t.Error("expected the service to refuse a currency that is not an ISO 4217 code")
+	}
+}
@@ -0,0 +1,236 @@
+package couponservice
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+const (
+	VERSIONS_PATH       string = "/versions"
+	VERSION_DIFF_PATH   string = "/versions/diff"
+	VERSION_REVERT_PATH string = "/versions/revert"
+)
+
+//diffCoupons lists the fields whose value differs between two versions of a coupon
+func diffCoupons(from, to api.Coupon) []api.FieldChange {
+	changes := []api.FieldChange{}
+	if from.Name != to.Name {
+		changes = append(changes, api.FieldChange{Field: "name", From: from.Name, To: to.Name})
+	}
+	if from.Brand != to.Brand {
+		changes = append(changes, api.FieldChange{Field: "brand", From: from.Brand, To: to.Brand})
+	}
+	if from.Value != to.Value {
+		changes = append(changes, api.FieldChange{Field: "value", From: from.Value, To: to.Value})
+	}
+	if !from.Expiry.Equal(to.Expiry) {
+		changes = append(changes, api.FieldChange{Field: "expiry", From: from.Expiry, To: to.Expiry})
+	}
+	return changes
+}
+
+func versionFromQuery(r *http.Request, param string) (int64, error) {
+	raw := r.URL.Query().Get(param)
+	if raw == "" {
+		return 0, api.NewErrorf(api.ERR_VERSION_REQUIRED, "the %s parameter is required", param)
+	}
+	version, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || version < 1 {
+		return 0, api.NewErrorf(api.ERR_INVALID_REQUEST, "%s must be a coupon version, got: %s", param, raw)
+	}
+	return version, nil
+}
+
+//handleVersions reads the history of a coupon (GET ?id=): every version, one of them (&version=) or the one current
+//at a point in time (&at=, RFC 3339). The api key is sent in the X-API-Key header.
+func (s *CouponService) handleVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "coupon versions are read with GET"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	id, err := objectIdFromQuery(r, "id")
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	var result interface{}
+	switch {
+	case query.Get("version") != "" && query.Get("at") != "":
+		err = api.NewError(api.ERR_INVALID_REQUEST, "a version is asked for either by number or by time, not both")
+	case query.Get("version") != "":
+		var version int64
+		if version, err = versionFromQuery(r, "version"); err == nil {
+			result, err = s.db.CouponVersion(id, version)
+		}
+	case query.Get("at") != "":
+		var at time.Time
+		if at, err = time.Parse(time.RFC3339, query.Get("at")); err != nil {
+			err = api.NewError(api.ERR_INVALID_REQUEST, "at must be an RFC 3339 time, e.g. 2019-03-01T00:00:00Z")
+		} else {
+			result, err = s.db.CouponAt(id, at)
+		}
+	default:
+		result, err = s.db.CouponVersions(id)
+	}
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(result))
+}
+
+//handleVersionDiff compares two versions of a coupon field by field (GET ?id=&from=&to=).
+//The api key is sent in the X-API-Key header.
+func (s *CouponService) handleVersionDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "coupon versions are compared with GET"))
+		return
+	}
+
+	if err := s.authenticate(&api.Request{ApiKey: r.Header.Get(API_KEY_HEADER)}); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	diff, err := s.diffVersions(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(diff))
+}
+
+func (s *CouponService) diffVersions(r *http.Request) (*api.VersionDiff, error) {
+	id, err := objectIdFromQuery(r, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := [2]*api.CouponVersion{}
+	for i, param := range []string{"from", "to"} {
+		version, err := versionFromQuery(r, param)
+		if err != nil {
+			return nil, err
+		}
+		if versions[i], err = s.db.CouponVersion(id, version); err != nil {
+			return nil, err
+		}
+	}
+
+	return &api.VersionDiff{
+		CouponId: id,
+		From:     versions[0].Version,
+		To:       versions[1].Version,
+		Changes:  diffCoupons(versions[0].Coupon, versions[1].Coupon),
+	}, nil
+}
+
+//handleVersionRevert writes a prior version of a coupon again (POST ?id=&version=), as a new version. Like an update,
+//it is validated and carries the current version of the coupon in the If-Match header, a coupon changed in the meantime
+//is reported as a conflict. The api key is sent in the X-API-Key header.
+func (s *CouponService) handleVersionRevert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "coupons are reverted with POST"))
+		return
+	}
+
+	req := &api.Request{ApiKey: r.Header.Get(API_KEY_HEADER), RequestId: r.Header.Get(REQUEST_ID_HEADER), ApiVersion: API_VERSION_1}
+	if err := s.authenticate(req); err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	revert, err := s.revertFromRequest(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	outcome, err := s.revertCoupon(actorFromRequest(req), revert)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	if len(outcome.coupons) == 1 {
+		w.Header().Set("ETag", etagForVersion(outcome.coupons[0].Version))
+	}
+	s.respondWithOutcome(w, req, outcome)
+}
+
+//revertCoupon validates the revert like an update and writes every field of it, see dblayer.RevertCoupon
+func (s *CouponService) revertCoupon(actor api.Actor, revert api.Coupon) (*writeOutcome, error) {
+	if validationSuccess, errors := s.validateManyForUpdate(&api.CouponCollection{Coupons: []api.Coupon{revert}}); !validationSuccess {
+		return &writeOutcome{errors: errors}, nil
+	}
+
+	err := s.db.RevertCoupon(actor, revert)
+	if conflict, isConflict := err.(*dblayer.ConflictError); isConflict {
+		return &writeOutcome{conflict: conflict}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("coupon %s reverted", revert.Id.Hex())
+
+	coupons, err := s.db.FindByIds([]interface{}{revert.Id})
+	if err != nil {
+		return nil, afterWrite(err)
+	}
+	return &writeOutcome{coupons: coupons}, nil
+}
+
+//revertFromRequest builds the revert that sets every field of the coupon back to the version asked for
+func (s *CouponService) revertFromRequest(r *http.Request) (api.Coupon, error) {
+	id, err := objectIdFromQuery(r, "id")
+	if err != nil {
+		return api.Coupon{}, err
+	}
+	version, err := versionFromQuery(r, "version")
+	if err != nil {
+		return api.Coupon{}, err
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return api.Coupon{}, api.NewError(api.ERR_VERSION_REQUIRED, "the current version of the coupon must be sent in the If-Match header")
+	}
+	current, err := versionFromEtag(ifMatch)
+	if err != nil {
+		return api.Coupon{}, err
+	}
+
+	target, err := s.db.CouponVersion(id, version)
+	if err != nil {
+		return api.Coupon{}, err
+	}
+
+	return api.Coupon{
+		Id:      id,
+		Name:    target.Coupon.Name,
+		Brand:   target.Coupon.Brand,
+		Value:   target.Coupon.Value,
+		Expiry:  target.Coupon.Expiry,
+		Version: current,
+	}, nil
+}
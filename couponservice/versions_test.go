@@ -0,0 +1,207 @@
+package couponservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+)
+
+//versionRequest calls a version endpoint, decoding the result into result
+func versionRequest(t *testing.T, handler http.HandlerFunc, method, path, ifMatch string, result interface{}) (int, []api.Error) {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	resp := &struct {
+		Errors []api.Error `json:"errors"`
+		Result interface{} `json:"result"`
+	}{Result: result}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp.Errors
+}
+
+//newVersionedCoupon creates a coupon and updates it twice, to versions 2 (value) and 3 (brand)
+func newVersionedCoupon(t *testing.T) (*CouponService, *dbtest.DB, api.Coupon) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+
+	res, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10, Expiry: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpns, _ := db.FindByIds(res.InsertedIDs)
+	cpn := cpns[0]
+	for _, update := range []api.Coupon{{Id: cpn.Id, Value: 20, Version: 1}, {Id: cpn.Id, Brand: "Boots", Version: 2}} {
+		if _, err := db.UpdateCoupons(api.Actor{}, []api.Coupon{update}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, db, cpn
+}
+
+func TestVersions(t *testing.T) {
+	s, _, cpn := newVersionedCoupon(t)
+	id := cpn.Id.Hex()
+
+	versions := []api.CouponVersion{}
+	if status, errs := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?id="+id, "", &versions); status != http.StatusOK {
+		t.Fatalf("failed to list the versions: %d %v", status, errs)
+	}
+	if len(versions) != 3 || versions[0].Coupon.Value != 10 || versions[1].Coupon.Value != 20 || versions[2].Coupon.Brand != "Boots" || versions[2].Coupon.Value != 20 {
+		t.Fatalf("expected every version in full, oldest first, but got %+v", versions)
+	}
+
+	version := &api.CouponVersion{}
+	if status, _ := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?id="+id+"&version=2", "", version); status != http.StatusOK || version.Version != 2 || version.Coupon.Value != 20 {
+		t.Errorf("unexpected version 2: %+v (%d)", version, status)
+	}
+
+	//the coupon as it was at the time of the second version, and before it existed
+	at := &api.CouponVersion{}
+	query := url.Values{"id": {id}, "at": {versions[1].At.Format(time.RFC3339Nano)}}
+	if status, _ := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?"+query.Encode(), "", at); status != http.StatusOK || at.Version != 2 {
+		t.Errorf("expected version 2 at %s, but got %+v (%d)", versions[1].At, at, status)
+	}
+	query.Set("at", versions[0].At.Add(-time.Minute).Format(time.RFC3339Nano))
+	if status, errs := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?"+query.Encode(), "", nil); status != http.StatusNotFound || errs[0].Code != api.ERR_COUPON_VERSION_NOT_FOUND {
+		t.Errorf("expected the coupon not to exist before it was created, but got %d %v", status, errs)
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"no id", "version=1", http.StatusBadRequest, api.ERR_ID_REQUIRED},
+		{"unknown version", "id=" + id + "&version=9", http.StatusNotFound, api.ERR_COUPON_VERSION_NOT_FOUND},
+		{"invalid version", "id=" + id + "&version=latest", http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+		{"invalid time", "id=" + id + "&at=yesterday", http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+		{"version and time", "id=" + id + "&version=1&at=2019-03-01T00:00:00Z", http.StatusBadRequest, api.ERR_INVALID_REQUEST},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, errs := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?"+test.query, "", nil)
+			if status != test.expectedStatus || len(errs) != 1 || errs[0].Code != test.expectedCode {
+				t.Errorf("expected %s (%d), but got %v (%d)", test.expectedCode, test.expectedStatus, errs, status)
+			}
+		})
+	}
+}
+
+func TestVersionsDeleted(t *testing.T) {
+	s, db, cpn := newVersionedCoupon(t)
+	if _, err := db.DeleteCoupons(api.Actor{}, []api.Coupon{{Id: cpn.Id, Version: 3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := []api.CouponVersion{}
+	versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?id="+cpn.Id.Hex(), "", &versions)
+	if len(versions) != 4 || !versions[3].Deleted || versions[3].Version != 3 || versions[3].Coupon.Brand != "Boots" {
+		t.Fatalf("expected the delete to end the history, but got %+v", versions)
+	}
+
+	//the deleted version is still in the history, but the coupon no longer exists
+	if status, _ := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?id="+cpn.Id.Hex()+"&version=3", "", nil); status != http.StatusOK {
+		t.Errorf("expected version 3 to be kept, but got %d", status)
+	}
+	query := url.Values{"id": {cpn.Id.Hex()}, "at": {time.Now().Format(time.RFC3339Nano)}}
+	if status, _ := versionRequest(t, s.handleVersions, http.MethodGet, VERSIONS_PATH+"?"+query.Encode(), "", nil); status != http.StatusNotFound {
+		t.Errorf("expected a deleted coupon not to exist, but got %d", status)
+	}
+}
+
+func TestVersionDiff(t *testing.T) {
+	s, _, cpn := newVersionedCoupon(t)
+
+	diff := &api.VersionDiff{}
+	status, errs := versionRequest(t, s.handleVersionDiff, http.MethodGet, fmt.Sprintf("%s?id=%s&from=1&to=3", VERSION_DIFF_PATH, cpn.Id.Hex()), "", diff)
+	if status != http.StatusOK {
+		t.Fatalf("failed to diff the versions: %d %v", status, errs)
+	}
+	if diff.From != 1 || diff.To != 3 || fmt.Sprint(diff.Changes) != "[{brand Tesco Boots} {value 10 20}]" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+
+	if status, _ := versionRequest(t, s.handleVersionDiff, http.MethodGet, fmt.Sprintf("%s?id=%s&from=1", VERSION_DIFF_PATH, cpn.Id.Hex()), "", nil); status != http.StatusBadRequest {
+		t.Errorf("expected both versions to be required, but got %d", status)
+	}
+}
+
+func TestVersionRevert(t *testing.T) {
+	s, db, cpn := newVersionedCoupon(t)
+	path := fmt.Sprintf("%s?id=%s&version=1", VERSION_REVERT_PATH, cpn.Id.Hex())
+
+	if status, errs := versionRequest(t, s.handleVersionRevert, http.MethodPost, path, "", nil); status != http.StatusBadRequest || errs[0].Code != api.ERR_VERSION_REQUIRED {
+		t.Errorf("expected the current version to be required, but got %d %v", status, errs)
+	}
+	if status, errs := versionRequest(t, s.handleVersionRevert, http.MethodPost, path, `"2"`, nil); status != http.StatusConflict {
+		t.Errorf("expected a stale version to conflict, but got %d %v", status, errs)
+	}
+
+	reverted := []api.Coupon{}
+	status, errs := versionRequest(t, s.handleVersionRevert, http.MethodPost, path, `"3"`, &reverted)
+	if status != http.StatusOK || len(reverted) != 1 {
+		t.Fatalf("failed to revert: %d %v", status, errs)
+	}
+	if reverted[0].Version != 4 || reverted[0].Brand != "Tesco" || reverted[0].Value != 10 {
+		t.Errorf("expected version 1 written again as version 4, but got %+v", reverted[0])
+	}
+
+	//the revert is a change like any other, it is in the history and the audit log
+	versions, _ := db.CouponVersions(cpn.Id)
+	if len(versions) != 4 || versions[3].Coupon.Value != 10 {
+		t.Errorf("expected the revert in the history, but got %+v", versions)
+	}
+	entries, _ := db.SearchAudit(&api.AuditFilter{CouponId: cpn.Id, Limit: 1})
+	if len(entries) != 1 || entries[0].Version != 4 || entries[0].Actor.Principal == "" || fmt.Sprint(entries[0].ChangedFields) != "[brand value]" {
+		t.Errorf("expected the revert in the audit log, but got %+v", entries)
+	}
+}
+
+func TestVersionRevertEmptyFields(t *testing.T) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+
+	//a coupon stored before the name and the expiry were required
+	res, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Brand: "Tesco", Value: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := res.InsertedIDs[0].(primitive.ObjectID)
+	if _, err := db.UpdateCoupons(api.Actor{}, []api.Coupon{{Id: id, Name: "Save 10", Expiry: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reverted := []api.Coupon{}
+	path := fmt.Sprintf("%s?id=%s&version=1", VERSION_REVERT_PATH, id.Hex())
+	if status, errs := versionRequest(t, s.handleVersionRevert, http.MethodPost, path, `"2"`, &reverted); status != http.StatusOK {
+		t.Fatalf("failed to revert: %d %v", status, errs)
+	}
+	if len(reverted) != 1 || reverted[0].Version != 3 || reverted[0].Name != "" || !reverted[0].Expiry.IsZero() {
+		t.Errorf("expected the empty name and expiry of version 1 written again, but got %+v", reverted)
+	}
+}
@@ -0,0 +1,401 @@
+package couponservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+const (
+	//t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>" keyed with the secret of the subscription>
+	WEBHOOK_SIGNATURE_HEADER string = "X-Coupon-Signature"
+	WEBHOOK_EVENT_HEADER     string = "X-Coupon-Event"
+	WEBHOOK_DELIVERY_HEADER  string = "X-Coupon-Delivery"
+
+	//deliveries sent per run of the worker, the rest wait for the next run
+	webhookBatchSize = 100
+	//this much of a receiver's answer is read, so the connection can be reused
+	webhookResponseLimit = 64 << 10
+)
+
+type webhookSettings struct {
+	pollInterval time.Duration
+	timeout      time.Duration
+	maxAttempts  int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	concurrency  int
+
+	allowPrivateNetworks bool
+}
+
+//nonPublicNetworks are the ranges next to the loopback, private, link-local and multicast ones that no receiver is reached in:
+//"this" network, shared address space (carrier-grade nat, also used for cloud metadata), ietf protocol assignments,
+//benchmarking and reserved
+var nonPublicNetworks = parseNetworks("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//isPublicAddress tells whether a webhook may be sent to ip. The metadata endpoints of the clouds are link-local.
+func isPublicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//isPublicHost refuses the host of a subscription url that is known not to be public without resolving it
+func isPublicHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicAddress(ip)
+	}
+	return true
+}
+
+//refusePrivateAddress is the Control of the dialer of the webhook client. It runs once the host has been resolved,
+//for every address the client connects to, so a name resolving to an internal address is refused however it came to.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("%s is not a public address, webhooks are not sent to it", host)
+	}
+	return nil
+}
+
+//newWebhookClient makes the client the deliveries are sent with. It connects directly, a proxy would connect on its
+//behalf to addresses that are not checked, and does not follow redirects: a receiver answering one fails the attempt.
+func newWebhookClient(settings webhookSettings) *http.Client {
+	dialer := &net.Dialer{Timeout: settings.timeout, KeepAlive: 30 * time.Second}
+	if !settings.allowPrivateNetworks {
+		dialer.Control = refusePrivateAddress
+	}
+
+	return &http.Client{
+		Timeout: settings.timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: settings.timeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+//webhookWorker sends the webhook deliveries. All of its state is kept in the db with the deliveries,
+//so it carries on where it stopped after a restart and any number of instances of the service can run it side by side.
+type webhookWorker struct {
+	db       dblayer.Interface
+	client   *http.Client
+	settings webhookSettings
+}
+
+func (s *CouponService) newWebhookWorker() *webhookWorker {
+	settings := s.webhooks
+	if settings.timeout <= 0 {
+		settings.timeout = 10 * time.Second
+	}
+	if settings.maxAttempts <= 0 {
+		settings.maxAttempts = 1
+	}
+	if settings.minBackoff <= 0 {
+		settings.minBackoff = time.Second
+	}
+	if settings.maxBackoff < settings.minBackoff {
+		settings.maxBackoff = settings.minBackoff
+	}
+	if settings.concurrency <= 0 {
+		settings.concurrency = 1
+	}
+
+	return &webhookWorker{
+		db:       s.db,
+		client:   newWebhookClient(settings),
+		settings: settings,
+	}
+}
+
+//run sends the due deliveries every pollInterval until ctx is done
+func (w *webhookWorker) run(ctx context.Context) {
+	ticker := time.NewTicker(w.settings.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.deliverDue(ctx); err != nil {
+			log.Printf("failed to send webhook deliveries: %s", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//subscriptionMatches picks the events a subscription asked for, out of the ones stored after it was created
+func subscriptionMatches(sub api.WebhookSubscription, event api.CouponEvent) bool {
+	if event.Seq <= sub.FromSeq {
+		return false
+	}
+	if !(&eventMatcher{brand: sub.Brand}).matches(event) {
+		return false
+	}
+	if len(sub.EventTypes) == 0 {
+		return true
+	}
+	for _, eventType := range sub.EventTypes {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func deliveryId(subId primitive.ObjectID, seq int64) string {
+	return subId.Hex() + "-" + strconv.FormatInt(seq, 10)
+}
+
+//webhookSink turns the events relayed from the outbox into deliveries to the subscriptions they match,
+//which the webhook worker sends. Deliveries relayed again are ignored by the db, so each is sent once.
+type webhookSink struct {
+	db dblayer.Interface
+}
+
+func (ws *webhookSink) Name() string {
+	return dblayer.WEBHOOK_SINK
+}
+
+func (ws *webhookSink) Publish(ctx context.Context, events []api.CouponEvent) error {
+	subs, err := ws.db.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	deliveries := []api.WebhookDelivery{}
+	for _, event := range events {
+		for _, sub := range subs {
+			if !subscriptionMatches(sub, event) {
+				continue
+			}
+			deliveries = append(deliveries, api.WebhookDelivery{
+				Id:             deliveryId(sub.Id, event.Seq),
+				SubscriptionId: sub.Id,
+				Owner:          sub.Owner,
+				Event:          event,
+				Status:         api.DELIVERY_PENDING,
+				Attempts:       []api.DeliveryAttempt{},
+				NextAttemptAt:  now,
+				CreatedAt:      now,
+			})
+		}
+	}
+
+	return ws.db.EnqueueDeliveries(deliveries)
+}
+
+//deliveryResult is what a delivery sent by deliverDue came to
+type deliveryResult struct {
+	subscriptionId primitive.ObjectID
+	err            error
+}
+
+//deliverDue sends the deliveries that are due, up to concurrency at a time and one at a time per subscription, so a slow
+//or unreachable receiver only holds up its own deliveries. Each is claimed for twice the receiver timeout just before
+//it is sent, so one that is never recorded, because the service stopped on the way, is sent again soon after.
+func (w *webhookWorker) deliverDue(ctx context.Context) (int, error) {
+	subs, err := w.db.Subscriptions()
+	if err != nil {
+		return 0, err
+	}
+	subsById := map[primitive.ObjectID]api.WebhookSubscription{}
+	for _, sub := range subs {
+		subsById[sub.Id] = sub
+	}
+
+	//the loop owns the state, the deliveries being sent report back on finished
+	finished := make(chan deliveryResult, w.settings.concurrency)
+	busy := map[primitive.ObjectID]bool{}
+	sent, claimed := 0, 0
+	var firstErr error
+	wait := func() {
+		result := <-finished
+		delete(busy, result.subscriptionId)
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		} else if result.err == nil {
+			sent++
+		}
+	}
+
+	for ctx.Err() == nil && firstErr == nil {
+		if len(busy) == w.settings.concurrency || claimed == webhookBatchSize {
+			if len(busy) == 0 {
+				break
+			}
+			wait()
+			continue
+		}
+
+		skip := []primitive.ObjectID{}
+		for id := range busy {
+			skip = append(skip, id)
+		}
+		next, err := w.db.ClaimDeliveries(time.Now(), 2*w.settings.timeout, 1, skip)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		if len(next) == 0 {
+			//the deliveries left may be waiting for a subscription that is busy
+			if len(busy) == 0 {
+				break
+			}
+			wait()
+			continue
+		}
+
+		delivery := next[0]
+		busy[delivery.SubscriptionId] = true
+		claimed++
+		go func() {
+			finished <- deliveryResult{subscriptionId: delivery.SubscriptionId, err: w.deliver(ctx, subsById, delivery)}
+		}()
+	}
+
+	for len(busy) > 0 {
+		wait()
+	}
+	return sent, firstErr
+}
+
+//deliver sends a claimed delivery and records the attempt, a delivery whose subscription was deleted is dead
+func (w *webhookWorker) deliver(ctx context.Context, subsById map[primitive.ObjectID]api.WebhookSubscription, delivery api.WebhookDelivery) error {
+	var attempt api.DeliveryAttempt
+	status, next := api.DELIVERY_DEAD, time.Time{}
+	if sub, found := subsById[delivery.SubscriptionId]; found {
+		attempt = w.send(ctx, sub, delivery)
+		status, next = w.outcome(delivery, attempt)
+	} else {
+		attempt = api.DeliveryAttempt{At: time.Now(), Error: "the subscription was deleted"}
+	}
+
+	return w.db.RecordDeliveryAttempt(delivery.Id, attempt, status, next)
+}
+
+//signWebhook signs the body with the time it is sent at, so a receiver can reject a delivery replayed later
+func signWebhook(secret string, at time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", at.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+//send POSTs the delivery to the subscription, any answer but a 2xx status is a failed attempt
+func (w *webhookWorker) send(ctx context.Context, sub api.WebhookSubscription, delivery api.WebhookDelivery) api.DeliveryAttempt {
+	started := time.Now()
+	attempt := api.DeliveryAttempt{At: started}
+
+	body, err := json.Marshal(api.WebhookPayload{DeliveryId: delivery.Id, Event: delivery.Event})
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, delivery.Event.Type)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, delivery.Id)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(sub.Secret, started, body))
+
+	resp, err := w.client.Do(req)
+	attempt.DurationMs = int64(time.Since(started) / time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, webhookResponseLimit)); err != nil {
+		log.Printf("failed to read the answer to webhook delivery %s: %s", delivery.Id, err.Error())
+	}
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "the receiver answered " + resp.Status
+	}
+	return attempt
+}
+
+//outcome decides what follows an attempt: done, another attempt after the backoff, or dead once maxAttempts failed
+func (w *webhookWorker) outcome(delivery api.WebhookDelivery, attempt api.DeliveryAttempt) (string, time.Time) {
+	if attempt.Error == "" {
+		return api.DELIVERY_DELIVERED, time.Time{}
+	}
+
+	failed := len(delivery.Attempts) + 1
+	if failed >= w.settings.maxAttempts {
+		return api.DELIVERY_DEAD, time.Time{}
+	}
+	return api.DELIVERY_PENDING, attempt.At.Add(w.backoff(failed))
+}
+
+//backoff is minBackoff after the first failed attempt, doubled after each further one, up to maxBackoff
+func (w *webhookWorker) backoff(failed int) time.Duration {
+	wait := w.settings.minBackoff
+	for i := 1; i < failed && wait < w.settings.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > w.settings.maxBackoff {
+		wait = w.settings.maxBackoff
+	}
+	return wait
+}
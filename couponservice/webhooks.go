@@ -0,0 +1,242 @@
+package couponservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+const (
+	WEBHOOKS_PATH           string = "/webhooks"
+	WEBHOOK_DELIVERIES_PATH string = "/webhooks/deliveries"
+
+	//subscriptions are small, a larger body is not one
+	maxSubscriptionSize = 64 << 10
+	//deliveries listed when the request does not ask for a number, and the most it can ask for
+	defaultDeliveriesLimit = 100
+	maxDeliveriesLimit     = 1000
+)
+
+//webhookEventTypes are the types a subscription can ask for
+var webhookEventTypes = map[string]bool{
+	api.EVENT_CREATED:  true,
+	api.EVENT_UPDATED:  true,
+	api.EVENT_DELETED:  true,
+	api.EVENT_EXPIRED:  true,
+	api.EVENT_REDEEMED: true,
+}
+
+func invalidSubscription(field, format string, args ...interface{}) api.Error {
+	err := api.NewErrorf(api.ERR_INVALID_SUBSCRIPTION, format, args...)
+	err.Field = field
+	return err
+}
+
+//subscriptionFromRequest reads the url, event types, brand and secret of a new subscription.
+//A subscription without a secret is given a random one. Unless private networks are allowed a url naming a loopback,
+//private or link-local address is refused right away, the addresses a host name resolves to are checked as it is sent to.
+func subscriptionFromRequest(r *http.Request, allowPrivateNetworks bool) (*api.WebhookSubscription, error) {
+	sub := &api.WebhookSubscription{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSubscriptionSize)).Decode(sub); err != nil {
+		return nil, api.NewErrorf(api.ERR_INVALID_REQUEST, "failed to parse the webhook subscription: %s", err.Error())
+	}
+
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, invalidSubscription("url", "%q is not an absolute http or https url", sub.URL)
+	}
+	if !allowPrivateNetworks && !isPublicHost(target.Hostname()) {
+		return nil, invalidSubscription("url", "%q is not a public address", target.Hostname())
+	}
+
+	for i, eventType := range sub.EventTypes {
+		if !webhookEventTypes[eventType] {
+			return nil, invalidSubscription(fmt.Sprintf("eventTypes[%d]", i), "%q is not an event type", eventType)
+		}
+	}
+
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, api.NewErrorf(api.ERR_INTERNAL, "failed to generate a webhook secret: %s", err.Error())
+		}
+		sub.Secret = hex.EncodeToString(secret)
+	}
+
+	return &api.WebhookSubscription{URL: sub.URL, EventTypes: sub.EventTypes, Brand: sub.Brand, Secret: sub.Secret}, nil
+}
+
+func objectIdFromQuery(r *http.Request, param string) (primitive.ObjectID, error) {
+	raw := r.URL.Query().Get(param)
+	if raw == "" {
+		return primitive.ObjectID{}, api.NewErrorf(api.ERR_ID_REQUIRED, "the %s parameter is required", param)
+	}
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		return primitive.ObjectID{}, api.NewErrorf(api.ERR_ID_INVALID, "%s is not a valid id", raw)
+	}
+	return id, nil
+}
+
+//webhookOwners authenticates the request by its X-API-Key header and returns the owners whose subscriptions the key
+//manages: its own, the first one, and for an admin key also the ones created before subscriptions had an owner
+func (s *CouponService) webhookOwners(r *http.Request) ([]string, error) {
+	apiKey := r.Header.Get(API_KEY_HEADER)
+	key, err := s.authenticateKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []string{principalForKey(apiKey)}
+	if key.Admin {
+		owners = append(owners, "")
+	}
+	return owners, nil
+}
+
+//handleWebhooks creates (POST), lists (GET) and deletes (DELETE ?id=) webhook subscriptions.
+//The api key is sent in the X-API-Key header, a key only sees the subscriptions it created.
+//The secret of a subscription is only returned by the POST creating it.
+func (s *CouponService) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "webhook subscriptions are created with POST, listed with GET and deleted with DELETE"))
+		return
+	}
+
+	owners, err := s.webhookOwners(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if atomic.LoadInt32(&s.webhooksRelayed) == 0 {
+			s.respondWithError(w, api.NewError(api.ERR_WEBHOOKS_UNAVAILABLE, "webhooks are not delivered: WEBHOOK_POLL_INTERVAL is 0, "+
+				"or mongo does not run as a replica set and OUTBOX_REQUIRE_TRANSACTIONS is set"))
+			return
+		}
+		sub, err := subscriptionFromRequest(r, s.webhooks.allowPrivateNetworks)
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		sub.Owner = owners[0]
+		if err := s.db.CreateSubscription(sub); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		writeResponse(w, s.newResponse(sub))
+
+	case http.MethodGet:
+		subs, err := s.db.Subscriptions(owners...)
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		writeResponse(w, s.newResponse(subs))
+
+	case http.MethodDelete:
+		id, err := objectIdFromQuery(r, "id")
+		if err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		if err := s.db.DeleteSubscription(id, owners...); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		writeResponse(w, s.newResponse(nil))
+	}
+}
+
+func deliveryFilterFromQuery(r *http.Request) (dblayer.DeliveryFilter, error) {
+	query := r.URL.Query()
+	filter := dblayer.DeliveryFilter{Status: query.Get("status"), Limit: defaultDeliveriesLimit}
+
+	if query.Get("subscriptionId") != "" {
+		id, err := objectIdFromQuery(r, "subscriptionId")
+		if err != nil {
+			return filter, err
+		}
+		filter.SubscriptionId = id
+	}
+
+	switch filter.Status {
+	case "", api.DELIVERY_PENDING, api.DELIVERY_DELIVERED, api.DELIVERY_DEAD:
+	default:
+		return filter, api.NewErrorf(api.ERR_INVALID_REQUEST, "%s is not a delivery status", filter.Status)
+	}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxDeliveriesLimit {
+			return filter, api.NewErrorf(api.ERR_INVALID_REQUEST, "limit must be a number from 1 to %d", maxDeliveriesLimit)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+//handleWebhookDeliveries lists the delivery log (GET, newest first) and sends a delivery again (POST ?id=),
+//which is how a dead delivery is brought back once its receiver is fixed. The api key is sent in the X-API-Key header,
+//a key only sees the deliveries to the subscriptions it created.
+func (s *CouponService) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		s.respondWithErrors(w, api.NewError(api.ERR_UNKNOWN_OPERATION, "webhook deliveries are listed with GET and sent again with POST"))
+		return
+	}
+
+	owners, err := s.webhookOwners(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			s.respondWithErrors(w, api.NewError(api.ERR_ID_REQUIRED, "the id parameter is required"))
+			return
+		}
+		if err := s.db.Redeliver(id, time.Now(), owners...); err != nil {
+			s.respondWithError(w, err)
+			return
+		}
+		writeResponse(w, s.newResponse(nil))
+		return
+	}
+
+	filter, err := deliveryFilterFromQuery(r)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	filter.Owners = owners
+	deliveries, err := s.db.Deliveries(filter)
+	if err != nil {
+		s.respondWithError(w, err)
+		return
+	}
+	writeResponse(w, s.newResponse(deliveries))
+}
@@ -0,0 +1,369 @@
+package couponservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+	"github.com/akh-dev/coupons-service/dblayer/dbtest"
+)
+
+//webhookReceiver records the deliveries POSTed to it and answers them with status
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	w.WriteHeader(rcv.status)
+}
+
+func (rcv *webhookReceiver) received() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+}
+
+func newWebhookSvc(t *testing.T) (*CouponService, *dbtest.DB) {
+	s, err := getNewSvc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := dbtest.New()
+	s.db = db
+	//the receivers of the tests listen on loopback
+	s.webhooks = webhookSettings{timeout: time.Second, maxAttempts: 3, minBackoff: time.Millisecond, maxBackoff: time.Millisecond, allowPrivateNetworks: true}
+	s.webhooksRelayed = 1
+	return s, db
+}
+
+func subscribe(t *testing.T, db *dbtest.DB, sub api.WebhookSubscription) api.WebhookSubscription {
+	if err := db.CreateSubscription(&sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+//deliverWebhooks relays the events to the webhook sink, and sends the deliveries that are due
+func deliverWebhooks(t *testing.T, s *CouponService, relay *outboxRelay, worker *webhookWorker) {
+	if _, err := relay.relay(context.Background(), &webhookSink{db: s.db}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worker.deliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	s, db := newWebhookSvc(t)
+	rcv := &webhookReceiver{status: http.StatusNoContent}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	//a coupon changed before the subscription is not delivered
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Before", Brand: "Tesco", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	sub := subscribe(t, db, api.WebhookSubscription{URL: server.URL, EventTypes: []string{api.EVENT_CREATED}, Brand: "Tesco", Secret: "shh"})
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}, {Name: "Save 5", Brand: "Boots", Value: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	relay := s.newOutboxRelay()
+	deliverWebhooks(t, s, relay, s.newWebhookWorker())
+
+	if rcv.received() != 1 {
+		t.Fatalf("expected a single delivery, but got %d", rcv.received())
+	}
+	r, body := rcv.requests[0], rcv.bodies[0]
+
+	payload := api.WebhookPayload{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event.Type != api.EVENT_CREATED || payload.Event.Brand != "Tesco" || payload.Event.Seq != 2 {
+		t.Errorf("unexpected event %+v", payload.Event)
+	}
+	if r.Header.Get(WEBHOOK_DELIVERY_HEADER) != payload.DeliveryId || r.Header.Get(WEBHOOK_EVENT_HEADER) != api.EVENT_CREATED {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+
+	//the receiver checks the signature by signing the body with its copy of the secret
+	signature := r.Header.Get(WEBHOOK_SIGNATURE_HEADER)
+	signedAt, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+	if err != nil || signature != signWebhook("shh", time.Unix(signedAt, 0), body) {
+		t.Errorf("the signature %s does not match the body", signature)
+	}
+
+	deliveries, _ := db.Deliveries(dblayer.DeliveryFilter{SubscriptionId: sub.Id})
+	if len(deliveries) != 1 || deliveries[0].Status != api.DELIVERY_DELIVERED || len(deliveries[0].Attempts) != 1 || deliveries[0].Attempts[0].StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected delivery log %+v", deliveries)
+	}
+
+	//the relay carries on from its checkpoint and a restarted worker from the delivery log, nothing is sent twice
+	deliverWebhooks(t, s, relay, s.newWebhookWorker())
+	if rcv.received() != 1 {
+		t.Errorf("expected the delivery to be sent once, but it was sent %d times", rcv.received())
+	}
+}
+
+func TestWebhookRetriesAndDeadLetter(t *testing.T) {
+	s, db := newWebhookSvc(t)
+	rcv := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	sub := subscribe(t, db, api.WebhookSubscription{URL: server.URL, Secret: "shh"})
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}}); err != nil {
+		t.Fatal(err)
+	}
+
+	relay, worker := s.newOutboxRelay(), s.newWebhookWorker()
+	for i := 0; i < 5; i++ {
+		deliverWebhooks(t, s, relay, worker)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	deliveries, _ := db.Deliveries(dblayer.DeliveryFilter{Status: api.DELIVERY_DEAD})
+	if rcv.received() != 3 || len(deliveries) != 1 || len(deliveries[0].Attempts) != 3 {
+		t.Fatalf("expected a dead delivery after 3 attempts, but got %d attempts and %+v", rcv.received(), deliveries)
+	}
+	if deliveries[0].SubscriptionId != sub.Id || !strings.Contains(deliveries[0].Attempts[2].Error, "500") {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+
+	//brought back once the receiver is fixed
+	rcv.mu.Lock()
+	rcv.status = http.StatusOK
+	rcv.mu.Unlock()
+
+	r := httptest.NewRequest(http.MethodPost, WEBHOOK_DELIVERIES_PATH+"?id="+deliveries[0].Id, nil)
+	r.Header.Set(API_KEY_HEADER, "Valid API Key")
+	w := httptest.NewRecorder()
+	s.handleWebhookDeliveries(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected redelivery response %d: %s", w.Code, w.Body.String())
+	}
+
+	deliverWebhooks(t, s, relay, worker)
+	deliveries, _ = db.Deliveries(dblayer.DeliveryFilter{})
+	if rcv.received() != 4 || deliveries[0].Status != api.DELIVERY_DELIVERED {
+		t.Errorf("expected the redelivery to succeed, but got %+v", deliveries)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	w := &webhookWorker{settings: webhookSettings{maxAttempts: 10, minBackoff: 10 * time.Second, maxBackoff: time.Minute}}
+
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, wait := range expected {
+		if backoff := w.backoff(i + 1); backoff != wait {
+			t.Errorf("expected a backoff of %s after %d failed attempts, but got %s", wait, i+1, backoff)
+		}
+	}
+}
+
+func TestHandleWebhooks(t *testing.T) {
+	s, db := newWebhookSvc(t)
+
+	send := func(method, query, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, WEBHOOKS_PATH+query, bytes.NewBufferString(body))
+		r.Header.Set(API_KEY_HEADER, "Valid API Key")
+		w := httptest.NewRecorder()
+		s.handleWebhooks(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"subscribed", `{"url":"https://example.com/hook","eventTypes":["created","redeemed"],"brand":"Tesco"}`, http.StatusOK},
+		{"relative url", `{"url":"/hook"}`, http.StatusUnprocessableEntity},
+		{"not http", `{"url":"ftp://example.com/hook"}`, http.StatusUnprocessableEntity},
+		{"unknown event type", `{"url":"https://example.com/hook","eventTypes":["renamed"]}`, http.StatusUnprocessableEntity},
+		{"not json", `url=https://example.com/hook`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := send(http.MethodPost, "", test.body); w.Code != test.expectedStatus {
+				t.Errorf("expected http status %d, but got %d: %s", test.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	subs, _ := db.Subscriptions()
+	if len(subs) != 1 || len(subs[0].Secret) != 64 {
+		t.Fatalf("expected a subscription with a generated secret, but got %+v", subs)
+	}
+
+	w := send(http.MethodGet, "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), subs[0].Id.Hex()) || strings.Contains(w.Body.String(), subs[0].Secret) {
+		t.Errorf("expected the subscriptions without their secrets, but got %s", w.Body.String())
+	}
+
+	if w := send(http.MethodDelete, "?id="+subs[0].Id.Hex(), ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected delete response %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodDelete, "?id="+subs[0].Id.Hex(), ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected a second delete to find nothing, but got %d", w.Code)
+	}
+	if w := send(http.MethodPut, "", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected a put to be refused, but got %d", w.Code)
+	}
+
+	//a subscription would never fire while the relay is not running
+	s.webhooksRelayed = 0
+	if w := send(http.MethodPost, "", `{"url":"https://example.com/hook"}`); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), api.ERR_WEBHOOKS_UNAVAILABLE) {
+		t.Errorf("expected the subscription to be refused without the relay, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	addresses := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.100.100.200": false,
+		"0.0.0.0":         false,
+		"fd00:ec2::254":   false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	}
+	for address, public := range addresses {
+		if isPublicAddress(net.ParseIP(address)) != public {
+			t.Errorf("expected %s to be public: %t", address, public)
+		}
+	}
+
+	s, db := newWebhookSvc(t)
+	s.webhooks.allowPrivateNetworks = false
+
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data", "http://localhost:8080/hook", "http://[::1]/hook"} {
+		code, _ := apiKeyRequest(t, s.handleWebhooks, http.MethodPost, WEBHOOKS_PATH, "Valid API Key", `{"url":"`+url+`"}`, nil)
+		if code != http.StatusUnprocessableEntity {
+			t.Errorf("expected a subscription to %s to be refused, but got %d", url, code)
+		}
+	}
+
+	//the address is checked again as the delivery is sent, whatever the url names
+	rcv := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+	subscribe(t, db, api.WebhookSubscription{URL: server.URL, Secret: "shh"})
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	deliverWebhooks(t, s, s.newOutboxRelay(), s.newWebhookWorker())
+
+	deliveries, _ := db.Deliveries(dblayer.DeliveryFilter{})
+	if rcv.received() != 0 || len(deliveries) != 1 || len(deliveries[0].Attempts) == 0 || !strings.Contains(deliveries[0].Attempts[0].Error, "not a public address") {
+		t.Errorf("expected the delivery to a loopback address to be refused, but got %d requests and %+v", rcv.received(), deliveries)
+	}
+}
+
+func TestWebhooksScopedToApiKey(t *testing.T) {
+	s, db := newWebhookSvc(t)
+	checkout := createApiKey(t, s, `{"owner":"checkout"}`)
+	billing := createApiKey(t, s, `{"owner":"billing"}`)
+
+	sub := &api.WebhookSubscription{}
+	if code, errs := apiKeyRequest(t, s.handleWebhooks, http.MethodPost, WEBHOOKS_PATH, checkout.Key, `{"url":"https://example.com/hook"}`, sub); code != http.StatusOK {
+		t.Fatalf("failed to subscribe: %d %v", code, errs)
+	}
+	db.EnqueueDeliveries([]api.WebhookDelivery{{Id: deliveryId(sub.Id, 1), SubscriptionId: sub.Id, Owner: principalForKey(checkout.Key), Status: api.DELIVERY_DEAD}})
+
+	subs := []api.WebhookSubscription{}
+	if apiKeyRequest(t, s.handleWebhooks, http.MethodGet, WEBHOOKS_PATH, billing.Key, "", &subs); len(subs) != 0 {
+		t.Errorf("expected another key not to see the subscription, but got %+v", subs)
+	}
+	if code, _ := apiKeyRequest(t, s.handleWebhooks, http.MethodDelete, WEBHOOKS_PATH+"?id="+sub.Id.Hex(), billing.Key, "", nil); code != http.StatusNotFound {
+		t.Errorf("expected another key not to delete the subscription, but got %d", code)
+	}
+	deliveries := []api.WebhookDelivery{}
+	if apiKeyRequest(t, s.handleWebhookDeliveries, http.MethodGet, WEBHOOK_DELIVERIES_PATH, billing.Key, "", &deliveries); len(deliveries) != 0 {
+		t.Errorf("expected another key not to see the deliveries, but got %+v", deliveries)
+	}
+	if code, _ := apiKeyRequest(t, s.handleWebhookDeliveries, http.MethodPost, WEBHOOK_DELIVERIES_PATH+"?id="+deliveryId(sub.Id, 1), billing.Key, "", nil); code != http.StatusNotFound {
+		t.Errorf("expected another key not to redeliver, but got %d", code)
+	}
+
+	if apiKeyRequest(t, s.handleWebhooks, http.MethodGet, WEBHOOKS_PATH, checkout.Key, "", &subs); len(subs) != 1 || subs[0].Id != sub.Id {
+		t.Errorf("expected the key to see its subscription, but got %+v", subs)
+	}
+	if apiKeyRequest(t, s.handleWebhookDeliveries, http.MethodGet, WEBHOOK_DELIVERIES_PATH, checkout.Key, "", &deliveries); len(deliveries) != 1 {
+		t.Errorf("expected the key to see its deliveries, but got %+v", deliveries)
+	}
+	if code, _ := apiKeyRequest(t, s.handleWebhooks, http.MethodDelete, WEBHOOKS_PATH+"?id="+sub.Id.Hex(), checkout.Key, "", nil); code != http.StatusOK {
+		t.Errorf("expected the key to delete its subscription, but got %d", code)
+	}
+}
+
+//a receiver that does not answer holds up its own deliveries only
+func TestWebhookDeliveriesConcurrent(t *testing.T) {
+	s, db := newWebhookSvc(t)
+	s.webhooks.concurrency = 2
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	rcv := &webhookReceiver{status: http.StatusOK}
+	fast := httptest.NewServer(rcv)
+	defer fast.Close()
+
+	subscribe(t, db, api.WebhookSubscription{URL: slow.URL, Secret: "shh"})
+	subscribe(t, db, api.WebhookSubscription{URL: fast.URL, Secret: "shh"})
+	if _, err := db.CreateCoupons(api.Actor{}, []api.Coupon{{Name: "Save 10", Brand: "Tesco", Value: 10}, {Name: "Save 5", Brand: "Tesco", Value: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.newOutboxRelay().relay(context.Background(), &webhookSink{db: s.db}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		sent, _ := s.newWebhookWorker().deliverDue(context.Background())
+		done <- sent
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for rcv.received() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if rcv.received() != 2 {
+		t.Errorf("expected the fast receiver to get its deliveries while the slow one holds its first, but it got %d", rcv.received())
+	}
+
+	close(release)
+	if sent := <-done; sent != 4 {
+		t.Errorf("expected 4 deliveries to be sent, but %d were", sent)
+	}
+}
@@ -0,0 +1,142 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_API_KEY_COLLECTION string = "api_keys"
+)
+
+//ApiKeyStore keeps the api keys, with the salted hashes of their secrets
+type ApiKeyStore interface {
+	CreateApiKey(key *api.ApiKey) error
+	ApiKey(id primitive.ObjectID) (*api.ApiKey, error)
+	ApiKeys() ([]api.ApiKey, error)
+	//RotateApiKey replaces the secret of the key, the old one stops working
+	RotateApiKey(id primitive.ObjectID, salt, hash []byte) error
+	SetApiKeyDisabled(id primitive.ObjectID, disabled bool) error
+	//DeleteApiKey revokes the key for good
+	DeleteApiKey(id primitive.ObjectID) error
+}
+
+func apiKeyNotFound(id primitive.ObjectID) api.Error {
+	return api.NewErrorf(api.ERR_API_KEY_NOT_FOUND, "api key %s does not exist", id.Hex())
+}
+
+func (dbl *T) CreateApiKey(key *api.ApiKey) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_API_KEY_COLLECTION)
+
+	key.Id = primitive.NewObjectID()
+	key.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	if _, err := keyColl.InsertOne(ctx, key); err != nil {
+		return dbFailure(err, "failed to store the api key")
+	}
+	return nil
+}
+
+func (dbl *T) ApiKey(id primitive.ObjectID) (*api.ApiKey, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_API_KEY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	key := &api.ApiKey{}
+	err := keyColl.FindOne(ctx, bson.D{{"_id", id}}).Decode(key)
+	if err == mongo.ErrNoDocuments {
+		return nil, apiKeyNotFound(id)
+	}
+	if err != nil {
+		return nil, dbFailure(err, "failed to read the api key from the db")
+	}
+	return key, nil
+}
+
+func (dbl *T) ApiKeys() ([]api.ApiKey, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_API_KEY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	cur, err := keyColl.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{"createdAt", 1}}))
+	if err != nil {
+		return nil, dbFailure(err, "failed to read api keys from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	keys := []api.ApiKey{}
+	for cur.Next(ctx) {
+		key := api.ApiKey{}
+		if err := cur.Decode(&key); err != nil {
+			return nil, dbFailure(err, "failed to read an api key from the db")
+		}
+		keys = append(keys, key)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, dbFailure(err, "failed to read api keys from the db")
+	}
+
+	return keys, nil
+}
+
+func (dbl *T) RotateApiKey(id primitive.ObjectID, salt, hash []byte) error {
+	return dbl.updateApiKey(id, bson.D{{"salt", salt}, {"hash", hash}, {"rotatedAt", time.Now()}})
+}
+
+func (dbl *T) SetApiKeyDisabled(id primitive.ObjectID, disabled bool) error {
+	return dbl.updateApiKey(id, bson.D{{"disabled", disabled}})
+}
+
+func (dbl *T) updateApiKey(id primitive.ObjectID, fields bson.D) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_API_KEY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	res, err := keyColl.UpdateOne(ctx, bson.D{{"_id", id}}, bson.D{{"$set", fields}})
+	if err != nil {
+		return dbFailure(err, "failed to update the api key")
+	}
+	if res.MatchedCount == 0 {
+		return apiKeyNotFound(id)
+	}
+	return nil
+}
+
+func (dbl *T) DeleteApiKey(id primitive.ObjectID) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_API_KEY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	res, err := keyColl.DeleteOne(ctx, bson.D{{"_id", id}})
+	if err != nil {
+		return dbFailure(err, "failed to delete the api key")
+	}
+	if res.DeletedCount == 0 {
+		return apiKeyNotFound(id)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_AUDIT_COLLECTION string = "audit_log"
+)
+
+//AuditStore searches the audit log. The entries are recorded by the writes of the coupons, in the same transaction
+//as their versions and events (see appendHistory), so there is no way to add, change or remove an entry through it.
+type AuditStore interface {
+	SearchAudit(filter *api.AuditFilter) ([]api.AuditEntry, error)
+}
+
+//NewAuditEntry records the change the event describes as made by actor, with the coupon before and after it
+func NewAuditEntry(actor api.Actor, event api.CouponEvent, before, after *api.Coupon) api.AuditEntry {
+	entry := api.AuditEntry{
+		Id:       primitive.NewObjectID(),
+		CouponId: event.CouponId,
+		Action:   event.Type,
+		Actor:    actor,
+		At:       time.Now(),
+		Version:  event.Version,
+		Before:   before,
+		After:    after,
+	}
+	if event.Type == api.EVENT_UPDATED {
+		entry.ChangedFields = event.ChangedFields
+	}
+	return entry
+}
+
+//appendAudit stores the entries of a write, ctx is the one of the write, see appendEvents
+func (dbl *T) appendAudit(ctx context.Context, entries []api.AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	db := dbl.mongoClient.Database(dbl.dbName)
+	auditColl := db.Collection(DB_AUDIT_COLLECTION)
+
+	opCtx, cancel := context.WithTimeout(ctx, dbl.timeout)
+	defer cancel()
+
+	documents := []interface{}{}
+	for _, entry := range entries {
+		documents = append(documents, entry)
+	}
+	_, err := auditColl.InsertMany(opCtx, documents)
+	return err
+}
+
+//removeAudit takes back the entries of a failed write that made it to the db
+func (dbl *T) removeAudit(entries []api.AuditEntry) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	auditColl := db.Collection(DB_AUDIT_COLLECTION)
+
+	ids := bson.A{}
+	for _, entry := range entries {
+		ids = append(ids, entry.Id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := auditColl.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}})
+	return errors.Wrap(err, "failed to remove the audit entries of a failed write")
+}
+
+func (dbl *T) SearchAudit(filter *api.AuditFilter) ([]api.AuditEntry, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	auditColl := db.Collection(DB_AUDIT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	query := bson.D{}
+	if !filter.CouponId.IsZero() {
+		query = append(query, bson.E{"couponId", filter.CouponId})
+	}
+	if filter.Principal != "" {
+		query = append(query, bson.E{"actor.principal", filter.Principal})
+	}
+	at := bson.D{}
+	if !filter.From.IsZero() {
+		at = append(at, bson.E{"$gte", filter.From})
+	}
+	if !filter.To.IsZero() {
+		at = append(at, bson.E{"$lte", filter.To})
+	}
+	if len(at) > 0 {
+		query = append(query, bson.E{"at", at})
+	}
+
+	opts := options.Find().SetSort(bson.D{{"at", -1}, {"_id", -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	cur, err := auditColl.Find(ctx, query, opts)
+	if err != nil {
+		return nil, dbFailure(err, "failed to read the audit log from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	entries := []api.AuditEntry{}
+	for cur.Next(ctx) {
+		entry := api.AuditEntry{}
+		if err := cur.Decode(&entry); err != nil {
+			return nil, dbFailure(err, "failed to read an audit entry from the db")
+		}
+		entries = append(entries, entry)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, dbFailure(err, "failed to read the audit log from the db")
+	}
+
+	return entries, nil
+}
+
+//ensureAuditIndexes creates an index per filter of SearchAudit, each sorted as its results
+func (dbl *T) ensureAuditIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	auditColl := db.Collection(DB_AUDIT_COLLECTION)
+
+	for _, keys := range []bson.D{
+		{{"couponId", 1}, {"at", -1}},
+		{{"actor.principal", 1}, {"at", -1}},
+		{{"at", -1}},
+	} {
+		if _, err := auditColl.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys}); err != nil {
+			return errors.Wrap(err, "failed to create an audit log index")
+		}
+	}
+
+	return nil
+}
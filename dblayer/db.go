@@ -21,108 +21,503 @@ const (
 )
 
 type Interface interface {
-	CreateCoupons(coupons []api.Coupon) (*mongo.InsertManyResult, error)
-	UpdateCoupons(coupons []api.Coupon) (int64, error)
+	Init() error
+	//the writes record their changes in the audit log as made by actor
+	CreateCoupons(actor api.Actor, coupons []api.Coupon) (*mongo.InsertManyResult, error)
+	UpdateCoupons(actor api.Actor, coupons []api.Coupon) (int64, error)
+	RevertCoupon(actor api.Actor, cpn api.Coupon) error
+	DeleteCoupons(actor api.Actor, coupons []api.Coupon) (int64, error)
 	FindByIds(ids []interface{}) ([]api.Coupon, error)
 	SearchFromRequest(reqFilter *api.CouponFilter) ([]api.Coupon, error)
+	SearchEach(ctx context.Context, reqFilter *api.CouponFilter, fn func(cpn api.Coupon) error) error
+	BatchWriteMode() string
+	LastImportedRow(importId string) (int, error)
+
+	EventsAfter(ctx context.Context, after int64, limit int) (events []api.CouponEvent, settled int64, err error)
+	EventBounds() (oldest, newest int64, err error)
+	ExpireCoupons(now time.Time) (int, error)
+
+	ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(key string, statusCode int, response []byte) error
+	ReleaseIdempotencyKey(key string) error
+
+	WebhookStore
+	OutboxStore
+	AuditStore
+	VersionStore
+	ApiKeyStore
+	ImportStore
 }
 
 type T struct {
 	mongoClient *mongo.Client
 	dbName      string
 	timeout     time.Duration
+	writeMode   string
+
+	//how long coupon events are kept, a stream can be resumed from within this window
+	eventRetention time.Duration
 }
 
-func New(client *mongo.Client, dbName string, timeout time.Duration) (*T, error) {
+func New(client *mongo.Client, dbName string, timeout, eventRetention time.Duration) (*T, error) {
 	if client == nil {
 		return nil, errors.Errorf("a valid mongo client must be provided")
 	}
 
 	db := &T{
-		mongoClient: client,
-		dbName:      dbName,
-		timeout:     timeout,
+		mongoClient:    client,
+		dbName:         dbName,
+		timeout:        timeout,
+		eventRetention: eventRetention,
 	}
 
 	return db, nil
 }
 
-func (dbl *T) CreateCoupons(coupons []api.Coupon) (*mongo.InsertManyResult, error) {
+//Init prepares the collections for use: coupons written before versioning was introduced get version 1
+//and the indexes the service relies on are created. It also detects whether batch writes can use transactions.
+func (dbl *T) Init() error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	dbl.writeMode = dbl.detectWriteMode(ctx)
+	log.Printf("batch writes will use the %s mode", dbl.writeMode)
+
+	res, err := couponColl.UpdateMany(
+		ctx,
+		bson.D{{"version", bson.D{{"$exists", false}}}},
+		bson.D{{"$set", bson.D{{"version", int64(1)}}}},
+	)
+	if err != nil {
+		err = errors.Wrap(err, "failed to backfill coupon versions")
+		log.Println(err.Error())
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("%d coupons were assigned an initial version", res.ModifiedCount)
+	}
+
+	if err := dbl.ensureIdempotencyIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.ensureImportIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.ensureEventIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.ensureWebhookIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.migrateWebhookCheckpoint(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.ensureAuditIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	if err := dbl.ensureVersionIndexes(ctx); err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (dbl *T) CreateCoupons(actor api.Actor, coupons []api.Coupon) (*mongo.InsertManyResult, error) {
 
 	db := dbl.mongoClient.Database(dbl.dbName)
 	couponColl := db.Collection(DB_COUPON_COLLECTION)
 
+	//ids are assigned upfront, so a partially inserted batch can be found and removed again
+	ids := bson.A{}
+	created := []primitive.ObjectID{}
 	documents := []interface{}{}
+	events := []api.CouponEvent{}
+	versions := []api.CouponVersion{}
+	audit := []api.AuditEntry{}
+	now := time.Now()
 	for _, cpn := range coupons {
-		documents = append(documents, bson.M{
+		id := primitive.NewObjectID()
+		ids = append(ids, id)
+		created = append(created, id)
+		event := api.CouponEvent{
+			Type:          api.EVENT_CREATED,
+			CouponId:      id,
+			Brand:         cpn.Brand,
+			ChangedFields: couponFields,
+			Version:       1,
+		}
+		events = append(events, event)
+		document := bson.M{
+			"_id":       id,
 			"name":      cpn.Name,
 			"brand":     cpn.Brand,
 			"value":     cpn.Value,
 			"expiry":    cpn.Expiry,
-			"createdAt": time.Now(),
-		})
+			"createdAt": now,
+			"version":   int64(1),
+		}
+		if cpn.Import != nil {
+			document["import"] = cpn.Import
+		}
+		documents = append(documents, document)
+		stored := api.Coupon{Id: id, Name: cpn.Name, Brand: cpn.Brand, Value: cpn.Value, Expiry: cpn.Expiry, CreatedAt: now, Version: 1}
+		versions = append(versions, api.CouponVersion{CouponId: id, Version: 1, Coupon: stored})
+		audit = append(audit, NewAuditEntry(actor, event, nil, &stored))
+	}
+
+	var res *mongo.InsertManyResult
+	insert := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, dbl.timeout)
+		defer cancel()
 
+		var err error
+		res, err = couponColl.InsertMany(ctx, documents)
+		if err != nil {
+			return err
+		}
+		return dbl.appendHistory(ctx, versions, audit, events)
 	}
-	ctx, _ := context.WithTimeout(context.Background(), dbl.timeout)
-	res, err := couponColl.InsertMany(ctx, documents)
-	if err != nil {
-		err = errors.Wrap(err, "failed to write new coupons to the db")
-		log.Println(err.Error())
-		return nil, err
+	//which of the coupons were inserted is not known, so all of them are reported if removing them fails
+	removeInserted := func() ([]primitive.ObjectID, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+		defer cancel()
+
+		if _, err := couponColl.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}}); err != nil {
+			return created, err
+		}
+		return nil, nil
+	}
+
+	if err := dbl.runBatch(insert, removeInserted); err != nil {
+		if apiErr, isApiErr := errors.Cause(err).(api.Error); isApiErr {
+			return nil, apiErr
+		}
+		return nil, dbFailure(err, "failed to write new coupons to the db")
 	}
 
 	return res, nil
 
 }
 
-func (dbl *T) UpdateCoupons(coupons []api.Coupon) (int64, error) {
+func (dbl *T) UpdateCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+	return dbl.updateCoupons(actor, coupons, false)
+}
+
+//RevertCoupon writes every versioned field of the coupon as given, empty ones included, as a new version.
+//Like an update, the coupon must carry the version the caller last saw.
+func (dbl *T) RevertCoupon(actor api.Actor, cpn api.Coupon) error {
+	_, err := dbl.updateCoupons(actor, []api.Coupon{cpn}, true)
+	return err
+}
+
+//updateCoupons applies the updates, with replace every versioned field is written rather than only the ones set
+func (dbl *T) updateCoupons(actor api.Actor, coupons []api.Coupon, replace bool) (int64, error) {
 
 	db := dbl.mongoClient.Database(dbl.dbName)
 	couponColl := db.Collection(DB_COUPON_COLLECTION)
 
+	//check the expected versions upfront, so a stale batch is rejected before anything is written
+	previous, err := dbl.checkVersions(coupons)
+	if err != nil {
+		return 0, err
+	}
+
 	var UpdatedCnt int64 = 0
+	applied := []api.Coupon{}
+
+	update := func(ctx context.Context) error {
+		events := []api.CouponEvent{}
+		versions := []api.CouponVersion{}
+		audit := []api.AuditEntry{}
+		for _, cpn := range coupons {
+			change := bson.D{
+				{"$set", updatedFields(cpn, replace)},
+				{"$inc", bson.D{
+					{"version", 1},
+				}},
+				{"$currentDate", bson.D{
+					{"lastModified", true},
+				}},
+			}
+			//a new expiry is reported again once it passes
+			if replace || !cpn.Expiry.IsZero() {
+				change = append(change, bson.E{"$unset", bson.D{{"expiredEventAt", ""}}})
+			}
 
-	for _, cpn := range coupons {
-		fields := bson.D{}
+			opCtx, cancel := context.WithTimeout(ctx, dbl.timeout)
+			res, err := couponColl.UpdateOne(
+				opCtx,
+				bson.D{
+					{"_id", cpn.Id},
+					{"version", cpn.Version},
+				},
+				change,
+			)
+			cancel()
+
+			if err != nil {
+				return err
+			}
 
-		if cpn.Name != "" {
-			fields = append(fields, bson.E{"name", cpn.Name})
+			//the coupon was changed by someone else between the version check and the write
+			if res.MatchedCount == 0 {
+				return dbl.conflictFor([]interface{}{cpn.Id})
+			}
+
+			UpdatedCnt = UpdatedCnt + res.ModifiedCount
+			applied = append(applied, cpn)
+			prev, event, updated := previous[cpn.Id], updateEvent(previous[cpn.Id], cpn, replace), updatedCoupon(previous[cpn.Id], cpn, replace)
+			events = append(events, event)
+			versions = append(versions, api.CouponVersion{CouponId: cpn.Id, Version: cpn.Version + 1, Coupon: updated})
+			audit = append(audit, NewAuditEntry(actor, event, &prev, &updated))
 		}
-		if cpn.Brand != "" {
-			fields = append(fields, bson.E{"brand", cpn.Brand})
+		return dbl.appendHistory(ctx, versions, audit, events)
+	}
+
+	//the coupons are put back at the version they were updated from. The history and the events of the failed update
+	//were not written or are taken back with it (see appendHistory), so no trace of the version it wrote is left.
+	//A coupon changed again since the update is left alone, and reported as not restored.
+	restorePrevious := func() ([]primitive.ObjectID, error) {
+		changed := []primitive.ObjectID{}
+		var undoErr error
+		for _, cpn := range applied {
+			prev := previous[cpn.Id]
+
+			ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+			res, err := couponColl.UpdateOne(
+				ctx,
+				bson.D{
+					{"_id", cpn.Id},
+					{"version", cpn.Version + 1},
+				},
+				bson.D{
+					{"$set", bson.D{
+						{"name", prev.Name},
+						{"brand", prev.Brand},
+						{"value", prev.Value},
+						{"expiry", prev.Expiry},
+						{"version", cpn.Version},
+					}},
+				},
+			)
+			cancel()
+
+			if err != nil {
+				undoErr = err
+				changed = append(changed, cpn.Id)
+				continue
+			}
+			if res.MatchedCount == 0 {
+				changed = append(changed, cpn.Id)
+			}
 		}
-		if cpn.Value > 0 {
-			fields = append(fields, bson.E{"value", cpn.Value})
+		return changed, undoErr
+	}
+
+	if err := dbl.runBatch(update, restorePrevious); err != nil {
+		switch errors.Cause(err).(type) {
+		case *ConflictError, api.Error:
+			return 0, err
 		}
-		if !cpn.Expiry.IsZero() {
-			fields = append(fields, bson.E{"expiry", cpn.Expiry})
+		return 0, dbFailure(err, "failed to write new coupons to the db")
+	}
+
+	return UpdatedCnt, nil
+
+}
+
+//DeleteCoupons removes the coupons, every coupon must carry the version the caller last saw.
+//The batch is all-or-nothing: a coupon modified in the meantime fails it with a ConflictError.
+func (dbl *T) DeleteCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+
+	db := dbl.mongoClient.Database(dbl.dbName)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	previous, err := dbl.checkVersions(coupons)
+	if err != nil {
+		return 0, err
+	}
+
+	var deletedCnt int64 = 0
+	deleted := []api.Coupon{}
+
+	remove := func(ctx context.Context) error {
+		events := []api.CouponEvent{}
+		versions := []api.CouponVersion{}
+		audit := []api.AuditEntry{}
+		for _, cpn := range coupons {
+			opCtx, cancel := context.WithTimeout(ctx, dbl.timeout)
+			res, err := couponColl.DeleteOne(opCtx, bson.D{{"_id", cpn.Id}, {"version", cpn.Version}})
+			cancel()
+
+			if err != nil {
+				return err
+			}
+
+			//the coupon was changed by someone else between the version check and the delete
+			if res.DeletedCount == 0 {
+				return dbl.conflictFor([]interface{}{cpn.Id})
+			}
+
+			deletedCnt = deletedCnt + res.DeletedCount
+			prev := previous[cpn.Id]
+			deleted = append(deleted, prev)
+			event := api.CouponEvent{
+				Type:     api.EVENT_DELETED,
+				CouponId: cpn.Id,
+				Brand:    prev.Brand,
+				Version:  cpn.Version,
+			}
+			events = append(events, event)
+			versions = append(versions, api.CouponVersion{CouponId: cpn.Id, Version: cpn.Version, Deleted: true, Coupon: prev})
+			audit = append(audit, NewAuditEntry(actor, event, &prev, nil))
 		}
+		return dbl.appendHistory(ctx, versions, audit, events)
+	}
 
-		ctx, _ := context.WithTimeout(context.Background(), dbl.timeout)
-		res, err := couponColl.UpdateOne(
-			ctx,
-			bson.D{
-				{"item", "paper"},
-			},
-			bson.D{
-				{"$set", fields},
-				{"$currentDate", bson.D{
-					{"lastModified", true},
-				}},
-			},
-		)
+	//the coupons are restored as they were stored, with their ids and versions
+	restoreDeleted := func() ([]primitive.ObjectID, error) {
+		if len(deleted) == 0 {
+			return nil, nil
+		}
 
-		if err != nil {
-			err = errors.Wrap(err, "failed to write new coupons to the db")
-			log.Println(err.Error())
-			return UpdatedCnt, err
+		documents := []interface{}{}
+		ids := []primitive.ObjectID{}
+		for _, cpn := range deleted {
+			documents = append(documents, cpn)
+			ids = append(ids, cpn.Id)
 		}
 
-		UpdatedCnt = UpdatedCnt + res.ModifiedCount
+		ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+		defer cancel()
+
+		if _, err := couponColl.InsertMany(ctx, documents); err != nil {
+			return ids, err
+		}
+		return nil, nil
 	}
 
-	return UpdatedCnt, nil
+	if err := dbl.runBatch(remove, restoreDeleted); err != nil {
+		switch errors.Cause(err).(type) {
+		case *ConflictError, api.Error:
+			return 0, err
+		}
+		return 0, dbFailure(err, "failed to delete coupons from the db")
+	}
+
+	return deletedCnt, nil
+}
+
+//couponFields are the json names of the fields a coupon is created with
+var couponFields = []string{"name", "brand", "value", "expiry"}
+
+//updateEvent describes an update by the fields whose stored value it changed, see updatedFields
+func updateEvent(prev, cpn api.Coupon, replace bool) api.CouponEvent {
+	event := api.CouponEvent{
+		Type:     api.EVENT_UPDATED,
+		CouponId: cpn.Id,
+		Brand:    prev.Brand,
+		Version:  cpn.Version + 1,
+	}
+
+	if (replace || cpn.Name != "") && cpn.Name != prev.Name {
+		event.ChangedFields = append(event.ChangedFields, "name")
+	}
+	if (replace || cpn.Brand != "") && cpn.Brand != prev.Brand {
+		event.ChangedFields = append(event.ChangedFields, "brand")
+		event.Brand = cpn.Brand
+		event.PreviousBrand = prev.Brand
+	}
+	if (replace || cpn.Value > 0) && cpn.Value != prev.Value {
+		event.ChangedFields = append(event.ChangedFields, "value")
+	}
+	if (replace || !cpn.Expiry.IsZero()) && !cpn.Expiry.Equal(prev.Expiry) {
+		event.ChangedFields = append(event.ChangedFields, "expiry")
+	}
+
+	return event
+}
+
+//updatedFields lists the fields an update sets, fields left empty in the request keep their stored value.
+//With replace every field is set, a revert writes the empty ones of the version it goes back to as well.
+func updatedFields(cpn api.Coupon, replace bool) bson.D {
+	fields := bson.D{}
+
+	if replace || cpn.Name != "" {
+		fields = append(fields, bson.E{"name", cpn.Name})
+	}
+	if replace || cpn.Brand != "" {
+		fields = append(fields, bson.E{"brand", cpn.Brand})
+	}
+	if replace || cpn.Value > 0 {
+		fields = append(fields, bson.E{"value", cpn.Value})
+	}
+	if replace || !cpn.Expiry.IsZero() {
+		fields = append(fields, bson.E{"expiry", cpn.Expiry})
+	}
+
+	return fields
+}
+
+//checkVersions makes sure every coupon exists and its stored version matches the one the caller based the update on.
+//The stored coupons are returned by id.
+func (dbl *T) checkVersions(coupons []api.Coupon) (map[primitive.ObjectID]api.Coupon, error) {
+	ids := []interface{}{}
+	for _, cpn := range coupons {
+		ids = append(ids, cpn.Id)
+	}
+
+	current, err := dbl.FindByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	currentById := map[primitive.ObjectID]api.Coupon{}
+	for _, cpn := range current {
+		currentById[cpn.Id] = cpn
+	}
+
+	conflicts := []api.Coupon{}
+	for _, cpn := range coupons {
+		stored, found := currentById[cpn.Id]
+		if !found {
+			return nil, api.NewErrorf(api.ERR_COUPON_NOT_FOUND, "coupon %s does not exist", cpn.Id.Hex())
+		}
+		if stored.Version != cpn.Version {
+			conflicts = append(conflicts, stored)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, &ConflictError{Current: conflicts}
+	}
 
+	return currentById, nil
+}
+
+//conflictFor builds a ConflictError carrying the current state of the given coupons
+func (dbl *T) conflictFor(ids []interface{}) error {
+	current, err := dbl.FindByIds(ids)
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Current: current}
 }
 
 func (dbl *T) FindByIds(ids []interface{}) ([]api.Coupon, error) {
@@ -136,14 +531,29 @@ func (dbl *T) FindByIds(ids []interface{}) ([]api.Coupon, error) {
 }
 
 func (dbl *T) findManyWithFilter(filter interface{}) ([]api.Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	coupons := []api.Coupon{}
+	err := dbl.eachWithFilter(ctx, filter, func(cpn api.Coupon) error {
+		coupons = append(coupons, cpn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coupons, nil
+}
+
+//eachWithFilter hands the matching coupons to fn one at a time, as they are read from the cursor
+func (dbl *T) eachWithFilter(ctx context.Context, filter interface{}, fn func(cpn api.Coupon) error) error {
 
 	db := dbl.mongoClient.Database(dbl.dbName)
 	couponColl := db.Collection(DB_COUPON_COLLECTION)
-	ctx, _ := context.WithTimeout(context.Background(), dbl.timeout)
 	cur, err := couponColl.Find(ctx, filter)
 	if err != nil {
-		log.Println(err.Error())
-		return nil, err
+		return dbFailure(err, "failed to search coupons in the db")
 	}
 	defer func() {
 		if err := cur.Close(ctx); err != nil {
@@ -151,23 +561,21 @@ func (dbl *T) findManyWithFilter(filter interface{}) ([]api.Coupon, error) {
 		}
 	}()
 
-	coupons := []api.Coupon{}
 	for cur.Next(ctx) {
-		log.Println("found one")
 		cpn := api.Coupon{}
 		err := cur.Decode(&cpn)
 		if err != nil {
-			log.Println(err.Error())
-			return nil, err
+			return dbFailure(err, "failed to read a coupon from the db")
+		}
+		if err := fn(cpn); err != nil {
+			return err
 		}
-		coupons = append(coupons, cpn)
 	}
 	if err := cur.Err(); err != nil {
-		log.Println(err.Error())
-		return nil, err
+		return dbFailure(err, "failed to read coupons from the db")
 	}
 
-	return coupons, nil
+	return nil
 }
 
 func (dbl *T) SearchFromRequest(reqFilter *api.CouponFilter) ([]api.Coupon, error) {
@@ -178,20 +586,32 @@ func (dbl *T) SearchFromRequest(reqFilter *api.CouponFilter) ([]api.Coupon, erro
 	return dbl.findManyWithFilter(dbFilter)
 }
 
+//SearchEach streams the coupons matching the filter to fn straight from the db cursor, so large results are never held in memory.
+//The search runs until ctx is done, iteration stops at the first error returned by fn.
+func (dbl *T) SearchEach(ctx context.Context, reqFilter *api.CouponFilter, fn func(cpn api.Coupon) error) error {
+	dbFilter, err := dbl.buildFilterFromRequest(reqFilter)
+	if err != nil {
+		return err
+	}
+	return dbl.eachWithFilter(ctx, dbFilter, fn)
+}
+
 func (dbl *T) buildFilterFromRequest(reqFilter *api.CouponFilter) (bson.D, error) {
 	fieldsFilter := bson.D{}
 
 	if reqFilter == nil {
-		return nil, errors.Errorf("Search criteria must be provided")
+		return nil, api.NewError(api.ERR_INVALID_FILTER, "Search criteria must be provided")
 	}
 
 	//filter by ID
 	if len(reqFilter.IdIn) > 0 {
 		ids := bson.A{}
-		for _, id := range reqFilter.IdIn {
+		for i, id := range reqFilter.IdIn {
 			objId, err := primitive.ObjectIDFromHex(id)
 			if err != nil {
-				return nil, err
+				filterErr := api.NewErrorf(api.ERR_INVALID_FILTER, "%s is not a valid coupon id", id)
+				filterErr.Field = fmt.Sprintf("idIn[%d]", i)
+				return nil, filterErr
 			}
 			ids = append(ids, objId)
 		}
@@ -202,13 +622,13 @@ func (dbl *T) buildFilterFromRequest(reqFilter *api.CouponFilter) (bson.D, error
 	}
 
 	//Filter by Value
-	if reqFilter.ValueFrom != nil || reqFilter.ValueTo != nil {
+	if valueFrom, valueTo := reqFilter.ValueRange(); valueFrom != nil || valueTo != nil {
 		valueFilter := bson.D{}
-		if reqFilter.ValueFrom != nil {
-			valueFilter = append(valueFilter, bson.E{"$gte", *reqFilter.ValueFrom})
+		if valueFrom != nil {
+			valueFilter = append(valueFilter, bson.E{"$gte", *valueFrom})
 		}
-		if reqFilter.ValueTo != nil {
-			valueFilter = append(valueFilter, bson.E{"$lte", *reqFilter.ValueTo})
+		if valueTo != nil {
+			valueFilter = append(valueFilter, bson.E{"$lte", *valueTo})
 		}
 		fieldsFilter = append(fieldsFilter, bson.E{"value", valueFilter})
 	}
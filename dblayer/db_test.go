@@ -1,10 +1,16 @@
 package dblayer
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
 	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"github.com/akh-dev/coupons-service/api"
 )
 
 func TestNew(t *testing.T) {
@@ -14,7 +20,7 @@ func TestNew(t *testing.T) {
 		return
 	}
 
-	db, err := New(client, "test", time.Duration(1)*time.Second)
+	db, err := New(client, "test", time.Duration(1)*time.Second, time.Duration(24)*time.Hour)
 	if err != nil || db == nil {
 		t.Errorf("failed to create a db layer: %s", err.Error())
 		return
@@ -31,4 +37,117 @@ func TestNew(t *testing.T) {
 	if db.timeout != time.Duration(1)*time.Second {
 		t.Errorf("db.timeout was expected to be '1s', but got: '%s'", db.timeout)
 	}
+
+	if db.eventRetention != time.Duration(24)*time.Hour {
+		t.Errorf("db.eventRetention was expected to be '24h', but got: '%s'", db.eventRetention)
+	}
+}
+
+func TestBatchWriteModeDefault(t *testing.T) {
+	client, err := mongo.NewClient("mongodb://localhost:80")
+	if err != nil || client == nil {
+		t.Errorf("failed to create a mongo client: %s", err.Error())
+		return
+	}
+
+	db, err := New(client, "test", time.Duration(1)*time.Second, time.Duration(24)*time.Hour)
+	if err != nil || db == nil {
+		t.Errorf("failed to create a db layer: %s", err.Error())
+		return
+	}
+
+	//until Init has checked the server topology, batch writes must not assume transactions are available
+	if mode := db.BatchWriteMode(); mode != WRITE_MODE_COMPENSATING {
+		t.Errorf("db.BatchWriteMode() was expected to be '%s', but got: '%s'", WRITE_MODE_COMPENSATING, mode)
+	}
+}
+
+func TestUpdateEvent(t *testing.T) {
+	prev := api.Coupon{Name: "Save £1 at Tesco", Brand: "Tesco", Value: 1, Expiry: time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), Version: 2}
+
+	tests := []struct {
+		name          string
+		update        api.Coupon
+		replace       bool
+		changedFields []string
+		brand         string
+		previousBrand string
+	}{
+		{"changed value", api.Coupon{Value: 2, Version: 2}, false, []string{"value"}, "Tesco", ""},
+		{"same value", api.Coupon{Name: "Save £1 at Tesco", Value: 1, Version: 2}, false, nil, "Tesco", ""},
+		{"moved brand", api.Coupon{Brand: "Boots", Expiry: prev.Expiry.Add(time.Hour), Version: 2}, false, []string{"brand", "expiry"}, "Boots", "Tesco"},
+		{"replaced with empty fields", api.Coupon{Brand: "Tesco", Value: 1, Version: 2}, true, []string{"name", "expiry"}, "Tesco", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := updateEvent(prev, test.update, test.replace)
+			if event.Type != api.EVENT_UPDATED || event.Version != 3 {
+				t.Errorf("expected an update to version 3, but got %s to version %d", event.Type, event.Version)
+			}
+			if fmt.Sprint(event.ChangedFields) != fmt.Sprint(test.changedFields) {
+				t.Errorf("expected the changed fields %v, but got %v", test.changedFields, event.ChangedFields)
+			}
+			if event.Brand != test.brand || event.PreviousBrand != test.previousBrand {
+				t.Errorf("expected the brand %s (previously %s), but got %s (previously %s)", test.brand, test.previousBrand, event.Brand, event.PreviousBrand)
+			}
+		})
+	}
+}
+
+func TestUpdatedCoupon(t *testing.T) {
+	prev := api.Coupon{Name: "Save £1 at Tesco", Brand: "Tesco", Value: 1, Expiry: time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), Version: 2}
+
+	//the stored version is the previous one with the fields the update sets
+	cpn := updatedCoupon(prev, api.Coupon{Value: 2, Version: 2}, false)
+	expected := prev
+	expected.Value, expected.Version = 2, 3
+	if cpn != expected {
+		t.Errorf("expected %+v, but got %+v", expected, cpn)
+	}
+
+	//a revert replaces every field, the empty ones too
+	cpn = updatedCoupon(prev, api.Coupon{Brand: "Tesco", Value: 2, Version: 2}, true)
+	expected = api.Coupon{Brand: "Tesco", Value: 2, Version: 3}
+	if cpn != expected {
+		t.Errorf("expected %+v, but got %+v", expected, cpn)
+	}
+}
+
+func TestRunBatchCompensationFailure(t *testing.T) {
+	//without a topology check the batch is compensated rather than run in a transaction
+	dbl := &T{}
+	conflict := &ConflictError{Current: []api.Coupon{{Id: primitive.NewObjectID(), Version: 3}}}
+	left := primitive.NewObjectID()
+
+	tests := []struct {
+		name         string
+		changed      []primitive.ObjectID
+		undoErr      error
+		expectedCode string
+	}{
+		{"undone", nil, nil, ""},
+		{"coupon changed again", []primitive.ObjectID{left}, nil, api.ERR_BATCH_PARTIALLY_APPLIED},
+		{"undo failed", []primitive.ObjectID{left}, fmt.Errorf("update failed"), api.ERR_BATCH_PARTIALLY_APPLIED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := dbl.runBatch(
+				func(ctx context.Context) error { return conflict },
+				func() ([]primitive.ObjectID, error) { return test.changed, test.undoErr },
+			)
+
+			if test.expectedCode == "" {
+				if err != conflict {
+					t.Errorf("expected the conflict of the undone batch, but got %v", err)
+				}
+				return
+			}
+			apiErr, isApiErr := err.(api.Error)
+			if !isApiErr || apiErr.Code != test.expectedCode || !strings.Contains(apiErr.Message, left.Hex()) {
+				t.Errorf("expected %s listing %s, but got %v", test.expectedCode, left.Hex(), err)
+			}
+		})
+	}
 }
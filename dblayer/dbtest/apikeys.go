@@ -0,0 +1,83 @@
+package dbtest
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func apiKeyNotFound(id primitive.ObjectID) api.Error {
+	return api.NewErrorf(api.ERR_API_KEY_NOT_FOUND, "api key %s does not exist", id.Hex())
+}
+
+func (db *DB) CreateApiKey(key *api.ApiKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key.Id = primitive.NewObjectID()
+	key.CreatedAt = time.Now()
+
+	stored := *key
+	stored.Key = ""
+	db.apiKeys = append(db.apiKeys, stored)
+	return nil
+}
+
+func (db *DB) ApiKey(id primitive.ObjectID) (*api.ApiKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, key := range db.apiKeys {
+		if key.Id == id {
+			return &key, nil
+		}
+	}
+	return nil, apiKeyNotFound(id)
+}
+
+func (db *DB) ApiKeys() ([]api.ApiKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return append([]api.ApiKey{}, db.apiKeys...), nil
+}
+
+func (db *DB) RotateApiKey(id primitive.ObjectID, salt, hash []byte) error {
+	return db.updateApiKey(id, func(key *api.ApiKey) {
+		key.Salt, key.Hash, key.RotatedAt = salt, hash, time.Now()
+	})
+}
+
+func (db *DB) SetApiKeyDisabled(id primitive.ObjectID, disabled bool) error {
+	return db.updateApiKey(id, func(key *api.ApiKey) {
+		key.Disabled = disabled
+	})
+}
+
+func (db *DB) updateApiKey(id primitive.ObjectID, update func(key *api.ApiKey)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := range db.apiKeys {
+		if db.apiKeys[i].Id == id {
+			update(&db.apiKeys[i])
+			return nil
+		}
+	}
+	return apiKeyNotFound(id)
+}
+
+func (db *DB) DeleteApiKey(id primitive.ObjectID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, key := range db.apiKeys {
+		if key.Id == id {
+			db.apiKeys = append(db.apiKeys[:i], db.apiKeys[i+1:]...)
+			return nil
+		}
+	}
+	return apiKeyNotFound(id)
+}
@@ -0,0 +1,62 @@
+package dbtest
+
+import (
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//AppendAudit fills the audit log for a test, the writes of the coupons record their own entries
+func (db *DB) AppendAudit(entries []api.AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, entry := range entries {
+		db.appendAudit(entry)
+	}
+	return nil
+}
+
+//appendAudit records an entry, the lock must be held
+func (db *DB) appendAudit(entry api.AuditEntry) {
+	db.audit = append(db.audit, copyAuditEntry(entry))
+}
+
+func (db *DB) SearchAudit(filter *api.AuditFilter) ([]api.AuditEntry, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entries := []api.AuditEntry{}
+	for i := len(db.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+		entry := db.audit[i]
+		if !filter.CouponId.IsZero() && entry.CouponId != filter.CouponId {
+			continue
+		}
+		if filter.Principal != "" && entry.Actor.Principal != filter.Principal {
+			continue
+		}
+		if !filter.From.IsZero() && entry.At.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && entry.At.After(filter.To) {
+			continue
+		}
+		entries = append(entries, copyAuditEntry(entry))
+	}
+	return entries, nil
+}
+
+//copyAuditEntry keeps the stored entries from being changed through the coupons they point to
+func copyAuditEntry(entry api.AuditEntry) api.AuditEntry {
+	if entry.Before != nil {
+		before := *entry.Before
+		entry.Before = &before
+	}
+	if entry.After != nil {
+		after := *entry.After
+		entry.After = &after
+	}
+	entry.ChangedFields = append([]string(nil), entry.ChangedFields...)
+	return entry
+}
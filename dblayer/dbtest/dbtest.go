@@ -0,0 +1,446 @@
+// Package dbtest is an in-memory implementation of dblayer.Interface, for running the service in tests without a mongo server.
+// It follows the semantics of the mongo implementation: versions, version conflicts, the search filter, coupon events,
+// idempotency keys, webhook deliveries, the relay checkpoints, the audit log, the coupon history, the api keys and the progress of imports.
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+type DB struct {
+	mu sync.Mutex
+
+	coupons map[primitive.ObjectID]api.Coupon
+	//ids in the order the coupons were created, searches return the coupons in that order
+	order           []primitive.ObjectID
+	idempotencyKeys map[string]*dblayer.IdempotencyRecord
+
+	events []api.CouponEvent
+	//coupons whose expiry was reported, until their expiry is changed
+	expiryReported map[primitive.ObjectID]bool
+
+	subscriptions []api.WebhookSubscription
+	deliveries    map[string]api.WebhookDelivery
+	//ids in the order the deliveries were enqueued
+	deliveryOrder []string
+
+	relayCheckpoints map[string]int64
+	relayLeases      map[string]relayLease
+
+	//the audit log, in the order the entries were appended
+	audit []api.AuditEntry
+	//the history of every coupon, the oldest version first
+	versions map[primitive.ObjectID][]api.CouponVersion
+
+	//api keys, in the order they were created
+	apiKeys []api.ApiKey
+
+	imports map[string]*dblayer.ImportRecord
+}
+
+func New() *DB {
+	return &DB{
+		coupons:          map[primitive.ObjectID]api.Coupon{},
+		idempotencyKeys:  map[string]*dblayer.IdempotencyRecord{},
+		expiryReported:   map[primitive.ObjectID]bool{},
+		deliveries:       map[string]api.WebhookDelivery{},
+		relayCheckpoints: map[string]int64{},
+		relayLeases:      map[string]relayLease{},
+		versions:         map[primitive.ObjectID][]api.CouponVersion{},
+		imports:          map[string]*dblayer.ImportRecord{},
+	}
+}
+
+func (db *DB) Init() error {
+	return nil
+}
+
+//BatchWriteMode reports transactions, a batch is applied under a single lock and cannot be seen half written
+func (db *DB) BatchWriteMode() string {
+	return dblayer.WRITE_MODE_TRANSACTION
+}
+
+func (db *DB) CreateCoupons(actor api.Actor, coupons []api.Coupon) (*mongo.InsertManyResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res := &mongo.InsertManyResult{}
+	for _, cpn := range coupons {
+		cpn.Id = primitive.NewObjectID()
+		cpn.CreatedAt = time.Now()
+		cpn.Version = 1
+
+		db.coupons[cpn.Id] = cpn
+		db.order = append(db.order, cpn.Id)
+		res.InsertedIDs = append(res.InsertedIDs, cpn.Id)
+		event := api.CouponEvent{
+			Type:          api.EVENT_CREATED,
+			CouponId:      cpn.Id,
+			Brand:         cpn.Brand,
+			ChangedFields: []string{"name", "brand", "value", "expiry"},
+			Version:       1,
+		}
+		db.appendEvent(event)
+		db.appendVersion(api.CouponVersion{CouponId: cpn.Id, Version: 1, Coupon: cpn})
+		db.appendAudit(dblayer.NewAuditEntry(actor, event, nil, &cpn))
+	}
+
+	return res, nil
+}
+
+func (db *DB) UpdateCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+	return db.updateCoupons(actor, coupons, false)
+}
+
+func (db *DB) RevertCoupon(actor api.Actor, cpn api.Coupon) error {
+	_, err := db.updateCoupons(actor, []api.Coupon{cpn}, true)
+	return err
+}
+
+func (db *DB) updateCoupons(actor api.Actor, coupons []api.Coupon, replace bool) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkVersions(coupons); err != nil {
+		return 0, err
+	}
+
+	var updatedCnt int64
+	for _, cpn := range coupons {
+		stored := db.coupons[cpn.Id]
+		prev := stored
+		event := api.CouponEvent{Type: api.EVENT_UPDATED, CouponId: cpn.Id, Brand: stored.Brand}
+		//fields left empty in the request keep their stored value unless replaced, the event lists those whose value changed
+		if (replace || cpn.Name != "") && cpn.Name != stored.Name {
+			stored.Name = cpn.Name
+			event.ChangedFields = append(event.ChangedFields, "name")
+		}
+		if (replace || cpn.Brand != "") && cpn.Brand != stored.Brand {
+			event.PreviousBrand = stored.Brand
+			event.Brand = cpn.Brand
+			stored.Brand = cpn.Brand
+			event.ChangedFields = append(event.ChangedFields, "brand")
+		}
+		if (replace || cpn.Value > 0) && cpn.Value != stored.Value {
+			stored.Value = cpn.Value
+			event.ChangedFields = append(event.ChangedFields, "value")
+		}
+		if replace || !cpn.Expiry.IsZero() {
+			if !cpn.Expiry.Equal(stored.Expiry) {
+				event.ChangedFields = append(event.ChangedFields, "expiry")
+			}
+			stored.Expiry = cpn.Expiry
+			delete(db.expiryReported, cpn.Id)
+		}
+		stored.Version++
+		event.Version = stored.Version
+
+		db.coupons[cpn.Id] = stored
+		db.appendEvent(event)
+		db.appendVersion(api.CouponVersion{CouponId: cpn.Id, Version: stored.Version, Coupon: stored})
+		db.appendAudit(dblayer.NewAuditEntry(actor, event, &prev, &stored))
+		updatedCnt++
+	}
+
+	return updatedCnt, nil
+}
+
+func (db *DB) DeleteCoupons(actor api.Actor, coupons []api.Coupon) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkVersions(coupons); err != nil {
+		return 0, err
+	}
+
+	deleted := map[primitive.ObjectID]bool{}
+	for _, cpn := range coupons {
+		prev := db.coupons[cpn.Id]
+		event := api.CouponEvent{Type: api.EVENT_DELETED, CouponId: cpn.Id, Brand: prev.Brand, Version: cpn.Version}
+		db.appendEvent(event)
+		db.appendVersion(api.CouponVersion{CouponId: cpn.Id, Version: cpn.Version, Deleted: true, Coupon: prev})
+		db.appendAudit(dblayer.NewAuditEntry(actor, event, &prev, nil))
+		delete(db.coupons, cpn.Id)
+		delete(db.expiryReported, cpn.Id)
+		deleted[cpn.Id] = true
+	}
+
+	order := []primitive.ObjectID{}
+	for _, id := range db.order {
+		if !deleted[id] {
+			order = append(order, id)
+		}
+	}
+	db.order = order
+
+	return int64(len(deleted)), nil
+}
+
+//checkVersions makes sure every coupon exists at the version the caller expects, the lock must be held
+func (db *DB) checkVersions(coupons []api.Coupon) error {
+	conflicts := []api.Coupon{}
+	for _, cpn := range coupons {
+		stored, found := db.coupons[cpn.Id]
+		if !found {
+			return api.NewErrorf(api.ERR_COUPON_NOT_FOUND, "coupon %s does not exist", cpn.Id.Hex())
+		}
+		if stored.Version != cpn.Version {
+			conflicts = append(conflicts, stored)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &dblayer.ConflictError{Current: conflicts}
+	}
+	return nil
+}
+
+func (db *DB) FindByIds(ids []interface{}) ([]api.Coupon, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	wanted := map[primitive.ObjectID]bool{}
+	for _, id := range ids {
+		if objId, isObjId := id.(primitive.ObjectID); isObjId {
+			wanted[objId] = true
+		}
+	}
+
+	coupons := []api.Coupon{}
+	for _, id := range db.order {
+		if wanted[id] {
+			coupons = append(coupons, db.coupons[id])
+		}
+	}
+	return coupons, nil
+}
+
+func (db *DB) SearchFromRequest(reqFilter *api.CouponFilter) ([]api.Coupon, error) {
+	coupons := []api.Coupon{}
+	err := db.SearchEach(context.Background(), reqFilter, func(cpn api.Coupon) error {
+		coupons = append(coupons, cpn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+//SearchEach hands the matching coupons to fn from a snapshot, so fn may write to the db
+func (db *DB) SearchEach(ctx context.Context, reqFilter *api.CouponFilter, fn func(cpn api.Coupon) error) error {
+	match, err := matcherFor(reqFilter)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	matching := []api.Coupon{}
+	for _, id := range db.order {
+		if cpn := db.coupons[id]; match(cpn) {
+			matching = append(matching, cpn)
+		}
+	}
+	db.mu.Unlock()
+
+	for _, cpn := range matching {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(cpn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//matcherFor checks the filter as the mongo implementation does, every condition that is set must hold
+func matcherFor(reqFilter *api.CouponFilter) (func(cpn api.Coupon) bool, error) {
+	if reqFilter == nil {
+		return nil, api.NewError(api.ERR_INVALID_FILTER, "Search criteria must be provided")
+	}
+
+	ids := map[primitive.ObjectID]bool{}
+	for i, id := range reqFilter.IdIn {
+		objId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			filterErr := api.NewErrorf(api.ERR_INVALID_FILTER, "%s is not a valid coupon id", id)
+			filterErr.Field = fmt.Sprintf("idIn[%d]", i)
+			return nil, filterErr
+		}
+		ids[objId] = true
+	}
+
+	var name *regexp.Regexp
+	if reqFilter.NameContains != "" {
+		var err error
+		if name, err = regexp.Compile(reqFilter.NameContains); err != nil {
+			return nil, api.NewErrorf(api.ERR_INVALID_FILTER, "nameContains is not a valid pattern: %s", err.Error())
+		}
+	}
+
+	valueFrom, valueTo := reqFilter.ValueRange()
+	return func(cpn api.Coupon) bool {
+		switch {
+		case len(ids) > 0 && !ids[cpn.Id]:
+			return false
+		case valueFrom != nil && cpn.Value < *valueFrom:
+			return false
+		case valueTo != nil && cpn.Value > *valueTo:
+			return false
+		case name != nil && !name.MatchString(cpn.Name):
+			return false
+		case reqFilter.BrandEqual != "" && cpn.Brand != reqFilter.BrandEqual:
+			return false
+		case !reqFilter.ExpiryFrom.IsZero() && cpn.Expiry.Before(reqFilter.ExpiryFrom):
+			return false
+		case !reqFilter.ExpiryTo.IsZero() && cpn.Expiry.After(reqFilter.ExpiryTo):
+			return false
+		case !reqFilter.CreatedAtFrom.IsZero() && cpn.CreatedAt.Before(reqFilter.CreatedAtFrom):
+			return false
+		case !reqFilter.CreatedAtTo.IsZero() && cpn.CreatedAt.After(reqFilter.CreatedAtTo):
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (db *DB) LastImportedRow(importId string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	lastRow := 0
+	for _, cpn := range db.coupons {
+		if cpn.Import != nil && cpn.Import.Id == importId && cpn.Import.Row > lastRow {
+			lastRow = cpn.Import.Row
+		}
+	}
+	return lastRow, nil
+}
+
+//appendEvent numbers the event and stores it, the lock must be held
+func (db *DB) appendEvent(event api.CouponEvent) {
+	event.Seq = 1
+	if len(db.events) > 0 {
+		event.Seq = db.events[len(db.events)-1].Seq + 1
+	}
+	event.At = time.Now()
+	db.events = append(db.events, event)
+}
+
+//EventsAfter has nothing pending, the events are numbered and stored under the lock of the write
+func (db *DB) EventsAfter(ctx context.Context, after int64, limit int) ([]api.CouponEvent, int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	events := []api.CouponEvent{}
+	settled := after
+	for _, event := range db.events {
+		if len(events) == limit {
+			break
+		}
+		if event.Seq > after {
+			events = append(events, event)
+			settled = event.Seq
+		}
+	}
+	return events, settled, nil
+}
+
+func (db *DB) EventBounds() (oldest, newest int64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(db.events) == 0 {
+		return 0, 0, nil
+	}
+	return db.events[0].Seq, db.events[len(db.events)-1].Seq, nil
+}
+
+//DropEventsBefore removes the events older than seq, as the retention of the mongo implementation does
+func (db *DB) DropEventsBefore(seq int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	kept := []api.CouponEvent{}
+	for _, event := range db.events {
+		if event.Seq >= seq {
+			kept = append(kept, event)
+		}
+	}
+	db.events = kept
+}
+
+func (db *DB) ExpireCoupons(now time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	reported := 0
+	for _, id := range db.order {
+		cpn := db.coupons[id]
+		if cpn.Expiry.After(now) || db.expiryReported[id] {
+			continue
+		}
+		db.expiryReported[id] = true
+		db.appendEvent(api.CouponEvent{Type: api.EVENT_EXPIRED, CouponId: id, Brand: cpn.Brand, Version: cpn.Version})
+		reported++
+	}
+	return reported, nil
+}
+
+//ReserveIdempotencyKey claims the key for the calling request, expired keys are treated as never used
+func (db *DB) ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (*dblayer.IdempotencyRecord, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	if existing, found := db.idempotencyKeys[key]; found && now.Before(existing.ExpiresAt) {
+		copied := *existing
+		return &copied, false, nil
+	}
+
+	record := &dblayer.IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	db.idempotencyKeys[key] = record
+
+	copied := *record
+	return &copied, true, nil
+}
+
+func (db *DB) CompleteIdempotencyKey(key string, statusCode int, response []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if record, found := db.idempotencyKeys[key]; found {
+		record.Completed = true
+		record.StatusCode = statusCode
+		record.Response = append([]byte(nil), response...)
+	}
+	return nil
+}
+
+func (db *DB) ReleaseIdempotencyKey(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if record, found := db.idempotencyKeys[key]; found && !record.Completed {
+		delete(db.idempotencyKeys, key)
+	}
+	return nil
+}
+
+//the compiler checks the fake keeps up with the interface
+var _ dblayer.Interface = (*DB)(nil)
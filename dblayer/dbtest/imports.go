@@ -0,0 +1,35 @@
+package dbtest
+
+import (
+	"time"
+
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+func (db *DB) StartImport(importId, principal string) (*dblayer.ImportRecord, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if existing, found := db.imports[importId]; found {
+		record := *existing
+		return &record, false, nil
+	}
+
+	now := time.Now()
+	db.imports[importId] = &dblayer.ImportRecord{Id: importId, Principal: principal, CreatedAt: now, UpdatedAt: now}
+	record := *db.imports[importId]
+	return &record, true, nil
+}
+
+func (db *DB) AdvanceImport(importId string, row int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if record, found := db.imports[importId]; found {
+		if row > record.LastRow {
+			record.LastRow = row
+		}
+		record.UpdatedAt = time.Now()
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package dbtest
+
+import "time"
+
+type relayLease struct {
+	owner string
+	until time.Time
+}
+
+func (db *DB) RelayCheckpoint(sink string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.relayCheckpoints[sink], nil
+}
+
+func (db *DB) SaveRelayCheckpoint(sink string, seq int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if seq > db.relayCheckpoints[sink] {
+		db.relayCheckpoints[sink] = seq
+	}
+	return nil
+}
+
+func (db *DB) AcquireRelayLease(sink, owner string, ttl time.Duration) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	if lease, found := db.relayLeases[sink]; found && lease.owner != owner && lease.until.After(now) {
+		return false, nil
+	}
+	db.relayLeases[sink] = relayLease{owner: owner, until: now.Add(ttl)}
+	return true, nil
+}
@@ -0,0 +1,53 @@
+package dbtest
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//appendVersion adds to the history of the coupon, the lock must be held
+func (db *DB) appendVersion(version api.CouponVersion) {
+	version.Id = primitive.NewObjectID()
+	version.At = time.Now()
+	db.versions[version.CouponId] = append(db.versions[version.CouponId], version)
+}
+
+func (db *DB) CouponVersions(id primitive.ObjectID) ([]api.CouponVersion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return append([]api.CouponVersion{}, db.versions[id]...), nil
+}
+
+func (db *DB) CouponVersion(id primitive.ObjectID, version int64) (*api.CouponVersion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, stored := range db.versions[id] {
+		if stored.Version == version && !stored.Deleted {
+			return &stored, nil
+		}
+	}
+	return nil, api.NewErrorf(api.ERR_COUPON_VERSION_NOT_FOUND, "coupon %s has no version %d", id.Hex(), version)
+}
+
+func (db *DB) CouponAt(id primitive.ObjectID, t time.Time) (*api.CouponVersion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var current *api.CouponVersion
+	for i, stored := range db.versions[id] {
+		if stored.At.After(t) {
+			break
+		}
+		current = &db.versions[id][i]
+	}
+	if current == nil || current.Deleted {
+		return nil, api.NewErrorf(api.ERR_COUPON_VERSION_NOT_FOUND, "coupon %s did not exist at %s", id.Hex(), t.Format(time.RFC3339))
+	}
+	found := *current
+	return &found, nil
+}
@@ -0,0 +1,167 @@
+package dbtest
+
+import (
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/dblayer"
+)
+
+func (db *DB) CreateSubscription(sub *api.WebhookSubscription) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sub.Id = primitive.NewObjectID()
+	sub.CreatedAt = time.Now()
+	sub.FromSeq = 0
+	if len(db.events) > 0 {
+		sub.FromSeq = db.events[len(db.events)-1].Seq
+	}
+
+	db.subscriptions = append(db.subscriptions, *sub)
+	return nil
+}
+
+//ownedBy tells whether owner is one of owners, anything is when no owner is given
+func ownedBy(owner string, owners []string) bool {
+	if len(owners) == 0 {
+		return true
+	}
+	for _, o := range owners {
+		if o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) Subscriptions(owners ...string) ([]api.WebhookSubscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	subs := []api.WebhookSubscription{}
+	for _, sub := range db.subscriptions {
+		if ownedBy(sub.Owner, owners) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func (db *DB) DeleteSubscription(id primitive.ObjectID, owners ...string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, sub := range db.subscriptions {
+		if sub.Id == id && ownedBy(sub.Owner, owners) {
+			db.subscriptions = append(db.subscriptions[:i], db.subscriptions[i+1:]...)
+			return nil
+		}
+	}
+	return api.NewErrorf(api.ERR_SUBSCRIPTION_NOT_FOUND, "webhook subscription %s does not exist", id.Hex())
+}
+
+func (db *DB) EnqueueDeliveries(deliveries []api.WebhookDelivery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		if _, found := db.deliveries[delivery.Id]; found {
+			continue
+		}
+		db.deliveries[delivery.Id] = delivery
+		db.deliveryOrder = append(db.deliveryOrder, delivery.Id)
+	}
+	return nil
+}
+
+func (db *DB) ClaimDeliveries(now time.Time, lease time.Duration, limit int, skip []primitive.ObjectID) ([]api.WebhookDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	skipped := map[primitive.ObjectID]bool{}
+	for _, id := range skip {
+		skipped[id] = true
+	}
+
+	claimed := []api.WebhookDelivery{}
+	for _, id := range db.deliveryOrder {
+		if len(claimed) == limit {
+			break
+		}
+		delivery := db.deliveries[id]
+		if delivery.Status != api.DELIVERY_PENDING || delivery.NextAttemptAt.After(now) || delivery.LockedUntil.After(now) || skipped[delivery.SubscriptionId] {
+			continue
+		}
+		delivery.LockedUntil = now.Add(lease)
+		db.deliveries[id] = delivery
+		claimed = append(claimed, copyDelivery(delivery))
+	}
+	return claimed, nil
+}
+
+func (db *DB) RecordDeliveryAttempt(id string, attempt api.DeliveryAttempt, status string, nextAttemptAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delivery, found := db.deliveries[id]
+	if !found {
+		return nil
+	}
+
+	delivery.Attempts = append(copyDelivery(delivery).Attempts, attempt)
+	delivery.Status = status
+	delivery.NextAttemptAt = nextAttemptAt
+	delivery.LockedUntil = time.Time{}
+	if status == api.DELIVERY_DELIVERED {
+		delivery.DeliveredAt = attempt.At
+	}
+	db.deliveries[id] = delivery
+	return nil
+}
+
+func (db *DB) Deliveries(filter dblayer.DeliveryFilter) ([]api.WebhookDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deliveries := []api.WebhookDelivery{}
+	for i := len(db.deliveryOrder) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(deliveries) == filter.Limit {
+			break
+		}
+		delivery := db.deliveries[db.deliveryOrder[i]]
+		if !filter.SubscriptionId.IsZero() && delivery.SubscriptionId != filter.SubscriptionId {
+			continue
+		}
+		if filter.Status != "" && delivery.Status != filter.Status {
+			continue
+		}
+		if !ownedBy(delivery.Owner, filter.Owners) {
+			continue
+		}
+		deliveries = append(deliveries, copyDelivery(delivery))
+	}
+	return deliveries, nil
+}
+
+func (db *DB) Redeliver(id string, now time.Time, owners ...string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delivery, found := db.deliveries[id]
+	if !found || !ownedBy(delivery.Owner, owners) {
+		return api.NewErrorf(api.ERR_DELIVERY_NOT_FOUND, "webhook delivery %s does not exist", id)
+	}
+	delivery.Status = api.DELIVERY_PENDING
+	delivery.NextAttemptAt = now
+	db.deliveries[id] = delivery
+	return nil
+}
+
+//copyDelivery keeps the callers from sharing the attempt log with the db
+func copyDelivery(delivery api.WebhookDelivery) api.WebhookDelivery {
+	delivery.Attempts = append([]api.DeliveryAttempt{}, delivery.Attempts...)
+	return delivery
+}
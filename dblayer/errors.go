@@ -0,0 +1,82 @@
+package dblayer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+// ConflictError is returned when a coupon was modified since the version the caller expected.
+// Current holds the stored state of the conflicting coupons so the caller can re-apply its changes.
+type ConflictError struct {
+	Current []api.Coupon
+}
+
+func (e *ConflictError) Error() string {
+	ids := []string{}
+	for _, cpn := range e.Current {
+		ids = append(ids, fmt.Sprintf("%s (current version %d)", cpn.Id.Hex(), cpn.Version))
+	}
+	return fmt.Sprintf("version conflict, coupons were modified by another request: %s", strings.Join(ids, ", "))
+}
+
+//dbFailure turns a driver error into an api error, telling an unreachable db apart from a failed operation
+func dbFailure(err error, msg string) api.Error {
+	code := api.ERR_DB_FAILURE
+	if isUnavailable(err) {
+		code = api.ERR_DB_UNAVAILABLE
+	}
+
+	apiErr := api.NewErrorf(code, "%s: %s", msg, err.Error())
+	log.Println(apiErr.Message)
+	return apiErr
+}
+
+//compensationFailure reports a batch that failed midway and could not be undone: the changed coupons are left as
+//the batch wrote them. Whatever failed the batch (e.g. a version conflict), this is a failure of the service.
+func compensationFailure(err, undoErr error, changed []primitive.ObjectID) api.Error {
+	ids := []string{}
+	for _, id := range changed {
+		ids = append(ids, id.Hex())
+	}
+	if len(ids) == 0 {
+		ids = append(ids, "none")
+	}
+
+	msg := fmt.Sprintf("batch failed midway (%s) and could not be undone, coupons left changed: %s", err.Error(), strings.Join(ids, ", "))
+	if undoErr != nil {
+		msg = fmt.Sprintf("%s (undo failed: %s)", msg, undoErr.Error())
+	}
+
+	apiErr := api.NewError(api.ERR_BATCH_PARTIALLY_APPLIED, msg)
+	log.Println(apiErr.Message)
+	return apiErr
+}
+
+//historyFailure reports a write that failed in the compensating write mode after some of its versions or audit entries
+//were stored, and whose history could not be removed again: it lists a change of the coupons that was undone.
+func historyFailure(err, undoErr error) api.Error {
+	apiErr := api.NewErrorf(api.ERR_DB_FAILURE, "write failed (%s) and its history could not be removed, the coupon versions and "+
+		"audit log list changes that were not made: %s", err.Error(), undoErr.Error())
+	log.Println(apiErr.Message)
+	return apiErr
+}
+
+//the driver reports an unreachable server as a failed server selection once the context runs out
+func isUnavailable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return true
+	}
+	if _, isNetErr := cause.(net.Error); isNetErr {
+		return true
+	}
+	return strings.Contains(err.Error(), "server selection")
+}
@@ -0,0 +1,376 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_EVENT_COLLECTION   string = "coupon_events"
+	DB_COUNTER_COLLECTION string = "counters"
+
+	//the counter document the sequence numbers of the events are taken from
+	eventSeqCounter = "coupon_events"
+
+	//a sequence number that is still pending this many db timeouts after it was taken is claimed as abandoned
+	eventSeqClaimFactor = 3
+
+	//the states of a stored event, a committed one has none
+	eventStatePending   = "pending"
+	eventStateAbandoned = "abandoned"
+)
+
+type counter struct {
+	Seq int64 `bson:"seq"`
+}
+
+//storedEvent is an event as it is kept in the db. Every sequence number is stored as soon as it is taken, as a pending
+//placeholder the write fills in with its event. A placeholder whose write failed is abandoned, so readers can tell
+//a number that will never be used from one whose write has not been committed yet (see EventsAfter).
+type storedEvent struct {
+	api.CouponEvent `bson:",inline"`
+	State           string `bson:"state,omitempty"`
+	//a pending placeholder may be claimed as abandoned once this has passed
+	Deadline time.Time `bson:"deadline,omitempty"`
+}
+
+func (dbl *T) eventSeqClaimWait() time.Duration {
+	return eventSeqClaimFactor * dbl.timeout
+}
+
+//reserveEventSeqs takes n consecutive sequence numbers, stores a pending placeholder for each and returns the first one.
+//It runs outside the transaction of the write the events belong to, a counter updated by every transaction would make
+//concurrent writes conflict, and the placeholders have to be seen by readers before the write is committed.
+func (dbl *T) reserveEventSeqs(n int) (int64, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	counterColl := db.Collection(DB_COUNTER_COLLECTION)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	c := &counter{}
+	err := counterColl.FindOneAndUpdate(
+		ctx,
+		bson.D{{"_id", eventSeqCounter}},
+		bson.D{{"$inc", bson.D{{"seq", int64(n)}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(c)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to reserve event sequence numbers")
+	}
+	first := c.Seq - int64(n) + 1
+
+	now := time.Now()
+	placeholders := []interface{}{}
+	for i := 0; i < n; i++ {
+		placeholders = append(placeholders, storedEvent{
+			CouponEvent: api.CouponEvent{Seq: first + int64(i), At: now},
+			State:       eventStatePending,
+			Deadline:    now.Add(dbl.eventSeqClaimWait()),
+		})
+	}
+	if _, err := eventColl.InsertMany(ctx, placeholders); err != nil {
+		//a reader took the numbers for abandoned, or some of the placeholders were not stored
+		if undoErr := dbl.abandonEventSeqs(first, c.Seq); undoErr != nil {
+			log.Printf("%s, they are claimed once their deadline passed", undoErr.Error())
+		}
+		return 0, errors.Wrap(err, "failed to store the reserved event sequence numbers")
+	}
+
+	return first, nil
+}
+
+//abandonEventSeqs gives up the numbers of a write that failed, so readers go on without waiting for them. The events
+//of the write already stored are given up too, readers skip them like the placeholders.
+func (dbl *T) abandonEventSeqs(first, last int64) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := eventColl.UpdateMany(
+		ctx,
+		bson.D{{"_id", bson.D{{"$gte", first}, {"$lte", last}}}},
+		bson.D{{"$set", bson.D{{"state", eventStateAbandoned}}}},
+	)
+	return errors.Wrapf(err, "failed to abandon the events %d-%d of a failed write", first, last)
+}
+
+//appendEvents stores the events of a write, numbered in the order given. ctx is the one of the write, so in the
+//transaction write mode the events are committed or rolled back with the coupons. A placeholder that was claimed
+//as abandoned in the meantime fails the write: its number has been given up on by the readers.
+//Without transactions the placeholders are replaced from the last one back, readers stop at the first one until
+//every event of the write is stored, and the events of a write that fails midway are all abandoned.
+func (dbl *T) appendEvents(ctx context.Context, events []api.CouponEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	first, err := dbl.reserveEventSeqs(len(events))
+	if err != nil {
+		return err
+	}
+	last := first + int64(len(events)) - 1
+
+	opCtx, cancel := context.WithTimeout(ctx, dbl.timeout)
+	defer cancel()
+
+	now := time.Now()
+	for i := range events {
+		events[i].Seq = first + int64(i)
+		events[i].At = now
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		res, err := eventColl.ReplaceOne(
+			opCtx,
+			bson.D{{"_id", events[i].Seq}, {"state", eventStatePending}},
+			storedEvent{CouponEvent: events[i]},
+		)
+		if err == nil && res.MatchedCount == 0 {
+			err = errors.Errorf("the event sequence number %d was claimed as abandoned", events[i].Seq)
+		}
+		if err != nil {
+			//in the transaction write mode the placeholders are left to their deadline, the transaction holds them until it is aborted
+			if dbl.BatchWriteMode() != WRITE_MODE_TRANSACTION {
+				if undoErr := dbl.abandonEventSeqs(first, last); undoErr != nil {
+					return historyFailure(err, undoErr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//EventsAfter returns up to limit events following the one with the given sequence number, in sequence order, and the
+//sequence number every number up to which is settled: its event was committed or its write failed. Reading stops at
+//a number whose write may still be committed. A placeholder past its deadline, or a number without one that was taken
+//before an event as old as the deadline, is claimed as abandoned. The claim and the write race for the same document,
+//so a number is never given up on once its event is committed, the write fails instead.
+func (dbl *T) EventsAfter(ctx context.Context, after int64, limit int) ([]api.CouponEvent, int64, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(ctx, dbl.timeout)
+	defer cancel()
+
+	cur, err := eventColl.Find(
+		ctx,
+		bson.D{{"_id", bson.D{{"$gt", after}}}},
+		options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, after, dbFailure(err, "failed to read coupon events from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	stored := []storedEvent{}
+	for cur.Next(ctx) {
+		event := storedEvent{}
+		if err := cur.Decode(&event); err != nil {
+			return nil, after, dbFailure(err, "failed to read a coupon event from the db")
+		}
+		stored = append(stored, event)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, after, dbFailure(err, "failed to read coupon events from the db")
+	}
+
+	events := []api.CouponEvent{}
+	settled := after
+	for _, event := range stored {
+		//the numbers missing before the event were taken before it, their placeholders are not stored yet
+		if event.Seq > settled+1 {
+			if time.Since(event.At) < dbl.eventSeqClaimWait() {
+				break
+			}
+			claimed, err := dbl.claimMissingEventSeqs(ctx, settled+1, event.Seq-1)
+			if err != nil || !claimed {
+				return events, settled, err
+			}
+		}
+
+		switch event.State {
+		case eventStatePending:
+			if time.Now().Before(event.Deadline) {
+				return events, settled, nil
+			}
+			claimed, err := dbl.claimPendingEventSeq(ctx, event.Seq)
+			if err != nil || !claimed {
+				return events, settled, err
+			}
+		case eventStateAbandoned:
+		default:
+			events = append(events, event.CouponEvent)
+		}
+		settled = event.Seq
+	}
+
+	return events, settled, nil
+}
+
+//claimPendingEventSeq abandons the placeholder unless its write has filled it in meanwhile
+func (dbl *T) claimPendingEventSeq(ctx context.Context, seq int64) (bool, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	res, err := eventColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", seq}, {"state", eventStatePending}},
+		bson.D{{"$set", bson.D{{"state", eventStateAbandoned}}}},
+	)
+	if err != nil {
+		return false, dbFailure(err, "failed to claim an abandoned coupon event")
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+//claimMissingEventSeqs stores the numbers as abandoned unless their write has stored its placeholders meanwhile.
+//A write storing its placeholders after the claim fails on the duplicate numbers.
+func (dbl *T) claimMissingEventSeqs(ctx context.Context, first, last int64) (bool, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	now := time.Now()
+	for seq := first; seq <= last; seq++ {
+		_, err := eventColl.InsertOne(ctx, storedEvent{CouponEvent: api.CouponEvent{Seq: seq, At: now}, State: eventStateAbandoned})
+		if isDuplicateKeyError(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, dbFailure(err, "failed to claim an abandoned coupon event")
+		}
+	}
+	return true, nil
+}
+
+//EventBounds returns the sequence numbers of the oldest and the newest stored event, 0 when there are none.
+//Events older than the retention are removed by the db, so the oldest one moves on over time. While a write is pending
+//the newest is the one before its placeholder, so whoever starts reading after it does not miss the write.
+func (dbl *T) EventBounds() (oldest, newest int64, err error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	bound := func(filter bson.D, order int) (int64, error) {
+		event := &api.CouponEvent{}
+		err := eventColl.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{"_id", order}})).Decode(event)
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, dbFailure(err, "failed to read coupon events from the db")
+		}
+		return event.Seq, nil
+	}
+
+	if oldest, err = bound(bson.D{}, 1); err != nil {
+		return 0, 0, err
+	}
+	if newest, err = bound(bson.D{}, -1); err != nil {
+		return 0, 0, err
+	}
+	pending, err := bound(bson.D{{"state", eventStatePending}}, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pending > 0 {
+		newest = pending - 1
+	}
+	return oldest, newest, nil
+}
+
+//ExpireCoupons records an expired event for every coupon whose expiry passed since it was last run.
+//A coupon is marked as it is reported, so each expiry is reported once however many instances of the service run it.
+func (dbl *T) ExpireCoupons(now time.Time) (int, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	expired := []api.Coupon{}
+	err := dbl.eachWithFilter(
+		ctx,
+		bson.D{{"expiry", bson.D{{"$lte", now}}}, {"expiredEventAt", bson.D{{"$exists", false}}}},
+		func(cpn api.Coupon) error {
+			expired = append(expired, cpn)
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	reported := 0
+	for _, cpn := range expired {
+		//claim the expiry, unless another instance did or the coupon was changed in the meantime
+		res, err := couponColl.UpdateOne(
+			ctx,
+			bson.D{{"_id", cpn.Id}, {"version", cpn.Version}, {"expiredEventAt", bson.D{{"$exists", false}}}},
+			bson.D{{"$set", bson.D{{"expiredEventAt", now}}}},
+		)
+		if err != nil {
+			return reported, dbFailure(err, "failed to mark an expired coupon")
+		}
+		if res.ModifiedCount == 0 {
+			continue
+		}
+
+		event := api.CouponEvent{Type: api.EVENT_EXPIRED, CouponId: cpn.Id, Brand: cpn.Brand, Version: cpn.Version}
+		if err := dbl.appendEvents(ctx, []api.CouponEvent{event}); err != nil {
+			//released, so the expiry is reported by the next run
+			if _, uErr := couponColl.UpdateOne(ctx, bson.D{{"_id", cpn.Id}}, bson.D{{"$unset", bson.D{{"expiredEventAt", ""}}}}); uErr != nil {
+				log.Printf("failed to release the expiry of coupon %s: %s", cpn.Id.Hex(), uErr.Error())
+			}
+			return reported, dbFailure(err, "failed to record the expiry of a coupon")
+		}
+		reported++
+	}
+
+	return reported, nil
+}
+
+//events are removed by mongo once they are older than the retention
+func (dbl *T) ensureEventIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	eventColl := db.Collection(DB_EVENT_COLLECTION)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	_, err := eventColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"at", 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(dbl.eventRetention / time.Second)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the coupon event ttl index")
+	}
+
+	//expired coupons are looked for on every run of ExpireCoupons
+	_, err = couponColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"expiry", 1}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the coupon expiry index")
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package dblayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+)
+
+const (
+	DB_IDEMPOTENCY_COLLECTION string = "idempotency_keys"
+
+	//a pending key older than this many db timeouts is considered abandoned (e.g. the service crashed mid-request)
+	idempotencyStaleFactor = 3
+
+	mongoDuplicateKeyCode = 11000
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an idempotency key.
+// A record that is not Completed is held by a request that is still executing.
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	RequestHash string    `bson:"requestHash"`
+	Completed   bool      `bson:"completed"`
+	StatusCode  int       `bson:"statusCode"`
+	Response    []byte    `bson:"response"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+//ReserveIdempotencyKey claims the key for the calling request.
+//If the key was already claimed, the existing record is returned and reserved is false.
+func (dbl *T) ReserveIdempotencyKey(key, requestHash string, ttl time.Duration) (record *IdempotencyRecord, reserved bool, err error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_IDEMPOTENCY_COLLECTION)
+
+	now := time.Now()
+	record = &IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	//_id is unique, so only one of several concurrent requests with the same key can insert it
+	_, err = keyColl.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !isDuplicateKeyError(err) {
+		return nil, false, dbFailure(err, "failed to store the idempotency key")
+	}
+
+	existing := &IdempotencyRecord{}
+	if err := keyColl.FindOne(ctx, bson.D{{"_id", key}}).Decode(existing); err != nil {
+		return nil, false, dbFailure(err, "failed to read the idempotency key")
+	}
+
+	if existing.Completed || existing.RequestHash != requestHash || now.Sub(existing.CreatedAt) < dbl.timeout*idempotencyStaleFactor {
+		return existing, false, nil
+	}
+
+	//the request holding the key never finished, take the key over unless someone else did it first
+	res, err := keyColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", key}, {"completed", false}, {"createdAt", existing.CreatedAt}},
+		bson.D{{"$set", bson.D{{"createdAt", now}, {"expiresAt", now.Add(ttl)}}}},
+	)
+	if err != nil {
+		return nil, false, dbFailure(err, "failed to take over an abandoned idempotency key")
+	}
+	if res.MatchedCount == 0 {
+		return existing, false, nil
+	}
+
+	return record, true, nil
+}
+
+//CompleteIdempotencyKey stores the response of the request holding the key, so retries get it replayed
+func (dbl *T) CompleteIdempotencyKey(key string, statusCode int, response []byte) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_IDEMPOTENCY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := keyColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", key}},
+		bson.D{{"$set", bson.D{
+			{"completed", true},
+			{"statusCode", statusCode},
+			{"response", response},
+		}}},
+	)
+	if err != nil {
+		return dbFailure(err, "failed to store the idempotent response")
+	}
+
+	return nil
+}
+
+//ReleaseIdempotencyKey drops a key whose request failed, so it can be retried with the same key
+func (dbl *T) ReleaseIdempotencyKey(key string) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_IDEMPOTENCY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	if _, err := keyColl.DeleteOne(ctx, bson.D{{"_id", key}, {"completed", false}}); err != nil {
+		return dbFailure(err, "failed to release the idempotency key")
+	}
+
+	return nil
+}
+
+//records are removed by mongo once they reach expiresAt
+func (dbl *T) ensureIdempotencyIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	keyColl := db.Collection(DB_IDEMPOTENCY_COLLECTION)
+
+	_, err := keyColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"expiresAt", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the idempotency key ttl index")
+	}
+
+	return nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == mongoDuplicateKeyCode {
+				return true
+			}
+		}
+	case mongo.WriteErrors:
+		for _, we := range e {
+			if we.Code == mongoDuplicateKeyCode {
+				return true
+			}
+		}
+	}
+	return false
+}
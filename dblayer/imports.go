@@ -0,0 +1,129 @@
+package dblayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_IMPORT_COLLECTION string = "imports"
+)
+
+//ImportRecord is the progress of a csv import. Only its Principal can resume it.
+//LastRow is the high-water mark of the import: every row up to it was written, so it is skipped on resume
+//even if its coupon was deleted since.
+type ImportRecord struct {
+	Id        string    `bson:"_id"`
+	Principal string    `bson:"principal"`
+	LastRow   int       `bson:"lastRow"`
+	CreatedAt time.Time `bson:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+//ImportStore keeps the progress of the csv imports
+type ImportStore interface {
+	//StartImport stores a new import of principal. If the id is taken, the stored import is returned and started is false.
+	StartImport(importId, principal string) (record *ImportRecord, started bool, err error)
+	//AdvanceImport raises the high-water mark of the import to row, it never lowers it
+	AdvanceImport(importId string, row int) error
+}
+
+func (dbl *T) StartImport(importId, principal string) (*ImportRecord, bool, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	importColl := db.Collection(DB_IMPORT_COLLECTION)
+
+	now := time.Now()
+	record := &ImportRecord{Id: importId, Principal: principal, CreatedAt: now, UpdatedAt: now}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	//_id is unique, so of several imports started with the same id only one gets it
+	_, err := importColl.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !isDuplicateKeyError(err) {
+		return nil, false, dbFailure(err, "failed to store the import")
+	}
+
+	existing := &ImportRecord{}
+	if err := importColl.FindOne(ctx, bson.D{{"_id", importId}}).Decode(existing); err != nil {
+		return nil, false, dbFailure(err, "failed to read the import")
+	}
+	return existing, false, nil
+}
+
+func (dbl *T) AdvanceImport(importId string, row int) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	importColl := db.Collection(DB_IMPORT_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := importColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", importId}},
+		bson.D{
+			{"$max", bson.D{{"lastRow", row}}},
+			{"$set", bson.D{{"updatedAt", time.Now()}}},
+		},
+	)
+	if err != nil {
+		return dbFailure(err, "failed to store the progress of the import")
+	}
+
+	return nil
+}
+
+//LastImportedRow returns the last row of the import that made it to the db, 0 if none did.
+//Imports are written in batches that are all-or-nothing, so every row up to it was written.
+//It covers a chunk that was written when advancing the high-water mark of the import failed.
+func (dbl *T) LastImportedRow(importId string) (int, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	cpn := &api.Coupon{}
+	err := couponColl.FindOne(
+		ctx,
+		bson.D{{"import.id", importId}},
+		options.FindOne().SetSort(bson.D{{"import.row", -1}}),
+	).Decode(cpn)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, dbFailure(err, "failed to read the progress of the import")
+	}
+	if cpn.Import == nil {
+		return 0, nil
+	}
+
+	return cpn.Import.Row, nil
+}
+
+//the last row of an import is looked up every time it is resumed
+func (dbl *T) ensureImportIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	couponColl := db.Collection(DB_COUPON_COLLECTION)
+
+	_, err := couponColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"import.id", 1}, {"import.row", -1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the import index")
+	}
+
+	return nil
+}
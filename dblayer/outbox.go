@@ -0,0 +1,129 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+)
+
+//The coupon events are the outbox of the service: they are written with the coupons they describe (see appendEvents),
+//and relayed to the sinks from there. Each sink keeps its own checkpoint in the event log, and is relayed by a single
+//instance of the service at a time, the one holding its lease.
+const (
+	DB_RELAY_LEASE_COLLECTION string = "relay_leases"
+
+	//the sink the webhook deliveries are made from
+	WEBHOOK_SINK string = "webhooks"
+
+	//the counter documents holding the checkpoints of the sinks are named by this prefix and the sink
+	relayCheckpointPrefix = "relay:"
+	//the checkpoint the webhooks kept before they were relayed from the outbox
+	legacyWebhookCheckpoint = "webhook_dispatch"
+)
+
+type OutboxStore interface {
+	RelayCheckpoint(sink string) (int64, error)
+	SaveRelayCheckpoint(sink string, seq int64) error
+	AcquireRelayLease(sink, owner string, ttl time.Duration) (bool, error)
+}
+
+//RelayCheckpoint returns the sequence number of the last event the sink took, 0 before the first one
+func (dbl *T) RelayCheckpoint(sink string) (int64, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	counterColl := db.Collection(DB_COUNTER_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	c := &counter{}
+	err := counterColl.FindOne(ctx, bson.D{{"_id", relayCheckpointPrefix + sink}}).Decode(c)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, dbFailure(err, "failed to read the relay checkpoint")
+	}
+	return c.Seq, nil
+}
+
+//SaveRelayCheckpoint only ever moves the checkpoint forward, an instance whose lease ran out cannot rewind it
+func (dbl *T) SaveRelayCheckpoint(sink string, seq int64) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	counterColl := db.Collection(DB_COUNTER_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := counterColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", relayCheckpointPrefix + sink}},
+		bson.D{{"$max", bson.D{{"seq", seq}}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return dbFailure(err, "failed to save the relay checkpoint")
+	}
+	return nil
+}
+
+//AcquireRelayLease takes or renews the lease of the sink for ttl. It is refused while another owner holds it.
+func (dbl *T) AcquireRelayLease(sink, owner string, ttl time.Duration) (bool, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	leaseColl := db.Collection(DB_RELAY_LEASE_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	now := time.Now()
+	_, err := leaseColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", sink}, {"$or", bson.A{bson.D{{"owner", owner}}, bson.D{{"until", bson.D{{"$lte", now}}}}}}},
+		bson.D{{"$set", bson.D{{"owner", owner}, {"until", now.Add(ttl)}}}},
+		options.Update().SetUpsert(true),
+	)
+	//the lease is held, the upsert found nothing and ran into the stored lease
+	if isDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, dbFailure(err, "failed to acquire the relay lease")
+	}
+	return true, nil
+}
+
+//migrateWebhookCheckpoint carries the checkpoint the webhooks kept before the outbox over to their sink, so an upgrade
+//neither delivers the events since the first one again nor skips the ones not yet delivered
+func (dbl *T) migrateWebhookCheckpoint(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	counterColl := db.Collection(DB_COUNTER_COLLECTION)
+
+	legacy := &counter{}
+	err := counterColl.FindOne(ctx, bson.D{{"_id", legacyWebhookCheckpoint}}).Decode(legacy)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read the webhook checkpoint")
+	}
+
+	_, err = counterColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", relayCheckpointPrefix + WEBHOOK_SINK}},
+		bson.D{{"$max", bson.D{{"seq", legacy.Seq}}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to carry the webhook checkpoint over to the outbox")
+	}
+	if _, err := counterColl.DeleteOne(ctx, bson.D{{"_id", legacyWebhookCheckpoint}}); err != nil {
+		return errors.Wrap(err, "failed to remove the old webhook checkpoint")
+	}
+
+	log.Printf("the webhooks carry on relaying from event %d", legacy.Seq)
+	return nil
+}
@@ -0,0 +1,85 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+)
+
+const (
+	//batch writes run in a multi-document transaction (replica sets)
+	WRITE_MODE_TRANSACTION string = "transaction"
+	//batch writes are undone by compensating writes when they fail midway (standalone servers)
+	WRITE_MODE_COMPENSATING string = "compensating"
+)
+
+type isMasterResult struct {
+	SetName string `bson:"setName"`
+}
+
+//detectWriteMode checks whether the server is part of a replica set, which is what transactions require
+func (dbl *T) detectWriteMode(ctx context.Context) string {
+	db := dbl.mongoClient.Database(dbl.dbName)
+
+	res := &isMasterResult{}
+	if err := db.RunCommand(ctx, bson.D{{"isMaster", 1}}).Decode(res); err != nil {
+		log.Printf("failed to detect the server topology, batch writes will not be transactional: %s", err.Error())
+		return WRITE_MODE_COMPENSATING
+	}
+
+	if res.SetName == "" {
+		return WRITE_MODE_COMPENSATING
+	}
+	return WRITE_MODE_TRANSACTION
+}
+
+//BatchWriteMode reports how CreateCoupons and UpdateCoupons keep a batch all-or-nothing
+func (dbl *T) BatchWriteMode() string {
+	if dbl.writeMode == "" {
+		return WRITE_MODE_COMPENSATING
+	}
+	return dbl.writeMode
+}
+
+//runBatch executes write in a single transaction when the server supports it. Otherwise write is executed directly
+//and, if it fails, compensate is called to undo whatever part of the batch was already applied. compensate returns
+//the coupons it could not restore, any of them fails the batch with a compensationFailure rather than the error of write.
+func (dbl *T) runBatch(write func(ctx context.Context) error, compensate func() ([]primitive.ObjectID, error)) error {
+	if dbl.BatchWriteMode() != WRITE_MODE_TRANSACTION {
+		err := write(context.Background())
+		if err != nil {
+			if changed, cErr := compensate(); cErr != nil || len(changed) > 0 {
+				return compensationFailure(err, cErr, changed)
+			}
+		}
+		return err
+	}
+
+	sess, err := dbl.mongoClient.StartSession()
+	if err != nil {
+		return errors.Wrap(err, "failed to start a db session")
+	}
+	defer sess.EndSession(context.Background())
+
+	return mongo.WithSession(context.Background(), sess, func(sc mongo.SessionContext) error {
+		if err := sess.StartTransaction(); err != nil {
+			return errors.Wrap(err, "failed to start a transaction")
+		}
+
+		if err := write(sc); err != nil {
+			if abortErr := sess.AbortTransaction(sc); abortErr != nil {
+				log.Printf("failed to abort the transaction: %s", abortErr.Error())
+			}
+			return err
+		}
+
+		if err := sess.CommitTransaction(sc); err != nil {
+			return errors.Wrap(err, "failed to commit the transaction")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,211 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_VERSION_COLLECTION string = "coupon_versions"
+)
+
+//VersionStore reads the history of the coupons. Every create, update and delete stores the version it writes
+//along with its events, coupons written before the history was kept have none of their earlier versions.
+type VersionStore interface {
+	//CouponVersions returns the history of the coupon, the oldest version first
+	CouponVersions(id primitive.ObjectID) ([]api.CouponVersion, error)
+	CouponVersion(id primitive.ObjectID, version int64) (*api.CouponVersion, error)
+	//CouponAt returns the version of the coupon current at t
+	CouponAt(id primitive.ObjectID, t time.Time) (*api.CouponVersion, error)
+}
+
+//updatedCoupon is the coupon as an update leaves it, see updatedFields
+func updatedCoupon(prev, cpn api.Coupon, replace bool) api.Coupon {
+	if replace || cpn.Name != "" {
+		prev.Name = cpn.Name
+	}
+	if replace || cpn.Brand != "" {
+		prev.Brand = cpn.Brand
+	}
+	if replace || cpn.Value > 0 {
+		prev.Value = cpn.Value
+	}
+	if replace || !cpn.Expiry.IsZero() {
+		prev.Expiry = cpn.Expiry
+	}
+	prev.Version = cpn.Version + 1
+	return prev
+}
+
+//appendHistory stores the versions, the audit entries and the events of a write, see appendEvents. In the transaction
+//write mode they are committed or rolled back with the coupons. In the compensating write mode the versions and entries
+//of a write whose events fail are removed again, the undo of the write removes neither; when they cannot be removed the
+//write fails with a historyFailure rather than its own error.
+func (dbl *T) appendHistory(ctx context.Context, versions []api.CouponVersion, audit []api.AuditEntry, events []api.CouponEvent) error {
+	if err := dbl.appendVersions(ctx, versions); err != nil {
+		return err
+	}
+
+	err := dbl.appendAudit(ctx, audit)
+	if err == nil {
+		err = dbl.appendEvents(ctx, events)
+	}
+	if err != nil && dbl.BatchWriteMode() != WRITE_MODE_TRANSACTION {
+		undoErr := dbl.removeVersions(versions)
+		if auditErr := dbl.removeAudit(audit); undoErr == nil {
+			undoErr = auditErr
+		}
+		if undoErr != nil {
+			return historyFailure(err, undoErr)
+		}
+	}
+	return err
+}
+
+func (dbl *T) appendVersions(ctx context.Context, versions []api.CouponVersion) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	now := time.Now()
+	documents := []interface{}{}
+	for i := range versions {
+		versions[i].Id = primitive.NewObjectID()
+		versions[i].At = now
+		documents = append(documents, versions[i])
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, dbl.timeout)
+	defer cancel()
+
+	_, err := versionColl.InsertMany(opCtx, documents)
+	if err != nil && dbl.BatchWriteMode() != WRITE_MODE_TRANSACTION {
+		if undoErr := dbl.removeVersions(versions); undoErr != nil {
+			return historyFailure(err, undoErr)
+		}
+	}
+	return err
+}
+
+//removeVersions takes back the versions of a failed write that made it to the db
+func (dbl *T) removeVersions(versions []api.CouponVersion) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	ids := bson.A{}
+	for _, version := range versions {
+		ids = append(ids, version.Id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	_, err := versionColl.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}})
+	return errors.Wrap(err, "failed to remove the versions of a failed write")
+}
+
+func (dbl *T) CouponVersions(id primitive.ObjectID) ([]api.CouponVersion, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	cur, err := versionColl.Find(ctx, bson.D{{"couponId", id}}, options.Find().SetSort(bson.D{{"at", 1}, {"version", 1}}))
+	if err != nil {
+		return nil, dbFailure(err, "failed to read coupon versions from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	versions := []api.CouponVersion{}
+	for cur.Next(ctx) {
+		version := api.CouponVersion{}
+		if err := cur.Decode(&version); err != nil {
+			return nil, dbFailure(err, "failed to read a coupon version from the db")
+		}
+		versions = append(versions, version)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, dbFailure(err, "failed to read coupon versions from the db")
+	}
+
+	return versions, nil
+}
+
+func (dbl *T) CouponVersion(id primitive.ObjectID, version int64) (*api.CouponVersion, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	found := &api.CouponVersion{}
+	err := versionColl.FindOne(ctx, bson.D{{"couponId", id}, {"version", version}, {"deleted", bson.D{{"$ne", true}}}}).Decode(found)
+	if err == mongo.ErrNoDocuments {
+		return nil, api.NewErrorf(api.ERR_COUPON_VERSION_NOT_FOUND, "coupon %s has no version %d", id.Hex(), version)
+	}
+	if err != nil {
+		return nil, dbFailure(err, "failed to read a coupon version from the db")
+	}
+	return found, nil
+}
+
+func (dbl *T) CouponAt(id primitive.ObjectID, t time.Time) (*api.CouponVersion, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	found := &api.CouponVersion{}
+	err := versionColl.FindOne(
+		ctx,
+		bson.D{{"couponId", id}, {"at", bson.D{{"$lte", t}}}},
+		options.FindOne().SetSort(bson.D{{"at", -1}, {"version", -1}, {"deleted", -1}}),
+	).Decode(found)
+	if err == mongo.ErrNoDocuments || (err == nil && found.Deleted) {
+		return nil, api.NewErrorf(api.ERR_COUPON_VERSION_NOT_FOUND, "coupon %s did not exist at %s", id.Hex(), t.Format(time.RFC3339))
+	}
+	if err != nil {
+		return nil, dbFailure(err, "failed to read a coupon version from the db")
+	}
+	return found, nil
+}
+
+func (dbl *T) ensureVersionIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	versionColl := db.Collection(DB_VERSION_COLLECTION)
+
+	_, err := versionColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"couponId", 1}, {"version", 1}, {"deleted", 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the coupon version index")
+	}
+
+	_, err = versionColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"couponId", 1}, {"at", -1}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the coupon history index")
+	}
+
+	return nil
+}
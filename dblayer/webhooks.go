@@ -0,0 +1,319 @@
+package dblayer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/options"
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+const (
+	DB_SUBSCRIPTION_COLLECTION string = "webhook_subscriptions"
+	DB_DELIVERY_COLLECTION     string = "webhook_deliveries"
+)
+
+//WebhookStore keeps the webhook subscriptions and the deliveries of coupon events to them
+type WebhookStore interface {
+	CreateSubscription(sub *api.WebhookSubscription) error
+	Subscriptions(owners ...string) ([]api.WebhookSubscription, error)
+	DeleteSubscription(id primitive.ObjectID, owners ...string) error
+
+	EnqueueDeliveries(deliveries []api.WebhookDelivery) error
+	ClaimDeliveries(now time.Time, lease time.Duration, limit int, skip []primitive.ObjectID) ([]api.WebhookDelivery, error)
+	RecordDeliveryAttempt(id string, attempt api.DeliveryAttempt, status string, nextAttemptAt time.Time) error
+	Deliveries(filter DeliveryFilter) ([]api.WebhookDelivery, error)
+	Redeliver(id string, now time.Time, owners ...string) error
+}
+
+//DeliveryFilter selects deliveries from the log, the newest first. Zero fields do not filter.
+type DeliveryFilter struct {
+	SubscriptionId primitive.ObjectID
+	Status         string
+	Owners         []string
+	Limit          int
+}
+
+//ownerFilter matches the subscriptions and deliveries of the owners. The empty owner stands for the ones stored
+//before they were given an owner, which have none.
+func ownerFilter(owners []string) bson.E {
+	in := bson.A{}
+	for _, owner := range owners {
+		if owner == "" {
+			//null matches a missing field
+			in = append(in, nil)
+		}
+		in = append(in, owner)
+	}
+	return bson.E{"owner", bson.D{{"$in", in}}}
+}
+
+//CreateSubscription stores the subscription, which gets the events stored from now on
+func (dbl *T) CreateSubscription(sub *api.WebhookSubscription) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	subColl := db.Collection(DB_SUBSCRIPTION_COLLECTION)
+
+	_, newest, err := dbl.EventBounds()
+	if err != nil {
+		return err
+	}
+
+	sub.Id = primitive.NewObjectID()
+	sub.CreatedAt = time.Now()
+	sub.FromSeq = newest
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	if _, err := subColl.InsertOne(ctx, sub); err != nil {
+		return dbFailure(err, "failed to store the webhook subscription")
+	}
+	return nil
+}
+
+//Subscriptions lists the subscriptions of the owners, every subscription when no owner is given
+func (dbl *T) Subscriptions(owners ...string) ([]api.WebhookSubscription, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	subColl := db.Collection(DB_SUBSCRIPTION_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	filter := bson.D{}
+	if len(owners) > 0 {
+		filter = append(filter, ownerFilter(owners))
+	}
+
+	cur, err := subColl.Find(ctx, filter, options.Find().SetSort(bson.D{{"createdAt", 1}}))
+	if err != nil {
+		return nil, dbFailure(err, "failed to read webhook subscriptions from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	subs := []api.WebhookSubscription{}
+	for cur.Next(ctx) {
+		sub := api.WebhookSubscription{}
+		if err := cur.Decode(&sub); err != nil {
+			return nil, dbFailure(err, "failed to read a webhook subscription from the db")
+		}
+		subs = append(subs, sub)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, dbFailure(err, "failed to read webhook subscriptions from the db")
+	}
+
+	return subs, nil
+}
+
+//DeleteSubscription removes the subscription, if one of the owners given has it. Its pending deliveries are dropped
+//by the worker as it comes across them, the delivery log is kept.
+func (dbl *T) DeleteSubscription(id primitive.ObjectID, owners ...string) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	subColl := db.Collection(DB_SUBSCRIPTION_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	filter := bson.D{{"_id", id}}
+	if len(owners) > 0 {
+		filter = append(filter, ownerFilter(owners))
+	}
+
+	res, err := subColl.DeleteOne(ctx, filter)
+	if err != nil {
+		return dbFailure(err, "failed to delete the webhook subscription")
+	}
+	if res.DeletedCount == 0 {
+		return api.NewErrorf(api.ERR_SUBSCRIPTION_NOT_FOUND, "webhook subscription %s does not exist", id.Hex())
+	}
+	return nil
+}
+
+//EnqueueDeliveries stores new deliveries. A delivery that is already stored is left as it is,
+//so events relayed again after a crash do not deliver twice.
+func (dbl *T) EnqueueDeliveries(deliveries []api.WebhookDelivery) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	for _, delivery := range deliveries {
+		if _, err := deliveryColl.InsertOne(ctx, delivery); err != nil && !isDuplicateKeyError(err) {
+			return dbFailure(err, "failed to store a webhook delivery")
+		}
+	}
+	return nil
+}
+
+//ClaimDeliveries takes up to limit pending deliveries that are due, for lease, leaving out the ones to the subscriptions
+//in skip. Other instances of the service skip a claimed delivery until the lease runs out, so a delivery whose instance
+//died on the way is sent again.
+func (dbl *T) ClaimDeliveries(now time.Time, lease time.Duration, limit int, skip []primitive.ObjectID) ([]api.WebhookDelivery, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	filter := bson.D{
+		{"status", api.DELIVERY_PENDING},
+		{"nextAttemptAt", bson.D{{"$lte", now}}},
+		{"lockedUntil", bson.D{{"$lte", now}}},
+	}
+	if len(skip) > 0 {
+		filter = append(filter, bson.E{"subscriptionId", bson.D{{"$nin", skip}}})
+	}
+
+	claimed := []api.WebhookDelivery{}
+	for len(claimed) < limit {
+		delivery := api.WebhookDelivery{}
+		err := deliveryColl.FindOneAndUpdate(
+			ctx,
+			filter,
+			bson.D{{"$set", bson.D{{"lockedUntil", now.Add(lease)}}}},
+			options.FindOneAndUpdate().SetSort(bson.D{{"nextAttemptAt", 1}}).SetReturnDocument(options.After),
+		).Decode(&delivery)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return claimed, dbFailure(err, "failed to claim a webhook delivery")
+		}
+		claimed = append(claimed, delivery)
+	}
+
+	return claimed, nil
+}
+
+//RecordDeliveryAttempt adds the attempt to the log of the delivery and releases it with its new status
+func (dbl *T) RecordDeliveryAttempt(id string, attempt api.DeliveryAttempt, status string, nextAttemptAt time.Time) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	set := bson.D{{"status", status}, {"nextAttemptAt", nextAttemptAt}, {"lockedUntil", time.Time{}}}
+	if status == api.DELIVERY_DELIVERED {
+		set = append(set, bson.E{"deliveredAt", attempt.At})
+	}
+
+	_, err := deliveryColl.UpdateOne(
+		ctx,
+		bson.D{{"_id", id}},
+		bson.D{{"$push", bson.D{{"attempts", attempt}}}, {"$set", set}},
+	)
+	if err != nil {
+		return dbFailure(err, "failed to record a webhook delivery attempt")
+	}
+	return nil
+}
+
+func (dbl *T) Deliveries(filter DeliveryFilter) ([]api.WebhookDelivery, error) {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	query := bson.D{}
+	if !filter.SubscriptionId.IsZero() {
+		query = append(query, bson.E{"subscriptionId", filter.SubscriptionId})
+	}
+	if filter.Status != "" {
+		query = append(query, bson.E{"status", filter.Status})
+	}
+	if len(filter.Owners) > 0 {
+		query = append(query, ownerFilter(filter.Owners))
+	}
+
+	opts := options.Find().SetSort(bson.D{{"createdAt", -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(int64(filter.Limit))
+	}
+
+	cur, err := deliveryColl.Find(ctx, query, opts)
+	if err != nil {
+		return nil, dbFailure(err, "failed to read webhook deliveries from the db")
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	deliveries := []api.WebhookDelivery{}
+	for cur.Next(ctx) {
+		delivery := api.WebhookDelivery{}
+		if err := cur.Decode(&delivery); err != nil {
+			return nil, dbFailure(err, "failed to read a webhook delivery from the db")
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, dbFailure(err, "failed to read webhook deliveries from the db")
+	}
+
+	return deliveries, nil
+}
+
+//Redeliver makes the delivery pending again, due now, if it goes to a subscription of one of the owners given.
+//Its log is kept, so a dead delivery brought back goes dead again after a single failed attempt.
+func (dbl *T) Redeliver(id string, now time.Time, owners ...string) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbl.timeout)
+	defer cancel()
+
+	filter := bson.D{{"_id", id}}
+	if len(owners) > 0 {
+		filter = append(filter, ownerFilter(owners))
+	}
+
+	res, err := deliveryColl.UpdateOne(
+		ctx,
+		filter,
+		bson.D{{"$set", bson.D{{"status", api.DELIVERY_PENDING}, {"nextAttemptAt", now}}}},
+	)
+	if err != nil {
+		return dbFailure(err, "failed to redeliver a webhook delivery")
+	}
+	if res.MatchedCount == 0 {
+		return api.NewErrorf(api.ERR_DELIVERY_NOT_FOUND, "webhook delivery %s does not exist", id)
+	}
+	return nil
+}
+
+//due deliveries are claimed on every run of the worker, the log is read per subscription
+func (dbl *T) ensureWebhookIndexes(ctx context.Context) error {
+	db := dbl.mongoClient.Database(dbl.dbName)
+	deliveryColl := db.Collection(DB_DELIVERY_COLLECTION)
+
+	_, err := deliveryColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"status", 1}, {"nextAttemptAt", 1}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the webhook delivery status index")
+	}
+
+	_, err = deliveryColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"subscriptionId", 1}, {"createdAt", -1}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the webhook delivery log index")
+	}
+
+	return nil
+}
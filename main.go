@@ -1,13 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/akh-dev/coupons-service/config"
 	"github.com/akh-dev/coupons-service/couponservice"
 )
 
+//dateFormats collects the repeated -date-format flags
+type dateFormats []string
+
+func (f *dateFormats) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *dateFormats) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
 
 	cfg, err := config.Get()
@@ -20,9 +37,84 @@ func main() {
 		log.Fatalf("Failed to initialise coupon service: %+v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importCSV(couponService, cfg, os.Args[2:]))
+	}
+
 	couponService.ListenAndServe()
 
 	log.Println("Coupon-Service started, press <ENTER> to exit")
 	fmt.Scanln()
 
 }
+
+//importCSV imports a csv file of coupons, printing the report. It returns the exit code: 1 when the import failed, 2 when some rows were invalid.
+func importCSV(couponService *couponservice.CouponService, cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	delimiter := flags.String("delimiter", ",", "the column delimiter, a single character or tab")
+	var formats dateFormats
+	flags.Var(&formats, "date-format", "a Go time layout dates are read with, may be repeated (default IMPORT_DATE_FORMATS)")
+	dryRun := flags.Bool("dry-run", false, "only validate the rows")
+	importId := flags.String("import-id", "", "resume the import with this id")
+	chunkSize := flags.Int("chunk-size", cfg.Service.ImportChunkSize, "how many rows are written at once")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: coupons-service import [flags] file.csv")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	if *delimiter == "tab" {
+		*delimiter = "\t"
+	}
+	if utf8.RuneCountInString(*delimiter) != 1 {
+		log.Printf("the delimiter must be a single character, got %s", *delimiter)
+		return 1
+	}
+	comma, _ := utf8.DecodeRuneInString(*delimiter)
+
+	if len(formats) == 0 {
+		formats = couponservice.SplitDateFormats(cfg.Service.ImportDateFormats)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Printf("Failed to open the file: %s", err.Error())
+		return 1
+	}
+	defer file.Close()
+
+	report, importErr := couponService.ImportCSV(file, couponservice.CSVImportOptions{
+		Delimiter:   comma,
+		DateFormats: formats,
+		DryRun:      *dryRun,
+		ImportId:    *importId,
+		ChunkSize:   *chunkSize,
+	})
+
+	if report != nil {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Printf("Failed to write the report: %s", err.Error())
+		} else {
+			fmt.Println(string(out))
+		}
+	}
+
+	switch {
+	case importErr != nil:
+		log.Printf("Import failed: %s", importErr.Error())
+		if report != nil && report.ImportId != "" {
+			log.Printf("run again with -import-id %s to resume", report.ImportId)
+		}
+		return 1
+	case report.Invalid > 0:
+		return 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,126 @@
+package outbox
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/eventspb"
+)
+
+const (
+	//the encodings of the events published to a broker, both follow the schema of api/eventspb
+	FORMAT_JSON     string = "json"
+	FORMAT_PROTOBUF string = "protobuf"
+
+	//headers of every message, so consumers can decode it without knowing the config of the publisher
+	HEADER_CONTENT_TYPE   string = "Content-Type"
+	HEADER_SCHEMA         string = "Coupon-Event-Schema"
+	HEADER_SCHEMA_VERSION string = "Coupon-Event-Schema-Version"
+
+	eventSchemaName = "coupons.events.v1.CouponEvent"
+)
+
+var contentTypes = map[string]string{
+	FORMAT_JSON:     "application/json",
+	FORMAT_PROTOBUF: "application/x-protobuf",
+}
+
+//Message is an encoded event on its way to a broker
+type Message struct {
+	//Key is the id of the coupon, brokers that partition by key (kafka) keep the events of a coupon in order
+	Key string
+	//Type is the type of the event, brokers that route by subject (nats) publish to a subject per type
+	Type    string
+	Value   []byte
+	Headers map[string]string
+	//Seq is the sequence number of the event, brokers that drop duplicates (nats jetstream) take it as the message id
+	Seq int64
+}
+
+//Publisher sends messages to a message broker
+type Publisher interface {
+	//Publish returns once the broker has taken the messages, in the order given
+	Publish(ctx context.Context, messages []Message) error
+	Close() error
+}
+
+//BrokerSink encodes the events in the versioned schema and publishes them
+type BrokerSink struct {
+	name      string
+	publisher Publisher
+	format    string
+}
+
+//NewBrokerSink publishes the events encoded in format (FORMAT_JSON or FORMAT_PROTOBUF). The name keeps the checkpoint
+//of the sink, it has to stay the same across restarts.
+func NewBrokerSink(name string, publisher Publisher, format string) (*BrokerSink, error) {
+	if err := ValidateFormat(format); err != nil {
+		return nil, err
+	}
+	return &BrokerSink{name: name, publisher: publisher, format: format}, nil
+}
+
+//ValidateFormat tells whether the events can be encoded in format, before a broker is connected to
+func ValidateFormat(format string) error {
+	if _, known := contentTypes[format]; !known {
+		return errors.Errorf("%q is not an event format, use %s or %s", format, FORMAT_JSON, FORMAT_PROTOBUF)
+	}
+	return nil
+}
+
+func (s *BrokerSink) Name() string {
+	return s.name
+}
+
+func (s *BrokerSink) Publish(ctx context.Context, events []api.CouponEvent) error {
+	messages := []Message{}
+	for _, event := range events {
+		message, err := EncodeEvent(event, s.format)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, message)
+	}
+	return s.publisher.Publish(ctx, messages)
+}
+
+func (s *BrokerSink) Close() error {
+	return s.publisher.Close()
+}
+
+//EncodeEvent encodes the event as a message in the schema of api/eventspb.
+//The json encoding is the canonical json mapping of protobuf, with the field names in lowerCamelCase.
+func EncodeEvent(event api.CouponEvent, format string) (Message, error) {
+	encoded := eventspb.FromInternal(event)
+
+	var value []byte
+	var err error
+	switch format {
+	case FORMAT_JSON:
+		value, err = protojson.Marshal(encoded)
+	case FORMAT_PROTOBUF:
+		value, err = proto.Marshal(encoded)
+	default:
+		err = errors.Errorf("%q is not an event format", format)
+	}
+	if err != nil {
+		return Message{}, errors.Wrapf(err, "failed to encode coupon event %d", event.Seq)
+	}
+
+	return Message{
+		Key:   event.CouponId.Hex(),
+		Type:  event.Type,
+		Value: value,
+		Headers: map[string]string{
+			HEADER_CONTENT_TYPE:   contentTypes[format],
+			HEADER_SCHEMA:         eventSchemaName,
+			HEADER_SCHEMA_VERSION: strconv.Itoa(int(eventspb.SCHEMA_VERSION)),
+		},
+		Seq: event.Seq,
+	}, nil
+}
@@ -0,0 +1,110 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson/primitive"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/akh-dev/coupons-service/api"
+	"github.com/akh-dev/coupons-service/api/eventspb"
+	"github.com/akh-dev/coupons-service/outbox"
+	"github.com/akh-dev/coupons-service/outbox/outboxtest"
+)
+
+func brokerEvents() []api.CouponEvent {
+	couponId := primitive.NewObjectID()
+	at := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	return []api.CouponEvent{
+		{Seq: 1, Type: api.EVENT_CREATED, CouponId: couponId, Brand: "Tesco", Version: 1, At: at},
+		{Seq: 2, Type: api.EVENT_UPDATED, CouponId: couponId, Brand: "Boots", PreviousBrand: "Tesco", ChangedFields: []string{"brand"}, Version: 2, At: at},
+	}
+}
+
+func TestBrokerSink(t *testing.T) {
+	events := brokerEvents()
+
+	for _, format := range []string{outbox.FORMAT_JSON, outbox.FORMAT_PROTOBUF} {
+		publisher := outboxtest.New()
+		sink, err := outbox.NewBrokerSink("test", publisher, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Publish(context.Background(), events); err != nil {
+			t.Fatal(err)
+		}
+
+		messages := publisher.Messages()
+		if len(messages) != len(events) {
+			t.Fatalf("%s: expected a message per event, but got %d", format, len(messages))
+		}
+		for i, message := range messages {
+			if message.Key != events[i].CouponId.Hex() || message.Type != events[i].Type || message.Seq != events[i].Seq {
+				t.Errorf("%s: unexpected message %d: %+v", format, i, message)
+			}
+			if message.Headers[outbox.HEADER_SCHEMA] != "coupons.events.v1.CouponEvent" || message.Headers[outbox.HEADER_SCHEMA_VERSION] != "1" {
+				t.Errorf("%s: unexpected headers %v", format, message.Headers)
+			}
+
+			decoded := &eventspb.CouponEvent{}
+			if format == outbox.FORMAT_JSON {
+				err = protojson.Unmarshal(message.Value, decoded)
+			} else {
+				err = proto.Unmarshal(message.Value, decoded)
+			}
+			if err != nil {
+				t.Fatalf("%s: failed to decode message %d: %v", format, i, err)
+			}
+			if !proto.Equal(decoded, eventspb.FromInternal(events[i])) {
+				t.Errorf("%s: expected %v, but decoded %v", format, eventspb.FromInternal(events[i]), decoded)
+			}
+		}
+
+		if err := sink.Close(); err != nil || !publisher.Closed() {
+			t.Errorf("%s: expected the publisher to be closed (%v)", format, err)
+		}
+	}
+}
+
+func TestBrokerSinkJSON(t *testing.T) {
+	message, err := outbox.EncodeEvent(brokerEvents()[1], outbox.FORMAT_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Headers[outbox.HEADER_CONTENT_TYPE] != "application/json" {
+		t.Errorf("unexpected content type %q", message.Headers[outbox.HEADER_CONTENT_TYPE])
+	}
+
+	//consumers without protobuf read the lowerCamelCase names
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal(message.Value, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["schemaVersion"] != float64(1) || decoded["previousBrand"] != "Tesco" || decoded["occurredAt"] != "2020-03-01T12:00:00Z" {
+		t.Errorf("unexpected json %s", message.Value)
+	}
+}
+
+func TestBrokerSinkFailure(t *testing.T) {
+	if _, err := outbox.NewBrokerSink("test", outboxtest.New(), "xml"); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+
+	publisher := outboxtest.New()
+	sink, err := outbox.NewBrokerSink("test", publisher, outbox.FORMAT_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.FailWith(errors.New("the broker is down"))
+	if err := sink.Publish(context.Background(), brokerEvents()); err == nil {
+		t.Error("expected the failure of the broker to be reported")
+	}
+	if len(publisher.Messages()) != 0 {
+		t.Errorf("expected nothing to be published, but got %v", publisher.Messages())
+	}
+}
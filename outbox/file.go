@@ -0,0 +1,47 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+//FileSink appends the events to a file, a json document per line
+type FileSink struct {
+	path string
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+//Publish opens the file for every batch, so a rotated file is picked up, and syncs it before the events are taken as published
+func (s *FileSink) Publish(ctx context.Context, events []api.CouponEvent) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the event log file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return errors.Wrap(err, "failed to write an event to the event log file")
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write to the event log file")
+	}
+	return errors.Wrap(f.Sync(), "failed to sync the event log file")
+}
@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := NewFileSink(filepath.Join(dir, "events.ndjson"))
+	batches := [][]api.CouponEvent{
+		{{Seq: 1, Type: api.EVENT_CREATED, Brand: "Tesco"}, {Seq: 2, Type: api.EVENT_UPDATED, Brand: "Tesco"}},
+		{{Seq: 3, Type: api.EVENT_DELETED, Brand: "Boots"}},
+	}
+	for _, batch := range batches {
+		if err := sink.Publish(context.Background(), batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "events.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per event, but got %q", content)
+	}
+	for i, line := range lines {
+		event := api.CouponEvent{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil || event.Seq != int64(i+1) {
+			t.Errorf("unexpected line %d: %s (%v)", i, line, err)
+		}
+	}
+}
+
+func TestFileSinkFailure(t *testing.T) {
+	sink := NewFileSink(filepath.Join("does", "not", "exist", "events.ndjson"))
+	if err := sink.Publish(context.Background(), []api.CouponEvent{{Seq: 1}}); err == nil {
+		t.Error("expected the events not to be taken")
+	}
+}
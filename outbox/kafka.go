@@ -0,0 +1,46 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+//KafkaPublisher publishes the events to a topic, keyed by the id of the coupon
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+//NewKafkaPublisher writes to topic on the brokers. The key picks the partition, so the events of a coupon stay in order,
+//and a message is taken once every in-sync replica stored it.
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, messages []Message) error {
+	kafkaMessages := []kafka.Message{}
+	for _, message := range messages {
+		headers := []kafka.Header{}
+		for name, value := range message.Headers {
+			headers = append(headers, kafka.Header{Key: name, Value: []byte(value)})
+		}
+		kafkaMessages = append(kafkaMessages, kafka.Message{Key: []byte(message.Key), Value: message.Value, Headers: headers})
+	}
+
+	if err := p.writer.WriteMessages(ctx, kafkaMessages...); err != nil {
+		return errors.Wrap(err, "failed to publish coupon events to kafka")
+	}
+	return nil
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
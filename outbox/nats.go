@@ -0,0 +1,67 @@
+package outbox
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+//NATSPublisher publishes every event to <subject prefix>.<event type>, e.g. coupons.events.created
+type NATSPublisher struct {
+	conn          *nats.Conn
+	js            nats.JetStreamContext
+	subjectPrefix string
+}
+
+//NewNATSPublisher connects to the NATS server at url. With jetStream the events are published through JetStream,
+//which acknowledges each one once a stream stored it and drops the ones published twice by their sequence number.
+//Without, an event is taken once the server got it, and is lost to subscribers that are not connected.
+func NewNATSPublisher(url, subjectPrefix string, jetStream bool) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("coupon-service"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to nats")
+	}
+
+	p := &NATSPublisher{conn: conn, subjectPrefix: subjectPrefix}
+	if jetStream {
+		if p.js, err = conn.JetStream(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to open the nats jetstream context")
+		}
+	}
+	return p, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, messages []Message) error {
+	for _, message := range messages {
+		msg := nats.NewMsg(p.subjectPrefix + "." + message.Type)
+		msg.Data = message.Value
+		for name, value := range message.Headers {
+			msg.Header.Set(name, value)
+		}
+
+		if p.js == nil {
+			if err := p.conn.PublishMsg(msg); err != nil {
+				return errors.Wrap(err, "failed to publish a coupon event to nats")
+			}
+			continue
+		}
+
+		//one at a time, an event is only published once the ones before it were stored
+		if _, err := p.js.PublishMsg(msg, nats.Context(ctx), nats.MsgId(strconv.FormatInt(message.Seq, 10))); err != nil {
+			return errors.Wrap(err, "failed to publish a coupon event to nats jetstream")
+		}
+	}
+
+	if p.js == nil {
+		return errors.Wrap(p.conn.FlushWithContext(ctx), "failed to flush the coupon events to nats")
+	}
+	return nil
+}
+
+//Close sends what is still buffered before it disconnects
+func (p *NATSPublisher) Close() error {
+	return p.conn.Drain()
+}
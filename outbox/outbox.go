@@ -0,0 +1,18 @@
+// Package outbox holds the sinks the coupon events are relayed to. The db layer writes the events with the changes of the
+// coupons, the relay (see couponservice) hands them to every sink in sequence order, so the events of a coupon arrive in
+// the order they happened. A sink that fails is handed the same events again, from the first one it did not take:
+// delivery is at least once, and a sink (or whatever it feeds) should drop the events it has seen by their sequence number.
+package outbox
+
+import (
+	"context"
+
+	"github.com/akh-dev/coupons-service/api"
+)
+
+type Sink interface {
+	//Name identifies the sink, its checkpoint is kept under it, so it must stay the same across restarts
+	Name() string
+	//Publish returns once the sink has taken the events, an error has them published again
+	Publish(ctx context.Context, events []api.CouponEvent) error
+}
@@ -0,0 +1,63 @@
+// Package outboxtest is an in-process outbox.Publisher, for testing the publishing of coupon events without a broker.
+package outboxtest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/akh-dev/coupons-service/outbox"
+)
+
+//Publisher keeps the messages it is handed, in order
+type Publisher struct {
+	mu       sync.Mutex
+	messages []outbox.Message
+	err      error
+	closed   bool
+}
+
+func New() *Publisher {
+	return &Publisher{}
+}
+
+//FailWith has every publish fail with err until it is called with nil, as a broker that is down
+func (p *Publisher) FailWith(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err
+}
+
+func (p *Publisher) Publish(ctx context.Context, messages []outbox.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+//Messages returns the messages published so far
+func (p *Publisher) Messages() []outbox.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]outbox.Message{}, p.messages...)
+}
+
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+func (p *Publisher) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrRequestTooLarge is returned when reading a compressed request body that decompresses to more than the limit
+var ErrRequestTooLarge = errors.New("the decompressed request body is too large")
+
+// UnsupportedEncodingError is returned for a request body in a Content-Encoding we cannot decode
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("request bodies encoded with %s are not supported, use one of %s", e.Encoding, strings.Join(supportedEncodings, ", "))
+}
+
+// limitedReader fails with ErrRequestTooLarge once more than max bytes were read, io.LimitReader would just end the body early
+type limitedReader struct {
+	io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, ErrRequestTooLarge
+	}
+	// one byte more than allowed is asked for, so a body of exactly the limit is not mistaken for a larger one
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n + int(r.remaining), ErrRequestTooLarge
+	}
+	return n, err
+}
+
+// decodedBody closes the decoders along with the original body
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var firstErr error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if err := b.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (d zstdCloser) Close() error {
+	d.Decoder.Close()
+	return nil
+}
+
+func newDecoder(encoding string, body io.Reader) (io.Reader, io.Closer, error) {
+	switch encoding {
+	case ENCODING_GZIP, "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz, nil
+	case ENCODING_BROTLI:
+		return brotli.NewReader(body), nil, nil
+	case ENCODING_ZSTD:
+		//the window is capped so a crafted frame cannot make the decoder allocate gigabytes up front
+		dec, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+		if err != nil {
+			return nil, nil, err
+		}
+		return dec, zstdCloser{dec}, nil
+	default:
+		return nil, nil, &UnsupportedEncodingError{Encoding: encoding}
+	}
+}
+
+// DecompressRequest replaces a compressed request body with the decompressed one, so handlers read it as if it was sent as is.
+// Encodings applied one after the other ("gzip, br") are undone in reverse. Reading more than maxSize decompressed bytes
+// fails with ErrRequestTooLarge, maxSize <= 0 leaves the body unlimited.
+func DecompressRequest(r *http.Request, maxSize int64) error {
+	header := r.Header.Get("Content-Encoding")
+	if header == "" || r.Body == nil {
+		return nil
+	}
+
+	encodings := []string{}
+	for _, encoding := range strings.Split(header, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding != "" && encoding != ENCODING_IDENTITY {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+
+	body := &decodedBody{Reader: r.Body, closers: []io.Closer{r.Body}}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		reader, closer, err := newDecoder(encodings[i], body.Reader)
+		if err != nil {
+			body.Close()
+			return err
+		}
+		body.Reader = reader
+		if closer != nil {
+			body.closers = append(body.closers, closer)
+		}
+	}
+	if maxSize > 0 {
+		body.Reader = &limitedReader{Reader: body.Reader, remaining: maxSize}
+	}
+
+	r.Body = body
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
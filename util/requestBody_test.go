@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	var enc io.WriteCloser
+	switch encoding {
+	case ENCODING_GZIP:
+		enc = gzip.NewWriter(buf)
+	case ENCODING_BROTLI:
+		enc = brotli.NewWriter(buf)
+	case ENCODING_ZSTD:
+		zw, err := zstd.NewWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc = zw
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressedRequest(contentEncoding string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+	r.Header.Set("Content-Encoding", contentEncoding)
+	return r
+}
+
+func TestDecompressRequest(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"name":"Save £1 at Tesco","brand":"Tesco","value":1}`, 50))
+
+	for _, encoding := range supportedEncodings {
+		r := compressedRequest(encoding, compress(t, encoding, payload))
+		if err := DecompressRequest(r, int64(len(payload))); err != nil {
+			t.Errorf("%s: %s", encoding, err.Error())
+			continue
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(body, payload) {
+			t.Errorf("%s: the body did not survive decompression: %v", encoding, err)
+		}
+		if r.Header.Get("Content-Encoding") != "" || r.ContentLength != -1 {
+			t.Errorf("%s: expected the request to look uncompressed, got %v", encoding, r.Header)
+		}
+		r.Body.Close()
+	}
+
+	//encodings applied one after the other are undone in reverse
+	stacked := compressedRequest("gzip, br", compress(t, ENCODING_BROTLI, compress(t, ENCODING_GZIP, payload)))
+	if err := DecompressRequest(stacked, 0); err != nil {
+		t.Error(err)
+		return
+	}
+	if body, err := ioutil.ReadAll(stacked.Body); err != nil || !bytes.Equal(body, payload) {
+		t.Errorf("the stacked encodings were not undone: %v", err)
+	}
+}
+
+func TestDecompressRequestLimit(t *testing.T) {
+	//a few kilobytes of gzip that inflate to a megabyte
+	bomb := compress(t, ENCODING_GZIP, make([]byte, 1<<20))
+
+	r := compressedRequest(ENCODING_GZIP, bomb)
+	if err := DecompressRequest(r, 64<<10); err != nil {
+		t.Error(err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != ErrRequestTooLarge {
+		t.Errorf("expected %v, got %v", ErrRequestTooLarge, err)
+	}
+	if len(body) != 64<<10 {
+		t.Errorf("expected reading to stop at the limit, read %d bytes", len(body))
+	}
+}
+
+func TestDecompressRequestUnsupported(t *testing.T) {
+	r := compressedRequest("deflate", []byte("x"))
+	err := DecompressRequest(r, 0)
+	if _, unsupported := err.(*UnsupportedEncodingError); !unsupported {
+		t.Errorf("expected an unsupported encoding error, got %v", err)
+	}
+
+	//the handler rejects the request before it reaches any route
+	w := httptest.NewRecorder()
+	(&CompressHandler{}).ServeHTTP(w, compressedRequest("deflate", []byte("x")))
+	if w.Code != http.StatusUnsupportedMediaType || w.Header().Get("Accept-Encoding") == "" {
+		t.Errorf("expected 415 with the encodings we take, got %d %v", w.Code, w.Header())
+	}
+
+	//identity is no encoding at all
+	r = compressedRequest("identity", []byte("x"))
+	if err := DecompressRequest(r, 0); err != nil {
+		t.Error(err)
+	}
+}
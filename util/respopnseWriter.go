@@ -1,38 +1,294 @@
 package util
 
 import (
+	"bytes"
 	"compress/gzip"
+	"fmt"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Since http.ResponseWriter is an interface, we can intercept it and provide our own ResponseWriter to add compression
+
+const (
+	ENCODING_BROTLI   string = "br"
+	ENCODING_ZSTD     string = "zstd"
+	ENCODING_GZIP     string = "gzip"
+	ENCODING_IDENTITY string = "identity"
 )
 
-// Since http.ResponseWriter is an interface, we can intercept it and provide our own ResponseWriter to add gzip functionality
+// The encodings we can compress with, in the order we prefer them when the client likes several equally
+var supportedEncodings = []string{ENCODING_BROTLI, ENCODING_ZSTD, ENCODING_GZIP}
+
+// CompressionConfig tells how responses are compressed, a config without any level set uses the levels of DefaultCompressionConfig
+type CompressionConfig struct {
+	// Responses smaller than this many bytes are sent uncompressed, compressing them would only add overhead
+	MinSize int
+
+	GzipLevel   int
+	BrotliLevel int
+	ZstdLevel   int
+}
+
+// DefaultCompressionConfig compresses every response with the default level of each encoding
+var DefaultCompressionConfig = CompressionConfig{
+	GzipLevel:   6,
+	BrotliLevel: 5,
+	ZstdLevel:   3,
+}
+
+// Validate checks the levels are in the range of their encoding, so a bad config fails at startup rather than on the first response
+func (c CompressionConfig) Validate() error {
+	if c.GzipLevel < gzip.BestSpeed || c.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("gzip level must be between %d and %d, got %d", gzip.BestSpeed, gzip.BestCompression, c.GzipLevel)
+	}
+	if c.BrotliLevel < brotli.BestSpeed || c.BrotliLevel > brotli.BestCompression {
+		return fmt.Errorf("brotli level must be between %d and %d, got %d", brotli.BestSpeed, brotli.BestCompression, c.BrotliLevel)
+	}
+	if c.ZstdLevel < 1 || c.ZstdLevel > 22 {
+		return fmt.Errorf("zstd level must be between 1 and 22, got %d", c.ZstdLevel)
+	}
+	return nil
+}
+
+// WithDefaults fills in the default levels when none is set, brotli 0 is a valid level so only a config without any level counts as unset
+func (c CompressionConfig) WithDefaults() CompressionConfig {
+	if c.GzipLevel == 0 && c.BrotliLevel == 0 && c.ZstdLevel == 0 {
+		c.GzipLevel = DefaultCompressionConfig.GzipLevel
+		c.BrotliLevel = DefaultCompressionConfig.BrotliLevel
+		c.ZstdLevel = DefaultCompressionConfig.ZstdLevel
+	}
+	return c
+}
+
+func (c CompressionConfig) level(encoding string) int {
+	switch encoding {
+	case ENCODING_BROTLI:
+		return c.BrotliLevel
+	case ENCODING_ZSTD:
+		return c.ZstdLevel
+	default:
+		return c.GzipLevel
+	}
+}
+
+// encoder is what gzip.Writer, brotli.Writer and zstd.Encoder have in common, Reset lets us reuse them across responses
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type poolKey struct {
+	encoding string
+	level    int
+}
+
+// Encoders allocate sizeable buffers and tables, so they are pooled per encoding and level rather than created per response
+var encoderPools sync.Map
+
+func getEncoder(encoding string, level int, w io.Writer) encoder {
+	pool, _ := encoderPools.LoadOrStore(poolKey{encoding, level}, &sync.Pool{
+		New: func() interface{} {
+			return newEncoder(encoding, level)
+		},
+	})
 
-// Since gzip is a stream-based protocol, we need to be able to tell when the stream is done so it can flush its buffers
-// CloseableResponseWriter is an interface as we might provide different ResponseWriters depending whether the client supports gzip or not
+	enc := pool.(*sync.Pool).Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func putEncoder(encoding string, level int, enc encoder) {
+	if pool, found := encoderPools.Load(poolKey{encoding, level}); found {
+		pool.(*sync.Pool).Put(enc)
+	}
+}
+
+// newEncoder creates an encoder, the levels were validated so creating one cannot fail
+func newEncoder(encoding string, level int) encoder {
+	switch encoding {
+	case ENCODING_BROTLI:
+		return brotli.NewWriterLevel(nil, level)
+	case ENCODING_ZSTD:
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		return enc
+	default:
+		enc, err := gzip.NewWriterLevel(nil, level)
+		if err != nil {
+			enc = gzip.NewWriter(nil)
+		}
+		return enc
+	}
+}
+
+// NegotiateEncoding picks the encoding of the response from an Accept-Encoding header, honouring q-values.
+// "identity" is returned when the client accepts none of the encodings we support.
+func NegotiateEncoding(acceptEncoding string) string {
+	qValues := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+
+		if coding == "*" {
+			wildcard = q
+		} else {
+			qValues[coding] = q
+		}
+	}
+
+	candidates := []string{}
+	for _, encoding := range supportedEncodings {
+		q, listed := qValues[encoding]
+		if !listed {
+			q = wildcard
+		}
+		if q > 0 {
+			qValues[encoding] = q
+			candidates = append(candidates, encoding)
+		}
+	}
+	if len(candidates) == 0 {
+		return ENCODING_IDENTITY
+	}
+
+	// stable, so encodings the client likes equally keep our order of preference
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return qValues[candidates[i]] > qValues[candidates[j]]
+	})
+	return candidates[0]
+}
+
+// Since compression is stream-based, we need to be able to tell when the stream is done so it can flush its buffers
+// CloseableResponseWriter is an interface as we might provide different ResponseWriters depending whether the client supports compression or not
 type CloseableResponseWriter interface {
 	http.ResponseWriter
 	Close()
 }
 
-type gzipResponseWriter struct {
+// compressResponseWriter holds back the start of the response until it knows whether it is worth compressing:
+// the first MinSize bytes are buffered, a response that ends before that is sent as is.
+type compressResponseWriter struct {
 	http.ResponseWriter
-	*gzip.Writer
+	encoding string
+	level    int
+	minSize  int
+
+	statusCode int
+	buf        bytes.Buffer
+	decided    bool
+	enc        encoder
+}
+
+// WriteHeader is held back too, the Content-Encoding header has to be set before the headers go out
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
 }
 
-// Since both http.ResponseWriter and gzip.Writer have Write method, we need to do some disambiguation and tell go explicitly which method to invoke
-func (w gzipResponseWriter) Write(data []byte) (int, error) {
-	return w.Writer.Write(data)
+func (w *compressResponseWriter) Write(data []byte) (int, error) {
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(data)
+		}
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buf.Write(data)
+	if w.buf.Len() >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
 }
 
-// CloseableResponseWriter interface implementation
-func (w gzipResponseWriter) Close() {
-	w.Writer.Close()
+// start sends the headers and what was buffered so far, compressed or not
+func (w *compressResponseWriter) start(compress bool) error {
+	w.decided = true
+
+	header := w.Header()
+	// a handler that encodes its response itself, or a response without a body, is left alone
+	if header.Get("Content-Encoding") != "" || w.statusCode == http.StatusNoContent || w.statusCode == http.StatusNotModified {
+		compress = false
+	}
+
+	if compress {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		w.enc = getEncoder(w.encoding, w.level, w.ResponseWriter)
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
 }
 
-// Same as with Write() we need to disambiguate Header() between http.ResponseWriter and gzip.Writer
-func (w gzipResponseWriter) Header() http.Header {
-	return w.ResponseWriter.Header()
+// http.Flusher implementation, so streamed responses reach the client as they are written.
+// A response that is flushed is streamed, its size is unknown, so it is compressed whatever was written so far.
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseableResponseWriter interface implementation: a response still buffered is small, so it goes out uncompressed
+func (w *compressResponseWriter) Close() {
+	if !w.decided {
+		w.start(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		putEncoder(w.encoding, w.level, w.enc)
+		w.enc = nil
+	}
 }
 
 // This is just a wrapper around http.ResponseWriter so we can work with it via CloseableResponseWriter interface
@@ -43,29 +299,85 @@ type closeableResponseWriter struct {
 // CloseableResponseWriter interface implementation
 func (w closeableResponseWriter) Close() {}
 
-// If the request header "Accept-Encoding" contains "gzip", we will create a gzipResponseWriter and populate its Writer field with a gzip.NewWriter(w)
+// http.Flusher implementation, embedding the http.ResponseWriter interface hides the Flush method of the writer it holds
+func (w closeableResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// GetCompressedResponseWriter negotiates the encoding from the request header "Accept-Encoding" and returns a writer compressing with it.
 // Otherwise we will return a standard http.ResponseWriter wrapped into a closeableResponseWriter struct
-func GetResponseWriter(w http.ResponseWriter, req *http.Request) CloseableResponseWriter {
-	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
-		w.Header().Set("Content-Encoding", "gzip")
-		gRW := gzipResponseWriter{
-			ResponseWriter: w,
-			Writer:         gzip.NewWriter(w),
-		}
-		return gRW
-	} else {
+func GetCompressedResponseWriter(w http.ResponseWriter, req *http.Request, cfg CompressionConfig) CloseableResponseWriter {
+	// the response depends on the header whether we compress it or not, caches have to know
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := NegotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == ENCODING_IDENTITY || req.Method == http.MethodHead {
 		return closeableResponseWriter{ResponseWriter: w}
 	}
+
+	return &compressResponseWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		level:          cfg.WithDefaults().level(encoding),
+		minSize:        cfg.MinSize,
+	}
+}
+
+// GetResponseWriter is GetCompressedResponseWriter with the default levels, compressing every response
+func GetResponseWriter(w http.ResponseWriter, req *http.Request) CloseableResponseWriter {
+	return GetCompressedResponseWriter(w, req, DefaultCompressionConfig)
 }
 
+//GzipHandler is the name CompressHandler had when it only spoke gzip
+//
+// Deprecated: use CompressHandler
+type GzipHandler = CompressHandler
+
 //providing our own handler that will be able to serve requests and decide on the fly wich writer to use
-type GzipHandler struct{}
+type CompressHandler struct {
+	Compression CompressionConfig
+
+	// Compressed request bodies are decompressed before they reach the handlers, up to this many bytes (see DecompressRequest)
+	MaxRequestSize int64
+	// RequestError reports a request body that cannot be decoded, by default with a plain text 415 or 400
+	RequestError func(w http.ResponseWriter, err error)
+
+	// Handler serves the requests, http.DefaultServeMux when nil
+	Handler http.Handler
+}
 
-//GzipHandler is the only bit that we expose for external use, everything else will be used internally
+//CompressHandler is the only bit that we expose for external use, everything else will be used internally
 //(GetResponseWriter is also exposed just in case there is a need for it from outside of the package)
-func (h *GzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	responseWriter := GetResponseWriter(w, r)
+func (h *CompressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	responseWriter := GetCompressedResponseWriter(w, r, h.Compression)
 	defer responseWriter.Close()
 
-	http.DefaultServeMux.ServeHTTP(responseWriter, r)
+	if err := DecompressRequest(r, h.MaxRequestSize); err != nil {
+		if _, unsupported := err.(*UnsupportedEncodingError); unsupported {
+			// tells the client what it can send instead (RFC 7694)
+			responseWriter.Header().Set("Accept-Encoding", strings.Join(supportedEncodings, ", "))
+		}
+		if h.RequestError != nil {
+			h.RequestError(responseWriter, err)
+		} else {
+			respondWithRequestError(responseWriter, err)
+		}
+		return
+	}
+
+	handler := h.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(responseWriter, r)
+}
+
+func respondWithRequestError(w http.ResponseWriter, err error) {
+	if _, unsupported := err.(*UnsupportedEncodingError); unsupported {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
 }
@@ -0,0 +1,163 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ENCODING_IDENTITY},
+		{"gzip", ENCODING_GZIP},
+		{"gzip, deflate, br", ENCODING_BROTLI},
+		{"gzip, zstd", ENCODING_ZSTD},
+		{"br;q=0.5, gzip;q=0.8", ENCODING_GZIP},
+		{"br;q=0, gzip;q=0", ENCODING_IDENTITY},
+		{"*", ENCODING_BROTLI},
+		{"*;q=0.1, gzip", ENCODING_GZIP},
+		{"br;q=0, *", ENCODING_ZSTD},
+		{"deflate, compress", ENCODING_IDENTITY},
+		{"GZIP", ENCODING_GZIP},
+	}
+
+	for _, tc := range testCases {
+		if actual := NegotiateEncoding(tc.acceptEncoding); actual != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.acceptEncoding, tc.expected, actual)
+		}
+	}
+}
+
+func decompress(t *testing.T, encoding string, body io.Reader) string {
+	var reader io.Reader
+	switch encoding {
+	case ENCODING_GZIP:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gz
+	case ENCODING_BROTLI:
+		reader = brotli.NewReader(body)
+	case ENCODING_ZSTD:
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		reader = body
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func serve(cfg CompressionConfig, acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+
+	responseWriter := GetCompressedResponseWriter(w, r, cfg)
+	handler(responseWriter, r)
+	responseWriter.Close()
+	return w
+}
+
+func TestCompressedResponse(t *testing.T) {
+	body := strings.Repeat(`{"name":"Save £1 at Tesco","brand":"Tesco","value":1}`, 100)
+	cfg := CompressionConfig{MinSize: 1024, GzipLevel: 9, BrotliLevel: 4, ZstdLevel: 1}
+
+	for _, encoding := range supportedEncodings {
+		//twice, so the second response gets an encoder back from the pool
+		for i := 0; i < 2; i++ {
+			w := serve(cfg, encoding, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				//written in pieces, so the threshold is crossed midway
+				w.Write([]byte(body[:100]))
+				w.Write([]byte(body[100:]))
+			})
+
+			if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%s: unexpected response %d %v", encoding, w.Code, w.Header())
+				continue
+			}
+			if w.Body.Len() >= len(body) {
+				t.Errorf("%s: expected the body to be compressed, got %d bytes", encoding, w.Body.Len())
+			}
+			if actual := decompress(t, encoding, w.Body); actual != body {
+				t.Errorf("%s: the body did not survive compression", encoding)
+			}
+		}
+	}
+}
+
+func TestSmallResponseIsNotCompressed(t *testing.T) {
+	w := serve(CompressionConfig{MinSize: 1024}, "gzip, br", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors":[]}`))
+	})
+
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"errors":[]}` {
+		t.Errorf("expected the response as is, got %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %v", w.Header())
+	}
+}
+
+func TestFlushedResponseIsCompressed(t *testing.T) {
+	w := serve(CompressionConfig{MinSize: 1024}, "gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("id,name\n"))
+		w.(http.Flusher).Flush()
+		if !w.(*compressResponseWriter).decided {
+			t.Error("expected the response to be started by the flush")
+		}
+		w.Write([]byte("1,Save £1 at Tesco\n"))
+	})
+
+	if w.Header().Get("Content-Encoding") != ENCODING_GZIP || !w.Flushed {
+		t.Errorf("expected a flushed gzip response, got %v", w.Header())
+		return
+	}
+	if actual := decompress(t, ENCODING_GZIP, bytes.NewReader(w.Body.Bytes())); actual != "id,name\n1,Save £1 at Tesco\n" {
+		t.Errorf("unexpected body %q", actual)
+	}
+}
+
+func TestCompressionConfigValidate(t *testing.T) {
+	for _, cfg := range []CompressionConfig{DefaultCompressionConfig, {GzipLevel: 1, BrotliLevel: 0, ZstdLevel: 1}, {GzipLevel: 9, BrotliLevel: 11, ZstdLevel: 22}} {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected %+v to be accepted: %s", cfg, err)
+		}
+	}
+	rejected := []CompressionConfig{
+		{GzipLevel: 0, BrotliLevel: 5, ZstdLevel: 3},
+		{GzipLevel: -2, BrotliLevel: 5, ZstdLevel: 3},
+		{GzipLevel: 10, BrotliLevel: 5, ZstdLevel: 3},
+		{GzipLevel: 6, BrotliLevel: -1, ZstdLevel: 3},
+		{GzipLevel: 6, BrotliLevel: 12, ZstdLevel: 3},
+		{GzipLevel: 6, BrotliLevel: 5, ZstdLevel: 0},
+		{GzipLevel: 6, BrotliLevel: 5, ZstdLevel: 23},
+	}
+	for _, cfg := range rejected {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}